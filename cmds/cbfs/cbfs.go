@@ -2,18 +2,97 @@
 // Use of this source code is governed by a BSD-style
 // license that can be found in the LICENSE file.
 
+// The cbfs command lists and changes the CBFS of a coreboot image.
+//
+// Synopsis:
+//     cbfs [flags] <firmware-file> <json,list,add,add-payload,add-stage,extract>
+//
+// Examples:
+//     # Add a compressed raw file, aligned on 4K:
+//     cbfs coreboot.rom add -f logo.bmp -n logo.bmp -c lzma -a 0x1000
+//
+//     # Add a LinuxBoot kernel, wrapped in an ELF, as a compressed payload:
+//     cbfs coreboot.rom add-payload -f vmlinux.elf -n fallback/payload -c lzma
+//
+//     # Add a flat binary loaded at 0x100000 as a payload:
+//     cbfs coreboot.rom add-payload -f payload.bin -n img/flat -l 0x100000 -e 0x100000
+//
+//     # Extract the ramstage as a 32 bit x86 ELF:
+//     cbfs coreboot.rom extract -n fallback/ramstage -f ramstage.elf -m x86
+//
+//     # Add a file to both RW CBFSes of a vboot image:
+//     cbfs image.bin add -f ec.bin -n ecrw -r FW_MAIN_A,FW_MAIN_B
+//
+// Regions:
+//     An image has a CBFS in each FMAP area starting with a CBFS file, like
+//     COREBOOT, FW_MAIN_A and FW_MAIN_B. -r selects them by a comma separated
+//     list of area names, like cbfstool -r. Without -r, the operations use
+//     COREBOOT, or the first CBFS if there is no COREBOOT area. `extract`
+//     needs a single one.
+//
+// Operations:
+//     `list`: List the files of the CBFS.
+//     `json`: Dump the files of the CBFS as JSON, in an array of the CBFSes
+//             when -r is given.
+//     `add`: Add the file given by -f with the name -n and the type -t, like
+//            cbfstool add. The image is changed in place.
+//     `add-payload`: Add the ELF executable given by -f as a payload named -n,
+//                    with its segments compressed with -c, like cbfstool
+//                    add-payload. With -l, the file is a flat binary loaded
+//                    at -l and started at -e, like cbfstool add-flat-binary.
+//     `add-stage`: Add the ELF executable, or flat binary with -l and -e,
+//                  given by -f as a stage named -n compressed with -c, like
+//                  cbfstool add-stage. --legacy-stage writes the stage format
+//                  of older coreboot releases.
+//     `extract`: Write the file named -n to the file given by -f, decompressed.
+//                Stages and payloads are written as ELF executables for the
+//                machine -m, which defaults to the architecture of the image.
 package main
 
 import (
+	"bytes"
+	"debug/elf"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"strings"
 
 	"github.com/linuxboot/fiano/pkg/cbfs"
 	flag "github.com/spf13/pflag"
 )
 
-var debug = flag.BoolP("debug", "d", false, "enable debug prints")
+var (
+	debug  = flag.BoolP("debug", "d", false, "enable debug prints")
+	region = flag.StringP("region", "r", "", "comma separated FMAP areas of the CBFSes to use")
+
+	// Flags of add.
+	file     = flag.StringP("file", "f", "", "file to add")
+	name     = flag.StringP("name", "n", "", "name of the added file")
+	fileType = flag.StringP("type", "t", "raw", "type of the added file")
+	compress = flag.StringP("compression", "c", "none", "compression of the added file: none, lzma, lz4")
+	hash     = flag.StringP("hash-algorithm", "A", "none", "add a hash of the added file: none, sha1, sha256, sha512")
+	base     = flag.Uint32P("base-address", "b", 0, "offset of the data of the added file in the CBFS")
+	align    = flag.Uint32P("alignment", "a", 0, "alignment of the data of the added file in the CBFS")
+
+	// Flags of add-payload and add-stage, which also use the flags of add
+	// but -t.
+	loadAddress = flag.Uint64P("load-address", "l", 0, "load address of an added flat binary")
+	entryPoint  = flag.Uint64P("entry-point", "e", 0, "entry point of an added flat binary")
+	legacy      = flag.Bool("legacy-stage", false, "add a legacy stage, for older coreboot releases")
+
+	// Flags of extract, which also uses -f and -n.
+	machine = flag.StringP("machine", "m", "", "ELF machine of extracted stages and payloads: x86, x86_64, arm, arm64, riscv")
+)
+
+var machines = map[string]elf.Machine{
+	"x86":     elf.EM_386,
+	"x86_64":  elf.EM_X86_64,
+	"arm":     elf.EM_ARM,
+	"arm64":   elf.EM_AARCH64,
+	"aarch64": elf.EM_AARCH64,
+	"riscv":   elf.EM_RISCV,
+}
 
 func main() {
 	flag.Parse()
@@ -24,7 +103,7 @@ func main() {
 
 	a := flag.Args()
 	if len(a) != 2 {
-		log.Fatal("Usage: cbfs <firmware-file> <json,list>")
+		log.Fatal("Usage: cbfs <firmware-file> <json,list,add,add-payload,add-stage,extract>")
 	}
 
 	i, err := cbfs.Open(a[0])
@@ -32,17 +111,182 @@ func main() {
 		log.Fatal(err)
 	}
 
+	regions := []string{i.Area.Name.String()}
+	if *region != "" {
+		regions = strings.Split(*region, ",")
+	}
+
 	switch a[1] {
 	case "list":
-		fmt.Printf("%s", i.String())
+		for _, r := range regions {
+			if err := i.Select(r); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("%s", i.String())
+		}
 	case "json":
-		j, err := json.MarshalIndent(i, "  ", "  ")
+		var j []byte
+		if *region == "" {
+			j, err = json.MarshalIndent(i, "  ", "  ")
+		} else {
+			var cbfses []json.RawMessage
+			for _, r := range regions {
+				if err := i.Select(r); err != nil {
+					log.Fatal(err)
+				}
+				b, err := json.Marshal(i)
+				if err != nil {
+					log.Fatal(err)
+				}
+				cbfses = append(cbfses, b)
+			}
+			j, err = json.MarshalIndent(cbfses, "  ", "  ")
+		}
 		if err != nil {
 			log.Fatal(err)
 		}
 		fmt.Printf("%s", string(j))
+	case "add", "add-payload", "add-stage":
+		adders := map[string]func(*cbfs.Image) error{"add": add, "add-payload": addPayload, "add-stage": addStage}
+		for _, r := range regions {
+			if err := i.Select(r); err != nil {
+				log.Fatal(err)
+			}
+			if err := adders[a[1]](i); err != nil {
+				log.Fatal(err)
+			}
+		}
+		if err := i.Update(); err != nil {
+			log.Fatal(err)
+		}
+		if err := i.WriteFile(a[0], 0666); err != nil {
+			log.Fatal(err)
+		}
+	case "extract":
+		if len(regions) != 1 {
+			log.Fatal("extract needs a single region")
+		}
+		if err := i.Select(regions[0]); err != nil {
+			log.Fatal(err)
+		}
+		if err := extract(i); err != nil {
+			log.Fatal(err)
+		}
 	default:
 		log.Fatal("?")
 	}
 
 }
+
+// addOptions returns the options of the add operations given by the flags,
+// and the contents of the file to add.
+func addOptions(op string) (*cbfs.AddOptions, []byte, error) {
+	if *file == "" || *name == "" {
+		return nil, nil, fmt.Errorf("%s needs a file (-f) and a name (-n)", op)
+	}
+	var err error
+	opts := &cbfs.AddOptions{Base: *base, Align: *align}
+	if opts.Compression, err = cbfs.ParseCompression(*compress); err != nil {
+		return nil, nil, err
+	}
+	if opts.Hash, err = cbfs.ParseHashType(*hash); err != nil {
+		return nil, nil, err
+	}
+	data, err := ioutil.ReadFile(*file)
+	if err != nil {
+		return nil, nil, err
+	}
+	return opts, data, nil
+}
+
+func add(i *cbfs.Image) error {
+	opts, data, err := addOptions("add")
+	if err != nil {
+		return err
+	}
+	t, err := cbfs.ParseFileType(*fileType)
+	if err != nil {
+		return err
+	}
+	return i.Add(*name, t, data, opts)
+}
+
+// flat tells whether the file to add is a flat binary rather than an ELF.
+func flat() bool {
+	return flag.CommandLine.Changed("load-address")
+}
+
+func addPayload(i *cbfs.Image) error {
+	opts, data, err := addOptions("add-payload")
+	if err != nil {
+		return err
+	}
+	var segs []cbfs.PayloadSegment
+	if flat() {
+		segs = cbfs.PayloadFromBinary(data, *loadAddress, *entryPoint)
+	} else {
+		e, err := elf.NewFile(bytes.NewReader(data))
+		if err != nil {
+			return fmt.Errorf("%s: %v", *file, err)
+		}
+		if segs, err = cbfs.PayloadFromELF(e); err != nil {
+			return fmt.Errorf("%s: %v", *file, err)
+		}
+	}
+	// The segments are compressed, not the file.
+	c := opts.Compression
+	opts.Compression = cbfs.None
+	if data, err = cbfs.EncodePayload(segs, c); err != nil {
+		return err
+	}
+	return i.Add(*name, cbfs.TypeSELF, data, opts)
+}
+
+func addStage(i *cbfs.Image) error {
+	opts, data, err := addOptions("add-stage")
+	if err != nil {
+		return err
+	}
+	var h *cbfs.FileAttrStageHeader
+	if flat() {
+		h, err = cbfs.StageFromBinary(data, *loadAddress, *entryPoint)
+	} else {
+		var e *elf.File
+		if e, err = elf.NewFile(bytes.NewReader(data)); err == nil {
+			h, data, err = cbfs.StageFromELF(e)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %v", *file, err)
+	}
+	if !*legacy {
+		opts.Stage = h
+		return i.Add(*name, cbfs.TypeStage, data, opts)
+	}
+	sh := cbfs.StageHeader{Entry: h.LoadAddress + uint64(h.EntryOffset), LoadAddress: h.LoadAddress, MemSize: h.MemSize}
+	c := opts.Compression
+	opts.Compression = cbfs.None
+	if data, err = cbfs.EncodeLegacyStage(sh, data, c); err != nil {
+		return err
+	}
+	return i.Add(*name, cbfs.TypeLegacyStage, data, opts)
+}
+
+func extract(i *cbfs.Image) error {
+	if *file == "" || *name == "" {
+		return fmt.Errorf("extract needs a file (-f) and a name (-n)")
+	}
+	m, ok := machines[*machine]
+	if !ok {
+		if *machine != "" {
+			return fmt.Errorf("unknown machine %q", *machine)
+		}
+		// Stages and payloads fail to extract without a machine.
+		m, _ = i.Architecture().Machine(false)
+	}
+	data, err := i.Extract(*name, m)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(*file, data, 0666)
+}
@@ -14,6 +14,7 @@ import (
 	"os"
 	"strings"
 
+	"github.com/linuxboot/fiano/pkg/compression"
 	"github.com/linuxboot/fiano/pkg/guid"
 	"github.com/linuxboot/fiano/pkg/uefi"
 	"github.com/linuxboot/fiano/pkg/visitors"
@@ -26,9 +27,10 @@ var (
 	filetype   = flag.String("type", "DRIVER", "UEFI filetype")
 	version    = flag.String("version", "1.0", "File version")
 	guidString = flag.String("guid", "", "File GUID")
-	depex      = flag.String("depex", "", "Space or comma separated protocol guid dependencies or TRUE")
+	depex      = flag.String("depex", "", "Dependency expression, such as 'GUID1 AND (GUID2 OR NOT GUID3)', or space or comma separated protocol guid dependencies")
 	compress   = flag.Bool("compress", false, "Wrap section data in a compressed section")
 	auto       = flag.Bool("auto", false, "Attempt to determine section types from file extensions")
+	xzPath     = flag.String("xzPath", "xz", "Path to system xz command used for lzma encoding. If unset, an internal lzma implementation is used.")
 
 	printf = func(string, ...interface{}) {}
 )
@@ -37,41 +39,27 @@ const (
 	usageString = "Usage: create-ffs [flags] file.efi"
 )
 
+// createDepExes compiles the dependency expression of the depex flag. A list
+// of GUIDs separated by spaces or commas requires all of them.
 func createDepExes(deps string) ([]uefi.DepExOp, error) {
-	var err error
-	ops := []uefi.DepExOp{}
-
-	if strings.ToUpper(deps) == "TRUE" {
-		// Create just "TRUE" and "END" for now, but this feels unnecessary to me.
-		ops = append(ops, uefi.DepExOp{OpCode: "TRUE"})
-		ops = append(ops, uefi.DepExOp{OpCode: "END"})
-		return ops, nil
-	}
-
-	// we expect a space or comma separated list of GUIDs, split by both.
-	guidSpace := strings.Split(deps, " ")
-	guids := []string{}
-	for _, g := range guidSpace {
-		guids = append(guids, strings.Split(g, ",")...)
-	}
-
-	for _, guidStr := range guids {
-		var g *guid.GUID
-
-		if g, err = guid.Parse(guidStr); err != nil {
-			return nil, err
+	fields := strings.FieldsFunc(deps, func(r rune) bool {
+		return r == ' ' || r == ','
+	})
+	isList := len(fields) > 1
+	for _, f := range fields {
+		switch strings.ToUpper(f) {
+		case "BEFORE", "AFTER", "SOR", "AND", "OR", "NOT", "TRUE", "FALSE":
+			isList = false
+		}
+		if strings.ContainsAny(f, "()") {
+			isList = false
 		}
-		printf("depex guid requested: %v", *g)
-		ops = append(ops, uefi.DepExOp{OpCode: "PUSH", GUID: g})
 	}
-
-	// Append an "AND" for n-1 pushes.
-	for i := 1; i < len(guids); i++ {
-		ops = append(ops, uefi.DepExOp{OpCode: "AND"})
+	if isList {
+		deps = strings.Join(fields, " AND ")
 	}
-
-	ops = append(ops, uefi.DepExOp{OpCode: "END"})
-	return ops, nil
+	printf("depex requested: %v", deps)
+	return uefi.ParseDepExText(deps)
 }
 
 func parseFlags() (fType uefi.FVFileType, fGUID *guid.GUID, depOps []uefi.DepExOp, err error) {
@@ -195,7 +183,8 @@ func main() {
 		file.Sections = append(file.Sections, s)
 	}
 
-	save := &visitors.Save{DirPath: *outfile}
+	cfg := compression.Config{XZPath: *xzPath}
+	save := &visitors.Save{DirPath: *outfile, Compression: &cfg}
 
 	err = file.Apply(save)
 	if err != nil {
@@ -5,13 +5,15 @@
 // glzma compresses and decompresses in the same manner as EDK2's LzmaCompress.
 //
 // Synopsis:
-//     glzma -o OUTPUT_FILE (-d|-e) [-f86] INPUT_FILE
+//     glzma -o OUTPUT_FILE (-d|-e) [-f86] [-xzPath XZ] INPUT_FILE
 //
 // Options:
 //     -d: decode
 //     -e: encode
 //     -f86: Use the x86 branch/call/jump filter. See `man xz` for more information.
 //     -o OUTPUT_FILE: output file
+//     -xzPath XZ: system xz command used for encoding. If unset, an internal
+//                 lzma implementation is used.
 package main
 
 import (
@@ -23,10 +25,11 @@ import (
 )
 
 var (
-	d   = flag.Bool("d", false, "decode")
-	e   = flag.Bool("e", false, "encode")
-	f86 = flag.Bool("f86", false, "use x86 extension")
-	o   = flag.String("o", "", "output file")
+	d      = flag.Bool("d", false, "decode")
+	e      = flag.Bool("e", false, "encode")
+	f86    = flag.Bool("f86", false, "use x86 extension")
+	o      = flag.String("o", "", "output file")
+	xzPath = flag.String("xzPath", "xz", "Path to system xz command used for lzma encoding. If unset, an internal lzma implementation is used.")
 )
 
 func main() {
@@ -42,11 +45,12 @@ func main() {
 		log.Fatalf("expected one input file")
 	}
 
+	cfg := compression.Config{XZPath: *xzPath}
 	var compressor compression.Compressor
 	if *f86 {
-		compressor = compression.CompressorFromGUID(&compression.LZMAX86GUID)
+		compressor = cfg.CompressorFromGUID(&compression.LZMAX86GUID)
 	} else {
-		compressor = compression.CompressorFromGUID(&compression.LZMAGUID)
+		compressor = cfg.CompressorFromGUID(&compression.LZMAGUID)
 	}
 
 	var op func([]byte) ([]byte, error)
@@ -17,6 +17,9 @@
 //     # Dump GUIDs and sizes to a compact table:
 //     utk winterfell.rom table
 //
+//     # Dump the large drivers which are not network drivers (using a query):
+//     utk winterfell.rom find 'type==DRIVER && size>64K && !name=~Net'
+//
 //     # Extract everything into a directory:
 //     utk winterfell.rom extract winterfell/
 //
@@ -37,7 +40,11 @@
 //              consumption and the format may change without notice.
 //     `find (GUID|NAME)`: Dump the JSON of one or more files. The file is
 //                         found by a regex match to its GUID or name in the UI
-//                         section.
+//                         section, or by a query such as
+//                         'type==DRIVER && has_section(PE32)'. Queries
+//                         compare the guid, name, type, size, depex,
+//                         compression, fv and machine fields of files and
+//                         are also accepted by `remove`, `dump` and `cat`.
 //     `remove (GUID|NAME)`: Remove the first file which matches the given GUID
 //                           or NAME. The same matching rules and exit status
 //                           are used as `find`.
@@ -48,20 +55,53 @@
 //     `save FILE`: Save the current state of the image to the give file.
 //                  Remember that operations are applied left-to-right, so only
 //                  the operations to the left are included in the new image.
+//                  Files which were not edited keep their original bytes.
+//     `roundtrip-check`: Rebuild every node of the image and compare it with
+//                        the original. The first differing offset and the
+//                        node owning it are reported with a non-zero exit
+//                        status.
 //     `extract DIR`: Extract the BIOS to the given directory. Remember that
 //                    operations are applied left-to-right, so only the
 //                    operations to the left are included in the new image.
+//     `extract_query (GUID|NAME|QUERY) DIR`: Extract only the matching files
+//                                            to the given directory.
+//     `diff FILE`: Print the regions, volumes, files, sections and NVARs
+//                  added, removed, moved or changed in FILE. `diff-json`
+//                  prints the same as JSON.
+//     `dispatch DB`: Simulate the dispatch of the PEI, DXE and MM files. DB is
+//                    a JSON file listing the GUIDs installed by each file.
+//                    `dispatch_remove DB (GUID|NAME|QUERY)` simulates the
+//                    dispatch without the matching files and reports the
+//                    dependency expressions they break.
+//     `depex (GUID|NAME|QUERY)`: Print the dependency expressions of the
+//                               matching files, such as
+//                               'SOR AcpiTableDxe AND NOT GUID'.
+//     `set_depex (GUID|NAME|QUERY) DEPEX`: Replace the dependency expression
+//                                         of the matching files, or add one.
+//     `export_patch FILE`: Print as JSON the operations turning the image into
+//                          FILE: remove, replace_ffs, insert_after,
+//                          insert_before and insert_front. Files are located
+//                          by GUID, so the patch applies to other builds.
+//     `apply_patch PATCH`: Replay the operations of a patch written by
+//                          `export_patch`.
 package main
 
 import (
 	"flag"
 	"fmt"
 
+	"github.com/linuxboot/fiano/pkg/compression"
 	"github.com/linuxboot/fiano/pkg/log"
+	"github.com/linuxboot/fiano/pkg/uefi"
 	"github.com/linuxboot/fiano/pkg/utk"
 	"github.com/linuxboot/fiano/pkg/visitors"
 )
 
+var (
+	xzPath    = flag.String("xzPath", "xz", "Path to system xz command used for lzma encoding. If unset, an internal lzma implementation is used.")
+	parseJobs = flag.Int("parseJobs", uefi.ParseJobs, "Number of goroutines decompressing and parsing the image concurrently.")
+)
+
 func init() {
 	flag.Usage = func() {
 		fmt.Fprintf(flag.CommandLine.Output(), "Usage: utk [flags] <file name> [0 or more operations]\n")
@@ -72,10 +112,12 @@ func init() {
 
 func main() {
 	flag.Parse()
+	cfg := compression.Config{XZPath: *xzPath}
+	uefi.ParseJobs = *parseJobs
 	if len(flag.Args()) == 0 || flag.Args()[0] == "help" {
 		flag.Usage()
 	}
-	if err := utk.Run(flag.Args()...); err != nil {
+	if err := utk.RunWithCompression(&cfg, flag.Args()...); err != nil {
 		log.Fatalf("%v", err)
 	}
 }
@@ -3,6 +3,7 @@ module github.com/linuxboot/fiano
 go 1.16
 
 require (
+	github.com/andybalholm/brotli v1.0.4
 	github.com/dustin/go-humanize v1.0.0
 	github.com/fatih/camelcase v1.0.0
 	github.com/fatih/structtag v1.2.0 // indirect
@@ -0,0 +1,198 @@
+// Copyright 2018-2021 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbfs
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"fmt"
+	"os"
+)
+
+// emptyHeaderSize is the size of the header of an empty record: the file
+// header and an empty name.
+const emptyHeaderSize = FileSize + 16
+
+// AddOptions control where Image.Add places a file and the attributes it
+// gets. Offsets are relative to the start of the CBFS.
+type AddOptions struct {
+	// Compression compresses the data and adds a compression attribute.
+	Compression Compression
+	// Hash adds a hash attribute of the data as stored.
+	Hash HashType
+	// Align, if not 0, aligns the data and adds an alignment attribute.
+	Align uint32
+	// Base, if not 0, is the offset of the data and adds a position
+	// attribute. Offset 0 always holds a header.
+	Base uint32
+	// Stage, if not nil, adds a stage header attribute. Its Tag and Size
+	// are set by Add.
+	Stage *FileAttrStageHeader
+}
+
+// Add adds a file to the image in the first empty record where it fits. The
+// empty record is split into the file and the empty records around it. Like
+// Remove, Add only changes Segs, Update writes the image.
+func (i *Image) Add(name string, t FileType, data []byte, opts *AddOptions) error {
+	if opts == nil {
+		opts = &AddOptions{}
+	}
+	if name == "" {
+		return fmt.Errorf("Add: file has no name")
+	}
+	for _, s := range i.Segs {
+		if s.GetFile().Name == name {
+			return fmt.Errorf("Add %q: %w", name, os.ErrExist)
+		}
+	}
+	if _, ok := SegReaders[t]; !ok {
+		return fmt.Errorf("Add %q: can not read back files of type %v", name, t)
+	}
+	stored, attrs, err := fileAttributes(t, data, opts)
+	if err != nil {
+		return fmt.Errorf("Add %q: %v", name, err)
+	}
+	encoded, err := encodeAttributes(attrs)
+	if err != nil {
+		return fmt.Errorf("Add %q: %v", name, err)
+	}
+	hsize := uint32(FileSize + nameSize(name) + len(encoded))
+
+	for x, s := range i.Segs {
+		e, ok := s.(*EmptyRecord)
+		if !ok {
+			continue
+		}
+		start := e.RecordStart
+		end := start + e.SubHeaderOffset + e.Size
+		rec, off, ok := place(start, end, hsize, uint32(len(stored)), opts)
+		if !ok {
+			continue
+		}
+		f := File{
+			FileHeader:  FileHeader{Size: uint32(len(stored)), Type: t, SubHeaderOffset: off},
+			RecordStart: rec,
+			Name:        name,
+			FData:       stored,
+		}
+		copy(f.Magic[:], FileMagic)
+		if len(attrs) > 0 {
+			f.AttrOffset = uint32(FileSize + nameSize(name))
+			f.Attr = attrs
+		}
+		r, err := SegReaders[t].New(&f)
+		if err != nil {
+			return err
+		}
+		if err := r.Read(bytes.NewReader(f.FData)); err != nil {
+			return fmt.Errorf("Add %q: %v", name, err)
+		}
+		Debug("Add: %s in empty record [%#x, %#x]", r.String(), start, end)
+
+		segs := append([]ReadWriter{}, i.Segs[:x]...)
+		if rec > start {
+			segs = append(segs, newEmptyRecord(start, rec))
+		}
+		segs = append(segs, r)
+		if next := align(rec+off+f.Size, Alignment); next < end {
+			segs = append(segs, newEmptyRecord(next, end))
+		}
+		i.Segs = append(segs, i.Segs[x+1:]...)
+		return nil
+	}
+	return fmt.Errorf("Add %q: no room for %#x bytes", name, len(stored))
+}
+
+// fileAttributes returns the data of a file as stored, compressed if asked,
+// and its attributes.
+func fileAttributes(t FileType, data []byte, opts *AddOptions) ([]byte, []Attribute, error) {
+	var attrs []Attribute
+	if opts.Compression != None {
+		// Their segments are compressed, not the whole file.
+		if t == TypeSELF || t == TypeLegacyStage {
+			return nil, nil, fmt.Errorf("%v files can not be compressed", t)
+		}
+		c, err := compress(opts.Compression, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		attrs = append(attrs, &FileAttrCompression{Tag: Compressed, Size: 16, Compression: opts.Compression, DecompressedSize: uint32(len(data))})
+		data = c
+	}
+	if opts.Hash != HashNone {
+		sum, err := hashData(opts.Hash, data)
+		if err != nil {
+			return nil, nil, err
+		}
+		attrs = append(attrs, &FileAttrHash{Tag: Hash, Size: uint32(12 + len(sum)), HashType: opts.Hash, Data: sum})
+	}
+	if opts.Base != 0 {
+		attrs = append(attrs, &FileAttrPos{Tag: PSCB, Size: 12, Pos: opts.Base})
+	}
+	if opts.Align != 0 {
+		attrs = append(attrs, &FileAttrAlign{Tag: ALCB, Size: 12, Align: opts.Align})
+	}
+	if opts.Stage != nil {
+		h := *opts.Stage
+		h.Tag, h.Size = SHCB, 24
+		attrs = append(attrs, &h)
+	}
+	return data, attrs, nil
+}
+
+// hashData returns the hash of data with algorithm h.
+func hashData(h HashType, data []byte) ([]byte, error) {
+	switch h {
+	case HashSHA1:
+		s := sha1.Sum(data)
+		return s[:], nil
+	case HashSHA256:
+		s := sha256.Sum256(data)
+		return s[:], nil
+	case HashSHA512:
+		s := sha512.Sum512(data)
+		return s[:], nil
+	}
+	return nil, fmt.Errorf("unknown hash algorithm %v", h)
+}
+
+// place returns where a file with a header of hsize bytes and size bytes of
+// data starts in the free space [start, end), and the offset of its data.
+// Records start on Alignment, a header larger than hsize puts the data at
+// Base or on Align.
+func place(start, end, hsize, size uint32, opts *AddOptions) (uint32, uint32, bool) {
+	data := align(start, Alignment) + hsize
+	switch {
+	case opts.Base != 0:
+		data = opts.Base
+	case opts.Align != 0:
+		data = align(data, opts.Align)
+	}
+	if data < hsize {
+		return 0, 0, false
+	}
+	rec := (data - hsize) &^ (Alignment - 1)
+	if rec < start || (rec > start && rec-start < emptyHeaderSize) || align(data+size, Alignment) > end {
+		return 0, 0, false
+	}
+	return rec, data - rec, true
+}
+
+// newEmptyRecord returns an empty record filling [start, end).
+func newEmptyRecord(start, end uint32) ReadWriter {
+	f := File{
+		FileHeader:  FileHeader{Size: end - start - emptyHeaderSize, Type: TypeDeleted2, SubHeaderOffset: emptyHeaderSize},
+		RecordStart: start,
+	}
+	copy(f.Magic[:], FileMagic)
+	r, _ := NewEmptyRecord(&f)
+	return r
+}
+
+func align(v, a uint32) uint32 {
+	return (v + a - 1) / a * a
+}
@@ -0,0 +1,194 @@
+// Copyright 2018-2021 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbfs
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+)
+
+func (t Tag) String() string {
+	switch t {
+	case Unused, Unused2:
+		return "unused"
+	case Compressed:
+		return "compression"
+	case Hash:
+		return "hash"
+	case PSCB:
+		return "position"
+	case ALCB:
+		return "alignment"
+	case SHCB:
+		return "stageheader"
+	case IBB:
+		return "ibb"
+	}
+	return fmt.Sprintf("%#x", uint32(t))
+}
+
+// MarshalText shows tags by name in JSON.
+func (t Tag) MarshalText() ([]byte, error) {
+	return []byte(t.String()), nil
+}
+
+// MarshalText shows compressions by name in JSON.
+func (c Compression) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// MarshalText shows hash algorithms by name in JSON.
+func (h HashType) MarshalText() ([]byte, error) {
+	return []byte(h.String()), nil
+}
+
+func (a *FileAttr) AttrTag() Tag            { return Tag(a.Tag) }
+func (a *FileAttrCompression) AttrTag() Tag { return a.Tag }
+func (a *FileAttrHash) AttrTag() Tag        { return a.Tag }
+func (a *FileAttrPos) AttrTag() Tag         { return a.Tag }
+func (a *FileAttrAlign) AttrTag() Tag       { return a.Tag }
+func (a *FileAttrStageHeader) AttrTag() Tag { return a.Tag }
+func (a *FileAttrIBB) AttrTag() Tag         { return a.Tag }
+
+func (a *FileAttr) String() string {
+	return fmt.Sprintf("Tag %#x Size %#x", a.Tag, a.Size)
+}
+
+func (a *FileAttrCompression) String() string {
+	return fmt.Sprintf("Compression %v DecompressedSize %#x", a.Compression, a.DecompressedSize)
+}
+
+func (a *FileAttrHash) String() string {
+	return fmt.Sprintf("Hash %v %x", a.HashType, a.Data)
+}
+
+// MarshalJSON shows the hash in hexadecimal.
+func (a *FileAttrHash) MarshalJSON() ([]byte, error) {
+	return json.Marshal(struct {
+		Tag      Tag
+		Size     uint32
+		HashType HashType
+		Data     string
+	}{a.Tag, a.Size, a.HashType, hex.EncodeToString(a.Data)})
+}
+
+func (a *FileAttrPos) String() string {
+	return fmt.Sprintf("Position %#x", a.Pos)
+}
+
+func (a *FileAttrAlign) String() string {
+	return fmt.Sprintf("Align %#x", a.Align)
+}
+
+func (a *FileAttrIBB) String() string {
+	return "IBB"
+}
+
+// parseAttributes parses the attribute list of a file. The bytes following
+// the list, up to the data, are returned as well. Attributes of unknown
+// types, or of an unexpected size, are kept as a FileAttr.
+func parseAttributes(b []byte) ([]Attribute, []byte) {
+	var attrs []Attribute
+	for len(b) >= 8 {
+		tag, size := Tag(Endian.Uint32(b)), Endian.Uint32(b[4:])
+		if tag == Unused || tag == Unused2 {
+			break
+		}
+		if size < 8 || int(size) > len(b) {
+			Debug("Attribute %v of %#x bytes does not fit in %#x bytes", tag, size, len(b))
+			break
+		}
+		attrs = append(attrs, parseAttribute(tag, b[:size]))
+		b = b[size:]
+	}
+	return attrs, b
+}
+
+func parseAttribute(tag Tag, b []byte) Attribute {
+	var a Attribute
+	switch tag {
+	case Compressed:
+		a = &FileAttrCompression{}
+	case Hash:
+		if len(b) >= 12 {
+			return &FileAttrHash{Tag: tag, Size: uint32(len(b)), HashType: HashType(Endian.Uint32(b[8:])), Data: append([]byte{}, b[12:]...)}
+		}
+	case PSCB:
+		a = &FileAttrPos{}
+	case ALCB:
+		a = &FileAttrAlign{}
+	case SHCB:
+		a = &FileAttrStageHeader{}
+	case IBB:
+		a = &FileAttrIBB{}
+	}
+	if a != nil && binary.Size(a) == len(b) && Read(bytes.NewReader(b), a) == nil {
+		return a
+	}
+	return &FileAttr{Tag: uint32(tag), Size: uint32(len(b)), Data: append([]byte{}, b[8:]...)}
+}
+
+// encodeAttributes returns the encoded attribute list.
+func encodeAttributes(attrs []Attribute) ([]byte, error) {
+	var b bytes.Buffer
+	for _, a := range attrs {
+		var err error
+		switch a := a.(type) {
+		case *FileAttr:
+			err = Write(&b, []uint32{a.Tag, a.Size})
+			b.Write(a.Data)
+		case *FileAttrHash:
+			err = Write(&b, []uint32{uint32(a.Tag), a.Size, uint32(a.HashType)})
+			b.Write(a.Data)
+		default:
+			err = Write(&b, a)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Writing attribute %v: %v", a, err)
+		}
+	}
+	return b.Bytes(), nil
+}
+
+// Attribute returns the first attribute of f with tag t, or nil.
+func (f *File) Attribute(t Tag) Attribute {
+	for _, a := range f.Attr {
+		if a.AttrTag() == t {
+			return a
+		}
+	}
+	return nil
+}
+
+// VerifyHash checks the data of f against its hash attributes. Files without
+// one are valid.
+func (f *File) VerifyHash() error {
+	for _, a := range f.Attr {
+		h, ok := a.(*FileAttrHash)
+		if !ok {
+			continue
+		}
+		sum, err := hashData(h.HashType, f.FData)
+		if err != nil {
+			return fmt.Errorf("%q: %v", f.Name, err)
+		}
+		if !bytes.Equal(sum, h.Data) {
+			return fmt.Errorf("%q: %v hash is %x, want %x", f.Name, h.HashType, sum, h.Data)
+		}
+	}
+	return nil
+}
+
+// attrCompression returns the compression of the data of f given by its
+// compression attribute.
+func attrCompression(f *File) Compression {
+	if c, ok := f.Attribute(Compressed).(*FileAttrCompression); ok {
+		return c.Compression
+	}
+	return None
+}
@@ -0,0 +1,48 @@
+// Copyright 2018-2021 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbfs
+
+import (
+	"fmt"
+
+	"github.com/linuxboot/fiano/pkg/compression"
+)
+
+// compressor returns the compressor of c, or nil for None. LZMA data has the
+// 13 byte header of the lzma tool and LZ4 data is an LZ4 frame, which is what
+// coreboot expects.
+func compressor(c Compression) (compression.Compressor, error) {
+	switch c {
+	case None:
+		return nil, nil
+	case LZMA:
+		return &compression.LZMA{}, nil
+	case LZ4:
+		return &compression.LZ4{}, nil
+	}
+	return nil, fmt.Errorf("%v compression is not supported", c)
+}
+
+// compress encodes data with c.
+func compress(c Compression, data []byte) ([]byte, error) {
+	z, err := compressor(c)
+	if err != nil || z == nil {
+		return data, err
+	}
+	return z.Encode(data)
+}
+
+// decompress decodes data compressed with c.
+func decompress(c Compression, data []byte) ([]byte, error) {
+	z, err := compressor(c)
+	if err != nil || z == nil {
+		return data, err
+	}
+	d, err := z.Decode(data)
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", c, err)
+	}
+	return d, nil
+}
@@ -0,0 +1,227 @@
+// Copyright 2018-2021 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbfs
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+)
+
+// elfSegment is a loadable segment of an ELF executable.
+type elfSegment struct {
+	addr    uint64
+	data    []byte
+	memSize uint64
+	flags   elf.ProgFlag
+}
+
+// elfRWX are the flags of the segment of a stage.
+const elfRWX = elf.PF_R | elf.PF_W | elf.PF_X
+
+// Machine returns the ELF machine of the architecture, for the 64 bit variant
+// if wide is set.
+func (a Architecture) Machine(wide bool) (elf.Machine, error) {
+	switch {
+	case a == X86 && wide:
+		return elf.EM_X86_64, nil
+	case a == X86:
+		return elf.EM_386, nil
+	case a == ARM && wide, a == ARM64:
+		return elf.EM_AARCH64, nil
+	case a == ARM:
+		return elf.EM_ARM, nil
+	case a == RISCV:
+		return elf.EM_RISCV, nil
+	}
+	return elf.EM_NONE, fmt.Errorf("no ELF machine for architecture %#x", uint32(a))
+}
+
+// elfClass64 lists the machines whose executables are ELF64.
+var elfClass64 = map[elf.Machine]bool{
+	elf.EM_X86_64:  true,
+	elf.EM_AARCH64: true,
+	elf.EM_RISCV:   true,
+}
+
+// writeELF returns a little endian ELF executable for machine m loading segs
+// and starting at entry, like the ones cbfstool extracts.
+func writeELF(m elf.Machine, entry uint64, segs []elfSegment) ([]byte, error) {
+	if m == elf.EM_NONE {
+		return nil, fmt.Errorf("no ELF machine")
+	}
+	var b bytes.Buffer
+	ident := [elf.EI_NIDENT]byte{0: 0x7f, 1: 'E', 2: 'L', 3: 'F',
+		elf.EI_DATA: byte(elf.ELFDATA2LSB), elf.EI_VERSION: byte(elf.EV_CURRENT)}
+	if elfClass64[m] {
+		ident[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+		hsize, psize := binary.Size(elf.Header64{}), binary.Size(elf.Prog64{})
+		h := elf.Header64{Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(m), Version: uint32(elf.EV_CURRENT),
+			Entry: entry, Phoff: uint64(hsize), Ehsize: uint16(hsize), Phentsize: uint16(psize), Phnum: uint16(len(segs))}
+		if err := WriteLE(&b, h); err != nil {
+			return nil, err
+		}
+		off := uint64(hsize + len(segs)*psize)
+		for _, s := range segs {
+			p := elf.Prog64{Type: uint32(elf.PT_LOAD), Flags: uint32(s.flags), Off: off, Vaddr: s.addr, Paddr: s.addr,
+				Filesz: uint64(len(s.data)), Memsz: s.memSize, Align: 1}
+			if p.Memsz < p.Filesz {
+				p.Memsz = p.Filesz
+			}
+			if err := WriteLE(&b, p); err != nil {
+				return nil, err
+			}
+			off += p.Filesz
+		}
+	} else {
+		ident[elf.EI_CLASS] = byte(elf.ELFCLASS32)
+		if entry > 0xffffffff {
+			return nil, fmt.Errorf("entry %#x does not fit in ELF32", entry)
+		}
+		hsize, psize := binary.Size(elf.Header32{}), binary.Size(elf.Prog32{})
+		h := elf.Header32{Ident: ident, Type: uint16(elf.ET_EXEC), Machine: uint16(m), Version: uint32(elf.EV_CURRENT),
+			Entry: uint32(entry), Phoff: uint32(hsize), Ehsize: uint16(hsize), Phentsize: uint16(psize), Phnum: uint16(len(segs))}
+		if err := WriteLE(&b, h); err != nil {
+			return nil, err
+		}
+		off := uint32(hsize + len(segs)*psize)
+		for _, s := range segs {
+			if s.addr+s.memSize > 1<<32 || s.addr+uint64(len(s.data)) > 1<<32 {
+				return nil, fmt.Errorf("segment at %#x does not fit in ELF32", s.addr)
+			}
+			p := elf.Prog32{Type: uint32(elf.PT_LOAD), Flags: uint32(s.flags), Off: off, Vaddr: uint32(s.addr), Paddr: uint32(s.addr),
+				Filesz: uint32(len(s.data)), Memsz: uint32(s.memSize), Align: 1}
+			if p.Memsz < p.Filesz {
+				p.Memsz = p.Filesz
+			}
+			if err := WriteLE(&b, p); err != nil {
+				return nil, err
+			}
+			off += p.Filesz
+		}
+	}
+	for _, s := range segs {
+		b.Write(s.data)
+	}
+	return b.Bytes(), nil
+}
+
+// loadSegments returns the PT_LOAD segments of e which take memory, with
+// their data, at their physical addresses. The entry point is translated to
+// a physical address as well.
+func loadSegments(e *elf.File) ([]elfSegment, uint64, error) {
+	var segs []elfSegment
+	entry := e.Entry
+	for i, p := range e.Progs {
+		if p.Type != elf.PT_LOAD || p.Memsz == 0 {
+			continue
+		}
+		if p.Filesz > p.Memsz {
+			return nil, 0, fmt.Errorf("ELF segment #%d has %#x bytes of data but takes %#x bytes", i, p.Filesz, p.Memsz)
+		}
+		if p.Memsz > math.MaxUint32 {
+			return nil, 0, fmt.Errorf("ELF segment #%d of %#x bytes is too large", i, p.Memsz)
+		}
+		d := make([]byte, p.Filesz)
+		if _, err := io.ReadFull(p.Open(), d); err != nil {
+			return nil, 0, fmt.Errorf("ELF segment #%d: %v", i, err)
+		}
+		if e.Entry >= p.Vaddr && e.Entry-p.Vaddr < p.Memsz {
+			entry = e.Entry - p.Vaddr + p.Paddr
+		}
+		segs = append(segs, elfSegment{p.Paddr, d, p.Memsz, p.Flags})
+	}
+	return segs, entry, nil
+}
+
+// PayloadFromELF returns the segments of a payload loading the ELF executable
+// e, like cbfstool add-payload. Executable segments are code, other segments
+// are data, or BSS if they have no data. The segments are followed by the
+// entry. Pass them to EncodePayload to get the contents of a TypeSELF file.
+func PayloadFromELF(e *elf.File) ([]PayloadSegment, error) {
+	load, entry, err := loadSegments(e)
+	if err != nil {
+		return nil, err
+	}
+	var segs []PayloadSegment
+	for _, l := range load {
+		s := PayloadSegment{PayloadHeader: PayloadHeader{Type: SegData, LoadAddress: l.addr, MemSize: uint32(l.memSize)}, Data: l.data}
+		switch {
+		case len(l.data) == 0:
+			s.Type, s.Data = SegBSS, nil
+		case l.flags&elf.PF_X != 0:
+			s.Type = SegCode
+		}
+		segs = append(segs, s)
+	}
+	return append(segs, PayloadSegment{PayloadHeader: PayloadHeader{Type: SegEntry, LoadAddress: entry}}), nil
+}
+
+// PayloadFromBinary returns the segments of a payload loading the flat binary
+// b at load and starting at entry, like cbfstool add-flat-binary.
+func PayloadFromBinary(b []byte, load, entry uint64) []PayloadSegment {
+	return []PayloadSegment{
+		{PayloadHeader: PayloadHeader{Type: SegCode, LoadAddress: load, MemSize: uint32(len(b))}, Data: b},
+		{PayloadHeader: PayloadHeader{Type: SegEntry, LoadAddress: entry}},
+	}
+}
+
+// StageFromELF returns the stage header and the data of a stage loading the
+// ELF executable e, like cbfstool add-stage. The segments are merged into one
+// image from the lowest load address, gaps and BSS at the end are zeroed by
+// the loader. The header can be passed to Image.Add in AddOptions.Stage for a
+// TypeStage file, or be turned into a StageHeader for EncodeLegacyStage.
+func StageFromELF(e *elf.File) (*FileAttrStageHeader, []byte, error) {
+	segs, entry, err := loadSegments(e)
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(segs) == 0 {
+		return nil, nil, fmt.Errorf("ELF has no loadable segment")
+	}
+	start, dataEnd, memEnd := uint64(math.MaxUint64), uint64(0), uint64(0)
+	for _, s := range segs {
+		if s.addr < start {
+			start = s.addr
+		}
+		if end := s.addr + uint64(len(s.data)); len(s.data) > 0 && end > dataEnd {
+			dataEnd = end
+		}
+		if end := s.addr + s.memSize; end > memEnd {
+			memEnd = end
+		}
+	}
+	if dataEnd < start {
+		dataEnd = start
+	}
+	if memEnd-start > math.MaxUint32 {
+		return nil, nil, fmt.Errorf("ELF segments span %#x bytes", memEnd-start)
+	}
+	data := make([]byte, dataEnd-start)
+	for _, s := range segs {
+		if len(s.data) > 0 {
+			copy(data[s.addr-start:], s.data)
+		}
+	}
+	h, err := StageFromBinary(data, start, entry)
+	if err != nil {
+		return nil, nil, err
+	}
+	h.MemSize = uint32(memEnd - start)
+	return h, data, nil
+}
+
+// StageFromBinary returns the stage header of a stage loading the flat binary
+// b at load and starting at entry. The entry is stored as an offset from
+// load, it is not checked against b: relocatable stages have made up ones.
+func StageFromBinary(b []byte, load, entry uint64) (*FileAttrStageHeader, error) {
+	if entry < load || entry-load > math.MaxUint32 {
+		return nil, fmt.Errorf("Stage entry %#x is not within 4GiB above the load address %#x", entry, load)
+	}
+	return &FileAttrStageHeader{Tag: SHCB, Size: 24, LoadAddress: load, EntryOffset: uint32(entry - load), MemSize: uint32(len(b))}, nil
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"strconv"
 	"strings"
 	"unicode"
 )
@@ -56,7 +57,87 @@ func (c Compression) String() string {
 	case LZ4:
 		return "lz4"
 	}
-	return "unknown"
+	return fmt.Sprintf("%#x", uint32(c))
+}
+
+// ParseCompression returns the Compression named n, as printed by String.
+func ParseCompression(n string) (Compression, error) {
+	for _, c := range []Compression{None, LZMA, LZ4} {
+		if c.String() == n {
+			return c, nil
+		}
+	}
+	return None, fmt.Errorf("unknown compression %q", n)
+}
+
+func (h HashType) String() string {
+	switch h {
+	case HashNone:
+		return "none"
+	case HashSHA1:
+		return "sha1"
+	case HashSHA256:
+		return "sha256"
+	case HashSHA512:
+		return "sha512"
+	}
+	return fmt.Sprintf("%#x", uint32(h))
+}
+
+// ParseHashType returns the HashType named n, as printed by String.
+func ParseHashType(n string) (HashType, error) {
+	for _, h := range []HashType{HashNone, HashSHA1, HashSHA256, HashSHA512} {
+		if h.String() == n {
+			return h, nil
+		}
+	}
+	return HashNone, fmt.Errorf("unknown hash algorithm %q", n)
+}
+
+// fileTypeNames are the names cbfstool uses for the file types.
+var fileTypeNames = map[string]FileType{
+	"null":         TypeDeleted2,
+	"deleted":      TypeDeleted,
+	"bootblock":    TypeBootBlock,
+	"cbfs header":  TypeMaster,
+	"legacy stage": TypeLegacyStage,
+	"stage":        TypeStage,
+	"simple elf":   TypeSELF,
+	"payload":      TypeSELF,
+	"fit":          TypeFIT,
+	"optionrom":    TypeOptionRom,
+	"bootsplash":   TypeBootSplash,
+	"raw":          TypeRaw,
+	"vsa":          TypeVSA,
+	"mbi":          TypeMBI,
+	"microcode":    TypeMicroCode,
+	"fsp":          TypeFSP,
+	"mrc":          TypeMRC,
+	"mma":          TypeMMA,
+	"efi":          TypeEFI,
+	"struct":       TypeStruct,
+	"cmos_default": TypeCMOS,
+	"spd":          TypeSPD,
+	"mrc_cache":    TypeMRCCache,
+	"cmos_layout":  TypeCMOSLayout,
+}
+
+// ParseFileType returns the FileType named n. n is a cbfstool name such as
+// "raw", a name printed by String such as "TypeRaw", or a number.
+func ParseFileType(n string) (FileType, error) {
+	if t, ok := fileTypeNames[n]; ok {
+		return t, nil
+	}
+	for _, t := range fileTypeNames {
+		if t.String() == n {
+			return t, nil
+		}
+	}
+	t, err := strconv.ParseUint(n, 0, 32)
+	if err != nil {
+		return 0, fmt.Errorf("unknown file type %q", n)
+	}
+	return FileType(t), nil
 }
 
 func (f FileType) String() string {
@@ -149,6 +230,7 @@ func ReadName(r io.Reader, f *File, size uint32) error {
 	return nil
 }
 
+// ReadAttributes reads and parses the attribute list of a file.
 func ReadAttributes(r io.Reader, f *File) error {
 	if f.AttrOffset == 0 {
 		return nil
@@ -166,7 +248,7 @@ func ReadAttributes(r io.Reader, f *File) error {
 		Debug("ReadAttributes short: %v", err)
 		return err
 	}
-	f.Attr = b
+	f.Attr, f.attrPad = parseAttributes(b)
 	return nil
 }
 
@@ -194,3 +276,8 @@ func ffbyte(s uint32) []byte {
 	}
 	return b
 }
+
+// nameSize returns the size of a NUL terminated file name padded to 16 bytes.
+func nameSize(n string) int {
+	return (len(n) + 1 + 15) &^ 15
+}
@@ -6,6 +6,7 @@ package cbfs
 
 import (
 	"bytes"
+	"debug/elf"
 	"encoding/json"
 	"fmt"
 	"io"
@@ -32,6 +33,9 @@ func RegisterFileReader(f *SegReader) error {
 	return nil
 }
 
+// NewImage reads an image and the CBFS in each of its FMAP areas starting
+// with a CBFS file, like COREBOOT, FW_MAIN_A and FW_MAIN_B in vboot images.
+// COREBOOT, or the first of them if there is none, is selected.
 func NewImage(rs io.ReadSeeker) (*Image, error) {
 	// Suck the image in. Todo: write a thing that implements
 	// ReadSeeker on a []byte.
@@ -46,26 +50,59 @@ func NewImage(rs io.ReadSeeker) (*Image, error) {
 	}
 	Debug("Fmap %v", f)
 	var i = &Image{FMAP: f, FMAPMetadata: m, Data: b}
-	for _, a := range f.Areas {
-		Debug("Check %v", a.Name.String())
-		if a.Name.String() == "COREBOOT" {
-			i.Area = &a
-			break
+	for _, a := range cbfsAreas(f, b) {
+		segs, err := readRegion(in, a)
+		if err != nil {
+			return nil, fmt.Errorf("CBFS in %s: %v", a.Name.String(), err)
+		}
+		r := &Region{Area: a, Segs: segs}
+		i.Regions = append(i.Regions, r)
+		if i.Area == nil || a.Name.String() == "COREBOOT" {
+			i.Area, i.Segs = &r.Area, r.Segs
 		}
 	}
 	if i.Area == nil {
 		return nil, fmt.Errorf("No CBFS in fmap")
 	}
-	r := io.NewSectionReader(in, int64(i.Area.Offset), int64(i.Area.Size))
+	return i, nil
+}
+
+// cbfsAreas returns the areas of f starting with a CBFS file in the image b.
+// Of areas starting at the same offset, like an RW section and the CBFS in
+// it, only the smallest one is kept.
+func cbfsAreas(f *fmap.FMap, b []byte) []fmap.Area {
+	var areas []fmap.Area
+	for _, a := range f.Areas {
+		Debug("Check %v", a.Name.String())
+		if a.Size < uint32(len(FileMagic)) || uint64(a.Offset) > uint64(len(b)) || !bytes.HasPrefix(b[a.Offset:], []byte(FileMagic)) {
+			continue
+		}
+		inner := true
+		for _, o := range f.Areas {
+			if o.Offset == a.Offset && o.Size < a.Size {
+				inner = false
+			}
+		}
+		if inner {
+			areas = append(areas, a)
+		}
+	}
+	return areas
+}
 
-	for off := int64(0); off < int64(i.Area.Size); {
+// readRegion reads the records of the CBFS in area a.
+func readRegion(in io.ReaderAt, a fmap.Area) ([]ReadWriter, error) {
+	var segs []ReadWriter
+	r := io.NewSectionReader(in, int64(a.Offset), int64(a.Size))
+
+	for off := int64(0); off < int64(a.Size); {
 		var f File
 		if _, err := r.Seek(off, io.SeekStart); err != nil {
 			return nil, err
 		}
 		err := Read(r, &f.FileHeader)
 		if err == io.EOF {
-			return i, nil
+			return segs, nil
 		}
 		if err != nil {
 			return nil, err
@@ -76,7 +113,7 @@ func NewImage(rs io.ReadSeeker) (*Image, error) {
 		}
 		Debug("It is %v type %v", f, f.Type)
 		f.RecordStart = uint32(off)
-		Debug("Starting at %#02x + %#02x", i.Area.Offset, f.RecordStart)
+		Debug("Starting at %#02x + %#02x", a.Offset, f.RecordStart)
 		nameStart, err := r.Seek(0, io.SeekCurrent)
 		if err != nil {
 			return nil, fmt.Errorf("Getting file offset for name: %v", err)
@@ -85,7 +122,9 @@ func NewImage(rs io.ReadSeeker) (*Image, error) {
 		// If we cant find any new match, break out of the loop.
 		if !ok {
 			// Remove last segment in image, because it's garbage
-			i.Segs = i.Segs[:len(i.Segs)-1]
+			if len(segs) > 0 {
+				segs = segs[:len(segs)-1]
+			}
 			break
 		}
 		var nameSize uint32
@@ -112,7 +151,7 @@ func NewImage(rs io.ReadSeeker) (*Image, error) {
 			return nil, fmt.Errorf("Reading %#x byte subheader: %v", len(f.FData), err)
 		}
 		Debug("Segment was readable")
-		i.Segs = append(i.Segs, s)
+		segs = append(segs, s)
 		off, err = r.Seek(0, io.SeekCurrent)
 		if err != nil {
 			return nil, err
@@ -121,7 +160,7 @@ func NewImage(rs io.ReadSeeker) (*Image, error) {
 		off = (off + 15) & (^15)
 
 	}
-	return i, nil
+	return segs, nil
 }
 
 func (i *Image) WriteFile(name string, perm os.FileMode) error {
@@ -131,48 +170,130 @@ func (i *Image) WriteFile(name string, perm os.FileMode) error {
 	return nil
 }
 
-// Update creates a new []byte for the cbfs. It is complicated a lot
-// by the fact that endianness is not consistent in cbfs images.
+// Update creates a new []byte for the cbfs of every region. It is
+// complicated a lot by the fact that endianness is not consistent in cbfs
+// images.
 func (i *Image) Update() error {
-	//FIXME: Support additional regions
-	for _, s := range i.Segs {
+	i.sync()
+	for _, r := range i.Regions {
+		if err := i.updateRegion(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (i *Image) updateRegion(r *Region) error {
+	for _, s := range r.Segs {
 		var b bytes.Buffer
-		if err := Write(&b, s.GetFile().FileHeader); err != nil {
+		f := s.GetFile()
+		if err := Write(&b, f.FileHeader); err != nil {
 			return err
 		}
-		if _, err := b.Write(s.GetFile().Attr); err != nil {
+		// The name is NUL padded to 16 bytes, the rest of the space up to
+		// the attributes, or the data if there are none, is 0xff.
+		nameEnd := f.SubHeaderOffset
+		if f.AttrOffset != 0 {
+			nameEnd = f.AttrOffset
+		}
+		attrs, err := encodeAttributes(f.Attr)
+		if err != nil {
+			return fmt.Errorf("cbfs record %q: %v", f.Name, err)
+		}
+		if nameEnd < FileSize+uint32(len(f.Name)) || nameEnd+uint32(len(attrs)) > f.SubHeaderOffset {
+			return fmt.Errorf("Header of cbfs record %q does not fit in %#x bytes", f.Name, f.SubHeaderOffset)
+		}
+		name := ffbyte(nameEnd - FileSize)
+		for n := 0; n < len(name) && n < nameSize(f.Name); n++ {
+			name[n] = 0
+		}
+		copy(name, f.Name)
+		b.Write(name)
+		if _, err := b.Write(attrs); err != nil {
 			return fmt.Errorf("Writing attr to cbfs record for %v: %v", s, err)
 		}
+		pad := ffbyte(f.SubHeaderOffset - uint32(b.Len()))
+		if len(f.attrPad) == len(pad) {
+			pad = f.attrPad
+		}
+		b.Write(pad)
 		if err := s.Write(&b); err != nil {
 			return err
 		}
 		// This error should not happen but we need to check just in case.
 		end := uint32(len(b.Bytes())) + s.GetFile().RecordStart
-		if end > i.Area.Size {
-			return fmt.Errorf("Region [%#x, %#x] outside of CBFS [%#x, %#x]", s.GetFile().RecordStart, end, s.GetFile().RecordStart, i.Area.Size)
+		if end > r.Area.Size {
+			return fmt.Errorf("Region [%#x, %#x] outside of CBFS [%#x, %#x]", s.GetFile().RecordStart, end, s.GetFile().RecordStart, r.Area.Size)
 		}
 
-		Debug("Copy %s %d bytes to i.Data[%d]", s.GetFile().Type.String(), len(b.Bytes()), i.Area.Offset+s.GetFile().RecordStart)
-		copy(i.Data[i.Area.Offset+s.GetFile().RecordStart:], b.Bytes())
+		Debug("Copy %s %d bytes to i.Data[%d]", s.GetFile().Type.String(), len(b.Bytes()), r.Area.Offset+s.GetFile().RecordStart)
+		copy(i.Data[r.Area.Offset+s.GetFile().RecordStart:], b.Bytes())
 	}
 	return nil
 }
 
+// Select selects the CBFS in the FMAP area called name: Segs and Area are
+// set to its records and area, which the methods working on files use.
+// Changes to the records of the selected CBFS are kept.
+func (i *Image) Select(name string) error {
+	i.sync()
+	for _, r := range i.Regions {
+		if r.Area.Name.String() == name {
+			i.Area, i.Segs = &r.Area, r.Segs
+			return nil
+		}
+	}
+	return fmt.Errorf("Select %q: no CBFS in this FMAP area", name)
+}
+
+// RegionNames returns the names of the FMAP areas with a CBFS.
+func (i *Image) RegionNames() []string {
+	var names []string
+	for _, r := range i.Regions {
+		names = append(names, r.Area.Name.String())
+	}
+	return names
+}
+
+// sync stores the records of the selected CBFS in its region.
+func (i *Image) sync() {
+	for _, r := range i.Regions {
+		if &r.Area == i.Area {
+			r.Segs = i.Segs
+		}
+	}
+}
+
 type mImage struct {
+	Region   string
 	Offset   uint32
 	Segments []ReadWriter
 }
 
+// MarshalJSON marshals the selected CBFS.
 func (i *Image) MarshalJSON() ([]byte, error) {
-	return json.Marshal(mImage{Segments: i.Segs, Offset: i.Area.Offset})
+	return json.Marshal(mImage{Region: i.Area.Name.String(), Segments: i.Segs, Offset: i.Area.Offset})
 }
 
+// String lists the files of the selected CBFS.
 func (i *Image) String() string {
-	var s = "FMAP REGIOName: COREBOOT\n"
+	var s = fmt.Sprintf("FMAP REGIOName: %s\n", i.Area.Name.String())
 
 	s += fmt.Sprintf("%-32s %-8s   %-24s %-8s   %-4s\n", "Name", "Offset", "Type", "Size", "Comp")
 	for _, seg := range i.Segs {
 		s = s + seg.String() + "\n"
+		f := seg.GetFile()
+		for _, a := range f.Attr {
+			s += " " + a.String()
+			if a.AttrTag() == Hash {
+				if err := f.VerifyHash(); err != nil {
+					s += " (mismatch)"
+				} else {
+					s += " (valid)"
+				}
+			}
+			s += "\n"
+		}
 	}
 	return s
 }
@@ -194,7 +315,7 @@ func (i *Image) Remove(n string) error {
 	}
 	// You can not remove the master header
 	// Just remake the cbfs if you're doing that kind of surgery.
-	if found == 0 {
+	if _, ok := i.Segs[found].(*MasterRecord); ok {
 		return os.ErrPermission
 	}
 	// Bootblock on x86 is at the end of CBFS and shall stay untouched.
@@ -202,25 +323,61 @@ func (i *Image) Remove(n string) error {
 		return os.ErrPermission
 	}
 	start, end := found, found+1
-	if i.Segs[start-1].GetFile().Deleted() {
+	if start > 0 && i.Segs[start-1].GetFile().Deleted() {
 		start = start - 1
 	}
-	if i.Segs[end].GetFile().Deleted() {
+	if end < len(i.Segs) && i.Segs[end].GetFile().Deleted() {
 		end = end + 1
 	}
 	Debug("Remove: empty range [%d:%d]", start, end)
 	base := i.Segs[start].GetFile().RecordStart
-	top := i.Segs[end].GetFile().RecordStart
+	// Without a bootblock, like in the CBFS of other regions than
+	// COREBOOT, the last record can be removed.
+	var top uint32
+	if end < len(i.Segs) {
+		top = i.Segs[end].GetFile().RecordStart
+	} else {
+		f := i.Segs[end-1].GetFile()
+		top = align(f.RecordStart+f.SubHeaderOffset+f.Size, Alignment)
+	}
 	Debug("Remove: base %#x top %#x", base, top)
-	// 0x28: header size + 16-byte-aligned-size name
-	s := top - base - 0x28
-	i.Segs[found].GetFile().SubHeaderOffset = 0x28
-	i.Segs[found].GetFile().Size = s
-	del, _ := NewEmptyRecord(i.Segs[found].GetFile())
-	Debug("Offset is 0x28, Size is %#x", s)
+	del := newEmptyRecord(base, top)
 	Debug("Remove: Replace %d..%d with %s", start, end, del.String())
 	// At most, there will be an Empty record before us since
 	// things come pre-merged
 	i.Segs = append(append(i.Segs[:start], del), i.Segs[end:]...)
 	return nil
 }
+
+// Architecture returns the architecture in the master header, or 0 if there
+// is none. Only the COREBOOT CBFS has one, the others share it.
+func (i *Image) Architecture() Architecture {
+	i.sync()
+	for _, r := range i.Regions {
+		for _, s := range r.Segs {
+			if m, ok := s.(*MasterRecord); ok {
+				return m.Architecture
+			}
+		}
+	}
+	return 0
+}
+
+// Extract returns the contents of the file called name. Stages and payloads
+// are returned as ELF executables for machine m, like cbfstool extract -m,
+// the data of other files is decompressed.
+func (i *Image) Extract(name string, m elf.Machine) ([]byte, error) {
+	for _, s := range i.Segs {
+		f := s.GetFile()
+		if f.Name != name || f.Deleted() {
+			continue
+		}
+		if e, ok := s.(interface {
+			ELF(elf.Machine) ([]byte, error)
+		}); ok {
+			return e.ELF(m)
+		}
+		return decompress(attrCompression(f), f.FData)
+	}
+	return nil, fmt.Errorf("Extract %q: %w", name, os.ErrNotExist)
+}
@@ -6,12 +6,20 @@ package cbfs
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"debug/elf"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
 	"reflect"
+	"strings"
 	"testing"
+
+	"github.com/linuxboot/fiano/pkg/compression"
+	"github.com/linuxboot/fiano/pkg/fmap"
 )
 
 func TestReadFile(t *testing.T) {
@@ -193,3 +201,624 @@ func TestRemovePayload(t *testing.T) {
 	*/
 
 }
+
+func TestUpdateUnchanged(t *testing.T) {
+	old, err := ioutil.ReadFile("testdata/coreboot.rom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	i, err := NewImage(bytes.NewReader(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	i.Data = append([]byte{}, old...)
+	if err := i.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(old, i.Data) {
+		t.Fatalf("Update of an unchanged image changed it")
+	}
+}
+
+// attrTags returns the tags of the attributes of f.
+func attrTags(t *testing.T, f *File) []Tag {
+	var tags []Tag
+	for _, a := range f.Attr {
+		if _, ok := a.(*FileAttr); ok {
+			t.Errorf("%q: attribute %v was not parsed", f.Name, a)
+		}
+		tags = append(tags, a.AttrTag())
+	}
+	return tags
+}
+
+func TestAdd(t *testing.T) {
+	data := bytes.Repeat([]byte("linuxboot "), 100)
+	var tests = []struct {
+		n     string
+		t     FileType
+		opts  *AddOptions
+		tags  []Tag
+		start uint32
+	}{
+		{"plain", TypeRaw, nil, nil, 0x12e80},
+		{"lzma", TypeRaw, &AddOptions{Compression: LZMA, Hash: HashSHA256}, []Tag{Compressed, Hash}, 0x12e80},
+		{"align", TypeRaw, &AddOptions{Align: 0x1000}, []Tag{ALCB}, 0x12fc0},
+		{"base", TypeRaw, &AddOptions{Base: 0x20000}, []Tag{PSCB}, 0x1ffc0},
+		{"stage", TypeStage, &AddOptions{Stage: &FileAttrStageHeader{LoadAddress: 0x100000, EntryOffset: 0x10, MemSize: 0x2000}}, []Tag{SHCB}, 0x12e80},
+	}
+	for _, tc := range tests {
+		t.Run(tc.n, func(t *testing.T) {
+			old, err := ioutil.ReadFile("testdata/coreboot.rom")
+			if err != nil {
+				t.Fatal(err)
+			}
+			i, err := NewImage(bytes.NewReader(old))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := i.Add("added", tc.t, data, tc.opts); err != nil {
+				t.Fatal(err)
+			}
+			if err := i.Update(); err != nil {
+				t.Fatal(err)
+			}
+			n, err := NewImage(bytes.NewReader(i.Data))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(n.Segs) != len(i.Segs) {
+				t.Fatalf("got %d records, want %d:\n%s", len(n.Segs), len(i.Segs), n)
+			}
+			var f *File
+			var free uint32
+			for _, s := range n.Segs {
+				g := s.GetFile()
+				if g.Name == "added" {
+					f = g
+				}
+				if g.Type == TypeDeleted2 {
+					free += g.SubHeaderOffset + g.Size
+				}
+				if g.Type == TypeBootBlock && !bytes.Equal(old[n.Area.Offset+g.RecordStart:], i.Data[n.Area.Offset+g.RecordStart:]) {
+					t.Errorf("bootblock changed")
+				}
+			}
+			if f == nil {
+				t.Fatalf("added file not found in\n%s", n)
+			}
+			if f.RecordStart != tc.start {
+				t.Errorf("added file at %#x, want %#x", f.RecordStart, tc.start)
+			}
+			if used := 0x3fa40 - 0x12e80 - free; used != align(f.SubHeaderOffset+f.Size, Alignment) {
+				t.Errorf("added file uses %#x bytes of free space", used)
+			}
+			if !reflect.DeepEqual(attrTags(t, f), tc.tags) {
+				t.Errorf("got attributes %#x, want %#x", attrTags(t, f), tc.tags)
+			}
+			d := f.FData
+			if tc.opts != nil && tc.opts.Compression == LZMA {
+				if d, err = (&compression.LZMA{}).Decode(f.FData); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(d, data) {
+				t.Errorf("added file data differs")
+			}
+			if tc.opts == nil {
+				return
+			}
+			off := f.RecordStart + f.SubHeaderOffset
+			if tc.opts.Align != 0 && off%tc.opts.Align != 0 {
+				t.Errorf("data at %#x, want alignment %#x", off, tc.opts.Align)
+			}
+			if tc.opts.Base != 0 && off != tc.opts.Base {
+				t.Errorf("data at %#x, want %#x", off, tc.opts.Base)
+			}
+			if tc.opts.Hash == HashSHA256 {
+				sum := sha256.Sum256(f.FData)
+				if h, ok := f.Attribute(Hash).(*FileAttrHash); !ok || !bytes.Equal(h.Data, sum[:]) || f.VerifyHash() != nil {
+					t.Errorf("hash attribute does not hold the hash of the data")
+				}
+			}
+		})
+	}
+}
+
+func TestAddErrors(t *testing.T) {
+	var tests = []struct {
+		n    string
+		name string
+		size int
+		opts *AddOptions
+	}{
+		{"exists", "config", 16, nil},
+		{"too large", "big", 0x30000, nil},
+		{"base used", "base", 16, &AddOptions{Base: 0x100}},
+		{"no name", "", 16, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.n, func(t *testing.T) {
+			i, err := Open("testdata/coreboot.rom")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := i.Add(tc.name, TypeRaw, make([]byte, tc.size), tc.opts); err == nil {
+				t.Errorf("got nil, want an error")
+			}
+		})
+	}
+}
+
+func TestRemoveAdd(t *testing.T) {
+	i, err := Open("testdata/coreboot.rom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Remove("fallback/dsdt.aml"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Add("fallback/dsdt.aml", TypeRaw, make([]byte, 16), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Update(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewImage(bytes.NewReader(i.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n.String(), i.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+	if f := n.Segs[6].GetFile(); f.Name != "fallback/dsdt.aml" || f.RecordStart != 0x11280 {
+		t.Errorf("got %q at %#x, want fallback/dsdt.aml at 0x11280", f.Name, f.RecordStart)
+	}
+}
+
+func TestExtract(t *testing.T) {
+	i, err := Open("testdata/coreboot.rom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		name     string
+		entry    uint64
+		load     uint64
+		size     uint64
+		memSize  uint64
+		sections int
+	}{
+		{"fallback/romstage", 0xfffc0320, 0xfffc0300, 0x3da8, 0x3da8, 1},
+		// The ramstage is LZMA compressed.
+		{"fallback/ramstage", 0x4000000, 0, 148660, 0x2c6f8, 1},
+		{"fallback/payload", 0, 0, 0, 0, 0},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := i.Extract(tc.name, elf.EM_386)
+			if err != nil {
+				t.Fatal(err)
+			}
+			e, err := elf.NewFile(bytes.NewReader(b))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if e.Class != elf.ELFCLASS32 || e.Machine != elf.EM_386 || e.Entry != tc.entry || len(e.Progs) != tc.sections {
+				t.Fatalf("got %v %v entry %#x with %d segments, want ELF32 EM_386 entry %#x with %d segments",
+					e.Class, e.Machine, e.Entry, len(e.Progs), tc.entry, tc.sections)
+			}
+			if tc.sections == 0 {
+				return
+			}
+			p := e.Progs[0]
+			if p.Vaddr != tc.load || p.Filesz != tc.size || p.Memsz != tc.memSize {
+				t.Errorf("got segment at %#x of %#x/%#x bytes, want %#x of %#x/%#x bytes",
+					p.Vaddr, p.Filesz, p.Memsz, tc.load, tc.size, tc.memSize)
+			}
+		})
+	}
+
+	config, err := i.Extract("config", elf.EM_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(config, []byte("# This image was built using coreboot")) {
+		t.Errorf("config starts with %q", config[:16])
+	}
+	if _, err := i.Extract("fallback/ramstage", elf.EM_NONE); err == nil {
+		t.Errorf("extracting a stage without a machine: got nil, want an error")
+	}
+	if _, err := i.Extract("nonexistent", elf.EM_386); err == nil {
+		t.Errorf("extracting a missing file: got nil, want an error")
+	}
+}
+
+// addAndReparse adds a file to the test image and returns the record of the
+// file parsed back.
+func addAndReparse(t *testing.T, name string, typ FileType, data []byte, opts *AddOptions) ReadWriter {
+	i, err := Open("testdata/coreboot.rom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Add(name, typ, data, opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Update(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewImage(bytes.NewReader(i.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range n.Segs {
+		if s.GetFile().Name == name {
+			return s
+		}
+	}
+	t.Fatalf("%q not found in\n%s", name, n)
+	return nil
+}
+
+func TestStageAndPayloadCompression(t *testing.T) {
+	code := bytes.Repeat([]byte("\x90\x90\xeb\xfe"), 0x400)
+	for _, c := range []Compression{None, LZMA, LZ4} {
+		t.Run(c.String(), func(t *testing.T) {
+			b, err := EncodeLegacyStage(StageHeader{Entry: 0x100010, LoadAddress: 0x100000, MemSize: 0x2000}, code, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ls, ok := addAndReparse(t, "legacy", TypeLegacyStage, b, nil).(*LegacyStageRecord)
+			if !ok {
+				t.Fatalf("legacy stage is not a LegacyStageRecord")
+			}
+			if d, err := ls.Decompress(); err != nil || !bytes.Equal(d, code) || ls.Compression != c || ls.MemSize != 0x2000 {
+				t.Errorf("legacy stage: got %d bytes, %v compression, %#x memory, %v; want %d bytes, %v, 0x2000",
+					len(d), ls.Compression, ls.MemSize, err, len(code), c)
+			}
+
+			stage := &FileAttrStageHeader{LoadAddress: 0x100000, EntryOffset: 0x10, MemSize: 0x2000}
+			s, ok := addAndReparse(t, "stage", TypeStage, code, &AddOptions{Compression: c, Stage: stage}).(*StageRecord)
+			if !ok {
+				t.Fatalf("stage is not a StageRecord")
+			}
+			if d, err := s.Decompress(); err != nil || !bytes.Equal(d, code) {
+				t.Errorf("stage: got %d bytes, %v; want %d bytes", len(d), err, len(code))
+			}
+			if s.LoadAddress != 0x100000 || s.EntryOffset != 0x10 || !strings.Contains(s.String(), " "+c.String()) {
+				t.Errorf("stage: got %v, want the stage header and compression %v", s, c)
+			}
+
+			segs := []PayloadSegment{
+				{PayloadHeader{Type: SegCode, LoadAddress: 0x100000}, code},
+				{PayloadHeader{Type: SegData, LoadAddress: 0x200000}, []byte("payload data")},
+				{PayloadHeader{Type: SegBSS, LoadAddress: 0x300000, MemSize: 0x1000}, nil},
+				{PayloadHeader{Type: SegEntry, LoadAddress: 0x100010}, nil},
+			}
+			b, err = EncodePayload(segs, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			p, ok := addAndReparse(t, "payload", TypeSELF, b, nil).(*PayloadRecord)
+			if !ok {
+				t.Fatalf("payload is not a PayloadRecord")
+			}
+			got, err := p.Segments()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(got) != len(segs) {
+				t.Fatalf("got %d payload segments, want %d", len(got), len(segs))
+			}
+			for n := range segs {
+				if !bytes.Equal(got[n].Data, segs[n].Data) || got[n].LoadAddress != segs[n].LoadAddress {
+					t.Errorf("payload segment #%d: got %d bytes at %#x, want %d bytes at %#x",
+						n, len(got[n].Data), got[n].LoadAddress, len(segs[n].Data), segs[n].LoadAddress)
+				}
+			}
+			// The short data segment does not get smaller.
+			if got[0].Compression != c || got[1].Compression != None {
+				t.Errorf("got payload compression %v and %v, want %v and none", got[0].Compression, got[1].Compression, c)
+			}
+			e, err := p.ELF(elf.EM_X86_64)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f, err := elf.NewFile(bytes.NewReader(e))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if f.Entry != 0x100010 || len(f.Progs) != 3 || f.Progs[2].Memsz != 0x1000 {
+				t.Errorf("payload ELF: got entry %#x and %d segments, want 0x100010 and 3", f.Entry, len(f.Progs))
+			}
+		})
+	}
+}
+
+func TestAttributes(t *testing.T) {
+	var b bytes.Buffer
+	for _, v := range []interface{}{
+		FileAttrCompression{Compressed, 16, LZ4, 0x1000},
+		[]uint32{uint32(Hash), 12 + 20, uint32(HashSHA1)}, make([]byte, 20),
+		FileAttrPos{PSCB, 12, 0x20000},
+		FileAttrAlign{ALCB, 12, 0x40},
+		FileAttrStageHeader{SHCB, 24, 0x100000, 0x10, 0x2000},
+		FileAttrIBB{IBB, 8},
+		// An unknown attribute and a stage header of the wrong size.
+		[]uint32{0x12345678, 12, 0xcafe},
+		[]uint32{uint32(SHCB), 12, 0},
+	} {
+		if err := Write(&b, v); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := b.Bytes()
+	attrs, pad := parseAttributes(append(append([]byte{}, list...), ffbyte(8)...))
+	want := []string{
+		"Compression lz4 DecompressedSize 0x1000",
+		"Hash sha1 0000000000000000000000000000000000000000",
+		"Position 0x20000",
+		"Align 0x40",
+		"StageHeader LoadAddress 0x100000 EntryOffset 0x10 MemSize 0x2000",
+		"IBB",
+		"Tag 0x12345678 Size 0xc",
+		"Tag 0x53746748 Size 0xc",
+	}
+	var got []string
+	for _, a := range attrs {
+		got = append(got, a.String())
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got attributes\n%q\nwant\n%q", got, want)
+	}
+	if !bytes.Equal(pad, ffbyte(8)) {
+		t.Errorf("got padding %#x, want 8 bytes of 0xff", pad)
+	}
+	enc, err := encodeAttributes(attrs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(enc, list) {
+		t.Errorf("attributes encoded to\n%#x\nwant\n%#x", enc, list)
+	}
+}
+
+func TestAttributesUpdate(t *testing.T) {
+	i, err := Open("testdata/coreboot.rom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Add("hashed", TypeRaw, []byte("some data"), &AddOptions{Hash: HashSHA256}); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Update(); err != nil {
+		t.Fatal(err)
+	}
+	var config, hashed *File
+	for _, s := range i.Segs {
+		switch s.GetFile().Name {
+		case "config":
+			config = s.GetFile()
+		case "hashed":
+			hashed = s.GetFile()
+		}
+	}
+	c, ok := config.Attribute(Compressed).(*FileAttrCompression)
+	if !ok || c.Compression != None || c.DecompressedSize != 0x163 {
+		t.Fatalf("config has compression attribute %v, want none of 0x163 bytes", config.Attribute(Compressed))
+	}
+	for _, want := range []string{"config", " Compression none DecompressedSize 0x163\n", " (valid)\n"} {
+		if !strings.Contains(i.String(), want) {
+			t.Errorf("list does not show %q:\n%s", want, i)
+		}
+	}
+	j, err := json.Marshal(i)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(j, []byte(`"Tag":"compression","Size":16,"Compression":"none"`)) || !bytes.Contains(j, []byte(`"HashType":"sha256","Data":"`)) {
+		t.Errorf("JSON does not show the attributes:\n%s", j)
+	}
+
+	c.DecompressedSize = 0x164
+	hashed.FData[0]++
+	if err := hashed.VerifyHash(); err == nil {
+		t.Errorf("changed data: got nil, want a hash mismatch")
+	}
+	if err := i.Update(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewImage(bytes.NewReader(i.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := n.String(); !strings.Contains(s, "DecompressedSize 0x164\n") || !strings.Contains(s, " (mismatch)\n") {
+		t.Errorf("changed attributes were not written:\n%s", s)
+	}
+}
+
+func TestFromELF(t *testing.T) {
+	code := bytes.Repeat([]byte("\x90\x90\xeb\xfe"), 0x400)
+	data := []byte("initialized data")
+	b, err := writeELF(elf.EM_386, 0x100010, []elfSegment{
+		{0x100000, code, 0, elf.PF_R | elf.PF_X},
+		{0x102000, data, 0x100, elf.PF_R | elf.PF_W},
+		{0x103000, nil, 0x800, elf.PF_R | elf.PF_W},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := elf.NewFile(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	segs, err := PayloadFromELF(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []PayloadSegment{
+		{PayloadHeader{Type: SegCode, LoadAddress: 0x100000, MemSize: uint32(len(code))}, code},
+		{PayloadHeader{Type: SegData, LoadAddress: 0x102000, MemSize: 0x100}, data},
+		{PayloadHeader{Type: SegBSS, LoadAddress: 0x103000, MemSize: 0x800}, nil},
+		{PayloadHeader{Type: SegEntry, LoadAddress: 0x100010}, nil},
+	}
+	if !reflect.DeepEqual(segs, want) {
+		for n := range segs {
+			t.Logf("payload segment #%d: %v with %d bytes", n, &segs[n].PayloadHeader, len(segs[n].Data))
+		}
+		t.Errorf("payload segments: got %d segments, want code, data, BSS and entry", len(segs))
+	}
+	p, err := EncodePayload(segs, LZMA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pr, ok := addAndReparse(t, "payload", TypeSELF, p, nil).(*PayloadRecord)
+	if !ok {
+		t.Fatalf("payload is not a PayloadRecord")
+	}
+	got, err := pr.Segments()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for n := range want {
+		if got[n].Type != want[n].Type || got[n].LoadAddress != want[n].LoadAddress || got[n].MemSize != want[n].MemSize || !bytes.Equal(got[n].Data, want[n].Data) {
+			t.Errorf("payload segment #%d: got %v, want %v", n, &got[n].PayloadHeader, &want[n].PayloadHeader)
+		}
+	}
+
+	h, d, err := StageFromELF(e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.LoadAddress != 0x100000 || h.EntryOffset != 0x10 || h.MemSize != 0x3800 {
+		t.Errorf("stage header: got %v, want load address 0x100000, entry offset 0x10 and 0x3800 bytes", h)
+	}
+	wantData := make([]byte, 0x2000+len(data))
+	copy(wantData, code)
+	copy(wantData[0x2000:], data)
+	if !bytes.Equal(d, wantData) {
+		t.Errorf("stage data: got %d bytes, want %d bytes of code, zeros and data", len(d), len(wantData))
+	}
+	s, ok := addAndReparse(t, "stage", TypeStage, d, &AddOptions{Compression: LZ4, Stage: h}).(*StageRecord)
+	if !ok {
+		t.Fatalf("stage is not a StageRecord")
+	}
+	if sd, err := s.Decompress(); err != nil || !bytes.Equal(sd, d) || s.FileAttrStageHeader != *h {
+		t.Errorf("stage: got %v with %d bytes, %v; want %v with %d bytes", &s.FileAttrStageHeader, len(sd), err, h, len(d))
+	}
+}
+
+func TestFromBinary(t *testing.T) {
+	b := []byte("flat binary")
+	segs := PayloadFromBinary(b, 0x1000, 0x1004)
+	if len(segs) != 2 || segs[0].Type != SegCode || segs[0].LoadAddress != 0x1000 || !bytes.Equal(segs[0].Data, b) ||
+		segs[1].Type != SegEntry || segs[1].LoadAddress != 0x1004 {
+		t.Errorf("payload segments: got %+v, want the code at 0x1000 and the entry at 0x1004", segs)
+	}
+	h, err := StageFromBinary(b, 0x1000, 0x1004)
+	if err != nil || h.LoadAddress != 0x1000 || h.EntryOffset != 4 || h.MemSize != uint32(len(b)) {
+		t.Errorf("stage header: got %v, %v; want load address 0x1000, entry offset 4 and %#x bytes", h, err, len(b))
+	}
+	if _, err := StageFromBinary(b, 0x1000, 0x800); err == nil {
+		t.Errorf("stage with an entry below its load address: got nil, want an error")
+	}
+}
+
+// vbootImage returns testdata/coreboot.rom followed by an RW section with
+// a CBFS in FW_MAIN_A and an erased FW_MAIN_B, like in vboot images.
+func vbootImage(t *testing.T) []byte {
+	b, err := ioutil.ReadFile("testdata/coreboot.rom")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, m, err := fmap.Read(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := uint32(len(b))
+	for _, a := range []fmap.Area{{Offset: size, Size: 0x20000}, {Offset: size, Size: 0x10000}, {Offset: size + 0x10000, Size: 0x10000}} {
+		f.Areas = append(f.Areas, a)
+	}
+	copy(f.Areas[3].Name.Value[:], "RW_SECTION_A")
+	copy(f.Areas[4].Name.Value[:], "FW_MAIN_A")
+	copy(f.Areas[5].Name.Value[:], "FW_MAIN_B")
+	f.NAreas, f.Size = uint16(len(f.Areas)), size+0x20000
+
+	var h bytes.Buffer
+	if err := WriteLE(&h, f.Header); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteLE(&h, f.Areas); err != nil {
+		t.Fatal(err)
+	}
+	copy(b[m.Start:], h.Bytes())
+	rw := ffbyte(0x20000)
+	e := newEmptyRecord(0, 0x10000).GetFile()
+	var r bytes.Buffer
+	if err := Write(&r, e.FileHeader); err != nil {
+		t.Fatal(err)
+	}
+	copy(rw, r.Bytes())
+	copy(rw[FileSize:], make([]byte, 16))
+	return append(b, rw...)
+}
+
+func TestRegions(t *testing.T) {
+	old := vbootImage(t)
+	i, err := NewImage(bytes.NewReader(old))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := i.RegionNames(), []string{"COREBOOT", "FW_MAIN_A"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("regions: got %q, want %q", got, want)
+	}
+	if got := i.Area.Name.String(); got != "COREBOOT" || len(i.Segs) != 10 {
+		t.Errorf("got %d records in region %q, want 10 in COREBOOT", len(i.Segs), got)
+	}
+	if err := i.Select("FW_MAIN_B"); err == nil {
+		t.Errorf("selecting the erased FW_MAIN_B: got nil, want an error")
+	}
+
+	if err := i.Select("FW_MAIN_A"); err != nil {
+		t.Fatal(err)
+	}
+	if a := i.Architecture(); a != Architecture(0xffffffff) {
+		t.Errorf("architecture of FW_MAIN_A: got %#x, want the one of COREBOOT, 0xffffffff", uint32(a))
+	}
+	if err := i.Add("ecrw", TypeRaw, []byte("ec firmware"), nil); err != nil {
+		t.Fatal(err)
+	}
+	// Update writes all the regions, not only the selected one.
+	if err := i.Select("COREBOOT"); err != nil {
+		t.Fatal(err)
+	}
+	if err := i.Update(); err != nil {
+		t.Fatal(err)
+	}
+	n, err := NewImage(bytes.NewReader(i.Data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Select("FW_MAIN_A"); err != nil {
+		t.Fatal(err)
+	}
+	d, err := n.Extract("ecrw", elf.EM_NONE)
+	if err != nil || string(d) != "ec firmware" {
+		t.Errorf("ecrw in FW_MAIN_A: got %q, %v; want %q", d, err, "ec firmware")
+	}
+	if _, err := i.Extract("ecrw", elf.EM_NONE); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("ecrw in COREBOOT: got %v, want %v", err, os.ErrNotExist)
+	}
+
+	// Removing the file restores the image.
+	if err := n.Remove("ecrw"); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Update(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(n.Data, old) {
+		t.Errorf("image after adding and removing ecrw differs from the original")
+	}
+}
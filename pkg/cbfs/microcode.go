@@ -26,7 +26,7 @@ func (r *MicrocodeRecord) Read(in io.ReadSeeker) error {
 }
 
 func (r *MicrocodeRecord) String() string {
-	return recString(r.File.Name, r.RecordStart, r.Type.String(), r.Size, "none")
+	return recString(r.File.Name, r.RecordStart, r.Type.String(), r.Size, attrCompression(&r.File).String())
 }
 
 func (r *MicrocodeRecord) Write(w io.Writer) error {
@@ -5,8 +5,12 @@
 package cbfs
 
 import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 )
 
@@ -34,20 +38,13 @@ func (p *PayloadRecord) Read(in io.ReadSeeker) error {
 			break
 		}
 	}
-	where, err := in.Seek(0, io.SeekCurrent)
+	// The segment data follows the segment headers.
+	d, err := ioutil.ReadAll(in)
 	if err != nil {
-		return fmt.Errorf("Finding location in stream: %v", err)
+		return fmt.Errorf("Reading payload data: %v", err)
 	}
-	amt := uint32(where) - p.Size
-	if amt == 0 {
-		return nil
-	}
-	p.FData = make([]byte, amt)
-	n, err := in.Read(p.FData)
-	if err != nil {
-		return err
-	}
-	Debug("Payload read %d bytes", n)
+	p.Data = d
+	Debug("Payload read %d bytes", len(d))
 	return nil
 }
 
@@ -74,9 +71,103 @@ func (r *PayloadRecord) Write(w io.Writer) error {
 	if err := Write(w, r.Segs); err != nil {
 		return err
 	}
-	return Write(w, r.FData)
+	return Write(w, r.Data)
 }
 
 func (r *PayloadRecord) GetFile() *File {
 	return &r.File
 }
+
+// PayloadSegment is a segment of a payload with its data decompressed.
+type PayloadSegment struct {
+	PayloadHeader
+	Data []byte
+}
+
+// Segments returns the segments of the payload with their data decompressed.
+func (r *PayloadRecord) Segments() ([]PayloadSegment, error) {
+	// Offsets count from the start of the segment headers.
+	base := uint32(len(r.Segs) * binary.Size(PayloadHeader{}))
+	segs := make([]PayloadSegment, len(r.Segs))
+	for i, h := range r.Segs {
+		segs[i].PayloadHeader = h
+		if h.Size == 0 || h.Type == SegEntry || h.Type == SegBSS {
+			continue
+		}
+		if h.Offset < base || uint64(h.Offset-base)+uint64(h.Size) > uint64(len(r.Data)) {
+			return nil, fmt.Errorf("Payload segment #%d [%#x, %#x) is outside of the payload", i, h.Offset, h.Offset+h.Size)
+		}
+		d, err := decompress(h.Compression, r.Data[h.Offset-base:h.Offset-base+h.Size])
+		if err != nil {
+			return nil, fmt.Errorf("Payload segment #%d: %v", i, err)
+		}
+		segs[i].Data = d
+	}
+	return segs, nil
+}
+
+// ELF returns the payload as an ELF executable for machine m.
+func (r *PayloadRecord) ELF(m elf.Machine) ([]byte, error) {
+	segs, err := r.Segments()
+	if err != nil {
+		return nil, err
+	}
+	var entry uint64
+	var load []elfSegment
+	for _, s := range segs {
+		switch s.Type {
+		case SegEntry:
+			entry = s.LoadAddress
+		case SegCode:
+			load = append(load, elfSegment{s.LoadAddress, s.Data, uint64(s.MemSize), elf.PF_R | elf.PF_X})
+		case SegData, SegBSS:
+			load = append(load, elfSegment{s.LoadAddress, s.Data, uint64(s.MemSize), elf.PF_R | elf.PF_W})
+		}
+	}
+	return writeELF(m, entry, load)
+}
+
+// EncodePayload returns the contents of a payload with the segments segs.
+// The data of the code and data segments is compressed with c, unless it does
+// not get smaller, like cbfstool does. The last segment must be the entry.
+// The offsets, sizes and compression of the headers are set, MemSize is at
+// least the size of the data.
+func EncodePayload(segs []PayloadSegment, c Compression) ([]byte, error) {
+	if len(segs) == 0 || segs[len(segs)-1].Type != SegEntry {
+		return nil, fmt.Errorf("Payload does not end with an entry segment")
+	}
+	hs := make([]PayloadHeader, len(segs))
+	var data bytes.Buffer
+	off := uint32(len(segs) * binary.Size(PayloadHeader{}))
+	for i, s := range segs {
+		h := s.PayloadHeader
+		h.Compression, h.Offset, h.Size = None, off, 0
+		if s.Type == SegEntry {
+			h.Offset = 0
+		}
+		if len(s.Data) > 0 {
+			d, err := compress(c, s.Data)
+			if err != nil {
+				return nil, err
+			}
+			if len(d) < len(s.Data) {
+				h.Compression = c
+			} else {
+				d = s.Data
+			}
+			h.Size = uint32(len(d))
+			data.Write(d)
+		}
+		if h.MemSize < uint32(len(s.Data)) {
+			h.MemSize = uint32(len(s.Data))
+		}
+		off += h.Size
+		hs[i] = h
+	}
+	var b bytes.Buffer
+	if err := Write(&b, hs); err != nil {
+		return nil, err
+	}
+	b.Write(data.Bytes())
+	return b.Bytes(), nil
+}
@@ -25,7 +25,7 @@ func (r *RawRecord) Read(in io.ReadSeeker) error {
 }
 
 func (r *RawRecord) String() string {
-	return recString(r.File.Name, r.RecordStart, r.Type.String(), r.Size, "none")
+	return recString(r.File.Name, r.RecordStart, r.Type.String(), r.Size, attrCompression(&r.File).String())
 }
 
 func (r *RawRecord) Write(w io.Writer) error {
@@ -26,7 +26,7 @@ func (r *SPDRecord) Read(in io.ReadSeeker) error {
 }
 
 func (r *SPDRecord) String() string {
-	return recString(r.File.Name, r.RecordStart, r.Type.String(), r.Size, "none")
+	return recString(r.File.Name, r.RecordStart, r.Type.String(), r.Size, attrCompression(&r.File).String())
 }
 
 func (r *SPDRecord) Write(w io.Writer) error {
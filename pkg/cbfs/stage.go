@@ -5,9 +5,12 @@
 package cbfs
 
 import (
+	"bytes"
+	"debug/elf"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 )
 
@@ -65,7 +68,7 @@ func (h *LegacyStageRecord) MarshalJSON() ([]byte, error) {
 }
 
 func (h *StageHeader) String() string {
-	return fmt.Sprintf("Compression %#x Entry %#x LoadAddress %#x Size %#x MemSize %#x",
+	return fmt.Sprintf("Compression %v Entry %#x LoadAddress %#x Size %#x MemSize %#x",
 		h.Compression,
 		h.Entry,
 		h.LoadAddress,
@@ -89,26 +92,67 @@ func (r *LegacyStageRecord) GetFile() *File {
 	return &r.File
 }
 
+// Decompress returns the program loaded by the stage.
+func (r *LegacyStageRecord) Decompress() ([]byte, error) {
+	return decompress(r.Compression, r.Data)
+}
+
+// ELF returns the stage as an ELF executable for machine m.
+func (r *LegacyStageRecord) ELF(m elf.Machine) ([]byte, error) {
+	d, err := r.Decompress()
+	if err != nil {
+		return nil, err
+	}
+	return writeELF(m, r.Entry, []elfSegment{{r.LoadAddress, d, uint64(r.MemSize), elfRWX}})
+}
+
+// EncodeLegacyStage returns the contents of a legacy stage loading data,
+// compressed with c, at h.LoadAddress. The compression and the size in h are
+// set, MemSize is at least the size of data.
+func EncodeLegacyStage(h StageHeader, data []byte, c Compression) ([]byte, error) {
+	d, err := compress(c, data)
+	if err != nil {
+		return nil, err
+	}
+	h.Compression, h.Size = c, uint32(len(d))
+	if h.MemSize < uint32(len(data)) {
+		h.MemSize = uint32(len(data))
+	}
+	var b bytes.Buffer
+	if err := WriteLE(&b, h); err != nil {
+		return nil, err
+	}
+	b.Write(d)
+	return b.Bytes(), nil
+}
+
 func NewStageRecord(f *File) (ReadWriter, error) {
 	r := &StageRecord{File: *f}
 	return r, nil
 }
 
 func (r *StageRecord) Read(in io.ReadSeeker) error {
+	d, err := ioutil.ReadAll(in)
+	if err != nil {
+		return err
+	}
+	r.Data = d
+	// The load address is in an attribute.
+	if h, ok := r.Attribute(SHCB).(*FileAttrStageHeader); ok {
+		r.FileAttrStageHeader = *h
+	}
 	return nil
 }
 
 func (h *FileAttrStageHeader) String() string {
-	return fmt.Sprintf("Size %#x LoadAddress %#x EntryOffset %#x MemSize %#x",
-		h.Size,
+	return fmt.Sprintf("StageHeader LoadAddress %#x EntryOffset %#x MemSize %#x",
 		h.LoadAddress,
 		h.EntryOffset,
 		h.MemSize)
 }
 
 func (h *StageRecord) String() string {
-	// TODO read compression from Attributes
-	return recString(h.File.Name, h.RecordStart, h.Type.String(), h.File.Size, "none")
+	return recString(h.File.Name, h.RecordStart, h.Type.String(), h.File.Size, attrCompression(&h.File).String())
 }
 
 func (r *StageRecord) Write(w io.Writer) error {
@@ -118,3 +162,18 @@ func (r *StageRecord) Write(w io.Writer) error {
 func (r *StageRecord) GetFile() *File {
 	return &r.File
 }
+
+// Decompress returns the program loaded by the stage.
+func (r *StageRecord) Decompress() ([]byte, error) {
+	return decompress(attrCompression(&r.File), r.Data)
+}
+
+// ELF returns the stage as an ELF executable for machine m.
+func (r *StageRecord) ELF(m elf.Machine) ([]byte, error) {
+	d, err := r.Decompress()
+	if err != nil {
+		return nil, err
+	}
+	h := r.FileAttrStageHeader
+	return writeELF(m, h.LoadAddress+uint64(h.EntryOffset), []elfSegment{{h.LoadAddress, d, uint64(h.MemSize), elfRWX}})
+}
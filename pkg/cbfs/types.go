@@ -99,26 +99,38 @@ type File struct {
 	FileHeader
 	RecordStart uint32
 	Name        string
-	Attr        []byte
+	Attr        []Attribute
 	FData       []byte
+	// The bytes between the attributes and the data, kept when the
+	// attributes are rewritten if they still fit.
+	attrPad []byte
 }
 
 type mFile struct {
-	Name  string
-	Start uint32
-	Size  uint32
-	Type  string
+	Name       string
+	Start      uint32
+	Size       uint32
+	Type       string
+	Attributes []Attribute `json:",omitempty"`
 }
 
 func (f *File) MarshalJSON() ([]byte, error) {
 	return json.Marshal(mFile{
-		Name:  f.Name,
-		Start: f.RecordStart,
-		Size:  f.FileHeader.Size,
-		Type:  f.FileHeader.Type.String(),
+		Name:       f.Name,
+		Start:      f.RecordStart,
+		Size:       f.FileHeader.Size,
+		Type:       f.FileHeader.Type.String(),
+		Attributes: f.Attr,
 	})
 }
 
+// Attribute is a cbfs file attribute. The attributes follow the name of a
+// file and start with their tag and size.
+type Attribute interface {
+	AttrTag() Tag
+	String() string
+}
+
 // The common fields of extended cbfs file attributes.
 // Attributes are expected to start with tag/len, then append their
 // specific fields.
@@ -138,6 +150,7 @@ const (
 	PSCB       Tag = 0x42435350
 	ALCB       Tag = 0x42434c41
 	SHCB       Tag = 0x53746748
+	IBB        Tag = 0x32494242
 )
 
 type FileAttrCompression struct {
@@ -150,10 +163,21 @@ type FileAttrCompression struct {
 type FileAttrHash struct {
 	Tag      Tag
 	Size     uint32 // includes everything including data.
-	HashType uint32
+	HashType HashType
 	Data     []byte
 }
 
+// HashType is the algorithm of a hash attribute. The values are those of
+// vboot.
+type HashType uint32
+
+const (
+	HashNone HashType = iota
+	HashSHA1
+	HashSHA256
+	HashSHA512
+)
+
 type FileAttrPos struct {
 	Tag  Tag
 	Size uint32 // includes everything including data.
@@ -174,6 +198,12 @@ type FileAttrStageHeader struct {
 	MemSize     uint32
 }
 
+// FileAttrIBB marks the initial boot block, which has no other fields.
+type FileAttrIBB struct {
+	Tag  Tag
+	Size uint32
+}
+
 // Component sub-headers
 
 // Following are component sub-headers for the "standard"
@@ -203,8 +233,10 @@ type MasterRecord struct {
 type Architecture uint32
 
 const (
-	X86 Architecture = 1
-	ARM Architecture = 0x10
+	X86     Architecture = 1
+	ARM     Architecture = 0x10
+	ARM64   Architecture = 0xaa64
+	RISCV   Architecture = 0xc001
 )
 
 type StageHeader struct {
@@ -313,12 +345,21 @@ type ReadWriter interface {
 	Write(f io.Writer) error
 }
 
+// Region is a CBFS in an FMAP area.
+type Region struct {
+	Area fmap.Area
+	Segs []ReadWriter
+}
+
 type Image struct {
+	// Segs and Area are those of the selected region, see Select.
 	Segs []ReadWriter
 	// Scarf away the fmap info.
 	FMAP         *fmap.FMap
 	FMAPMetadata *fmap.Metadata
 	Area         *fmap.Area
+	// Regions are the CBFSes of the image, in FMAP order.
+	Regions []*Region
 	// And all the data.
 	Data []byte
 }
@@ -0,0 +1,77 @@
+// Copyright 2018 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compression
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/andybalholm/brotli"
+)
+
+// EDK2 prepends a header to the Brotli stream with the decoded size and the
+// size of the scratch buffer needed by its decoder.
+//
+// See: https://github.com/tianocore/edk2/blob/master/MdeModulePkg/Library/BrotliCustomDecompressLib/BrotliDecompress.c
+const brotliHeaderSize = 16
+
+// These match the defaults of EDK2's BrotliCompress tool.
+const (
+	brotliQuality = 9
+	brotliLGWin   = 22
+)
+
+// Brotli implements Compressor for the Brotli GUIDed section used by newer
+// EDK2 builds.
+type Brotli struct{}
+
+// Name returns the type of compression employed.
+func (c *Brotli) Name() string {
+	return "BROTLI"
+}
+
+// Decode decodes a byte slice of Brotli data.
+func (c *Brotli) Decode(encodedData []byte) ([]byte, error) {
+	if len(encodedData) < brotliHeaderSize {
+		return nil, fmt.Errorf("brotli data too short, got %d bytes, header needs %d",
+			len(encodedData), brotliHeaderSize)
+	}
+	decodedSize := binary.LittleEndian.Uint64(encodedData[0:8])
+	decodedData, err := ioutil.ReadAll(brotli.NewReader(bytes.NewReader(encodedData[brotliHeaderSize:])))
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(decodedData)) != decodedSize {
+		return nil, fmt.Errorf("brotli decoded size mismatch, header has %d bytes, got %d bytes",
+			decodedSize, len(decodedData))
+	}
+	return decodedData, nil
+}
+
+// Encode encodes a byte slice with Brotli.
+func (c *Brotli) Encode(decodedData []byte) ([]byte, error) {
+	stream := &bytes.Buffer{}
+	w := brotli.NewWriterOptions(stream, brotli.WriterOptions{
+		Quality: brotliQuality,
+		LGWin:   brotliLGWin,
+	})
+	if _, err := w.Write(decodedData); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	scratchSize, err := brotliScratchSize(stream.Bytes(), decodedData)
+	if err != nil {
+		return nil, err
+	}
+
+	encodedData := make([]byte, brotliHeaderSize, brotliHeaderSize+stream.Len())
+	binary.LittleEndian.PutUint64(encodedData[0:8], uint64(len(decodedData)))
+	binary.LittleEndian.PutUint64(encodedData[8:16], scratchSize)
+	return append(encodedData, stream.Bytes()...), nil
+}
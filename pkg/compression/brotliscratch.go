@@ -0,0 +1,962 @@
+// Copyright 2018 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compression
+
+import (
+	"errors"
+	"fmt"
+)
+
+// EDK2's decoder allocates from the scratch buffer and never frees, so the
+// buffer must hold every allocation the reference decoder makes while
+// decoding the stream. brotliAllocations walks the stream the way the
+// reference decoder does and lists these allocations, which only depend on
+// the stream. brotliScratchSize adds upper bounds for what depends on how
+// EDK2 builds the decoder, so the header is a conservative bound of what
+// BrotliCompress measures by decoding its output with a counting allocator.
+//
+// The walker follows RFC 7932. It does not need the static dictionary, the
+// decoded data is used instead for the literal context.
+//
+// Adapted from: https://github.com/google/brotli/blob/v1.0.9/c/dec/decode.c
+const (
+	// Upper bound of sizeof(BrotliDecoderState). It is about 3 KiB in
+	// v1.0.9 on 64 bit builds, most of it the header and body arenas of
+	// the meta-blocks.
+	brotliMaxStateSize = 0x2000
+	// Upper bound of the space lost to each allocation. EDK2's BrAlloc hands
+	// out consecutive slices of the scratch buffer without headers or
+	// alignment, so this is a margin in case another allocator aligns them.
+	brotliMaxAllocOverhead = 16
+
+	// Size of HuffmanCode and of a pointer on 64 bit builds.
+	brotliHuffmanCodeSize = 4
+	brotliPointerSize     = 8
+	// Sizes of the block type and block count tables, allocated once.
+	brotliMaxSize258 = 632
+	brotliMaxSize26  = 396
+	// Ring buffer slack used by the decoder.
+	brotliRingBufferSlack = 42
+
+	brotliNumLiteralSymbols  = 256
+	brotliNumCommandSymbols  = 704
+	brotliNumBlockLenSymbols = 26
+	brotliMaxDistanceBits    = 24
+	brotliLiteralContextBits = 6
+	brotliDistContextBits    = 2
+	brotliWindowGap          = 16
+	brotliMaxCodeLen         = 15
+)
+
+// brotliMaxHuffmanTableSize is the size of the decoding table of one prefix
+// code, indexed by (alphabet size + 31) / 32.
+var brotliMaxHuffmanTableSize = []uint32{
+	256, 402, 436, 468, 500, 534, 566, 598, 630, 662, 694, 726, 758, 790, 822,
+	854, 886, 920, 952, 984, 1016, 1048, 1080, 1112, 1144, 1176, 1208, 1240,
+	1272, 1304, 1336, 1368, 1400, 1432, 1464, 1496, 1528,
+}
+
+var brotliCodeLengthCodeOrder = [18]uint8{1, 2, 3, 4, 0, 5, 17, 6, 16, 7, 8, 9, 10, 11, 12, 13, 14, 15}
+
+// Static prefix code for the code length code lengths, indexed by the next 4
+// bits of the stream.
+var (
+	brotliCodeLengthPrefixLength = [16]uint8{2, 2, 2, 3, 2, 2, 2, 4, 2, 2, 2, 3, 2, 2, 2, 4}
+	brotliCodeLengthPrefixValue  = [16]uint8{0, 4, 3, 2, 0, 4, 3, 1, 0, 4, 3, 2, 0, 4, 3, 5}
+)
+
+type brotliPrefixRange struct {
+	base  uint32
+	nbits uint
+}
+
+var brotliBlockLengthPrefix = [brotliNumBlockLenSymbols]brotliPrefixRange{
+	{1, 2}, {5, 2}, {9, 2}, {13, 2}, {17, 3}, {25, 3}, {33, 3}, {41, 3},
+	{49, 4}, {65, 4}, {81, 4}, {97, 4}, {113, 5}, {145, 5}, {177, 5}, {209, 5},
+	{241, 6}, {305, 6}, {369, 7}, {497, 8}, {753, 9}, {1265, 10}, {2289, 11}, {4337, 12},
+	{8433, 13}, {16625, 24},
+}
+
+var brotliInsertLengthPrefix = [24]brotliPrefixRange{
+	{0, 0}, {1, 0}, {2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 1}, {8, 1},
+	{10, 2}, {14, 2}, {18, 3}, {26, 3}, {34, 4}, {50, 4}, {66, 5}, {98, 5},
+	{130, 6}, {194, 7}, {322, 8}, {578, 9}, {1090, 10}, {2114, 12}, {6210, 14}, {22594, 24},
+}
+
+var brotliCopyLengthPrefix = [24]brotliPrefixRange{
+	{2, 0}, {3, 0}, {4, 0}, {5, 0}, {6, 0}, {7, 0}, {8, 0}, {9, 0},
+	{10, 1}, {12, 1}, {14, 2}, {18, 2}, {22, 3}, {30, 3}, {38, 4}, {54, 4},
+	{70, 5}, {102, 5}, {134, 6}, {198, 7}, {326, 8}, {582, 9}, {1094, 10}, {2118, 24},
+}
+
+// brotliCommandCells maps the 64 symbol cells of the insert-and-copy
+// alphabet to the first insert and copy length codes.
+var brotliCommandCells = [11][2]uint32{
+	{0, 0}, {0, 8}, {0, 0}, {0, 8}, {8, 0}, {8, 8}, {0, 16}, {16, 0}, {8, 16}, {16, 8}, {16, 16},
+}
+
+// brotliDictSizeBits is the number of bits of the word index, per word
+// length.
+var brotliDictSizeBits = [25]uint{0, 0, 0, 0, 10, 10, 11, 11, 10, 10, 10, 10, 10, 9, 9, 8, 7, 7, 8, 7, 7, 6, 6, 5, 5}
+
+// brotliTransforms holds, for each dictionary word transform, the length of
+// its prefix and suffix and the number of bytes it omits from the word.
+var brotliTransforms = [121][2]uint8{
+	{0, 0}, {1, 0}, {2, 0}, {0, 1}, {1, 0}, {5, 0}, {1, 0}, {3, 0},
+	{4, 0}, {0, 0}, {5, 0}, {0, 2}, {0, 1}, {3, 0}, {2, 0}, {2, 0},
+	{4, 0}, {4, 0}, {3, 0}, {1, 0}, {1, 0}, {2, 0}, {1, 0}, {0, 3},
+	{1, 0}, {5, 0}, {0, 3}, {0, 2}, {3, 0}, {6, 0}, {1, 0}, {2, 0},
+	{1, 0}, {3, 0}, {0, 4}, {6, 0}, {1, 0}, {6, 0}, {4, 0}, {0, 5},
+	{0, 6}, {5, 0}, {0, 4}, {6, 0}, {0, 0}, {4, 0}, {4, 0}, {4, 0},
+	{0, 7}, {4, 1}, {2, 0}, {1, 0}, {3, 0}, {3, 0}, {0, 9}, {0, 7},
+	{0, 6}, {1, 0}, {2, 0}, {0, 8}, {4, 0}, {3, 0}, {9, 0}, {0, 5},
+	{0, 9}, {3, 0}, {1, 0}, {2, 0}, {1, 0}, {2, 0}, {2, 0}, {2, 0},
+	{5, 0}, {13, 0}, {1, 0}, {7, 0}, {1, 0}, {2, 0}, {1, 0}, {1, 0},
+	{5, 0}, {3, 0}, {3, 0}, {2, 0}, {3, 0}, {1, 0}, {2, 0}, {1, 0},
+	{2, 0}, {2, 0}, {4, 0}, {3, 0}, {4, 0}, {5, 0}, {1, 0}, {4, 0},
+	{2, 0}, {2, 0}, {3, 0}, {1, 0}, {4, 0}, {1, 0}, {2, 0}, {2, 0},
+	{2, 0}, {2, 0}, {4, 0}, {2, 0}, {2, 0}, {2, 0}, {3, 0}, {3, 0},
+	{1, 0}, {1, 0}, {2, 0}, {2, 0}, {2, 0}, {3, 0}, {3, 0}, {3, 0},
+	{3, 0},
+}
+
+// Literal context lookup tables of the UTF8 and signed context modes,
+// indexed by the last byte, then by the second last byte plus 256.
+var brotliContextUTF8 = [512]uint8{
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 4, 4, 0, 0, 4, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	8, 12, 16, 12, 12, 20, 12, 16, 24, 28, 12, 12, 32, 12, 36, 12,
+	44, 44, 44, 44, 44, 44, 44, 44, 44, 44, 32, 32, 24, 40, 28, 12,
+	12, 48, 52, 52, 52, 48, 52, 52, 52, 48, 52, 52, 52, 52, 52, 48,
+	52, 52, 52, 52, 52, 48, 52, 52, 52, 52, 52, 24, 12, 28, 12, 12,
+	12, 56, 60, 60, 60, 56, 60, 60, 60, 56, 60, 60, 60, 60, 60, 56,
+	60, 60, 60, 60, 60, 56, 60, 60, 60, 60, 60, 24, 12, 28, 12, 0,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1, 0, 1,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+	2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3, 2, 3,
+
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1, 1,
+	1, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 1, 1, 1, 1, 1,
+	1, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 1, 1, 1, 1, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+}
+
+var brotliContextSigned = [512]uint8{
+	0, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8, 8,
+	16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16,
+	16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16, 16,
+	24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24,
+	24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24,
+	24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24,
+	24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24, 24,
+	32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32,
+	32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32,
+	32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32,
+	32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32, 32,
+	40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40,
+	40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40,
+	40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40, 40,
+	48, 48, 48, 48, 48, 48, 48, 48, 48, 48, 48, 48, 48, 48, 48, 56,
+
+	0, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2, 2,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3, 3,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4, 4,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5, 5,
+	6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 6, 7,
+}
+
+var errBrotliTruncated = errors.New("brotli stream is truncated")
+
+// brotliBitReader reads the bitstream, least significant bit first.
+type brotliBitReader struct {
+	src []byte
+	pos uint // In bits
+}
+
+func (r *brotliBitReader) bits(n uint) (uint32, error) {
+	if r.pos+n > uint(len(r.src))*8 {
+		return 0, errBrotliTruncated
+	}
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		p := r.pos + i
+		v |= uint32(r.src[p/8]>>(p%8)&1) << i
+	}
+	r.pos += n
+	return v, nil
+}
+
+// peek returns the next n bits, padded with zeros past the end.
+func (r *brotliBitReader) peek(n uint) uint32 {
+	var v uint32
+	for i := uint(0); i < n; i++ {
+		p := r.pos + i
+		if p/8 < uint(len(r.src)) {
+			v |= uint32(r.src[p/8]>>(p%8)&1) << i
+		}
+	}
+	return v
+}
+
+func (r *brotliBitReader) alignToByte() error {
+	pad, err := r.bits((8 - r.pos%8) % 8)
+	if err != nil {
+		return err
+	}
+	if pad != 0 {
+		return errors.New("brotli padding bits are not zero")
+	}
+	return nil
+}
+
+// varLenUint8 reads a value in the range 0..255.
+func (r *brotliBitReader) varLenUint8() (uint32, error) {
+	b, err := r.bits(1)
+	if err != nil || b == 0 {
+		return 0, err
+	}
+	n, err := r.bits(3)
+	if err != nil || n == 0 {
+		return 1, err
+	}
+	v, err := r.bits(uint(n))
+	return v + 1<<n, err
+}
+
+// brotliHuffman is a canonical prefix code. Codes are assigned in order of
+// increasing length, and in symbol order within one length.
+type brotliHuffman struct {
+	count   [brotliMaxCodeLen + 1]uint16
+	symbols []uint16
+}
+
+func newBrotliHuffman(lengths []uint8) *brotliHuffman {
+	h := &brotliHuffman{}
+	for _, l := range lengths {
+		h.count[l]++
+	}
+	h.count[0] = 0
+	var offs [brotliMaxCodeLen + 2]int
+	for l := 1; l <= brotliMaxCodeLen; l++ {
+		offs[l+1] = offs[l] + int(h.count[l])
+	}
+	h.symbols = make([]uint16, offs[brotliMaxCodeLen+1])
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbols[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+	return h
+}
+
+func (h *brotliHuffman) decode(r *brotliBitReader) (uint32, error) {
+	// A code with a single symbol takes no bits.
+	if len(h.symbols) == 1 {
+		return uint32(h.symbols[0]), nil
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l <= brotliMaxCodeLen; l++ {
+		b, err := r.bits(1)
+		if err != nil {
+			return 0, err
+		}
+		code |= int(b)
+		count := int(h.count[l])
+		if code-count < first {
+			return uint32(h.symbols[index+code-first]), nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errors.New("invalid brotli prefix code")
+}
+
+// readPrefixCode reads a simple or complex prefix code over an alphabet.
+func (r *brotliBitReader) readPrefixCode(alphabetSize uint32) (*brotliHuffman, error) {
+	lengths := make([]uint8, alphabetSize)
+	hskip, err := r.bits(2)
+	if err != nil {
+		return nil, err
+	}
+	if hskip == 1 {
+		// Simple prefix code.
+		nsym, err := r.bits(2)
+		if err != nil {
+			return nil, err
+		}
+		nsym++
+		var nbits uint
+		for n := alphabetSize - 1; n != 0; n >>= 1 {
+			nbits++
+		}
+		symbols := make([]uint32, nsym)
+		for i := range symbols {
+			if symbols[i], err = r.bits(nbits); err != nil {
+				return nil, err
+			}
+			if symbols[i] >= alphabetSize {
+				return nil, fmt.Errorf("brotli symbol %d out of range", symbols[i])
+			}
+			for j := 0; j < i; j++ {
+				if symbols[i] == symbols[j] {
+					return nil, errors.New("duplicate symbol in simple brotli prefix code")
+				}
+			}
+		}
+		simpleLengths := [][]uint8{{0}, {1, 1}, {1, 2, 2}, {2, 2, 2, 2}}[nsym-1]
+		if nsym == 4 {
+			treeSelect, err := r.bits(1)
+			if err != nil {
+				return nil, err
+			}
+			if treeSelect == 1 {
+				simpleLengths = []uint8{1, 2, 3, 3}
+			}
+		}
+		if nsym == 1 {
+			return &brotliHuffman{symbols: []uint16{uint16(symbols[0])}}, nil
+		}
+		for i, s := range symbols {
+			lengths[s] = simpleLengths[i]
+		}
+		return newBrotliHuffman(lengths), nil
+	}
+
+	// Complex prefix code, starting with the code length code lengths.
+	var clLengths [18]uint8
+	space, numCodes := 32, 0
+	for i := hskip; i < 18 && space > 0; i++ {
+		p := r.peek(4)
+		l := brotliCodeLengthPrefixValue[p]
+		if _, err := r.bits(uint(brotliCodeLengthPrefixLength[p])); err != nil {
+			return nil, err
+		}
+		clLengths[brotliCodeLengthCodeOrder[i]] = l
+		if l != 0 {
+			space -= 32 >> l
+			numCodes++
+		}
+	}
+	if numCodes != 1 && space != 0 {
+		return nil, errors.New("invalid brotli code length code")
+	}
+	var clCode *brotliHuffman
+	if numCodes == 1 {
+		for sym, l := range clLengths {
+			if l != 0 {
+				clCode = &brotliHuffman{symbols: []uint16{uint16(sym)}}
+			}
+		}
+	} else {
+		clCode = newBrotliHuffman(clLengths[:])
+	}
+
+	symbol, prevLen, repeat, repeatLen := uint32(0), uint8(8), uint32(0), uint8(0)
+	space = 1 << 15
+	for symbol < alphabetSize && space > 0 {
+		c, err := clCode.decode(r)
+		if err != nil {
+			return nil, err
+		}
+		if c < 16 {
+			repeat = 0
+			lengths[symbol] = uint8(c)
+			symbol++
+			if c != 0 {
+				prevLen = uint8(c)
+				space -= 1 << 15 >> c
+			}
+			continue
+		}
+		extraBits, newLen := uint(2), prevLen
+		if c == 17 {
+			extraBits, newLen = 3, 0
+		}
+		if repeatLen != newLen {
+			repeat, repeatLen = 0, newLen
+		}
+		oldRepeat := repeat
+		if repeat > 0 {
+			repeat = (repeat - 2) << extraBits
+		}
+		extra, err := r.bits(extraBits)
+		if err != nil {
+			return nil, err
+		}
+		repeat += extra + 3
+		delta := repeat - oldRepeat
+		if symbol+delta > alphabetSize {
+			return nil, errors.New("brotli code length repeat overflows the alphabet")
+		}
+		for ; delta > 0; delta-- {
+			lengths[symbol] = repeatLen
+			symbol++
+			if repeatLen != 0 {
+				space -= 1 << 15 >> repeatLen
+			}
+		}
+	}
+	if space != 0 {
+		return nil, errors.New("invalid brotli prefix code, code is not complete")
+	}
+	return newBrotliHuffman(lengths), nil
+}
+
+// readPrefixCodeRange reads a symbol of a code mapping to a base value and a
+// number of extra bits.
+func (r *brotliBitReader) readPrefixCodeRange(h *brotliHuffman, ranges []brotliPrefixRange) (uint32, error) {
+	sym, err := h.decode(r)
+	if err != nil {
+		return 0, err
+	}
+	extra, err := r.bits(ranges[sym].nbits)
+	return ranges[sym].base + extra, err
+}
+
+// brotliBlockSwitch tracks the block types of one category: literals,
+// commands or distances.
+type brotliBlockSwitch struct {
+	n       uint32
+	types   *brotliHuffman
+	lengths *brotliHuffman
+	rb      [2]uint32
+	left    uint32
+}
+
+func (r *brotliBitReader) readBlockSwitch() (*brotliBlockSwitch, error) {
+	n, err := r.varLenUint8()
+	if err != nil {
+		return nil, err
+	}
+	b := &brotliBlockSwitch{n: n + 1, rb: [2]uint32{1, 0}, left: 1 << 24}
+	if b.n < 2 {
+		return b, nil
+	}
+	if b.types, err = r.readPrefixCode(b.n + 2); err != nil {
+		return nil, err
+	}
+	if b.lengths, err = r.readPrefixCode(brotliNumBlockLenSymbols); err != nil {
+		return nil, err
+	}
+	b.left, err = r.readPrefixCodeRange(b.lengths, brotliBlockLengthPrefix[:])
+	return b, err
+}
+
+// next consumes one symbol of the category, switching the block type first
+// if the current block is done.
+func (b *brotliBlockSwitch) next(r *brotliBitReader) error {
+	if b.left == 0 {
+		t, err := b.types.decode(r)
+		if err != nil {
+			return err
+		}
+		switch t {
+		case 0:
+			t = b.rb[0]
+		case 1:
+			t = b.rb[1] + 1
+		default:
+			t -= 2
+		}
+		if t >= b.n {
+			t -= b.n
+		}
+		b.rb = [2]uint32{b.rb[1], t}
+		if b.left, err = r.readPrefixCodeRange(b.lengths, brotliBlockLengthPrefix[:]); err != nil {
+			return err
+		}
+	}
+	b.left--
+	return nil
+}
+
+func (b *brotliBlockSwitch) current() uint32 {
+	return b.rb[1]
+}
+
+// brotliDistances holds the last four distances.
+type brotliDistances struct {
+	rb  [4]int
+	idx int
+}
+
+func newBrotliDistances() *brotliDistances {
+	return &brotliDistances{rb: [4]int{16, 15, 11, 4}}
+}
+
+func (d *brotliDistances) last(n int) int {
+	return d.rb[(d.idx-n)&3]
+}
+
+func (d *brotliDistances) push(distance int) {
+	d.rb[d.idx&3] = distance
+	d.idx++
+}
+
+// decode reads the extra bits of a distance code and returns the distance.
+func (d *brotliDistances) decode(r *brotliBitReader, dcode uint32, npostfix uint, ndirect uint32) (int, error) {
+	var distance int
+	switch {
+	case dcode < 4:
+		distance = d.last(int(dcode) + 1)
+	case dcode < 16:
+		// Last or second last distance, plus or minus up to 3.
+		n := 1
+		if dcode >= 10 {
+			n = 2
+		}
+		delta := int(dcode-4)%6/2 + 1
+		if dcode%2 == 0 {
+			delta = -delta
+		}
+		distance = d.last(n) + delta
+	case dcode < 16+ndirect:
+		distance = int(dcode) - 15
+	default:
+		distval := dcode - 16 - ndirect
+		postfix := distval & (1<<npostfix - 1)
+		distval >>= npostfix
+		nbits := uint(distval>>1) + 1
+		offset := (2+distval&1)<<nbits - 4
+		extra, err := r.bits(nbits)
+		if err != nil {
+			return 0, err
+		}
+		distance = int(ndirect+16+(offset+extra)<<npostfix+postfix) - 15
+	}
+	if distance <= 0 {
+		return 0, fmt.Errorf("invalid brotli distance code %d", dcode)
+	}
+	return distance, nil
+}
+
+// readContextMap reads a context map and returns it with its number of
+// trees.
+func (r *brotliBitReader) readContextMap(size uint32) ([]uint8, uint32, error) {
+	ntrees, err := r.varLenUint8()
+	if err != nil {
+		return nil, 0, err
+	}
+	ntrees++
+	cmap := make([]uint8, size)
+	if ntrees < 2 {
+		return cmap, ntrees, nil
+	}
+	var rleMax uint32
+	if b, err := r.bits(1); err != nil {
+		return nil, 0, err
+	} else if b == 1 {
+		if rleMax, err = r.bits(4); err != nil {
+			return nil, 0, err
+		}
+		rleMax++
+	}
+	h, err := r.readPrefixCode(ntrees + rleMax)
+	if err != nil {
+		return nil, 0, err
+	}
+	for i := uint32(0); i < size; {
+		c, err := h.decode(r)
+		if err != nil {
+			return nil, 0, err
+		}
+		switch {
+		case c == 0:
+			i++
+		case c <= rleMax:
+			extra, err := r.bits(uint(c))
+			if err != nil {
+				return nil, 0, err
+			}
+			if i += 1<<c + extra; i > size {
+				return nil, 0, errors.New("brotli context map repeat overflows the map")
+			}
+		default:
+			cmap[i] = uint8(c - rleMax)
+			i++
+		}
+	}
+	if b, err := r.bits(1); err != nil {
+		return nil, 0, err
+	} else if b == 1 {
+		// Inverse move-to-front transform.
+		var mtf [256]uint8
+		for i := range mtf {
+			mtf[i] = uint8(i)
+		}
+		for i, idx := range cmap {
+			v := mtf[idx]
+			cmap[i] = v
+			copy(mtf[1:idx+1], mtf[:idx])
+			mtf[0] = v
+		}
+	}
+	return cmap, ntrees, nil
+}
+
+// brotliTreeGroupSize returns the size of a group of prefix codes in the
+// reference decoder.
+func brotliTreeGroupSize(alphabetSize, ntrees uint32) uint64 {
+	return uint64(ntrees) * (uint64(brotliMaxHuffmanTableSize[(alphabetSize+31)>>5])*brotliHuffmanCodeSize + brotliPointerSize)
+}
+
+// brotliScratchSize returns an upper bound of the size of the scratch buffer
+// EDK2 needs to decode the encoded stream of decoded.
+func brotliScratchSize(encoded, decoded []byte) (uint64, error) {
+	allocs, err := brotliAllocations(encoded, decoded)
+	if err != nil {
+		return 0, err
+	}
+	size := uint64(brotliMaxStateSize + brotliMaxAllocOverhead)
+	for _, n := range allocs {
+		size += n + brotliMaxAllocOverhead
+	}
+	return size, nil
+}
+
+// brotliAllocations returns the sizes of the allocations the reference
+// decoder makes after creating its state to decode the encoded stream of
+// decoded.
+func brotliAllocations(encoded, decoded []byte) ([]uint64, error) {
+	var allocs []uint64
+	alloc := func(n uint64) {
+		allocs = append(allocs, n)
+	}
+
+	r := &brotliBitReader{src: encoded}
+	var wbits uint
+	if b, err := r.bits(1); err != nil {
+		return nil, err
+	} else if b == 0 {
+		wbits = 16
+	} else if n, err := r.bits(3); err != nil {
+		return nil, err
+	} else if n != 0 {
+		wbits = 17 + uint(n)
+	} else if n, err := r.bits(3); err != nil {
+		return nil, err
+	} else if n == 1 {
+		return nil, errors.New("large window brotli is not supported")
+	} else if n != 0 {
+		wbits = 8 + uint(n)
+	} else {
+		wbits = 17
+	}
+	windowSize := 1 << wbits
+	maxBackward := windowSize - brotliWindowGap
+	alloc(3 * (brotliMaxSize258 + brotliMaxSize26) * brotliHuffmanCodeSize)
+
+	// ensureRingBuffer allocates the ring buffer when a meta-block needs a
+	// bigger one. The old buffer is freed, which does not return it to the
+	// scratch buffer.
+	pos, ringSize := 0, 0
+	ensureRingBuffer := func(mlen int) {
+		if ringSize == windowSize {
+			return
+		}
+		minSize := 1024
+		if ringSize != 0 {
+			minSize = ringSize
+		}
+		if pos+mlen > minSize {
+			minSize = pos + mlen
+		}
+		newSize := windowSize
+		for newSize>>1 >= minSize {
+			newSize >>= 1
+		}
+		if newSize != ringSize {
+			alloc(uint64(newSize) + brotliRingBufferSlack)
+			ringSize = newSize
+		}
+	}
+
+	// The last distances are kept across meta-blocks.
+	distances := newBrotliDistances()
+	for isLast := uint32(0); isLast == 0; {
+		var err error
+		if isLast, err = r.bits(1); err != nil {
+			return nil, err
+		}
+		if isLast == 1 {
+			if empty, err := r.bits(1); err != nil {
+				return nil, err
+			} else if empty == 1 {
+				break
+			}
+		}
+		mnibbles, err := r.bits(2)
+		if err != nil {
+			return nil, err
+		}
+		if mnibbles == 3 {
+			// Metadata, which does not touch the ring buffer.
+			if reserved, err := r.bits(1); err != nil {
+				return nil, err
+			} else if reserved != 0 {
+				return nil, errors.New("brotli reserved bit is set")
+			}
+			skipBytes, err := r.bits(2)
+			if err != nil {
+				return nil, err
+			}
+			skip, err := r.bits(8 * uint(skipBytes))
+			if err != nil {
+				return nil, err
+			}
+			if skipBytes > 0 {
+				skip++
+			}
+			if err := r.alignToByte(); err != nil {
+				return nil, err
+			}
+			if _, err := r.bits(8 * uint(skip)); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		mlen, err := r.bits(4 * uint(mnibbles+4))
+		if err != nil {
+			return nil, err
+		}
+		mlen++
+		if pos+int(mlen) > len(decoded) {
+			return nil, errors.New("brotli meta-block is longer than the decoded data")
+		}
+
+		var uncompressed uint32
+		if isLast == 0 {
+			if uncompressed, err = r.bits(1); err != nil {
+				return nil, err
+			}
+		}
+		if uncompressed == 1 {
+			if err := r.alignToByte(); err != nil {
+				return nil, err
+			}
+			ensureRingBuffer(int(mlen))
+			if _, err := r.bits(8 * uint(mlen)); err != nil {
+				return nil, err
+			}
+			pos += int(mlen)
+			continue
+		}
+
+		if err := walkBrotliMetaBlock(r, decoded, &pos, int(mlen), maxBackward, distances, alloc, ensureRingBuffer); err != nil {
+			return nil, err
+		}
+	}
+	if pos != len(decoded) {
+		return nil, fmt.Errorf("brotli stream decodes to %d bytes, expected %d", pos, len(decoded))
+	}
+	return allocs, nil
+}
+
+// walkBrotliMetaBlock walks a compressed meta-block.
+func walkBrotliMetaBlock(r *brotliBitReader, decoded []byte, pos *int, mlen, maxBackward int, distances *brotliDistances, alloc func(uint64), ensureRingBuffer func(int)) error {
+	var blocks [3]*brotliBlockSwitch
+	for i := range blocks {
+		var err error
+		if blocks[i], err = r.readBlockSwitch(); err != nil {
+			return err
+		}
+	}
+	lit, cmd, dist := blocks[0], blocks[1], blocks[2]
+
+	distParams, err := r.bits(6)
+	if err != nil {
+		return err
+	}
+	npostfix := uint(distParams & 3)
+	ndirect := distParams >> 2 << npostfix
+	alloc(uint64(lit.n))
+	modes := make([]uint32, lit.n)
+	for i := range modes {
+		if modes[i], err = r.bits(2); err != nil {
+			return err
+		}
+	}
+
+	alloc(uint64(lit.n << brotliLiteralContextBits))
+	litMap, litTrees, err := r.readContextMap(lit.n << brotliLiteralContextBits)
+	if err != nil {
+		return err
+	}
+	alloc(uint64(dist.n << brotliDistContextBits))
+	distMap, distTrees, err := r.readContextMap(dist.n << brotliDistContextBits)
+	if err != nil {
+		return err
+	}
+
+	distAlphabet := 16 + ndirect + brotliMaxDistanceBits<<(npostfix+1)
+	alloc(brotliTreeGroupSize(brotliNumLiteralSymbols, litTrees))
+	alloc(brotliTreeGroupSize(brotliNumCommandSymbols, cmd.n))
+	alloc(brotliTreeGroupSize(distAlphabet, distTrees))
+	readGroup := func(alphabetSize, ntrees uint32) ([]*brotliHuffman, error) {
+		group := make([]*brotliHuffman, ntrees)
+		for i := range group {
+			var err error
+			if group[i], err = r.readPrefixCode(alphabetSize); err != nil {
+				return nil, err
+			}
+		}
+		return group, nil
+	}
+	litCodes, err := readGroup(brotliNumLiteralSymbols, litTrees)
+	if err != nil {
+		return err
+	}
+	cmdCodes, err := readGroup(brotliNumCommandSymbols, cmd.n)
+	if err != nil {
+		return err
+	}
+	distCodes, err := readGroup(distAlphabet, distTrees)
+	if err != nil {
+		return err
+	}
+	ensureRingBuffer(mlen)
+
+	end := *pos + mlen
+	for *pos < end {
+		if err := cmd.next(r); err != nil {
+			return err
+		}
+		sym, err := cmdCodes[cmd.current()].decode(r)
+		if err != nil {
+			return err
+		}
+		cell := brotliCommandCells[sym>>6]
+		insertCode, copyCode := cell[0]+(sym>>3&7), cell[1]+(sym&7)
+		insertExtra, err := r.bits(brotliInsertLengthPrefix[insertCode].nbits)
+		if err != nil {
+			return err
+		}
+		copyExtra, err := r.bits(brotliCopyLengthPrefix[copyCode].nbits)
+		if err != nil {
+			return err
+		}
+		insertLen := int(brotliInsertLengthPrefix[insertCode].base + insertExtra)
+		copyLen := int(brotliCopyLengthPrefix[copyCode].base + copyExtra)
+
+		if *pos+insertLen > end {
+			return errors.New("brotli insert length overflows the meta-block")
+		}
+		for ; insertLen > 0; insertLen-- {
+			if err := lit.next(r); err != nil {
+				return err
+			}
+			var p1, p2 byte
+			if *pos >= 1 {
+				p1 = decoded[*pos-1]
+			}
+			if *pos >= 2 {
+				p2 = decoded[*pos-2]
+			}
+			t := lit.current()
+			var ctx uint8
+			switch modes[t] {
+			case 0:
+				ctx = p1 & 0x3f
+			case 1:
+				ctx = p1 >> 2
+			case 2:
+				ctx = brotliContextUTF8[p1] | brotliContextUTF8[256+int(p2)]
+			case 3:
+				ctx = brotliContextSigned[p1] | brotliContextSigned[256+int(p2)]
+			}
+			b, err := litCodes[litMap[t<<brotliLiteralContextBits+uint32(ctx)]].decode(r)
+			if err != nil {
+				return err
+			}
+			if byte(b) != decoded[*pos] {
+				return fmt.Errorf("brotli literal at offset %#x does not match the decoded data", *pos)
+			}
+			*pos++
+		}
+		if *pos == end {
+			break
+		}
+
+		// Commands of the first two cells reuse the last distance.
+		dcode := uint32(0)
+		if sym >= 128 {
+			if err := dist.next(r); err != nil {
+				return err
+			}
+			ctx := uint32(copyLen - 2)
+			if ctx > 3 {
+				ctx = 3
+			}
+			if dcode, err = distCodes[distMap[dist.current()<<brotliDistContextBits+ctx]].decode(r); err != nil {
+				return err
+			}
+		}
+		distance, err := distances.decode(r, dcode, npostfix, ndirect)
+		if err != nil {
+			return err
+		}
+
+		maxDistance := maxBackward
+		if *pos < maxDistance {
+			maxDistance = *pos
+		}
+		if distance > maxDistance {
+			// Static dictionary reference.
+			if copyLen < 4 || copyLen > 24 {
+				return fmt.Errorf("invalid brotli dictionary word length %d", copyLen)
+			}
+			transform := (distance - maxDistance - 1) >> brotliDictSizeBits[copyLen]
+			if transform >= len(brotliTransforms) {
+				return fmt.Errorf("invalid brotli dictionary transform %d", transform)
+			}
+			wordLen := copyLen - int(brotliTransforms[transform][1])
+			if wordLen < 0 {
+				wordLen = 0
+			}
+			*pos += int(brotliTransforms[transform][0]) + wordLen
+		} else {
+			if dcode != 0 {
+				distances.push(distance)
+			}
+			*pos += copyLen
+		}
+		if *pos > end {
+			return errors.New("brotli copy overflows the meta-block")
+		}
+	}
+	return nil
+}
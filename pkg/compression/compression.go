@@ -4,19 +4,18 @@
 
 // Package compression implements reading and writing of compressed files.
 //
-// This package is specifically designed for the LZMA formats used by popular UEFI
-// implementations.
+// This package is specifically designed for the LZMA, Brotli and EFI standard
+// compression formats used by popular UEFI implementations, and the LZ4 frame
+// format used by coreboot.
 package compression
 
 import (
-	"flag"
+	"fmt"
 	"os/exec"
 
 	"github.com/linuxboot/fiano/pkg/guid"
 )
 
-var xzPath = flag.String("xzPath", "xz", "Path to system xz command used for lzma encoding. If unset, an internal lzma implementation is used.")
-
 // Compressor defines a single compression scheme (such as LZMA).
 type Compressor interface {
 	// Name is typically the name of a class.
@@ -31,26 +30,86 @@ type Compressor interface {
 var (
 	LZMAGUID    = *guid.MustParse("EE4E5898-3914-4259-9D6E-DC7BD79403CF")
 	LZMAX86GUID = *guid.MustParse("D42AE6BD-1352-4BFB-909A-CA72A6EAE889")
+	BrotliGUID  = *guid.MustParse("3D532050-5CDA-4FD0-879E-0F7F630D5AFB")
 )
 
-// CompressorFromGUID returns a Compressor for the corresponding GUIDed Section.
-func CompressorFromGUID(guid *guid.GUID) Compressor {
-	// Default to system xz command for lzma encoding; if not found, use an
-	// internal lzma implementation.
-	var lzma Compressor
-	if _, err := exec.LookPath(*xzPath); err == nil {
-		lzma = &SystemLZMA{*xzPath}
-	} else {
-		lzma = &LZMA{}
+// Config holds the settings used to construct Compressors.
+type Config struct {
+	// XZPath is the path to the system xz command used for LZMA encoding.
+	// If it is empty or not found, an internal LZMA implementation is used.
+	XZPath string
+}
+
+// DefaultConfig returns the Config used by CompressorFromGUID. It uses the
+// system xz command if one is found.
+func DefaultConfig() Config {
+	return Config{XZPath: "xz"}
+}
+
+// CompressorFactory creates a Compressor for a GUIDed section with the given
+// Config.
+type CompressorFactory func(cfg Config) Compressor
+
+var compressorRegistry = map[guid.GUID]CompressorFactory{}
+
+// RegisterCompressor registers a CompressorFactory for GUIDed sections with
+// the given GUID. Sections with this GUID are then decoded by uefi.NewSection
+// and encoded by the Assemble visitor. It is typically called from an init
+// function and panics if the GUID is already registered.
+func RegisterCompressor(g guid.GUID, factory CompressorFactory) {
+	if _, ok := compressorRegistry[g]; ok {
+		panic(fmt.Sprintf("two compressors registered the same GUID: %v", g))
 	}
-	switch *guid {
-	case LZMAGUID:
-		return lzma
-	case LZMAX86GUID:
+	compressorRegistry[g] = factory
+}
+
+func init() {
+	RegisterCompressor(LZMAGUID, func(cfg Config) Compressor {
+		return cfg.lzma()
+	})
+	RegisterCompressor(LZMAX86GUID, func(cfg Config) Compressor {
 		// Alternatively, the -f86 argument could be passed
 		// into xz. It does not make much difference because
 		// the x86 filter is not the bottleneck.
-		return &LZMAX86{lzma}
+		return &LZMAX86{cfg.lzma()}
+	})
+	RegisterCompressor(BrotliGUID, func(cfg Config) Compressor {
+		return &Brotli{}
+	})
+}
+
+// lzma returns the LZMA implementation selected by the config: the system xz
+// command for encoding if found; otherwise, an internal implementation.
+func (cfg Config) lzma() Compressor {
+	if cfg.XZPath != "" {
+		if _, err := exec.LookPath(cfg.XZPath); err == nil {
+			return &SystemLZMA{cfg.XZPath}
+		}
+	}
+	return &LZMA{}
+}
+
+// CompressorFromGUID returns a Compressor for the corresponding GUIDed Section
+// constructed with the config, or nil if no Compressor is registered for the
+// GUID.
+func (cfg Config) CompressorFromGUID(g *guid.GUID) Compressor {
+	factory, ok := compressorRegistry[*g]
+	if !ok {
+		return nil
 	}
-	return nil
+	return factory(cfg)
+}
+
+// CompressorFromGUID returns a Compressor for the corresponding GUIDed Section
+// using DefaultConfig.
+func CompressorFromGUID(g *guid.GUID) Compressor {
+	return DefaultConfig().CompressorFromGUID(g)
+}
+
+// StandardCompressors returns the Compressors for EFI_SECTION_COMPRESSION
+// sections of the standard compression type. The section header does not
+// tell the EFI and Tiano variants apart, so they are returned in the order
+// they should be tried when decoding.
+func StandardCompressors() []Compressor {
+	return []Compressor{&EFI{}, &Tiano{}}
 }
@@ -5,6 +5,9 @@
 package compression
 
 import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
 	"io/ioutil"
 	"reflect"
 	"testing"
@@ -42,6 +45,29 @@ var tests = []struct {
 		decodedFilename: "testdata/random.bin",
 		compressor:      &LZMAX86{&SystemLZMA{"xz"}},
 	},
+	// The EFI and Tiano fixtures were not produced by our encoder, they
+	// were written by a separate encoder following the bitstream of the
+	// UEFI Specification, Appendix H.
+	{
+		name:            "random data EFI",
+		encodedFilename: "testdata/random.bin.efi",
+		decodedFilename: "testdata/random.bin",
+		compressor:      &EFI{},
+	},
+	{
+		name:            "random data Tiano",
+		encodedFilename: "testdata/random.bin.tiano",
+		decodedFilename: "testdata/random.bin",
+		compressor:      &Tiano{},
+	},
+	// Written by the lz4 command, which stores the random blocks
+	// uncompressed.
+	{
+		name:            "random data LZ4",
+		encodedFilename: "testdata/random.bin.lz4",
+		decodedFilename: "testdata/random.bin",
+		compressor:      &LZ4{},
+	},
 }
 
 func TestEncodeDecode(t *testing.T) {
@@ -94,6 +120,223 @@ func TestDecode(t *testing.T) {
 	}
 }
 
+func TestEFIEncodeDecode(t *testing.T) {
+	random, err := ioutil.ReadFile("testdata/random.bin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	inputs := map[string][]byte{
+		"empty":      {},
+		"one byte":   {0x42},
+		"repetitive": bytes.Repeat([]byte("UEFI"), 50000),
+		"random":     random,
+	}
+	for _, c := range StandardCompressors() {
+		for name, want := range inputs {
+			t.Run(c.Name()+" "+name, func(t *testing.T) {
+				encoded, err := c.Encode(want)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, err := c.Decode(encoded)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if !bytes.Equal(got, want) {
+					t.Fatalf("decompressed data did not match, (got: %d bytes, want: %d bytes)", len(got), len(want))
+				}
+			})
+		}
+	}
+}
+
+func TestBrotliEncodeDecode(t *testing.T) {
+	want := bytes.Repeat([]byte("Brotli GUIDed section"), 10000)
+	encoded, err := (&Brotli{}).Encode(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := binary.LittleEndian.Uint64(encoded[0:8]); size != uint64(len(want)) {
+		t.Errorf("decoded size in header mismatch, got %d, want %d", size, len(want))
+	}
+	got, err := (&Brotli{}).Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("decompressed data did not match, (got: %d bytes, want: %d bytes)", len(got), len(want))
+	}
+
+	// Corrupt the decoded size.
+	encoded[0]++
+	if _, err := (&Brotli{}).Decode(encoded); err == nil {
+		t.Error("expected an error for a wrong decoded size")
+	}
+}
+
+func TestBrotliAllocations(t *testing.T) {
+	tests := []struct {
+		name    string
+		encoded []byte
+		decoded []byte
+		want    []uint64
+	}{
+		{
+			// BrotliDecoderStateInit allocates the block type and block
+			// length trees of the 3 categories, 3*(632+396) HuffmanCodes
+			// of 4 bytes. The uncompressed meta-block then allocates the
+			// smallest ring buffer, 1 KiB plus the 42 bytes of slack.
+			name:    "uncompressed meta-block",
+			encoded: []byte{0x0b, 0x00, 0x80, 0x41, 0x03},
+			decoded: []byte("A"),
+			want:    []uint64{12336, 1066},
+		},
+		{
+			// After the trees, the compressed meta-block with one block
+			// type per category allocates the context modes (1 byte),
+			// the literal and distance context maps (64 and 4 bytes), one
+			// tree of each group (630, 1080 and 436 HuffmanCodes, plus a
+			// pointer) and the 128 KiB ring buffer fitting the 65541 bytes
+			// of the last meta-block.
+			name: "compressed meta-block",
+			encoded: []byte{
+				0x5b, 0x04, 0x00, 0x01, 0x40, 0x74, 0x87, 0xd7, 0xbb, 0xeb, 0x9e, 0x91, 0xfc, 0x1d, 0x5f, 0x1d,
+				0x11, 0x91, 0xaa, 0xa1, 0xc3, 0xaa, 0xd2, 0xc0, 0xdb, 0x9f, 0x86, 0x85, 0xab, 0x12, 0x85, 0xaa,
+				0xf7, 0x00, 0x00,
+			},
+			decoded: bytes.Repeat([]byte("Brotli GUIDed section"), 3121),
+			want:    []uint64{12336, 1, 64, 4, 2528, 4328, 1752, 131114},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := brotliAllocations(test.encoded, test.decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("allocations mismatch, got %v, want %v", got, test.want)
+			}
+			if _, err := brotliAllocations(test.encoded, test.decoded[1:]); err == nil {
+				t.Error("expected an error for a wrong decoded size")
+			}
+
+			// The scratch size bounds the state and the allocations.
+			size, err := brotliScratchSize(test.encoded, test.decoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			min := uint64(3 << 10)
+			for _, n := range test.want {
+				min += n
+			}
+			if size < min {
+				t.Errorf("scratch size %d is less than the %d bytes of the state and allocations", size, min)
+			}
+		})
+	}
+
+	// Literals are checked against the decoded data.
+	decoded := append([]byte{}, tests[1].decoded...)
+	decoded[0]++
+	if _, err := brotliAllocations(tests[1].encoded, decoded); err == nil {
+		t.Error("expected an error for mismatching decoded data")
+	}
+}
+
+func TestBrotliEncodeScratchSize(t *testing.T) {
+	for _, size := range []int{64 << 10, 8 << 20} {
+		encoded, err := (&Brotli{}).Encode(make([]byte, size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The ring buffer holds the whole data up to the 4 MiB window,
+		// the tables of a few meta-blocks are small in comparison.
+		ring := uint64(size)
+		if ring > 1<<brotliLGWin {
+			ring = 1 << brotliLGWin
+		}
+		if got := binary.LittleEndian.Uint64(encoded[8:16]); got < ring || got > ring+128<<10 {
+			t.Errorf("scratch size for %d bytes is %d, want between %d and %d", size, got, ring, ring+128<<10)
+		}
+	}
+}
+
+func TestEFITianoMismatch(t *testing.T) {
+	want := bytes.Repeat([]byte("EFI and Tiano use different position sets. "), 1000)
+	encoded, err := (&Tiano{}).Encode(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := (&EFI{}).Decode(encoded); err == nil && bytes.Equal(got, want) {
+		t.Fatal("Tiano data was decoded with the EFI algorithm")
+	}
+}
+
+func TestLZ4EncodeDecode(t *testing.T) {
+	inputs := map[string][]byte{
+		"empty":      {},
+		"one byte":   {0x42},
+		"short":      []byte("coreboot"),
+		"repetitive": bytes.Repeat([]byte("LZ4"), 100000),
+		// More than one 4MiB block.
+		"zeros": make([]byte, 5<<20),
+	}
+	for name, want := range inputs {
+		t.Run(name, func(t *testing.T) {
+			encoded, err := (&LZ4{}).Encode(want)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := (&LZ4{}).Decode(encoded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Fatalf("decompressed data did not match, (got: %d bytes, want: %d bytes)", len(got), len(want))
+			}
+		})
+	}
+}
+
+// TestLZ4DecodeLinked decodes a frame written by "lz4 -9 -BD", which has
+// linked blocks and a content checksum.
+func TestLZ4DecodeLinked(t *testing.T) {
+	var want bytes.Buffer
+	for i := 0; i < 5000; i++ {
+		fmt.Fprintf(&want, "line %d: linuxboot fiano\n", i)
+	}
+	encoded, err := ioutil.ReadFile("testdata/lines.txt.lz4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := (&LZ4{}).Decode(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Fatalf("decompressed data did not match, (got: %d bytes, want: %d bytes)", len(got), want.Len())
+	}
+
+	// Corrupt the content checksum.
+	encoded[len(encoded)-1]++
+	if _, err := (&LZ4{}).Decode(encoded); err == nil {
+		t.Error("expected an error for a wrong content checksum")
+	}
+}
+
+func TestEFICorruptSize(t *testing.T) {
+	encoded, err := (&EFI{}).Encode([]byte("corrupt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Claim 4GiB of decoded data.
+	binary.LittleEndian.PutUint32(encoded[4:8], 0xFFFFFFFF)
+	if _, err := (&EFI{}).Decode(encoded); err == nil {
+		t.Fatal("expected an error for a corrupt decoded size")
+	}
+}
+
 func TestCompressorFromGUID(t *testing.T) {
 	var compressors = []struct {
 		name            string
@@ -116,6 +359,12 @@ func TestCompressorFromGUID(t *testing.T) {
 			encodedFilename: "testdata/random.bin.lzma86",
 			decodedFilename: "testdata/random.bin",
 		},
+		{
+			name:            "brotli",
+			guid:            &BrotliGUID,
+			expected:        &Brotli{},
+			decodedFilename: "testdata/random.bin",
+		},
 	}
 	for _, tt := range compressors {
 		t.Run(tt.name, func(t *testing.T) {
@@ -159,3 +408,65 @@ func TestCompressorFromGUID(t *testing.T) {
 
 	}
 }
+
+// xorCompressor is a trivial codec used to test the registry.
+type xorCompressor struct{}
+
+func (c *xorCompressor) Name() string {
+	return "XOR"
+}
+
+func (c *xorCompressor) Decode(encodedData []byte) ([]byte, error) {
+	decodedData := make([]byte, len(encodedData))
+	for i, b := range encodedData {
+		decodedData[i] = b ^ 0xFF
+	}
+	return decodedData, nil
+}
+
+func (c *xorCompressor) Encode(decodedData []byte) ([]byte, error) {
+	return c.Decode(decodedData)
+}
+
+func TestRegisterCompressor(t *testing.T) {
+	xorGUID := guid.MustParse("7E577E57-0123-4567-89AB-CDEF00000001")
+	if c := CompressorFromGUID(xorGUID); c != nil {
+		t.Fatalf("expected no compressor before registering, got %v", c.Name())
+	}
+	RegisterCompressor(*xorGUID, func(cfg Config) Compressor {
+		return &xorCompressor{}
+	})
+	if c := CompressorFromGUID(xorGUID); c == nil || c.Name() != "XOR" {
+		t.Fatalf("expected the XOR compressor after registering, got %v", c)
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("registering the same GUID twice did not panic")
+		}
+	}()
+	RegisterCompressor(*xorGUID, func(cfg Config) Compressor {
+		return &xorCompressor{}
+	})
+}
+
+func TestConfig(t *testing.T) {
+	var tests = []struct {
+		name     string
+		cfg      Config
+		guid     *guid.GUID
+		expected Compressor
+	}{
+		{"internal lzma", Config{}, &LZMAGUID, &LZMA{}},
+		{"missing xz", Config{XZPath: "/nonexistent/xz"}, &LZMAGUID, &LZMA{}},
+		{"internal lzma x86", Config{}, &LZMAX86GUID, &LZMAX86{&LZMA{}}},
+		{"system xz", Config{XZPath: "xz"}, &LZMAGUID, &SystemLZMA{"xz"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.cfg.CompressorFromGUID(tt.guid); !reflect.DeepEqual(got, tt.expected) {
+				t.Errorf("compressor mismatch, got %#v, want %#v", got, tt.expected)
+			}
+		})
+	}
+}
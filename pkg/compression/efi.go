@@ -0,0 +1,687 @@
+// Copyright 2018 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// The EFI standard compression algorithm is a LZ77 variant with Huffman
+// coding, described in the UEFI Specification, Appendix H. The Tiano variant
+// uses the same bitstream with a bigger sliding window, which needs one more
+// bit to store the number of position codes.
+//
+// Adapted from: https://github.com/tianocore/edk2/blob/00f5e11913a8706a1733da2b591502d59f848a99/MdePkg/Library/BaseUefiDecompressLib/BaseUefiDecompressLib.c
+// and https://github.com/tianocore/edk2/blob/00f5e11913a8706a1733da2b591502d59f848a99/BaseTools/Source/C/Common/EfiCompress.c
+const (
+	efiMaxMatch   = 256
+	efiThreshold  = 3
+	efiMaxCodeLen = 16
+
+	// C: Char&Len Set; P: Position Set; T: exTra Set
+	efiNC   = 0xff + efiMaxMatch + 2 - efiThreshold
+	efiCBit = 9
+	efiNT   = efiMaxCodeLen + 3
+	efiTBit = 5
+
+	// Maximum number of symbols in a block. The block size is stored in 16
+	// bits.
+	efiBlockSize = 0x4000
+	// Maximum number of hash chain entries to visit when looking for a match.
+	efiMaxChain = 256
+	// Expected maximum compression ratio, used to bound the initial
+	// allocation of the decoder.
+	efiMaxRatio = 32
+)
+
+// efiVariant holds the parameters which differ between EFI and Tiano.
+type efiVariant struct {
+	wndBit uint
+	pBit   uint
+}
+
+var (
+	efiVariantEFI   = efiVariant{wndBit: 13, pBit: 4}
+	efiVariantTiano = efiVariant{wndBit: 19, pBit: 5}
+)
+
+// np returns the number of symbols in the position set.
+func (v efiVariant) np() int {
+	return int(v.wndBit) + 1
+}
+
+// EFI implements Compressor for the EFI 1.1 standard compression algorithm
+// which is used by EFI_SECTION_COMPRESSION sections.
+type EFI struct{}
+
+// Name returns the type of compression employed.
+func (c *EFI) Name() string {
+	return "EFI"
+}
+
+// Decode decodes a byte slice of EFI compressed data.
+func (c *EFI) Decode(encodedData []byte) ([]byte, error) {
+	return efiDecode(encodedData, efiVariantEFI)
+}
+
+// Encode encodes a byte slice with EFI compression.
+func (c *EFI) Encode(decodedData []byte) ([]byte, error) {
+	return efiEncode(decodedData, efiVariantEFI)
+}
+
+// Tiano implements Compressor for the Tiano variant of the EFI standard
+// compression algorithm. It is popular in AMI and Insyde images, which store
+// it in EFI_SECTION_COMPRESSION sections as well.
+type Tiano struct{}
+
+// Name returns the type of compression employed.
+func (c *Tiano) Name() string {
+	return "TIANO"
+}
+
+// Decode decodes a byte slice of Tiano compressed data.
+func (c *Tiano) Decode(encodedData []byte) ([]byte, error) {
+	return efiDecode(encodedData, efiVariantTiano)
+}
+
+// Encode encodes a byte slice with Tiano compression.
+func (c *Tiano) Encode(decodedData []byte) ([]byte, error) {
+	return efiEncode(decodedData, efiVariantTiano)
+}
+
+// efiBitReader reads the bitstream, most significant bit first. Reading past
+// the end returns zeros, like EDK2 does, but is reported as an error once
+// decoding is done.
+type efiBitReader struct {
+	src     []byte
+	off     int
+	buf     uint64
+	nbits   uint
+	overrun int
+}
+
+func (r *efiBitReader) getBits(n uint) uint32 {
+	for r.nbits < n {
+		var b byte
+		if r.off < len(r.src) {
+			b = r.src[r.off]
+			r.off++
+		} else {
+			r.overrun++
+		}
+		r.buf = r.buf<<8 | uint64(b)
+		r.nbits += 8
+	}
+	r.nbits -= n
+	return uint32(r.buf>>r.nbits) & (1<<n - 1)
+}
+
+// efiHuffman is a canonical Huffman decoding table. Codes are assigned in
+// order of increasing length, and in symbol order within one length.
+type efiHuffman struct {
+	count   [efiMaxCodeLen + 1]uint16
+	symbols []uint16
+	// single is the only symbol of the set when the code has zero length,
+	// or -1.
+	single int
+}
+
+func newEFIHuffman(lengths []uint8) (*efiHuffman, error) {
+	h := &efiHuffman{single: -1}
+	for _, l := range lengths {
+		if l > efiMaxCodeLen {
+			return nil, fmt.Errorf("bad huffman table, code length %d is too long", l)
+		}
+		h.count[l]++
+	}
+	h.count[0] = 0
+
+	// The code must be complete, unless it is entirely unused.
+	left := 1
+	for l := 1; l <= efiMaxCodeLen; l++ {
+		left <<= 1
+		left -= int(h.count[l])
+		if left < 0 {
+			return nil, errors.New("bad huffman table, code is over-subscribed")
+		}
+	}
+	if left != 0 && left != 1<<efiMaxCodeLen {
+		return nil, errors.New("bad huffman table, code is incomplete")
+	}
+
+	var offs [efiMaxCodeLen + 2]int
+	for l := 1; l <= efiMaxCodeLen; l++ {
+		offs[l+1] = offs[l] + int(h.count[l])
+	}
+	h.symbols = make([]uint16, offs[efiMaxCodeLen+1])
+	for sym, l := range lengths {
+		if l != 0 {
+			h.symbols[offs[l]] = uint16(sym)
+			offs[l]++
+		}
+	}
+	return h, nil
+}
+
+func newEFIHuffmanSingle(sym uint32, n int) (*efiHuffman, error) {
+	if sym >= uint32(n) {
+		return nil, fmt.Errorf("bad huffman table, symbol %d out of range", sym)
+	}
+	return &efiHuffman{single: int(sym)}, nil
+}
+
+func (h *efiHuffman) decode(r *efiBitReader) (uint16, error) {
+	if h.single >= 0 {
+		return uint16(h.single), nil
+	}
+	code, first, index := 0, 0, 0
+	for l := 1; l <= efiMaxCodeLen; l++ {
+		code |= int(r.getBits(1))
+		count := int(h.count[l])
+		if code-count < first {
+			return h.symbols[index+code-first], nil
+		}
+		index += count
+		first += count
+		first <<= 1
+		code <<= 1
+	}
+	return 0, errors.New("invalid huffman code")
+}
+
+// efiReadPTLen reads the code lengths of the extra set or the position set.
+func efiReadPTLen(r *efiBitReader, nn int, nbit uint, special int) (*efiHuffman, error) {
+	number := int(r.getBits(nbit))
+	if number == 0 {
+		return newEFIHuffmanSingle(r.getBits(nbit), nn)
+	}
+	if number > nn {
+		return nil, fmt.Errorf("bad huffman table, %d codes, at most %d allowed", number, nn)
+	}
+	lengths := make([]uint8, 1<<nbit)
+	for i := 0; i < number; {
+		l := r.getBits(3)
+		// Lengths of 7 and more are stored as a series of "1"s followed
+		// by a terminating "0".
+		if l == 7 {
+			for r.getBits(1) == 1 {
+				l++
+				if l > efiMaxCodeLen {
+					return nil, fmt.Errorf("bad huffman table, code length %d is too long", l)
+				}
+			}
+		}
+		lengths[i] = uint8(l)
+		i++
+		// A 2-bit value holds the number of zero lengths following the
+		// special one.
+		if i == special {
+			for zeros := r.getBits(2); zeros > 0 && i < len(lengths); zeros-- {
+				lengths[i] = 0
+				i++
+			}
+		}
+	}
+	if len(lengths) > nn {
+		lengths = lengths[:nn]
+	}
+	return newEFIHuffman(lengths)
+}
+
+// efiReadCLen reads the code lengths of the char&len set, which are encoded
+// with the extra set.
+func efiReadCLen(r *efiBitReader, t *efiHuffman) (*efiHuffman, error) {
+	number := int(r.getBits(efiCBit))
+	if number == 0 {
+		return newEFIHuffmanSingle(r.getBits(efiCBit), efiNC)
+	}
+	if number > efiNC {
+		return nil, fmt.Errorf("bad huffman table, %d char&len codes, at most %d allowed", number, efiNC)
+	}
+	lengths := make([]uint8, efiNC)
+	for i := 0; i < number; {
+		c, err := t.decode(r)
+		if err != nil {
+			return nil, err
+		}
+		if c > 2 {
+			lengths[i] = uint8(c - 2)
+			i++
+			continue
+		}
+		var zeros int
+		switch c {
+		case 0:
+			zeros = 1
+		case 1:
+			zeros = int(r.getBits(4)) + 3
+		case 2:
+			zeros = int(r.getBits(efiCBit)) + 20
+		}
+		if i+zeros > efiNC {
+			return nil, errors.New("bad huffman table, too many char&len codes")
+		}
+		i += zeros
+	}
+	return newEFIHuffman(lengths)
+}
+
+func efiDecode(encodedData []byte, v efiVariant) ([]byte, error) {
+	if len(encodedData) < 8 {
+		return nil, fmt.Errorf("compressed data too short, got %d bytes", len(encodedData))
+	}
+	compSize := binary.LittleEndian.Uint32(encodedData[0:4])
+	origSize := binary.LittleEndian.Uint32(encodedData[4:8])
+	if uint64(compSize)+8 > uint64(len(encodedData)) {
+		return nil, fmt.Errorf("compressed size %d exceeds buffer of %d bytes", compSize, len(encodedData)-8)
+	}
+
+	r := &efiBitReader{src: encodedData[8 : 8+compSize]}
+	// Do not trust the header for the allocation, a corrupt size would
+	// allocate up to 4GiB. The slice grows as needed past the estimate.
+	capacity := origSize
+	if max := efiMaxRatio * uint32(len(encodedData)); capacity > max {
+		capacity = max
+	}
+	out := make([]byte, 0, capacity)
+	var blockSize uint32
+	var c, p *efiHuffman
+	for uint32(len(out)) < origSize {
+		if blockSize == 0 {
+			// Start a new block.
+			if blockSize = r.getBits(16); blockSize == 0 {
+				return nil, errors.New("empty block in compressed data")
+			}
+			t, err := efiReadPTLen(r, efiNT, efiTBit, 3)
+			if err != nil {
+				return nil, err
+			}
+			if c, err = efiReadCLen(r, t); err != nil {
+				return nil, err
+			}
+			if p, err = efiReadPTLen(r, v.np(), v.pBit, -1); err != nil {
+				return nil, err
+			}
+		}
+		blockSize--
+		if r.overrun > 8 {
+			return nil, errors.New("compressed data is truncated")
+		}
+
+		sym, err := c.decode(r)
+		if err != nil {
+			return nil, err
+		}
+		if sym < 256 {
+			out = append(out, byte(sym))
+			continue
+		}
+
+		length := int(sym) - (256 - efiThreshold)
+		pos, err := p.decode(r)
+		if err != nil {
+			return nil, err
+		}
+		dist := int(pos)
+		if pos > 1 {
+			dist = 1<<(pos-1) + int(r.getBits(uint(pos-1)))
+		}
+		start := len(out) - dist - 1
+		if start < 0 {
+			return nil, fmt.Errorf("match distance %d points before the start of the data", dist+1)
+		}
+		for i := 0; i < length && uint32(len(out)) < origSize; i++ {
+			out = append(out, out[start+i])
+		}
+	}
+	if r.overrun > 0 {
+		return nil, errors.New("compressed data is truncated")
+	}
+	return out, nil
+}
+
+// efiBitWriter writes the bitstream, most significant bit first.
+type efiBitWriter struct {
+	out   []byte
+	buf   uint64
+	nbits uint
+}
+
+func (w *efiBitWriter) putBits(n uint, val uint32) {
+	w.buf = w.buf<<n | uint64(val)&(1<<n-1)
+	w.nbits += n
+	for w.nbits >= 8 {
+		w.nbits -= 8
+		w.out = append(w.out, byte(w.buf>>w.nbits))
+	}
+}
+
+func (w *efiBitWriter) flush() []byte {
+	if w.nbits > 0 {
+		w.putBits(8-w.nbits, 0)
+	}
+	return w.out
+}
+
+// efiToken is either a literal byte or a match.
+type efiToken struct {
+	c   uint16 // literal byte, or match length + 253
+	pos uint32 // match distance - 1
+}
+
+// efiPosCode returns the position set symbol for a match position.
+func efiPosCode(pos uint32) int {
+	c := 0
+	for ; pos != 0; pos >>= 1 {
+		c++
+	}
+	return c
+}
+
+// efiCodeLengths computes Huffman code lengths no longer than maxLen for the
+// given frequencies. The number of used symbols is returned as well; when
+// it is below 2 the set is stored as a single symbol with no code.
+func efiCodeLengths(freq []uint32, maxLen int) ([]uint8, int) {
+	type node struct {
+		freq        uint64
+		sym         int
+		left, right int
+	}
+	lengths := make([]uint8, len(freq))
+	f := append([]uint32{}, freq...)
+	used := 0
+	for _, x := range f {
+		if x != 0 {
+			used++
+		}
+	}
+	if used < 2 {
+		return lengths, used
+	}
+	for {
+		nodes := []node{}
+		for sym, x := range f {
+			if x != 0 {
+				nodes = append(nodes, node{freq: uint64(x), sym: sym, left: -1, right: -1})
+			}
+		}
+		sort.SliceStable(nodes, func(i, j int) bool { return nodes[i].freq < nodes[j].freq })
+
+		// Two-queue Huffman construction: leaves are sorted, and internal
+		// nodes are created in order of non-decreasing frequency.
+		leaves := len(nodes)
+		li, ii := 0, leaves
+		pop := func() int {
+			if li < leaves && (ii >= len(nodes) || nodes[li].freq <= nodes[ii].freq) {
+				li++
+				return li - 1
+			}
+			ii++
+			return ii - 1
+		}
+		for len(nodes) < 2*leaves-1 {
+			a, b := pop(), pop()
+			nodes = append(nodes, node{freq: nodes[a].freq + nodes[b].freq, sym: -1, left: a, right: b})
+		}
+
+		depth := make([]int, len(nodes))
+		tooLong := false
+		for i := len(nodes) - 1; i >= 0; i-- {
+			if nodes[i].sym >= 0 {
+				if depth[i] > maxLen {
+					tooLong = true
+				}
+				lengths[nodes[i].sym] = uint8(depth[i])
+				continue
+			}
+			depth[nodes[i].left] = depth[i] + 1
+			depth[nodes[i].right] = depth[i] + 1
+		}
+		if !tooLong {
+			return lengths, used
+		}
+		// Flatten the distribution and try again.
+		for i, x := range f {
+			if x != 0 {
+				f[i] = (x + 1) / 2
+			}
+		}
+	}
+}
+
+// efiCodes assigns canonical codes to the code lengths.
+func efiCodes(lengths []uint8) []uint32 {
+	var count [efiMaxCodeLen + 1]uint32
+	for _, l := range lengths {
+		count[l]++
+	}
+	count[0] = 0
+	var next [efiMaxCodeLen + 2]uint32
+	for l := 1; l <= efiMaxCodeLen; l++ {
+		next[l+1] = (next[l] + count[l]) << 1
+	}
+	codes := make([]uint32, len(lengths))
+	for sym, l := range lengths {
+		if l != 0 {
+			codes[sym] = next[l]
+			next[l]++
+		}
+	}
+	return codes
+}
+
+// firstUsed returns the first symbol with a non-zero frequency, or 0.
+func firstUsed(freq []uint32) uint32 {
+	for sym, x := range freq {
+		if x != 0 {
+			return uint32(sym)
+		}
+	}
+	return 0
+}
+
+// trimLengths drops trailing zero code lengths.
+func trimLengths(lengths []uint8) []uint8 {
+	n := len(lengths)
+	for n > 0 && lengths[n-1] == 0 {
+		n--
+	}
+	return lengths[:n]
+}
+
+func (w *efiBitWriter) writePTLen(lengths []uint8, nbit uint, special int) {
+	lengths = trimLengths(lengths)
+	w.putBits(nbit, uint32(len(lengths)))
+	for i := 0; i < len(lengths); {
+		k := uint(lengths[i])
+		i++
+		if k <= 6 {
+			w.putBits(3, uint32(k))
+		} else {
+			w.putBits(k-3, 1<<(k-3)-2)
+		}
+		if i == special {
+			for i < 6 && (i >= len(lengths) || lengths[i] == 0) {
+				i++
+			}
+			w.putBits(2, uint32(i-3)&3)
+		}
+	}
+}
+
+// cLenRuns calls fn with the extra set symbol and, for runs of zero lengths,
+// the number of extra bits and their value, for every char&len code length.
+func cLenRuns(cLen []uint8, fn func(t int, nbit uint, val uint32)) {
+	cLen = trimLengths(cLen)
+	for i := 0; i < len(cLen); {
+		k := cLen[i]
+		i++
+		if k != 0 {
+			fn(int(k)+2, 0, 0)
+			continue
+		}
+		count := 1
+		for i < len(cLen) && cLen[i] == 0 {
+			i++
+			count++
+		}
+		switch {
+		case count <= 2:
+			for ; count > 0; count-- {
+				fn(0, 0, 0)
+			}
+		case count <= 18:
+			fn(1, 4, uint32(count-3))
+		case count == 19:
+			fn(0, 0, 0)
+			fn(1, 4, 15)
+		default:
+			fn(2, efiCBit, uint32(count-20))
+		}
+	}
+}
+
+func (w *efiBitWriter) writeBlock(tokens []efiToken, v efiVariant) {
+	cFreq := make([]uint32, efiNC)
+	pFreq := make([]uint32, v.np())
+	for _, tok := range tokens {
+		cFreq[tok.c]++
+		if tok.c >= 256 {
+			pFreq[efiPosCode(tok.pos)]++
+		}
+	}
+
+	w.putBits(16, uint32(len(tokens)))
+
+	cLen, cUsed := efiCodeLengths(cFreq, efiMaxCodeLen)
+	if cUsed < 2 {
+		w.putBits(efiTBit, 0)
+		w.putBits(efiTBit, 0)
+		w.putBits(efiCBit, 0)
+		w.putBits(efiCBit, firstUsed(cFreq))
+	} else {
+		tFreq := make([]uint32, efiNT)
+		cLenRuns(cLen, func(t int, _ uint, _ uint32) { tFreq[t]++ })
+		tLen, tUsed := efiCodeLengths(tFreq, efiMaxCodeLen)
+		if tUsed < 2 {
+			w.putBits(efiTBit, 0)
+			w.putBits(efiTBit, firstUsed(tFreq))
+		} else {
+			w.writePTLen(tLen, efiTBit, 3)
+		}
+		tCode := efiCodes(tLen)
+		trimmed := trimLengths(cLen)
+		w.putBits(efiCBit, uint32(len(trimmed)))
+		cLenRuns(trimmed, func(t int, nbit uint, val uint32) {
+			w.putBits(uint(tLen[t]), tCode[t])
+			w.putBits(nbit, val)
+		})
+	}
+	cCode := efiCodes(cLen)
+
+	pLen, pUsed := efiCodeLengths(pFreq, efiMaxCodeLen)
+	if pUsed < 2 {
+		w.putBits(v.pBit, 0)
+		w.putBits(v.pBit, firstUsed(pFreq))
+	} else {
+		w.writePTLen(pLen, v.pBit, -1)
+	}
+	pCode := efiCodes(pLen)
+
+	for _, tok := range tokens {
+		w.putBits(uint(cLen[tok.c]), cCode[tok.c])
+		if tok.c < 256 {
+			continue
+		}
+		pc := efiPosCode(tok.pos)
+		w.putBits(uint(pLen[pc]), pCode[pc])
+		if pc > 1 {
+			w.putBits(uint(pc-1), tok.pos-1<<(pc-1))
+		}
+	}
+}
+
+// efiTokenize finds LZ77 matches using hash chains.
+func efiTokenize(data []byte, v efiVariant) []efiToken {
+	const hashBits = 15
+	hash := func(i int) uint32 {
+		return (uint32(data[i])<<10 ^ uint32(data[i+1])<<5 ^ uint32(data[i+2])) & (1<<hashBits - 1)
+	}
+	window := 1 << v.wndBit
+	head := make([]int32, 1<<hashBits)
+	for i := range head {
+		head[i] = -1
+	}
+	prev := make([]int32, len(data))
+	insert := func(i int) {
+		if i+efiThreshold <= len(data) {
+			h := hash(i)
+			prev[i] = head[h]
+			head[h] = int32(i)
+		}
+	}
+
+	tokens := []efiToken{}
+	for i := 0; i < len(data); {
+		bestLen, bestStart := 0, 0
+		if i+efiThreshold <= len(data) {
+			maxLen := len(data) - i
+			if maxLen > efiMaxMatch {
+				maxLen = efiMaxMatch
+			}
+			for j, chain := int(head[hash(i)]), 0; j >= 0 && i-j <= window && chain < efiMaxChain; j, chain = int(prev[j]), chain+1 {
+				l := 0
+				for l < maxLen && data[j+l] == data[i+l] {
+					l++
+				}
+				if l > bestLen {
+					bestLen, bestStart = l, j
+					if l == maxLen {
+						break
+					}
+				}
+			}
+		}
+		if bestLen < efiThreshold {
+			tokens = append(tokens, efiToken{c: uint16(data[i])})
+			insert(i)
+			i++
+			continue
+		}
+		tokens = append(tokens, efiToken{
+			c:   uint16(bestLen + 256 - efiThreshold),
+			pos: uint32(i - bestStart - 1),
+		})
+		for end := i + bestLen; i < end; i++ {
+			insert(i)
+		}
+	}
+	return tokens
+}
+
+func efiEncode(decodedData []byte, v efiVariant) ([]byte, error) {
+	if uint64(len(decodedData)) > 0xFFFFFFFF {
+		return nil, fmt.Errorf("data too large to compress, got %d bytes", len(decodedData))
+	}
+	tokens := efiTokenize(decodedData, v)
+	w := &efiBitWriter{}
+	for len(tokens) > 0 {
+		n := len(tokens)
+		if n > efiBlockSize {
+			n = efiBlockSize
+		}
+		w.writeBlock(tokens[:n], v)
+		tokens = tokens[n:]
+	}
+	body := w.flush()
+
+	encodedData := make([]byte, 8, 8+len(body))
+	binary.LittleEndian.PutUint32(encodedData[0:4], uint32(len(body)))
+	binary.LittleEndian.PutUint32(encodedData[4:8], uint32(len(decodedData)))
+	return append(encodedData, body...), nil
+}
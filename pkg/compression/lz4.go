@@ -0,0 +1,321 @@
+// Copyright 2018 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package compression
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/bits"
+)
+
+// LZ4 data is stored in the LZ4 frame format, which coreboot uses for CBFS
+// files. The encoder writes what cbfstool writes: independent blocks of up
+// to 4MiB without checksums.
+//
+// See: https://github.com/lz4/lz4/blob/dev/doc/lz4_Frame_format.md
+// and https://github.com/lz4/lz4/blob/dev/doc/lz4_Block_format.md
+const (
+	lz4Magic = 0x184D2204
+
+	// Frame descriptor flags.
+	lz4Version          = 1 << 6
+	lz4BlockIndependent = 1 << 5
+	lz4BlockChecksum    = 1 << 4
+	lz4ContentSize      = 1 << 3
+	lz4ContentChecksum  = 1 << 2
+	lz4DictID           = 1 << 0
+
+	// Block size ID 7 is 4MiB.
+	lz4BlockSizeID = 7 << 4
+	lz4BlockSize   = 4 << 20
+	// The highest bit of a block size marks an uncompressed block.
+	lz4Uncompressed = 1 << 31
+
+	lz4MinMatch = 4
+	// The last match starts at least lz4MFLimit bytes before the end of a
+	// block, and the last lz4LastLiterals bytes are literals.
+	lz4MFLimit      = 12
+	lz4LastLiterals = 5
+	lz4HashLog      = 16
+	lz4MaxOffset    = 0xffff
+)
+
+// LZ4 implements Compressor for the LZ4 frame format.
+type LZ4 struct{}
+
+// Name returns the type of compression employed.
+func (c *LZ4) Name() string {
+	return "LZ4"
+}
+
+// Decode decodes a byte slice of LZ4 frame data.
+func (c *LZ4) Decode(encodedData []byte) ([]byte, error) {
+	d := encodedData
+	if len(d) < 7 || binary.LittleEndian.Uint32(d) != lz4Magic {
+		return nil, errors.New("lz4: no frame magic")
+	}
+	flg, bd := d[4], d[5]
+	if flg&0xc0 != lz4Version {
+		return nil, fmt.Errorf("lz4: unsupported frame version %d", flg>>6)
+	}
+	desc := 2
+	if flg&lz4ContentSize != 0 {
+		desc += 8
+	}
+	if flg&lz4DictID != 0 {
+		desc += 4
+	}
+	if len(d) < 4+desc+1 {
+		return nil, errors.New("lz4: frame descriptor too short")
+	}
+	if hc := byte(xxh32(d[4:4+desc], 0) >> 8); hc != d[4+desc] {
+		return nil, fmt.Errorf("lz4: frame descriptor checksum %#02x, want %#02x", d[4+desc], hc)
+	}
+	maxBlock := 1 << (8 + 2*((bd>>4)&7))
+	d = d[4+desc+1:]
+
+	var out []byte
+	for {
+		if len(d) < 4 {
+			return nil, errors.New("lz4: missing end mark")
+		}
+		size := binary.LittleEndian.Uint32(d)
+		d = d[4:]
+		if size == 0 {
+			break
+		}
+		n := int(size &^ lz4Uncompressed)
+		if n > len(d) || n > maxBlock {
+			return nil, fmt.Errorf("lz4: block of %#x bytes does not fit", n)
+		}
+		if size&lz4Uncompressed != 0 {
+			out = append(out, d[:n]...)
+		} else {
+			var err error
+			start := 0
+			if flg&lz4BlockIndependent != 0 {
+				start = len(out)
+			}
+			if out, err = lz4DecodeBlock(out, start, d[:n]); err != nil {
+				return nil, err
+			}
+		}
+		d = d[n:]
+		if flg&lz4BlockChecksum != 0 {
+			if len(d) < 4 {
+				return nil, errors.New("lz4: missing block checksum")
+			}
+			d = d[4:]
+		}
+	}
+	if flg&lz4ContentChecksum != 0 {
+		if len(d) < 4 {
+			return nil, errors.New("lz4: missing content checksum")
+		}
+		if sum := xxh32(out, 0); sum != binary.LittleEndian.Uint32(d) {
+			return nil, fmt.Errorf("lz4: content checksum %#08x, want %#08x", binary.LittleEndian.Uint32(d), sum)
+		}
+	}
+	return out, nil
+}
+
+// lz4DecodeBlock appends the decoded block src to out. Matches may reach
+// back to out[start:].
+func lz4DecodeBlock(out []byte, start int, src []byte) ([]byte, error) {
+	// length reads the extension of a literal or match length.
+	length := func(l int, i *int) (int, error) {
+		if l != 15 {
+			return l, nil
+		}
+		for {
+			if *i >= len(src) {
+				return 0, errors.New("lz4: truncated length")
+			}
+			b := src[*i]
+			*i++
+			l += int(b)
+			if b != 255 {
+				return l, nil
+			}
+		}
+	}
+	for i := 0; i < len(src); {
+		token := src[i]
+		i++
+		lits, err := length(int(token>>4), &i)
+		if err != nil {
+			return nil, err
+		}
+		if lits > len(src)-i {
+			return nil, errors.New("lz4: literals past the end of the block")
+		}
+		out = append(out, src[i:i+lits]...)
+		i += lits
+		// The last sequence has no match.
+		if i == len(src) {
+			break
+		}
+		if i+2 > len(src) {
+			return nil, errors.New("lz4: truncated match offset")
+		}
+		offset := int(binary.LittleEndian.Uint16(src[i:]))
+		i += 2
+		ml, err := length(int(token&15), &i)
+		if err != nil {
+			return nil, err
+		}
+		ml += lz4MinMatch
+		if offset == 0 || offset > len(out)-start {
+			return nil, fmt.Errorf("lz4: match offset %#x out of range", offset)
+		}
+		// Matches may overlap their own output.
+		for m := len(out) - offset; ml > 0; ml-- {
+			out = append(out, out[m])
+			m++
+		}
+	}
+	return out, nil
+}
+
+// Encode encodes a byte slice as an LZ4 frame.
+func (c *LZ4) Encode(decodedData []byte) ([]byte, error) {
+	out := make([]byte, 4, 7+len(decodedData)+len(decodedData)/255+16)
+	binary.LittleEndian.PutUint32(out, lz4Magic)
+	desc := []byte{lz4Version | lz4BlockIndependent, lz4BlockSizeID}
+	out = append(out, desc...)
+	out = append(out, byte(xxh32(desc, 0)>>8))
+
+	for d := decodedData; len(d) > 0; {
+		n := len(d)
+		if n > lz4BlockSize {
+			n = lz4BlockSize
+		}
+		block := lz4EncodeBlock(d[:n])
+		size := uint32(len(block))
+		if len(block) >= n {
+			block, size = d[:n], uint32(n)|lz4Uncompressed
+		}
+		out = lz4AppendUint32(out, size)
+		out = append(out, block...)
+		d = d[n:]
+	}
+	return lz4AppendUint32(out, 0), nil
+}
+
+// lz4EncodeBlock compresses src with a greedy search of 4 byte matches.
+func lz4EncodeBlock(src []byte) []byte {
+	var out []byte
+	// emit appends a sequence of literals followed by a match, if ml is
+	// not 0.
+	emit := func(lits []byte, offset, ml int) {
+		token := byte(0)
+		if len(lits) >= 15 {
+			token = 15 << 4
+		} else {
+			token = byte(len(lits)) << 4
+		}
+		if ml != 0 {
+			if ml-lz4MinMatch >= 15 {
+				token |= 15
+			} else {
+				token |= byte(ml - lz4MinMatch)
+			}
+		}
+		out = append(out, token)
+		out = lz4AppendLength(out, len(lits))
+		out = append(out, lits...)
+		if ml != 0 {
+			out = append(out, byte(offset), byte(offset>>8))
+			out = lz4AppendLength(out, ml-lz4MinMatch)
+		}
+	}
+
+	// The table holds the last position + 1 of each hashed 4 bytes.
+	var table [1 << lz4HashLog]int32
+	anchor := 0
+	for i := 0; i+lz4MFLimit < len(src); {
+		seq := binary.LittleEndian.Uint32(src[i:])
+		h := (seq * 2654435761) >> (32 - lz4HashLog)
+		ref := int(table[h]) - 1
+		table[h] = int32(i + 1)
+		if ref < 0 || i-ref > lz4MaxOffset || binary.LittleEndian.Uint32(src[ref:]) != seq {
+			i++
+			continue
+		}
+		ml := lz4MinMatch
+		for i+ml < len(src)-lz4LastLiterals && src[ref+ml] == src[i+ml] {
+			ml++
+		}
+		emit(src[anchor:i], i-ref, ml)
+		i += ml
+		anchor = i
+	}
+	emit(src[anchor:], 0, 0)
+	return out
+}
+
+func lz4AppendUint32(out []byte, v uint32) []byte {
+	return append(out, byte(v), byte(v>>8), byte(v>>16), byte(v>>24))
+}
+
+// lz4AppendLength appends the extension of a length of 15 or more.
+func lz4AppendLength(out []byte, l int) []byte {
+	if l < 15 {
+		return out
+	}
+	for l -= 15; l >= 255; l -= 255 {
+		out = append(out, 255)
+	}
+	return append(out, byte(l))
+}
+
+// xxHash32 primes.
+const (
+	xxh32Prime1 = 2654435761
+	xxh32Prime2 = 2246822519
+	xxh32Prime3 = 3266489917
+	xxh32Prime4 = 668265263
+	xxh32Prime5 = 374761393
+)
+
+// xxh32 returns the xxHash32 of b, which checksums LZ4 frames.
+//
+// See: https://github.com/Cyan4973/xxHash/blob/dev/doc/xxhash_spec.md
+func xxh32(b []byte, seed uint32) uint32 {
+	n := uint32(len(b))
+	var h uint32
+	if len(b) >= 16 {
+		round := func(acc, lane uint32) uint32 {
+			return bits.RotateLeft32(acc+lane*xxh32Prime2, 13) * xxh32Prime1
+		}
+		v1 := seed + xxh32Prime1 + xxh32Prime2
+		v2 := seed + xxh32Prime2
+		v3 := seed
+		v4 := seed - xxh32Prime1
+		for ; len(b) >= 16; b = b[16:] {
+			v1 = round(v1, binary.LittleEndian.Uint32(b))
+			v2 = round(v2, binary.LittleEndian.Uint32(b[4:]))
+			v3 = round(v3, binary.LittleEndian.Uint32(b[8:]))
+			v4 = round(v4, binary.LittleEndian.Uint32(b[12:]))
+		}
+		h = bits.RotateLeft32(v1, 1) + bits.RotateLeft32(v2, 7) + bits.RotateLeft32(v3, 12) + bits.RotateLeft32(v4, 18)
+	} else {
+		h = seed + xxh32Prime5
+	}
+	h += n
+	for ; len(b) >= 4; b = b[4:] {
+		h = bits.RotateLeft32(h+binary.LittleEndian.Uint32(b)*xxh32Prime3, 17) * xxh32Prime4
+	}
+	for _, c := range b {
+		h = bits.RotateLeft32(h+uint32(c)*xxh32Prime5, 11) * xxh32Prime1
+	}
+	h ^= h >> 15
+	h *= xxh32Prime2
+	h ^= h >> 13
+	h *= xxh32Prime3
+	h ^= h >> 16
+	return h
+}
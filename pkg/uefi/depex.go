@@ -0,0 +1,341 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefi
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/knownguids"
+)
+
+// DepExOrder returns the opcode and GUID of a BEFORE or AFTER dependency
+// expression. These expressions schedule the file relative to another file
+// instead of being evaluated.
+func DepExOrder(ops []DepExOp) (DepExOpCode, *guid.GUID) {
+	if len(ops) > 0 && (ops[0].OpCode == "BEFORE" || ops[0].OpCode == "AFTER") {
+		return ops[0].OpCode, ops[0].GUID
+	}
+	return "", nil
+}
+
+// DepExOnRequest reports whether the dependency expression starts with SOR.
+// Such files are only dispatched once another file requests it.
+func DepExOnRequest(ops []DepExOp) bool {
+	return len(ops) > 0 && ops[0].OpCode == "SOR"
+}
+
+// EvalDepEx evaluates a dependency expression. installed reports whether the
+// protocol or PPI with a GUID is installed. A leading SOR is ignored, and
+// BEFORE and AFTER expressions, which are not evaluated, return an error.
+func EvalDepEx(ops []DepExOp, installed func(guid.GUID) bool) (bool, error) {
+	if op, _ := DepExOrder(ops); op != "" {
+		return false, fmt.Errorf("%v dependency expressions are not evaluated", op)
+	}
+	if DepExOnRequest(ops) {
+		ops = ops[1:]
+	}
+
+	var stack []bool
+	pop := func() (bool, error) {
+		if len(stack) == 0 {
+			return false, errors.New("invalid DEPEX, stack underflow")
+		}
+		v := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return v, nil
+	}
+	for _, op := range ops {
+		switch op.OpCode {
+		case "PUSH":
+			if op.GUID == nil {
+				return false, errors.New("invalid DEPEX, PUSH without a GUID")
+			}
+			stack = append(stack, installed(*op.GUID))
+		case "AND", "OR":
+			a, err := pop()
+			if err != nil {
+				return false, err
+			}
+			b, err := pop()
+			if err != nil {
+				return false, err
+			}
+			if op.OpCode == "AND" {
+				stack = append(stack, a && b)
+			} else {
+				stack = append(stack, a || b)
+			}
+		case "NOT":
+			a, err := pop()
+			if err != nil {
+				return false, err
+			}
+			stack = append(stack, !a)
+		case "TRUE":
+			stack = append(stack, true)
+		case "FALSE":
+			stack = append(stack, false)
+		case "END":
+			v, err := pop()
+			if err != nil {
+				return false, err
+			}
+			if len(stack) != 0 {
+				return false, fmt.Errorf("invalid DEPEX, %d values left on the stack", len(stack))
+			}
+			return v, nil
+		default:
+			return false, fmt.Errorf("invalid DEPEX, unexpected %v", op.OpCode)
+		}
+	}
+	return false, errors.New("invalid DEPEX, no END")
+}
+
+// depExPrecedence is the precedence of the operators of dependency
+// expressions written as text. Operands have the highest precedence.
+var depExPrecedence = map[DepExOpCode]int{
+	"OR":  1,
+	"AND": 2,
+	"NOT": 3,
+}
+
+// depExNames maps the names of knownguids to their GUIDs. Names used by
+// several GUIDs map to nil.
+var (
+	depExNames     map[string]*guid.GUID
+	depExNamesOnce sync.Once
+)
+
+// depExLookup returns the GUID of a GUID string or knownguids name.
+func depExLookup(name string) (*guid.GUID, error) {
+	g, parseErr := guid.Parse(name)
+	if parseErr == nil {
+		return g, nil
+	}
+	depExNamesOnce.Do(func() {
+		depExNames = map[string]*guid.GUID{}
+		for g, n := range knownguids.GUIDs {
+			if _, ok := depExNames[n]; ok {
+				depExNames[n] = nil
+				continue
+			}
+			g := g
+			depExNames[n] = &g
+		}
+	})
+	g, ok := depExNames[name]
+	if !ok {
+		return nil, parseErr
+	}
+	if g == nil {
+		return nil, fmt.Errorf("GUID name %q is ambiguous, use the GUID", name)
+	}
+	return g, nil
+}
+
+// depExName returns the knownguids name of a GUID when it is unique and the
+// GUID otherwise.
+func depExName(g guid.GUID) string {
+	if name, ok := knownguids.GUIDs[g]; ok {
+		if n, err := depExLookup(name); err == nil && *n == g {
+			return name
+		}
+	}
+	return g.String()
+}
+
+// ParseDepExText compiles a dependency expression written as text, such as:
+//
+//     SOR (AcpiTableDxe OR NOT 26BACCB1-6F42-11D4-BCE7-0080C73C8881) AND TRUE
+//
+// into opcodes. Operands are GUIDs, knownguids names, TRUE and FALSE. They are
+// combined with NOT, AND and OR, from the highest to the lowest precedence,
+// and parentheses. The expression may start with SOR, or be BEFORE or AFTER
+// followed by a single GUID. The END opcode is added.
+func ParseDepExText(s string) ([]DepExOp, error) {
+	s = strings.NewReplacer("(", " ( ", ")", " ) ").Replace(s)
+	p := &depExParser{tokens: strings.Fields(s)}
+	var ops []DepExOp
+	switch p.peek() {
+	case "BEFORE", "AFTER":
+		op := DepExOpCode(p.next())
+		g, err := depExLookup(p.next())
+		if err != nil {
+			return nil, err
+		}
+		ops = []DepExOp{{OpCode: op, GUID: g}}
+	case "SOR":
+		p.next()
+		ops = []DepExOp{{OpCode: "SOR"}}
+		fallthrough
+	default:
+		expr, err := p.parse(1)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, expr...)
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("unexpected %q in dependency expression", p.tokens[p.pos])
+	}
+	return append(ops, DepExOp{OpCode: "END"}), nil
+}
+
+type depExParser struct {
+	tokens []string
+	pos    int
+}
+
+// peek returns the next token, in upper case for the keywords.
+func (p *depExParser) peek() string {
+	if p.pos >= len(p.tokens) {
+		return ""
+	}
+	t := p.tokens[p.pos]
+	switch u := strings.ToUpper(t); u {
+	case "BEFORE", "AFTER", "SOR", "AND", "OR", "NOT", "TRUE", "FALSE":
+		return u
+	}
+	return t
+}
+
+func (p *depExParser) next() string {
+	t := p.peek()
+	p.pos++
+	return t
+}
+
+// parse parses the operators of at least the given precedence into postfix
+// opcodes.
+func (p *depExParser) parse(precedence int) ([]DepExOp, error) {
+	var ops []DepExOp
+	switch t := p.next(); t {
+	case "":
+		return nil, errors.New("unexpected end of dependency expression")
+	case "(":
+		expr, err := p.parse(1)
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, errors.New("missing ) in dependency expression")
+		}
+		ops = expr
+	case "NOT":
+		expr, err := p.parse(depExPrecedence["NOT"])
+		if err != nil {
+			return nil, err
+		}
+		ops = append(expr, DepExOp{OpCode: "NOT"})
+	case "TRUE", "FALSE":
+		ops = []DepExOp{{OpCode: DepExOpCode(t)}}
+	case ")", "AND", "OR", "BEFORE", "AFTER", "SOR":
+		return nil, fmt.Errorf("unexpected %q in dependency expression", t)
+	default:
+		g, err := depExLookup(t)
+		if err != nil {
+			return nil, err
+		}
+		ops = []DepExOp{{OpCode: "PUSH", GUID: g}}
+	}
+
+	for {
+		op := DepExOpCode(p.peek())
+		prec, ok := depExPrecedence[op]
+		if !ok || op == "NOT" || prec < precedence {
+			return ops, nil
+		}
+		p.next()
+		right, err := p.parse(prec + 1)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(append(ops, right...), DepExOp{OpCode: op})
+	}
+}
+
+// DepExText disassembles dependency expression opcodes into the text parsed
+// by ParseDepExText. GUIDs with a unique knownguids name are printed by name.
+func DepExText(ops []DepExOp) (string, error) {
+	if len(ops) == 0 || ops[len(ops)-1].OpCode != "END" {
+		return "", errors.New("invalid DEPEX, no END")
+	}
+	ops = ops[:len(ops)-1]
+	if op, g := DepExOrder(ops); op != "" {
+		if len(ops) != 1 || g == nil {
+			return "", fmt.Errorf("invalid DEPEX, %v must be the only opcode", op)
+		}
+		return fmt.Sprintf("%v %v", op, depExName(*g)), nil
+	}
+	prefix := ""
+	if DepExOnRequest(ops) {
+		prefix = "SOR "
+		ops = ops[1:]
+	}
+
+	type operand struct {
+		text       string
+		precedence int
+	}
+	var stack []operand
+	pop := func() (operand, error) {
+		if len(stack) == 0 {
+			return operand{}, errors.New("invalid DEPEX, stack underflow")
+		}
+		o := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		return o, nil
+	}
+	const operandPrecedence = 4
+	for _, op := range ops {
+		switch op.OpCode {
+		case "PUSH":
+			if op.GUID == nil {
+				return "", errors.New("invalid DEPEX, PUSH without a GUID")
+			}
+			stack = append(stack, operand{depExName(*op.GUID), operandPrecedence})
+		case "TRUE", "FALSE":
+			stack = append(stack, operand{string(op.OpCode), operandPrecedence})
+		case "NOT":
+			o, err := pop()
+			if err != nil {
+				return "", err
+			}
+			if o.precedence < depExPrecedence["NOT"] {
+				o.text = "(" + o.text + ")"
+			}
+			stack = append(stack, operand{"NOT " + o.text, depExPrecedence["NOT"]})
+		case "AND", "OR":
+			right, err := pop()
+			if err != nil {
+				return "", err
+			}
+			left, err := pop()
+			if err != nil {
+				return "", err
+			}
+			prec := depExPrecedence[op.OpCode]
+			// Operators are left associative, so the right operand needs
+			// parentheses at the same precedence.
+			if left.precedence < prec {
+				left.text = "(" + left.text + ")"
+			}
+			if right.precedence <= prec {
+				right.text = "(" + right.text + ")"
+			}
+			stack = append(stack, operand{left.text + " " + string(op.OpCode) + " " + right.text, prec})
+		default:
+			return "", fmt.Errorf("invalid DEPEX, unexpected %v", op.OpCode)
+		}
+	}
+	if len(stack) != 1 {
+		return "", fmt.Errorf("invalid DEPEX, %d values on the stack", len(stack))
+	}
+	return prefix + stack[0].text, nil
+}
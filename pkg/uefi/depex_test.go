@@ -0,0 +1,156 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefi
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+)
+
+func TestEvalDepEx(t *testing.T) {
+	installed := guid.MustParse("11111111-1111-1111-1111-111111111111")
+	missing := guid.MustParse("22222222-2222-2222-2222-222222222222")
+	push := func(g *guid.GUID) DepExOp {
+		return DepExOp{OpCode: "PUSH", GUID: g}
+	}
+	op := func(code DepExOpCode) DepExOp {
+		return DepExOp{OpCode: code}
+	}
+	var tests = []struct {
+		name string
+		ops  []DepExOp
+		want bool
+		err  bool
+	}{
+		{"true", []DepExOp{op("TRUE"), op("END")}, true, false},
+		{"false", []DepExOp{op("FALSE"), op("END")}, false, false},
+		{"installed", []DepExOp{push(installed), op("END")}, true, false},
+		{"missing", []DepExOp{push(missing), op("END")}, false, false},
+		{"and", []DepExOp{push(installed), push(missing), op("AND"), op("END")}, false, false},
+		{"or", []DepExOp{push(installed), push(missing), op("OR"), op("END")}, true, false},
+		{"not", []DepExOp{push(missing), op("NOT"), op("END")}, true, false},
+		{"sor", []DepExOp{op("SOR"), push(installed), op("END")}, true, false},
+		{"before", []DepExOp{{OpCode: "BEFORE", GUID: installed}, op("END")}, false, true},
+		{"underflow", []DepExOp{push(installed), op("AND"), op("END")}, false, true},
+		{"left on stack", []DepExOp{push(installed), push(installed), op("END")}, false, true},
+		{"no END", []DepExOp{push(installed)}, false, true},
+		{"empty", []DepExOp{op("END")}, false, true},
+		{"PUSH without GUID", []DepExOp{op("PUSH"), op("END")}, false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := EvalDepEx(test.ops, func(g guid.GUID) bool {
+				return g == *installed
+			})
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, expected error: %v", err, test.err)
+			}
+			if got != test.want {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDepExText(t *testing.T) {
+	a := guid.MustParse("11111111-1111-1111-1111-111111111111")
+	b := guid.MustParse("22222222-2222-2222-2222-222222222222")
+	acpi := guid.MustParse("9622E42C-8E38-4A08-9E8F-54F784652F6B")
+	push := func(g *guid.GUID) DepExOp {
+		return DepExOp{OpCode: "PUSH", GUID: g}
+	}
+	op := func(code DepExOpCode) DepExOp {
+		return DepExOp{OpCode: code}
+	}
+	var tests = []struct {
+		text string
+		ops  []DepExOp
+		// out is the disassembled text, if it differs from the input.
+		out string
+	}{
+		{"TRUE", []DepExOp{op("TRUE"), op("END")}, ""},
+		{a.String(), []DepExOp{push(a), op("END")}, ""},
+		{"AcpiTableDxe", []DepExOp{push(acpi), op("END")}, ""},
+		{acpi.String(), []DepExOp{push(acpi), op("END")}, "AcpiTableDxe"},
+		{"11111111-1111-1111-1111-111111111111 and not 22222222-2222-2222-2222-222222222222",
+			[]DepExOp{push(a), push(b), op("NOT"), op("AND"), op("END")},
+			"11111111-1111-1111-1111-111111111111 AND NOT 22222222-2222-2222-2222-222222222222"},
+		{"TRUE OR FALSE AND TRUE",
+			[]DepExOp{op("TRUE"), op("FALSE"), op("TRUE"), op("AND"), op("OR"), op("END")}, ""},
+		{"(TRUE OR FALSE) AND TRUE",
+			[]DepExOp{op("TRUE"), op("FALSE"), op("OR"), op("TRUE"), op("AND"), op("END")}, ""},
+		{"TRUE AND (FALSE AND TRUE)",
+			[]DepExOp{op("TRUE"), op("FALSE"), op("TRUE"), op("AND"), op("AND"), op("END")}, ""},
+		{"(TRUE AND FALSE) AND TRUE",
+			[]DepExOp{op("TRUE"), op("FALSE"), op("AND"), op("TRUE"), op("AND"), op("END")},
+			"TRUE AND FALSE AND TRUE"},
+		{"NOT (TRUE OR FALSE)",
+			[]DepExOp{op("TRUE"), op("FALSE"), op("OR"), op("NOT"), op("END")}, ""},
+		{"SOR AcpiTableDxe AND TRUE",
+			[]DepExOp{op("SOR"), push(acpi), op("TRUE"), op("AND"), op("END")}, ""},
+		{"BEFORE AcpiTableDxe", []DepExOp{{OpCode: "BEFORE", GUID: acpi}, op("END")}, ""},
+		{"after 11111111-1111-1111-1111-111111111111", []DepExOp{{OpCode: "AFTER", GUID: a}, op("END")},
+			"AFTER 11111111-1111-1111-1111-111111111111"},
+	}
+	for _, test := range tests {
+		t.Run(test.text, func(t *testing.T) {
+			ops, err := ParseDepExText(test.text)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(ops, test.ops) {
+				t.Errorf("got %v, want %v", ops, test.ops)
+			}
+			text, err := DepExText(ops)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := test.out
+			if want == "" {
+				want = test.text
+			}
+			if text != want {
+				t.Errorf("disassembled to %q, want %q", text, want)
+			}
+		})
+	}
+}
+
+func TestParseDepExTextErrors(t *testing.T) {
+	for _, text := range []string{
+		"",
+		"SOR",
+		"TRUE AND",
+		"(TRUE",
+		"TRUE)",
+		"TRUE FALSE",
+		"NotAKnownGUID",
+		"BEFORE",
+		"BEFORE TRUE",
+		"AFTER AcpiTableDxe AND TRUE",
+		"TRUE AND SOR TRUE",
+	} {
+		if ops, err := ParseDepExText(text); err == nil {
+			t.Errorf("%q: expected an error, got %v", text, ops)
+		}
+	}
+}
+
+func TestDepExTextErrors(t *testing.T) {
+	for _, ops := range [][]DepExOp{
+		nil,
+		{{OpCode: "TRUE"}},
+		{{OpCode: "AND"}, {OpCode: "END"}},
+		{{OpCode: "TRUE"}, {OpCode: "TRUE"}, {OpCode: "END"}},
+		{{OpCode: "PUSH"}, {OpCode: "END"}},
+		{{OpCode: "BEFORE"}, {OpCode: "END"}},
+	} {
+		if text, err := DepExText(ops); err == nil {
+			t.Errorf("%v: expected an error, got %q", ops, text)
+		}
+	}
+}
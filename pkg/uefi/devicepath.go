@@ -0,0 +1,340 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Device paths are described in the UEFI specification, chapter 10 and their
+// text representation in section 10.6.
+
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/unicode"
+)
+
+// DevicePathType is the type of a device path node.
+type DevicePathType uint8
+
+// Device path node types
+const (
+	DevicePathTypeHardware  DevicePathType = 0x01
+	DevicePathTypeACPI      DevicePathType = 0x02
+	DevicePathTypeMessaging DevicePathType = 0x03
+	DevicePathTypeMedia     DevicePathType = 0x04
+	DevicePathTypeBBS       DevicePathType = 0x05
+	DevicePathTypeEnd       DevicePathType = 0x7F
+)
+
+// Device path end node sub types
+const (
+	DevicePathEndInstance uint8 = 0x01
+	DevicePathEndEntire   uint8 = 0xFF
+)
+
+// DevicePathNode is a node of a device path.
+type DevicePathNode struct {
+	Type    DevicePathType
+	SubType uint8
+	Data    []byte
+}
+
+// DevicePath is a device path instance, a list of nodes without the end node.
+type DevicePath []DevicePathNode
+
+// String returns the text representation of the device path.
+func (p DevicePath) String() string {
+	s := make([]string, len(p))
+	for i, n := range p {
+		s[i] = n.String()
+	}
+	return strings.Join(s, "/")
+}
+
+// ParseDevicePaths parses the device path instances at the start of buf, up to
+// the end of entire device path node.
+func ParseDevicePaths(buf []byte) ([]DevicePath, error) {
+	paths, _, err := parseDevicePaths(buf)
+	return paths, err
+}
+
+// parseDevicePaths parses the device path instances at the start of buf and
+// returns the bytes following the end of entire device path node.
+func parseDevicePaths(buf []byte) ([]DevicePath, []byte, error) {
+	var paths []DevicePath
+	var p DevicePath
+	for {
+		if len(buf) < 4 {
+			return nil, nil, errors.New("device path end node not found")
+		}
+		n := DevicePathNode{Type: DevicePathType(buf[0]), SubType: buf[1]}
+		l := int(binary.LittleEndian.Uint16(buf[2:]))
+		if l < 4 || l > len(buf) {
+			return nil, nil, fmt.Errorf("invalid device path node length %#x, %#x bytes remaining", l, len(buf))
+		}
+		n.Data = buf[4:l]
+		buf = buf[l:]
+		if n.Type != DevicePathTypeEnd {
+			p = append(p, n)
+			continue
+		}
+		paths = append(paths, p)
+		p = nil
+		if n.SubType == DevicePathEndEntire {
+			return paths, buf, nil
+		}
+	}
+}
+
+// devicePathReader reads the fields of a node, errors are only checked once all
+// the fields are read.
+type devicePathReader struct {
+	r   *bytes.Reader
+	err error
+}
+
+func (r *devicePathReader) read(data ...interface{}) {
+	for _, d := range data {
+		if r.err == nil {
+			r.err = binary.Read(r.r, binary.LittleEndian, d)
+		}
+	}
+}
+
+func (r *devicePathReader) rest() []byte {
+	b := make([]byte, r.r.Len())
+	r.r.Read(b)
+	return b
+}
+
+// String returns the text representation of the node. Nodes without a known
+// representation use the generic Path() form.
+func (n DevicePathNode) String() string {
+	r := &devicePathReader{r: bytes.NewReader(n.Data)}
+	var s string
+	switch n.Type {
+	case DevicePathTypeHardware:
+		s = n.hardwareString(r)
+	case DevicePathTypeACPI:
+		s = n.acpiString(r)
+	case DevicePathTypeMessaging:
+		s = n.messagingString(r)
+	case DevicePathTypeMedia:
+		s = n.mediaString(r)
+	case DevicePathTypeBBS:
+		if n.SubType == 0x01 {
+			var deviceType, statusFlag uint16
+			r.read(&deviceType, &statusFlag)
+			desc := strings.TrimRight(string(r.rest()), "\x00")
+			s = fmt.Sprintf("BBS(%#x,%v,%#x)", deviceType, desc, statusFlag)
+		}
+	}
+	if s == "" || r.err != nil {
+		return fmt.Sprintf("Path(%d,%d,%X)", n.Type, n.SubType, n.Data)
+	}
+	return s
+}
+
+func vendorString(prefix string, r *devicePathReader) string {
+	var g guid.GUID
+	r.read(&g)
+	if data := r.rest(); len(data) > 0 {
+		return fmt.Sprintf("%v(%v,%X)", prefix, g, data)
+	}
+	return fmt.Sprintf("%v(%v)", prefix, g)
+}
+
+func (n DevicePathNode) hardwareString(r *devicePathReader) string {
+	switch n.SubType {
+	case 0x01:
+		var function, device uint8
+		r.read(&function, &device)
+		return fmt.Sprintf("Pci(%#x,%#x)", device, function)
+	case 0x02:
+		var function uint8
+		r.read(&function)
+		return fmt.Sprintf("PcCard(%#x)", function)
+	case 0x03:
+		var memoryType uint32
+		var start, end uint64
+		r.read(&memoryType, &start, &end)
+		return fmt.Sprintf("MemoryMapped(%#x,%#x,%#x)", memoryType, start, end)
+	case 0x04:
+		return vendorString("VenHw", r)
+	case 0x05:
+		var controller uint32
+		r.read(&controller)
+		return fmt.Sprintf("Ctrl(%#x)", controller)
+	}
+	return ""
+}
+
+// eisaID returns the text form of a compressed EISA ID.
+func eisaID(id uint32) string {
+	if id&0xFFFF != 0x41D0 {
+		return fmt.Sprintf("%#010x", id)
+	}
+	return fmt.Sprintf("PNP%04X", id>>16)
+}
+
+func (n DevicePathNode) acpiString(r *devicePathReader) string {
+	switch n.SubType {
+	case 0x01:
+		var hid, uid uint32
+		r.read(&hid, &uid)
+		switch hid {
+		case 0x0A0341D0:
+			return fmt.Sprintf("PciRoot(%#x)", uid)
+		case 0x0A0841D0:
+			return fmt.Sprintf("PcieRoot(%#x)", uid)
+		}
+		return fmt.Sprintf("Acpi(%v,%#x)", eisaID(hid), uid)
+	case 0x03:
+		var adr uint32
+		r.read(&adr)
+		return fmt.Sprintf("AcpiAdr(%#x)", adr)
+	}
+	return ""
+}
+
+func (n DevicePathNode) messagingString(r *devicePathReader) string {
+	switch n.SubType {
+	case 0x01:
+		var primarySecondary, slaveMaster uint8
+		var lun uint16
+		r.read(&primarySecondary, &slaveMaster, &lun)
+		ps, sm := "Primary", "Master"
+		if primarySecondary != 0 {
+			ps = "Secondary"
+		}
+		if slaveMaster != 0 {
+			sm = "Slave"
+		}
+		return fmt.Sprintf("Ata(%v,%v,%#x)", ps, sm, lun)
+	case 0x02:
+		var pun, lun uint16
+		r.read(&pun, &lun)
+		return fmt.Sprintf("Scsi(%#x,%#x)", pun, lun)
+	case 0x05:
+		var port, iface uint8
+		r.read(&port, &iface)
+		return fmt.Sprintf("USB(%#x,%#x)", port, iface)
+	case 0x0A:
+		return vendorString("VenMsg", r)
+	case 0x0B:
+		var mac [32]uint8
+		var ifType uint8
+		r.read(&mac, &ifType)
+		l := 32
+		if ifType == 0 || ifType == 1 {
+			l = 6
+		}
+		return fmt.Sprintf("MAC(%X,%#x)", mac[:l], ifType)
+	case 0x0C:
+		var local, remote [4]uint8
+		var localPort, remotePort, protocol uint16
+		var static uint8
+		r.read(&local, &remote, &localPort, &remotePort, &protocol, &static)
+		origin := "DHCP"
+		if static != 0 {
+			origin = "Static"
+		}
+		return fmt.Sprintf("IPv4(%v,%v,%v,%v)", net.IP(remote[:]), ipProtocol(protocol), origin, net.IP(local[:]))
+	case 0x0D:
+		var local, remote [16]uint8
+		var localPort, remotePort, protocol uint16
+		r.read(&local, &remote, &localPort, &remotePort, &protocol)
+		return fmt.Sprintf("IPv6(%v,%v,%v)", net.IP(remote[:]), ipProtocol(protocol), net.IP(local[:]))
+	case 0x12:
+		var hba, portMultiplier, lun uint16
+		r.read(&hba, &portMultiplier, &lun)
+		return fmt.Sprintf("Sata(%#x,%#x,%#x)", hba, portMultiplier, lun)
+	case 0x17:
+		var nsid uint32
+		var eui [8]uint8
+		r.read(&nsid, &eui)
+		e := make([]string, len(eui))
+		for i, b := range eui {
+			e[i] = fmt.Sprintf("%02X", b)
+		}
+		return fmt.Sprintf("NVMe(%#x,%v)", nsid, strings.Join(e, "-"))
+	case 0x18:
+		return fmt.Sprintf("Uri(%v)", string(r.rest()))
+	}
+	return ""
+}
+
+func ipProtocol(p uint16) string {
+	switch p {
+	case 6:
+		return "TCP"
+	case 17:
+		return "UDP"
+	}
+	return fmt.Sprintf("%#x", p)
+}
+
+func (n DevicePathNode) mediaString(r *devicePathReader) string {
+	switch n.SubType {
+	case 0x01:
+		var partition uint32
+		var start, size uint64
+		var signature [16]uint8
+		var mbrType, signatureType uint8
+		r.read(&partition, &start, &size, &signature, &mbrType, &signatureType)
+		switch signatureType {
+		case 0x01:
+			return fmt.Sprintf("HD(%d,MBR,%#010x,%#x,%#x)", partition, binary.LittleEndian.Uint32(signature[:]), start, size)
+		case 0x02:
+			return fmt.Sprintf("HD(%d,GPT,%v,%#x,%#x)", partition, guid.GUID(signature), start, size)
+		}
+		return fmt.Sprintf("HD(%d,%#x,0,%#x,%#x)", partition, signatureType, start, size)
+	case 0x02:
+		var entry uint32
+		var start, size uint64
+		r.read(&entry, &start, &size)
+		return fmt.Sprintf("CDROM(%#x,%#x,%#x)", entry, start, size)
+	case 0x03:
+		return vendorString("VenMedia", r)
+	case 0x04:
+		return ucs2String(r.rest())
+	case 0x05:
+		var g guid.GUID
+		r.read(&g)
+		return fmt.Sprintf("Media(%v)", g)
+	case 0x06:
+		var g guid.GUID
+		r.read(&g)
+		return fmt.Sprintf("FvFile(%v)", g)
+	case 0x07:
+		var g guid.GUID
+		r.read(&g)
+		return fmt.Sprintf("Fv(%v)", g)
+	case 0x08:
+		var reserved uint32
+		var start, end uint64
+		r.read(&reserved, &start, &end)
+		return fmt.Sprintf("Offset(%#x,%#x)", start, end)
+	}
+	return ""
+}
+
+// ucs2String decodes a UCS2 string, stopping at the null terminator if any.
+func ucs2String(buf []byte) string {
+	for i := 0; i+1 < len(buf); i += 2 {
+		if buf[i] == 0 && buf[i+1] == 0 {
+			buf = buf[:i]
+			break
+		}
+	}
+	if len(buf) < 2 {
+		return ""
+	}
+	return unicode.UCS2ToUTF8(buf[:len(buf)&^1])
+}
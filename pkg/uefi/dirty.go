@@ -0,0 +1,55 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefi
+
+// DirtyTracker is implemented by the Firmware types which track whether they
+// changed since they were parsed.
+//
+// The nodes created by parsing an image are clean, their buffer holds the
+// bytes they were parsed from. SetBuf and the methods changing a node mark it
+// dirty. Code changing the fields of a node, or the list of its children,
+// must call MarkDirty. Nodes created any other way, such as from JSON, are
+// dirty. The Assemble visitor only rebuilds the dirty nodes and their
+// ancestors, the others keep their original bytes.
+type DirtyTracker interface {
+	IsDirty() bool
+	MarkDirty()
+}
+
+// dirtyState implements DirtyTracker. It is embedded in the Firmware types.
+// The zero value is dirty.
+type dirtyState struct {
+	clean bool
+}
+
+// IsDirty reports whether the node changed since it was parsed.
+func (d *dirtyState) IsDirty() bool {
+	return !d.clean
+}
+
+// MarkDirty records that the node changed and must be rebuilt.
+func (d *dirtyState) MarkDirty() {
+	d.clean = false
+}
+
+func (d *dirtyState) markClean() {
+	d.clean = true
+}
+
+// IsDirty reports whether f changed since it was parsed. Firmware types which
+// do not track their changes are always dirty.
+func IsDirty(f Firmware) bool {
+	if d, ok := f.(DirtyTracker); ok {
+		return d.IsDirty()
+	}
+	return true
+}
+
+// MarkDirty marks f dirty if it tracks its changes.
+func MarkDirty(f Firmware) {
+	if d, ok := f.(DirtyTracker); ok {
+		d.MarkDirty()
+	}
+}
@@ -9,6 +9,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"strings"
+	"sync/atomic"
 
 	"github.com/linuxboot/fiano/pkg/guid"
 	"github.com/linuxboot/fiano/pkg/log"
@@ -261,6 +262,28 @@ type File struct {
 	buf         []byte
 	ExtractPath string
 	DataOffset  uint64
+
+	// volume holds the *FirmwareVolume holding the file, see Volume. It is
+	// atomic as it is recorded by the visits, which may run concurrently.
+	volume atomic.Value
+
+	dirtyState
+}
+
+// Volume returns the firmware volume holding the file, or nil if it is not
+// known. The volume is recorded when the volume is parsed and whenever its
+// files are visited, and is not returned once the file is removed from it.
+func (f *File) Volume() *FirmwareVolume {
+	fv, _ := f.volume.Load().(*FirmwareVolume)
+	if fv == nil {
+		return nil
+	}
+	for _, file := range fv.Files {
+		if file == f {
+			return fv
+		}
+	}
+	return nil
 }
 
 // Buf returns the buffer.
@@ -273,6 +296,7 @@ func (f *File) Buf() []byte {
 // Used mostly for things interacting with the Firmware interface.
 func (f *File) SetBuf(buf []byte) {
 	f.buf = buf
+	f.MarkDirty()
 }
 
 // Apply calls the visitor on the File.
@@ -300,6 +324,7 @@ func (f *File) ApplyChildren(v Visitor) error {
 // If resizeFile is true, if the file is too large the file will be enlarged to make space
 // for the ExtendedHeader
 func (f *File) SetSize(size uint64, resizeFile bool) {
+	f.MarkDirty()
 	fh := &f.Header
 	// See if we need the extended size
 	// Check if size > 3 bytes size field
@@ -320,6 +345,7 @@ func (f *File) SetSize(size uint64, resizeFile bool) {
 
 // ChecksumAndAssemble takes in the fileData and assembles the file binary
 func (f *File) ChecksumAndAssemble(fileData []byte) error {
+	f.MarkDirty()
 	// Checksum the header and body, then write out the header.
 	// To checksum the header we write the temporary header to the file buffer first.
 	fh := &f.Header
@@ -413,7 +439,21 @@ func CreatePadFile(size uint64) (*File, error) {
 // object, if a valid one is passed, or an error. If no error is returned and the File
 // pointer is nil, it means we've reached the volume free space at the end of the FV.
 func NewFile(buf []byte) (*File, error) {
+	f, err := readFile(buf)
+	if f == nil || err != nil {
+		return nil, err
+	}
+	if err := f.parseContents(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// readFile reads the header of the file at the start of buf and copies out
+// its buffer. It returns nil at the start of the free space of a volume.
+func readFile(buf []byte) (*File, error) {
 	f := File{}
+	f.markClean()
 	f.DataOffset = FileHeaderMinLength
 	// Read in standard header.
 	r := bytes.NewReader(buf)
@@ -456,7 +496,12 @@ func NewFile(buf []byte) (*File, error) {
 		f.buf = make([]byte, f.Header.ExtendedSize)
 		copy(f.buf, newBuf)
 	}
+	return &f, nil
+}
 
+// parseContents parses the NVAR store or the sections of a file read by
+// readFile.
+func (f *File) parseContents() error {
 	// Special case for NVAR Store stored in raw file
 	if f.Header.Type == FVFileTypeRaw && f.Header.GUID == *NVAR {
 		ns, err := NewNVarStore(f.buf[f.DataOffset:])
@@ -469,22 +514,31 @@ func NewFile(buf []byte) (*File, error) {
 
 	// Parse sections
 	if _, ok := SupportedFiles[f.Header.Type]; !ok {
-		return &f, nil
+		return nil
+	}
+	if f.DataOffset >= uint64(len(f.buf)) {
+		return nil
+	}
+	data := f.buf[f.DataOffset:]
+	offsets := sectionOffsets(data)
+	if len(offsets) == 0 {
+		return nil
 	}
-	for i, offset := 0, f.DataOffset; offset < f.Header.ExtendedSize; i++ {
-		s, err := NewSection(f.buf[offset:], i)
+	sections := make([]*Section, len(offsets))
+	err := parseEach(len(offsets), func(i int) error {
+		s, err := NewSection(data[offsets[i]:], i)
 		if err != nil {
-			return nil, fmt.Errorf("error parsing sections of file %v: %v", f.Header.GUID, err)
+			return fmt.Errorf("error parsing sections of file %v: %v", f.Header.GUID, err)
 		}
 		if s.Header.ExtendedSize == 0 {
-			return nil, fmt.Errorf("invalid length of section of file %v", f.Header.GUID)
+			return fmt.Errorf("invalid length of section of file %v", f.Header.GUID)
 		}
-		offset += uint64(s.Header.ExtendedSize)
-		// Align to 4 bytes for now. The PI Spec doesn't say what alignment it should be
-		// but UEFITool aligns to 4 bytes, and this seems to work on everything I have.
-		offset = Align4(offset)
-		f.Sections = append(f.Sections, s)
+		sections[i] = s
+		return nil
+	})
+	if err != nil {
+		return err
 	}
-
-	return &f, nil
+	f.Sections = sections
+	return nil
 }
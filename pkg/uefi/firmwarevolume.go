@@ -94,6 +94,11 @@ type FirmwareVolume struct {
 	FirmwareVolumeExtHeader
 	Files []*File `json:",omitempty"`
 
+	// For NVRAM_EVSA volumes, the variable store and the fault tolerant
+	// write working block which follows it.
+	VarStore *VariableStore   `json:",omitempty"`
+	FTW      *FTWWorkingBlock `json:",omitempty"`
+
 	// Variables not in the binary for us to keep track of stuff/print
 	DataOffset  uint64
 	FVType      string `json:"-"`
@@ -102,6 +107,8 @@ type FirmwareVolume struct {
 	ExtractPath string
 	Resizable   bool   // Determines if this FV is resizable.
 	FreeSpace   uint64 `json:"-"`
+
+	dirtyState
 }
 
 // Buf returns the buffer.
@@ -114,6 +121,7 @@ func (fv *FirmwareVolume) Buf() []byte {
 // Used mostly for things interacting with the Firmware interface.
 func (fv *FirmwareVolume) SetBuf(buf []byte) {
 	fv.buf = buf
+	fv.MarkDirty()
 }
 
 // Apply calls the visitor on the FirmwareVolume.
@@ -124,10 +132,21 @@ func (fv *FirmwareVolume) Apply(v Visitor) error {
 // ApplyChildren calls the visitor on each child node of FirmwareVolume.
 func (fv *FirmwareVolume) ApplyChildren(v Visitor) error {
 	for _, f := range fv.Files {
+		f.volume.Store(fv)
 		if err := f.Apply(v); err != nil {
 			return err
 		}
 	}
+	if fv.VarStore != nil {
+		if err := fv.VarStore.Apply(v); err != nil {
+			return err
+		}
+	}
+	if fv.FTW != nil {
+		if err := fv.FTW.Apply(v); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -149,6 +168,7 @@ func (fv FirmwareVolume) String() string {
 
 // InsertFile appends the file to the end of the buffer according to alignment requirements.
 func (fv *FirmwareVolume) InsertFile(alignedOffset uint64, fBuf []byte) error {
+	fv.MarkDirty()
 	// fv.Length should contain the minimum fv size.
 	// If Resizable is not set, this is the exact FV size.
 	bufLen := uint64(len(fv.buf))
@@ -195,6 +215,7 @@ func FindFirmwareVolumeOffset(data []byte) int64 {
 // object, if a valid one is passed, or an error
 func NewFirmwareVolume(data []byte, fvOffset uint64, resizable bool) (*FirmwareVolume, error) {
 	fv := FirmwareVolume{Resizable: resizable}
+	fv.markClean()
 
 	if len(data) < FirmwareVolumeMinSize {
 		return nil, fmt.Errorf("Firmware Volume size too small: expected %v bytes, got %v",
@@ -262,6 +283,11 @@ func NewFirmwareVolume(data []byte, fvOffset uint64, resizable bool) (*FirmwareV
 		copy(fv.buf, newBuf)
 	}
 
+	if fv.FileSystemGUID == *EVSA {
+		fv.parseNVRAM()
+		return &fv, nil
+	}
+
 	// Parse the files.
 	// TODO: handle fv data alignment.
 	// Start from the end of the fv header.
@@ -270,11 +296,13 @@ func NewFirmwareVolume(data []byte, fvOffset uint64, resizable bool) (*FirmwareV
 		log.Warnf("unsupported fv type %v,%v not parsing it", fv.FileSystemGUID.String(), fv.FVType)
 		return &fv, nil
 	}
+	// The headers are read first, then the files are parsed concurrently.
 	lh := fv.Length - FileHeaderMinLength
 	var prevLen uint64
+	var offsets []uint64
 	for offset := fv.DataOffset; offset < lh; offset += prevLen {
 		offset = Align8(offset)
-		file, err := NewFile(data[offset:])
+		file, err := readFile(data[offset:])
 		if err != nil {
 			return nil, fmt.Errorf("unable to construct firmware file at offset %#x into FV: %v", offset, err)
 		}
@@ -283,11 +311,42 @@ func NewFirmwareVolume(data []byte, fvOffset uint64, resizable bool) (*FirmwareV
 			fv.FreeSpace = fv.Length - offset
 			break
 		}
+		file.volume.Store(&fv)
 		fv.Files = append(fv.Files, file)
+		offsets = append(offsets, offset)
 		prevLen = file.Header.ExtendedSize
 		if prevLen == 0 {
 			return nil, fmt.Errorf("invalid length of file at offset %#x", offset)
 		}
 	}
+	err := parseEach(len(fv.Files), func(i int) error {
+		if err := fv.Files[i].parseContents(); err != nil {
+			return fmt.Errorf("unable to construct firmware file at offset %#x into FV: %v", offsets[i], err)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
 	return &fv, nil
 }
+
+// parseNVRAM parses the variable store at the start of the data of an NVRAM
+// volume and the FTW working block following it. Parsing errors are logged and
+// leave the volume as an opaque blob.
+func (fv *FirmwareVolume) parseNVRAM() {
+	vs, err := NewVariableStore(fv.buf[fv.DataOffset:])
+	if err != nil {
+		log.Warnf("unable to parse variable store in fv %v: %v", fv.FVName, err)
+		return
+	}
+	fv.VarStore = vs
+
+	ftwOffset := Align8(fv.DataOffset + uint64(vs.Header.Size))
+	if ftwOffset >= fv.Length || !IsFTWWorkingBlock(fv.buf[ftwOffset:]) {
+		return
+	}
+	if fv.FTW, err = NewFTWWorkingBlock(fv.buf[ftwOffset:], ftwOffset); err != nil {
+		log.Warnf("unable to parse FTW working block in fv %v: %v", fv.FVName, err)
+	}
+}
@@ -7,8 +7,10 @@ package uefi
 import (
 	"fmt"
 	"io/ioutil"
+	"reflect"
 	"testing"
 
+	"github.com/linuxboot/fiano/pkg/compression"
 	"github.com/linuxboot/fiano/pkg/log"
 )
 
@@ -47,3 +49,51 @@ func TestNewFirmwareVolume(t *testing.T) {
 		})
 	}
 }
+
+func TestParseJobs(t *testing.T) {
+	// An LZMA section holding a copy of the sample FV and a UI section.
+	size := SectionMinLength + len(sampleFV)
+	payload := []byte{byte(size), byte(size >> 8), byte(size >> 16), byte(SectionTypeFirmwareVolumeImage)}
+	payload = append(payload, sampleFV...)
+	payload = append(payload, linuxSec...)
+	data, err := (&compression.LZMA{}).Encode(payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	size = SectionMinLength + 20 + len(data)
+	lzmaSec := []byte{byte(size), byte(size >> 8), byte(size >> 16), byte(SectionTypeGUIDDefined)}
+	lzmaSec = append(lzmaSec, compression.LZMAGUID[:]...)
+	lzmaSec = append(lzmaSec, SectionMinLength+20, 0, byte(GUIDEDSectionProcessingRequired), 0)
+	lzmaSec = append(lzmaSec, data...)
+
+	defer func(jobs int) {
+		ParseJobs = jobs
+	}(ParseJobs)
+	var tests = []struct {
+		name  string
+		parse func() (interface{}, error)
+	}{
+		{"FV", func() (interface{}, error) { return NewFirmwareVolume(sampleFV, 0, false) }},
+		{"nested FV", func() (interface{}, error) { return NewSection(lzmaSec, 0) }},
+	}
+	if s, err := NewSection(lzmaSec, 0); err != nil || len(s.Encapsulated) != 2 {
+		t.Fatalf("expected an FV and a UI section in the LZMA section, got error %v", err)
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ParseJobs = 1
+			serial, err := test.parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			ParseJobs = 8
+			parallel, err := test.parse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(serial, parallel) {
+				t.Error("the trees parsed serially and concurrently differ")
+			}
+		})
+	}
+}
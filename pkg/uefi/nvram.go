@@ -103,6 +103,7 @@ type NVar struct {
 	Type       NVarEntryType
 	Offset     uint64
 	NextOffset uint64
+	Value      *VariableValue `json:",omitempty"`
 
 	//Extended Header
 	ExtAttributes               *NVarExtAttribute `json:",omitempty"`
@@ -117,6 +118,8 @@ type NVar struct {
 	ExtractPath string
 	DataOffset  int64
 	ExtOffset   int64 `json:",omitempty"`
+
+	dirtyState
 }
 
 // String returns the String value of the NVAR: Type and Name if valid
@@ -137,6 +140,7 @@ func (v *NVar) Buf() []byte {
 // Used mostly for things interacting with the Firmware interface.
 func (v *NVar) SetBuf(buf []byte) {
 	v.buf = buf
+	v.MarkDirty()
 }
 
 // Apply calls the visitor on the NVar.
@@ -164,6 +168,8 @@ type NVarStore struct {
 	FreeSpaceOffset uint64
 	GUIDStoreOffset uint64
 	Length          uint64
+
+	dirtyState
 }
 
 // Buf returns the buffer.
@@ -176,6 +182,7 @@ func (s *NVarStore) Buf() []byte {
 // Used mostly for things interacting with the Firmware interface.
 func (s *NVarStore) SetBuf(buf []byte) {
 	s.buf = buf
+	s.MarkDirty()
 }
 
 // Apply calls the visitor on the NVarStore.
@@ -295,18 +302,7 @@ func (v *NVar) parseExtendedHeader() error {
 		storedChecksum = v.buf[int64(v.Header.Size)-int64(binary.Size(extendedHeaderSize)+binary.Size(storedChecksum))]
 		v.Checksum = &storedChecksum
 		// Recalculate checksum for the variable
-		calculatedChecksum := uint8(0)
-		// [0-3] _Skip_  entry 'NVAR' signature
-		// [4-5] Include entry size and flags
-		// [6-8] _Skip_  entry next (So linking will not invalidate the sum)
-		// [ 9 ] Include entry attributes
-		// [10-] Include entry data
-		for i := int64(4); i < int64(v.Header.Size); i++ {
-			calculatedChecksum += v.buf[i]
-			if i == 5 {
-				i += 3 // Skip Next
-			}
-		}
+		calculatedChecksum := v.checksum()
 		if calculatedChecksum != 0 {
 			calculatedChecksum = -calculatedChecksum
 			v.ExpectedChecksum = &calculatedChecksum
@@ -342,6 +338,50 @@ func (v *NVar) parseExtendedHeader() error {
 	return nil
 }
 
+// checksum returns the sum of the bytes covered by the extended header
+// checksum, a valid entry sums to zero.
+func (v *NVar) checksum() uint8 {
+	sum := uint8(0)
+	// [0-3] _Skip_  entry 'NVAR' signature
+	// [4-5] Include entry size and flags
+	// [6-8] _Skip_  entry next (So linking will not invalidate the sum)
+	// [ 9 ] Include entry attributes
+	// [10-] Include entry data
+	for i := int64(4); i < int64(v.Header.Size); i++ {
+		sum += v.buf[i]
+		if i == 5 {
+			i += 3 // Skip Next
+		}
+	}
+	return sum
+}
+
+// UpdateChecksum updates the checksum stored in the extended header, if any,
+// to match the content of the entry.
+func (v *NVar) UpdateChecksum() {
+	v.MarkDirty()
+	if v.ExtAttributes == nil || *v.ExtAttributes&NVarEntryExtChecksum == 0 {
+		return
+	}
+	var extendedHeaderSize uint16
+	i := int64(v.Header.Size) - int64(binary.Size(extendedHeaderSize)) - 1
+	v.buf[i] = 0
+	v.buf[i] = -v.checksum()
+	checksum := v.buf[i]
+	v.Checksum = &checksum
+	v.ExpectedChecksum = nil
+}
+
+// Invalidate marks the entry as invalid by clearing its Valid attribute.
+func (v *NVar) Invalidate() {
+	v.MarkDirty()
+	v.Type = InvalidNVarEntry
+	v.Header.Attributes &^= NVarEntryValid
+	if i := binary.Size(v.Header) - 1; len(v.buf) > i {
+		v.buf[i] = byte(v.Header.Attributes)
+	}
+}
+
 func (v *NVar) parseDataOnly(s *NVarStore) bool {
 	if v.Header.Attributes&NVarEntryDataOnly == 0 {
 		return false
@@ -442,6 +482,7 @@ func newNVar(buf []byte, offset uint64, s *NVarStore) (*NVar, error) {
 	}
 
 	v := NVar{Type: FullNVarEntry, Offset: offset}
+	v.markClean()
 	// read the header and check for existing NVAR
 	if err := v.parseHeader(buf); err != nil {
 		return nil, err
@@ -456,6 +497,14 @@ func newNVar(buf []byte, offset uint64, s *NVarStore) (*NVar, error) {
 	if !v.Header.Attributes.IsValid() {
 		v.Name = "Invalid"
 		v.Type = InvalidNVarEntry
+		// The GUID store still holds the GUID of a deleted variable, it
+		// must not be parsed as free space or entries.
+		if v.Header.Attributes&(NVarEntryDataOnly|NVarEntryGUID) == 0 && int64(len(v.buf)) > v.DataOffset {
+			i := uint64(v.buf[v.DataOffset])
+			if offset+uint64(v.Header.Size)+(i+1)*uint64(binary.Size(guid.GUID{})) <= s.Length {
+				s.getGUIDFromStore(uint8(i))
+			}
+		}
 		return &v, nil
 	}
 
@@ -484,10 +533,30 @@ func newNVar(buf []byte, offset uint64, s *NVarStore) (*NVar, error) {
 
 	// Try parsing the entry content
 	_ = v.parseContent(v.buf[v.DataOffset:])
+	v.DecodeValue()
 
 	return &v, nil
 }
 
+// Data returns the data of the entry, without the extended header.
+func (v *NVar) Data() []byte {
+	end := int64(len(v.buf))
+	if v.ExtAttributes != nil && v.ExtOffset >= v.DataOffset {
+		end = v.ExtOffset
+	}
+	return v.buf[v.DataOffset:end]
+}
+
+// DecodeValue decodes the data of valid entries of well-known variables into
+// Value.
+func (v *NVar) DecodeValue() {
+	v.Value = nil
+	if !v.IsValid() || v.NVarStore != nil {
+		return
+	}
+	v.Value = DecodeVariable(v.Name, v.GUID, v.Data())
+}
+
 // Assemble takes in the content and assembles the NVAR binary
 // Warning: when checkOnly is false the resulting NVar must be Assembled again
 // to fix the header content
@@ -567,6 +636,7 @@ func (v *NVar) Assemble(content []byte, checkOnly bool) error {
 // object, if a valid one is passed, or an error.
 func NewNVarStore(buf []byte) (*NVarStore, error) {
 	s := NVarStore{}
+	s.markClean()
 
 	// Copy out the buffer.
 	s.buf = make([]byte, len(buf))
@@ -348,3 +348,62 @@ func TestNVarStore_GetGUIDStoreBuf(t *testing.T) {
 		})
 	}
 }
+
+func TestNVar_UpdateChecksum(t *testing.T) {
+	Attributes.ErasePolarity = 0xFF
+	// Extended header with checksum: attributes, timestamp, checksum and size
+	ext := []byte{byte(NVarEntryExtChecksum), 1, 2, 3, 4, 5, 6, 7, 8, 0x42, 12, 0}
+	v := NVar{Type: FullNVarEntry, Header: NVarHeader{Attributes: NVarEntryValid | NVarEntryASCIIName | NVarEntryGUID | NVarEntryExtHeader}, GUID: *FFGUID, Name: "Test"}
+	if err := v.Assemble(append([]byte("data"), ext...), false); err != nil {
+		t.Fatalf("Unable to assemble NVar: %v", err)
+	}
+	if err := v.Assemble(v.buf[v.DataOffset:], true); err != nil {
+		t.Fatalf("Unable to assemble NVar: %v", err)
+	}
+	v.ExtOffset = int64(len(v.buf) - len(ext))
+	extAttributes := NVarEntryExtChecksum
+	v.ExtAttributes = &extAttributes
+	v.UpdateChecksum()
+	if v.Checksum == nil || *v.Checksum == 0x42 {
+		t.Fatalf("Checksum not updated")
+	}
+
+	var s NVarStore
+	parsed, err := newNVar(v.buf, 0, &s)
+	if err != nil {
+		t.Fatalf("Unable to parse NVar: %v", err)
+	}
+	if parsed.Checksum == nil || *parsed.Checksum != *v.Checksum {
+		t.Errorf("Bad parsed checksum, expected %#x got %v", *v.Checksum, parsed.Checksum)
+	}
+	if parsed.ExpectedChecksum != nil {
+		t.Errorf("Checksum mismatch, expected %#x", *parsed.ExpectedChecksum)
+	}
+
+	// Links do not change the checksum.
+	v.buf[6] = 0x20
+	if parsed, err = newNVar(v.buf, 0, &s); err != nil {
+		t.Fatalf("Unable to parse NVar: %v", err)
+	}
+	if parsed.ExpectedChecksum != nil {
+		t.Errorf("Checksum mismatch after linking, expected %#x", *parsed.ExpectedChecksum)
+	}
+}
+
+func TestNVar_Invalidate(t *testing.T) {
+	Attributes.ErasePolarity = 0xFF
+	var s NVarStore
+	v, err := newNVar(stored0GUIDASCIINameNVar, 0, &s)
+	if err != nil {
+		t.Fatalf("Unable to parse NVar: %v", err)
+	}
+	v.Invalidate()
+	if v.IsValid() {
+		t.Errorf("NVar still valid")
+	}
+	if parsed, err := newNVar(v.buf, 0, &s); err != nil {
+		t.Fatalf("Unable to parse NVar: %v", err)
+	} else if parsed.IsValid() {
+		t.Errorf("Parsed NVar still valid")
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefi
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+// parseWorkers counts the goroutines started by parseEach, which are limited
+// by ParseJobs.
+var parseWorkers struct {
+	sync.Mutex
+	n int
+}
+
+// startParseWorker reserves a goroutine for parseEach, if ParseJobs allows it.
+// The calling goroutine counts as one of the jobs.
+func startParseWorker() bool {
+	parseWorkers.Lock()
+	defer parseWorkers.Unlock()
+	if parseWorkers.n >= ParseJobs-1 {
+		return false
+	}
+	parseWorkers.n++
+	return true
+}
+
+func stopParseWorker() {
+	parseWorkers.Lock()
+	parseWorkers.n--
+	parseWorkers.Unlock()
+}
+
+// parseEach calls parse for each index from 0 to n-1. The calls run in other
+// goroutines while there are less than ParseJobs, and in the calling goroutine
+// otherwise, so that nested calls never wait for each other. Like a serial
+// loop, it returns the error of the lowest index.
+func parseEach(n int, parse func(i int) error) error {
+	errs := make([]error, n)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		if i < n-1 && startParseWorker() {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				defer stopParseWorker()
+				errs[i] = parse(i)
+			}(i)
+			continue
+		}
+		errs[i] = parse(i)
+	}
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sectionOffsets lists the offsets of the sections in buf, which are aligned
+// to 4 bytes, from their headers. A section with an invalid header ends the
+// list, NewSection then reports the error.
+func sectionOffsets(buf []byte) []uint64 {
+	var offsets []uint64
+	for offset := uint64(0); offset < uint64(len(buf)); {
+		offsets = append(offsets, offset)
+		size, err := sectionSize(buf[offset:])
+		if err != nil || size == 0 {
+			break
+		}
+		// Align to 4 bytes for now. The PI Spec doesn't say what alignment it should be
+		// but UEFITool aligns to 4 bytes, and this seems to work on everything I have.
+		offset = Align4(offset + size)
+	}
+	return offsets
+}
+
+// sectionSize reads the size of the section at the start of buf.
+func sectionSize(buf []byte) (uint64, error) {
+	if len(buf) < SectionMinLength {
+		return 0, errors.New("section header truncated")
+	}
+	var size [3]uint8
+	copy(size[:], buf)
+	if size != [3]uint8{0xFF, 0xFF, 0xFF} {
+		return Read3Size(size), nil
+	}
+	if len(buf) < SectionExtMinLength {
+		return 0, errors.New("extended section header truncated")
+	}
+	ext := binary.LittleEndian.Uint32(buf[SectionMinLength:])
+	if ext == 0xFFFFFFFF {
+		return 0, errors.New("invalid extended section size")
+	}
+	return uint64(ext), nil
+}
@@ -0,0 +1,591 @@
+// Copyright 2018 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefi
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// PEMachine holds the machine type of a PE/COFF or TE image.
+type PEMachine uint16
+
+// PE/COFF machine types found in UEFI images.
+const (
+	PEMachineI386        PEMachine = 0x014c
+	PEMachineIA64        PEMachine = 0x0200
+	PEMachineEBC         PEMachine = 0x0ebc
+	PEMachineX64         PEMachine = 0x8664
+	PEMachineARMThumb    PEMachine = 0x01c2
+	PEMachineARMThumb2   PEMachine = 0x01c4
+	PEMachineAArch64     PEMachine = 0xaa64
+	PEMachineRISCV32     PEMachine = 0x5032
+	PEMachineRISCV64     PEMachine = 0x5064
+	PEMachineRISCV128    PEMachine = 0x5128
+	PEMachineLoongArch64 PEMachine = 0x6264
+)
+
+var peMachineNames = map[PEMachine]string{
+	PEMachineI386:        "IA32",
+	PEMachineIA64:        "IPF",
+	PEMachineEBC:         "EBC",
+	PEMachineX64:         "X64",
+	PEMachineARMThumb:    "ARM",
+	PEMachineARMThumb2:   "ARMNT",
+	PEMachineAArch64:     "AARCH64",
+	PEMachineRISCV32:     "RISCV32",
+	PEMachineRISCV64:     "RISCV64",
+	PEMachineRISCV128:    "RISCV128",
+	PEMachineLoongArch64: "LOONGARCH64",
+}
+
+// String returns the EDK2 architecture name of the machine type.
+func (m PEMachine) String() string {
+	if s, ok := peMachineNames[m]; ok {
+		return s
+	}
+	return fmt.Sprintf("%#04x", uint16(m))
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (m PEMachine) MarshalText() ([]byte, error) {
+	return []byte(m.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (m *PEMachine) UnmarshalText(text []byte) error {
+	for k, v := range peMachineNames {
+		if v == string(text) {
+			*m = k
+			return nil
+		}
+	}
+	n, err := strconv.ParseUint(string(text), 0, 16)
+	if err != nil {
+		return fmt.Errorf("unknown machine type %q", text)
+	}
+	*m = PEMachine(n)
+	return nil
+}
+
+// PESubsystem holds the subsystem of a PE/COFF or TE image.
+type PESubsystem uint16
+
+// PE/COFF subsystems found in UEFI images.
+const (
+	PESubsystemNative               PESubsystem = 1
+	PESubsystemEFIApplication       PESubsystem = 10
+	PESubsystemEFIBootServiceDriver PESubsystem = 11
+	PESubsystemEFIRuntimeDriver     PESubsystem = 12
+	PESubsystemEFIROM               PESubsystem = 13
+)
+
+var peSubsystemNames = map[PESubsystem]string{
+	PESubsystemNative:               "NATIVE",
+	PESubsystemEFIApplication:       "EFI_APPLICATION",
+	PESubsystemEFIBootServiceDriver: "EFI_BOOT_SERVICE_DRIVER",
+	PESubsystemEFIRuntimeDriver:     "EFI_RUNTIME_DRIVER",
+	PESubsystemEFIROM:               "EFI_ROM",
+}
+
+// String returns the name of the subsystem.
+func (s PESubsystem) String() string {
+	if n, ok := peSubsystemNames[s]; ok {
+		return n
+	}
+	return fmt.Sprintf("%#x", uint16(s))
+}
+
+// MarshalText implements the encoding.TextMarshaler interface.
+func (s PESubsystem) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// UnmarshalText implements the encoding.TextUnmarshaler interface.
+func (s *PESubsystem) UnmarshalText(text []byte) error {
+	for k, v := range peSubsystemNames {
+		if v == string(text) {
+			*s = k
+			return nil
+		}
+	}
+	n, err := strconv.ParseUint(string(text), 0, 16)
+	if err != nil {
+		return fmt.Errorf("unknown subsystem %q", text)
+	}
+	*s = PESubsystem(n)
+	return nil
+}
+
+// PE/COFF image formats.
+const (
+	PEFormatPE32     = "PE32"
+	PEFormatPE32Plus = "PE32+"
+	PEFormatTE       = "TE"
+)
+
+// Data directory indices used by the parser.
+const (
+	peDirectorySecurity  = 4
+	peDirectoryBaseReloc = 5
+	peDirectoryDebug     = 6
+)
+
+const (
+	peOptionalMagicPE32     = 0x10b
+	peOptionalMagicPE32Plus = 0x20b
+
+	peDebugTypeCodeView = 2
+)
+
+// Base relocation types.
+const (
+	peRelBasedAbsolute = 0
+	peRelBasedHigh     = 1
+	peRelBasedLow      = 2
+	peRelBasedHighLow  = 3
+	peRelBasedDir64    = 10
+)
+
+// peFileHeader is the IMAGE_FILE_HEADER of a PE/COFF image.
+type peFileHeader struct {
+	Machine              PEMachine
+	NumberOfSections     uint16
+	TimeDateStamp        uint32
+	PointerToSymbolTable uint32
+	NumberOfSymbols      uint32
+	SizeOfOptionalHeader uint16
+	Characteristics      uint16
+}
+
+// peDataDirectory is an EFI_IMAGE_DATA_DIRECTORY.
+type peDataDirectory struct {
+	VirtualAddress uint32
+	Size           uint32
+}
+
+// teHeader is the EFI_TE_IMAGE_HEADER as specified in the UEFI PI Spec 15.2.
+type teHeader struct {
+	Signature           [2]uint8
+	Machine             PEMachine
+	NumberOfSections    uint8
+	Subsystem           uint8
+	StrippedSize        uint16
+	AddressOfEntryPoint uint32
+	BaseOfCode          uint32
+	ImageBase           uint64
+	BaseReloc           peDataDirectory
+	Debug               peDataDirectory
+}
+
+// TEHeaderSize is the size of the EFI_TE_IMAGE_HEADER.
+const TEHeaderSize = 40
+
+// peSectionHeader is an EFI_IMAGE_SECTION_HEADER.
+type peSectionHeader struct {
+	Name                 [8]uint8
+	VirtualSize          uint32
+	VirtualAddress       uint32
+	SizeOfRawData        uint32
+	PointerToRawData     uint32
+	PointerToRelocations uint32
+	PointerToLinenumbers uint32
+	NumberOfRelocations  uint16
+	NumberOfLinenumbers  uint16
+	Characteristics      uint32
+}
+
+// peDebugDirectoryEntry is an EFI_IMAGE_DEBUG_DIRECTORY_ENTRY.
+type peDebugDirectoryEntry struct {
+	Characteristics  uint32
+	TimeDateStamp    uint32
+	MajorVersion     uint16
+	MinorVersion     uint16
+	Type             uint32
+	SizeOfData       uint32
+	AddressOfRawData uint32
+	PointerToRawData uint32
+}
+
+// PESection describes one entry of the section table of a PE/COFF or TE image.
+// Addresses and offsets are as found in the image; for TE images the raw data
+// pointers have not been adjusted for the stripped header.
+type PESection struct {
+	Name             string
+	VirtualAddress   uint32
+	VirtualSize      uint32
+	PointerToRawData uint32
+	SizeOfRawData    uint32
+	Characteristics  uint32
+}
+
+// PEImage contains the interesting fields of a PE/COFF or TE image found in a
+// EFI_SECTION_PE32 or EFI_SECTION_TE section.
+type PEImage struct {
+	Format     string
+	Machine    PEMachine
+	Subsystem  PESubsystem
+	EntryPoint uint32 // RVA of the entry point.
+	ImageBase  uint64
+
+	// For TE images, the number of bytes of the original PE headers which
+	// were replaced by the TE header.
+	StrippedSize uint16 `json:",omitempty"`
+
+	Sections []PESection
+
+	// Path to the PDB file recorded in the CodeView debug entry. This is
+	// where the module was built.
+	PDBPath string `json:",omitempty"`
+
+	// Authenticode SHA256 digest of the image in hex. TE images have no
+	// Authenticode digest.
+	AuthenticodeSHA256 string `json:",omitempty"`
+
+	// rvaDelta converts a raw data pointer into an offset in the image.
+	rvaDelta int64
+	// Offset of the image base field in the header.
+	imageBaseOffset int64
+	relocDir        peDataDirectory
+}
+
+// String returns a short description of the image.
+func (p *PEImage) String() string {
+	return fmt.Sprintf("%s %v %v", p.Format, p.Machine, p.Subsystem)
+}
+
+// ParsePEImage parses a PE/COFF or TE image.
+func ParsePEImage(buf []byte) (*PEImage, error) {
+	switch {
+	case bytes.HasPrefix(buf, []byte("MZ")):
+		return parsePE(buf)
+	case bytes.HasPrefix(buf, []byte("VZ")):
+		return parseTE(buf)
+	}
+	return nil, errors.New("image has neither a MZ nor a VZ signature")
+}
+
+func parsePE(buf []byte) (*PEImage, error) {
+	if len(buf) < 0x40 {
+		return nil, fmt.Errorf("pe image too small for DOS header, got %#x bytes", len(buf))
+	}
+	peOffset := uint64(binary.LittleEndian.Uint32(buf[0x3c:]))
+	if peOffset+4 > uint64(len(buf)) || !bytes.Equal(buf[peOffset:peOffset+4], []byte("PE\x00\x00")) {
+		return nil, fmt.Errorf("no PE signature at offset %#x", peOffset)
+	}
+
+	var fh peFileHeader
+	r := bytes.NewReader(buf[peOffset+4:])
+	if err := binary.Read(r, binary.LittleEndian, &fh); err != nil {
+		return nil, fmt.Errorf("unable to read COFF header: %v", err)
+	}
+	optOffset := peOffset + 4 + uint64(binary.Size(fh))
+	optEnd := optOffset + uint64(fh.SizeOfOptionalHeader)
+	if optEnd > uint64(len(buf)) || fh.SizeOfOptionalHeader < 2 {
+		return nil, fmt.Errorf("optional header of size %#x at offset %#x is out of bounds", fh.SizeOfOptionalHeader, optOffset)
+	}
+	opt := buf[optOffset:optEnd]
+
+	p := &PEImage{Machine: fh.Machine}
+	var dirOffset uint64
+	var minSize int
+	switch magic := binary.LittleEndian.Uint16(opt); magic {
+	case peOptionalMagicPE32:
+		p.Format = PEFormatPE32
+		dirOffset, minSize = 96, 96
+	case peOptionalMagicPE32Plus:
+		p.Format = PEFormatPE32Plus
+		dirOffset, minSize = 112, 112
+	default:
+		return nil, fmt.Errorf("unknown optional header magic %#x", magic)
+	}
+	if len(opt) < minSize {
+		return nil, fmt.Errorf("optional header too small, got %#x bytes, need %#x", len(opt), minSize)
+	}
+	p.EntryPoint = binary.LittleEndian.Uint32(opt[16:])
+	if p.Format == PEFormatPE32 {
+		p.imageBaseOffset = int64(optOffset) + 28
+		p.ImageBase = uint64(binary.LittleEndian.Uint32(opt[28:]))
+	} else {
+		p.imageBaseOffset = int64(optOffset) + 24
+		p.ImageBase = binary.LittleEndian.Uint64(opt[24:])
+	}
+	sizeOfHeaders := binary.LittleEndian.Uint32(opt[60:])
+	p.Subsystem = PESubsystem(binary.LittleEndian.Uint16(opt[68:]))
+
+	// Data directories
+	numDirs := binary.LittleEndian.Uint32(opt[dirOffset-4:])
+	if maxDirs := uint32(len(opt)-int(dirOffset)) / 8; numDirs > maxDirs {
+		numDirs = maxDirs
+	}
+	dirs := make([]peDataDirectory, numDirs)
+	for i := range dirs {
+		d := opt[dirOffset+uint64(i)*8:]
+		dirs[i] = peDataDirectory{binary.LittleEndian.Uint32(d), binary.LittleEndian.Uint32(d[4:])}
+	}
+
+	sections, err := readPESections(buf, optEnd, int(fh.NumberOfSections))
+	if err != nil {
+		return nil, err
+	}
+	p.setSections(sections)
+
+	if len(dirs) > peDirectoryBaseReloc {
+		p.relocDir = dirs[peDirectoryBaseReloc]
+	}
+	if len(dirs) > peDirectoryDebug {
+		p.PDBPath = p.findPDBPath(buf, dirs[peDirectoryDebug])
+	}
+
+	// The checksum and certificate table entry are skipped by Authenticode.
+	checksumOffset := optOffset + 64
+	certEntryOffset := uint64(0)
+	var certDir peDataDirectory
+	if len(dirs) > peDirectorySecurity {
+		certEntryOffset = optOffset + dirOffset + peDirectorySecurity*8
+		certDir = dirs[peDirectorySecurity]
+	}
+	digest, err := authenticodeSHA256(buf, checksumOffset, certEntryOffset, certDir, sizeOfHeaders, sections)
+	if err != nil {
+		return nil, err
+	}
+	p.AuthenticodeSHA256 = hex.EncodeToString(digest)
+	return p, nil
+}
+
+func parseTE(buf []byte) (*PEImage, error) {
+	var th teHeader
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &th); err != nil {
+		return nil, fmt.Errorf("unable to read TE header: %v", err)
+	}
+	p := &PEImage{
+		Format:       PEFormatTE,
+		Machine:      th.Machine,
+		Subsystem:    PESubsystem(th.Subsystem),
+		EntryPoint:   th.AddressOfEntryPoint,
+		ImageBase:    th.ImageBase,
+		StrippedSize: th.StrippedSize,
+		rvaDelta:     TEHeaderSize - int64(th.StrippedSize),
+		// ImageBase follows the signature, machine, number of sections,
+		// subsystem, stripped size, entry point and base of code.
+		imageBaseOffset: 16,
+		relocDir:        th.BaseReloc,
+	}
+	sections, err := readPESections(buf, TEHeaderSize, int(th.NumberOfSections))
+	if err != nil {
+		return nil, err
+	}
+	p.setSections(sections)
+	p.PDBPath = p.findPDBPath(buf, th.Debug)
+	return p, nil
+}
+
+func readPESections(buf []byte, offset uint64, n int) ([]peSectionHeader, error) {
+	sections := make([]peSectionHeader, n)
+	if offset > uint64(len(buf)) {
+		return nil, fmt.Errorf("section table offset %#x is beyond image size %#x", offset, len(buf))
+	}
+	if err := binary.Read(bytes.NewReader(buf[offset:]), binary.LittleEndian, sections); err != nil {
+		return nil, fmt.Errorf("unable to read %d section headers: %v", n, err)
+	}
+	return sections, nil
+}
+
+func (p *PEImage) setSections(sections []peSectionHeader) {
+	p.Sections = make([]PESection, len(sections))
+	for i, s := range sections {
+		p.Sections[i] = PESection{
+			Name:             string(bytes.TrimRight(s.Name[:], "\x00")),
+			VirtualAddress:   s.VirtualAddress,
+			VirtualSize:      s.VirtualSize,
+			PointerToRawData: s.PointerToRawData,
+			SizeOfRawData:    s.SizeOfRawData,
+			Characteristics:  s.Characteristics,
+		}
+	}
+}
+
+// rvaToOffset converts a RVA into an offset into the image buffer.
+func (p *PEImage) rvaToOffset(rva uint32) int64 {
+	for _, s := range p.Sections {
+		size := s.VirtualSize
+		if size == 0 {
+			size = s.SizeOfRawData
+		}
+		if rva >= s.VirtualAddress && rva-s.VirtualAddress < size {
+			return int64(rva-s.VirtualAddress) + int64(s.PointerToRawData) + p.rvaDelta
+		}
+	}
+	// Not in a section, this is only valid within the headers.
+	return int64(rva) + p.rvaDelta
+}
+
+// findPDBPath returns the PDB path of the CodeView entry of the debug
+// directory, or the empty string if there is none.
+func (p *PEImage) findPDBPath(buf []byte, dir peDataDirectory) string {
+	if dir.VirtualAddress == 0 || dir.Size == 0 {
+		return ""
+	}
+	off := p.rvaToOffset(dir.VirtualAddress)
+	if off < 0 || off+int64(dir.Size) > int64(len(buf)) {
+		return ""
+	}
+	var entry peDebugDirectoryEntry
+	r := bytes.NewReader(buf[off : off+int64(dir.Size)])
+	for binary.Read(r, binary.LittleEndian, &entry) == nil {
+		if entry.Type != peDebugTypeCodeView {
+			continue
+		}
+		cvOff := int64(entry.PointerToRawData) + p.rvaDelta
+		if entry.AddressOfRawData != 0 {
+			cvOff = p.rvaToOffset(entry.AddressOfRawData)
+		}
+		if cvOff < 0 || cvOff+int64(entry.SizeOfData) > int64(len(buf)) || entry.SizeOfData < 4 {
+			return ""
+		}
+		cv := buf[cvOff : cvOff+int64(entry.SizeOfData)]
+		var pathOffset int
+		switch string(cv[:4]) {
+		case "NB10":
+			pathOffset = 16
+		case "RSDS":
+			pathOffset = 24
+		case "MTOC":
+			pathOffset = 20
+		default:
+			return ""
+		}
+		if pathOffset > len(cv) {
+			return ""
+		}
+		path := cv[pathOffset:]
+		if i := bytes.IndexByte(path, 0); i >= 0 {
+			path = path[:i]
+		}
+		return string(path)
+	}
+	return ""
+}
+
+// Rebase applies the base relocations of the image so it can run at newBase.
+// buf must hold the image p was parsed from and is modified in place. For TE
+// images, newBase is the base of the original PE image, which is the address
+// of the TE header plus the size of the TE header minus StrippedSize. p is
+// updated to describe the rebased image.
+func (p *PEImage) Rebase(buf []byte, newBase uint64) error {
+	delta := newBase - p.ImageBase
+	if delta == 0 {
+		return nil
+	}
+	if p.relocDir.VirtualAddress == 0 || p.relocDir.Size == 0 {
+		return errors.New("image has no relocations")
+	}
+	start := p.rvaToOffset(p.relocDir.VirtualAddress)
+	end := start + int64(p.relocDir.Size)
+	if start < 0 || end > int64(len(buf)) {
+		return fmt.Errorf("relocations [%#x:%#x] are beyond image size %#x", start, end, len(buf))
+	}
+
+	relocs := buf[start:end]
+	for len(relocs) >= 8 {
+		pageRVA := binary.LittleEndian.Uint32(relocs)
+		blockSize := binary.LittleEndian.Uint32(relocs[4:])
+		if blockSize < 8 || uint64(blockSize) > uint64(len(relocs)) {
+			return fmt.Errorf("invalid relocation block size %#x for page %#x", blockSize, pageRVA)
+		}
+		for i := uint32(8); i+2 <= blockSize; i += 2 {
+			entry := binary.LittleEndian.Uint16(relocs[i:])
+			typ, off := entry>>12, p.rvaToOffset(pageRVA+uint32(entry&0xfff))
+			size := int64(2)
+			switch typ {
+			case peRelBasedAbsolute:
+				continue
+			case peRelBasedHighLow:
+				size = 4
+			case peRelBasedDir64:
+				size = 8
+			}
+			if off < 0 || off+size > int64(len(buf)) {
+				return fmt.Errorf("relocation at %#x is beyond image size %#x", off, len(buf))
+			}
+			fixup := buf[off:]
+			switch typ {
+			case peRelBasedHigh:
+				binary.LittleEndian.PutUint16(fixup, binary.LittleEndian.Uint16(fixup)+uint16(delta>>16))
+			case peRelBasedLow:
+				binary.LittleEndian.PutUint16(fixup, binary.LittleEndian.Uint16(fixup)+uint16(delta))
+			case peRelBasedHighLow:
+				binary.LittleEndian.PutUint32(fixup, binary.LittleEndian.Uint32(fixup)+uint32(delta))
+			case peRelBasedDir64:
+				binary.LittleEndian.PutUint64(fixup, binary.LittleEndian.Uint64(fixup)+delta)
+			default:
+				return fmt.Errorf("unsupported relocation type %d at %#x", typ, off)
+			}
+		}
+		relocs = relocs[blockSize:]
+	}
+
+	if p.Format == PEFormatPE32 {
+		binary.LittleEndian.PutUint32(buf[p.imageBaseOffset:], uint32(newBase))
+	} else {
+		binary.LittleEndian.PutUint64(buf[p.imageBaseOffset:], newBase)
+	}
+	np, err := ParsePEImage(buf)
+	if err != nil {
+		return err
+	}
+	*p = *np
+	return nil
+}
+
+// authenticodeSHA256 computes the Authenticode digest of a PE/COFF image as
+// described in "Windows Authenticode Portable Executable Signature Format".
+func authenticodeSHA256(buf []byte, checksumOffset, certEntryOffset uint64, certDir peDataDirectory,
+	sizeOfHeaders uint32, sections []peSectionHeader) ([]byte, error) {
+	buflen := uint64(len(buf))
+	if uint64(sizeOfHeaders) > buflen || checksumOffset+4 > uint64(sizeOfHeaders) ||
+		(certEntryOffset != 0 && certEntryOffset+8 > uint64(sizeOfHeaders)) {
+		return nil, fmt.Errorf("pe headers of size %#x are out of bounds", sizeOfHeaders)
+	}
+
+	h := sha256.New()
+	h.Write(buf[:checksumOffset])
+	if certEntryOffset != 0 {
+		h.Write(buf[checksumOffset+4 : certEntryOffset])
+		h.Write(buf[certEntryOffset+8 : sizeOfHeaders])
+	} else {
+		h.Write(buf[checksumOffset+4 : sizeOfHeaders])
+	}
+
+	sorted := append([]peSectionHeader{}, sections...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].PointerToRawData < sorted[j].PointerToRawData
+	})
+	sumOfBytesHashed := uint64(sizeOfHeaders)
+	for _, s := range sorted {
+		if s.SizeOfRawData == 0 {
+			continue
+		}
+		start, end := uint64(s.PointerToRawData), uint64(s.PointerToRawData)+uint64(s.SizeOfRawData)
+		if end > buflen {
+			return nil, fmt.Errorf("section %q raw data [%#x:%#x] is beyond image size %#x",
+				bytes.TrimRight(s.Name[:], "\x00"), start, end, buflen)
+		}
+		h.Write(buf[start:end])
+		sumOfBytesHashed += uint64(s.SizeOfRawData)
+	}
+
+	// Hash trailing data which is not part of the certificate table.
+	if end := buflen - uint64(certDir.Size); end > sumOfBytesHashed && end <= buflen {
+		h.Write(buf[sumOfBytesHashed:end])
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2018 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+)
+
+// buildPE32Plus builds a small X64 PE32+ image with a single .text section
+// holding a CodeView debug entry.
+func buildPE32Plus() []byte {
+	const (
+		peOffset  = 0x80
+		optOffset = peOffset + 4 + 20
+		secOffset = optOffset + 0xf0
+	)
+	buf := make([]byte, 0x400)
+	copy(buf, "MZ")
+	binary.LittleEndian.PutUint32(buf[0x3c:], peOffset)
+	copy(buf[peOffset:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(buf[peOffset+4:], uint16(PEMachineX64))
+	binary.LittleEndian.PutUint16(buf[peOffset+6:], 1)     // NumberOfSections
+	binary.LittleEndian.PutUint16(buf[peOffset+20:], 0xf0) // SizeOfOptionalHeader
+
+	opt := buf[optOffset:]
+	binary.LittleEndian.PutUint16(opt, peOptionalMagicPE32Plus)
+	binary.LittleEndian.PutUint32(opt[16:], 0x1010) // AddressOfEntryPoint
+	binary.LittleEndian.PutUint64(opt[24:], 0x10000000)
+	binary.LittleEndian.PutUint32(opt[32:], 0x1000) // SectionAlignment
+	binary.LittleEndian.PutUint32(opt[36:], 0x200)  // FileAlignment
+	binary.LittleEndian.PutUint32(opt[56:], 0x2000) // SizeOfImage
+	binary.LittleEndian.PutUint32(opt[60:], 0x200)  // SizeOfHeaders
+	binary.LittleEndian.PutUint16(opt[68:], uint16(PESubsystemEFIBootServiceDriver))
+	binary.LittleEndian.PutUint32(opt[108:], 16) // NumberOfRvaAndSizes
+	binary.LittleEndian.PutUint32(opt[112+peDirectoryDebug*8:], 0x1100)
+	binary.LittleEndian.PutUint32(opt[112+peDirectoryDebug*8+4:], 28)
+
+	sec := buf[secOffset:]
+	copy(sec, ".text")
+	binary.LittleEndian.PutUint32(sec[8:], 0x200)   // VirtualSize
+	binary.LittleEndian.PutUint32(sec[12:], 0x1000) // VirtualAddress
+	binary.LittleEndian.PutUint32(sec[16:], 0x200)  // SizeOfRawData
+	binary.LittleEndian.PutUint32(sec[20:], 0x200)  // PointerToRawData
+	binary.LittleEndian.PutUint32(sec[36:], 0x60000020)
+
+	// Debug directory at RVA 0x1100 pointing at a RSDS entry at RVA 0x1120.
+	cv := append([]byte("RSDS"), make([]byte, 20)...)
+	cv = append(cv, "c:\\build\\X64\\Foo.pdb\x00"...)
+	dbg := buf[0x300:]
+	binary.LittleEndian.PutUint32(dbg[12:], peDebugTypeCodeView)
+	binary.LittleEndian.PutUint32(dbg[16:], uint32(len(cv)))
+	binary.LittleEndian.PutUint32(dbg[20:], 0x1120)
+	binary.LittleEndian.PutUint32(dbg[24:], 0x320)
+	copy(buf[0x320:], cv)
+	return buf
+}
+
+func TestParsePE32Plus(t *testing.T) {
+	buf := buildPE32Plus()
+	p, err := ParsePEImage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Format != PEFormatPE32Plus {
+		t.Errorf("format mismatch, expected %v, got %v", PEFormatPE32Plus, p.Format)
+	}
+	if p.Machine != PEMachineX64 || p.Subsystem != PESubsystemEFIBootServiceDriver {
+		t.Errorf("expected X64 EFI_BOOT_SERVICE_DRIVER, got %v %v", p.Machine, p.Subsystem)
+	}
+	if p.EntryPoint != 0x1010 || p.ImageBase != 0x10000000 {
+		t.Errorf("expected entry point 0x1010 and image base 0x10000000, got %#x and %#x", p.EntryPoint, p.ImageBase)
+	}
+	if len(p.Sections) != 1 || p.Sections[0].Name != ".text" {
+		t.Errorf("expected a single .text section, got %v", p.Sections)
+	}
+	if p.PDBPath != "c:\\build\\X64\\Foo.pdb" {
+		t.Errorf("PDB path mismatch, got %q", p.PDBPath)
+	}
+	if len(p.AuthenticodeSHA256) != 64 {
+		t.Fatalf("expected a SHA256 hex digest, got %q", p.AuthenticodeSHA256)
+	}
+
+	// The checksum does not take part in the Authenticode digest, the code does.
+	binary.LittleEndian.PutUint32(buf[0x80+4+20+64:], 0x12345678)
+	p2, err := ParsePEImage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2.AuthenticodeSHA256 != p.AuthenticodeSHA256 {
+		t.Errorf("checksum changed the digest from %v to %v", p.AuthenticodeSHA256, p2.AuthenticodeSHA256)
+	}
+	buf[0x200] ^= 0xff
+	p3, err := ParsePEImage(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p3.AuthenticodeSHA256 == p.AuthenticodeSHA256 {
+		t.Errorf("code change did not change the digest %v", p.AuthenticodeSHA256)
+	}
+}
+
+func TestParseTE(t *testing.T) {
+	th := teHeader{
+		Signature:           [2]uint8{'V', 'Z'},
+		Machine:             PEMachineI386,
+		NumberOfSections:    1,
+		Subsystem:           uint8(PESubsystemEFIBootServiceDriver),
+		StrippedSize:        0x1c0,
+		AddressOfEntryPoint: 0x240,
+		ImageBase:           0xFFF00000,
+	}
+	sec := peSectionHeader{VirtualAddress: 0x220, VirtualSize: 0x20, PointerToRawData: 0x220, SizeOfRawData: 0x20}
+	copy(sec.Name[:], ".text")
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, &th)
+	binary.Write(b, binary.LittleEndian, &sec)
+	b.Write(make([]byte, 0x20))
+
+	p, err := ParsePEImage(b.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := p.String(); s != "TE IA32 EFI_BOOT_SERVICE_DRIVER" {
+		t.Errorf("expected \"TE IA32 EFI_BOOT_SERVICE_DRIVER\", got %q", s)
+	}
+	if p.StrippedSize != 0x1c0 || p.ImageBase != 0xFFF00000 || p.EntryPoint != 0x240 {
+		t.Errorf("TE header mismatch, got %+v", p)
+	}
+	if p.AuthenticodeSHA256 != "" {
+		t.Errorf("TE images have no Authenticode digest, got %v", p.AuthenticodeSHA256)
+	}
+}
+
+func TestPEImageJSON(t *testing.T) {
+	p, err := ParsePEImage(buildPE32Plus())
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := json.Marshal(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte(`"Machine":"X64"`)) {
+		t.Errorf("expected machine name in JSON, got %s", b)
+	}
+	var p2 PEImage
+	if err := json.Unmarshal(b, &p2); err != nil {
+		t.Fatal(err)
+	}
+	if p2.Machine != p.Machine || p2.Subsystem != p.Subsystem {
+		t.Errorf("JSON round trip mismatch, expected %v, got %v", p, &p2)
+	}
+}
+
+func TestParsePEImageErrors(t *testing.T) {
+	for _, buf := range [][]byte{nil, []byte("banana"), []byte("MZbanana"), []byte("VZ")} {
+		if _, err := ParsePEImage(buf); err == nil {
+			t.Errorf("expected an error parsing %q", buf)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"unsafe"
 
 	"github.com/linuxboot/fiano/pkg/compression"
@@ -83,6 +84,10 @@ const (
 	GUIDEDSectionAuthStatusValid    GUIDEDSectionAttribute = 0x02
 )
 
+// CRC32GUID is the GUID of a GUID defined section which protects its payload
+// with a CRC32 checksum. The checksum directly follows the GUID defined header.
+var CRC32GUID = guid.MustParse("FC1BCDB0-7D31-49AA-936A-A4600D9DD083")
+
 // SectionHeader represents an EFI_COMMON_SECTION_HEADER as specified in
 // UEFI PI Spec 3.2.4 Firmware File Section
 type SectionHeader struct {
@@ -110,13 +115,51 @@ type SectionGUIDDefinedHeader struct {
 type SectionGUIDDefined struct {
 	SectionGUIDDefinedHeader
 
+	// CRC32 is only present in sections with the CRC32GUID.
+	CRC32 uint32 `json:",omitempty"`
+
 	// Metadata
 	Compression string
 }
 
 // GetBinHeaderLen returns the length of the binary typ specific header
 func (s *SectionGUIDDefined) GetBinHeaderLen() uint32 {
-	return uint32(unsafe.Sizeof(s.SectionGUIDDefinedHeader))
+	l := uint32(unsafe.Sizeof(s.SectionGUIDDefinedHeader))
+	if s.GUID == *CRC32GUID {
+		l += uint32(unsafe.Sizeof(s.CRC32))
+	}
+	return l
+}
+
+// CompressionType holds the compression type of an EFI_SECTION_COMPRESSION section.
+type CompressionType uint8
+
+// UEFI Compression Types
+const (
+	CompressionTypeNone     CompressionType = 0x00
+	CompressionTypeStandard CompressionType = 0x01
+)
+
+// SectionCompressionHeader contains the fields for a EFI_SECTION_COMPRESSION
+// encapsulated section header.
+type SectionCompressionHeader struct {
+	UncompressedLength uint32
+	CompressionType    CompressionType
+}
+
+// SectionCompression contains the type specific fields for a
+// EFI_SECTION_COMPRESSION section.
+type SectionCompression struct {
+	SectionCompressionHeader
+
+	// Metadata
+	Compression string
+}
+
+// GetBinHeaderLen returns the length of the binary typ specific header
+func (s *SectionCompression) GetBinHeaderLen() uint32 {
+	// The header is packed, so unsafe.Sizeof would count the padding.
+	return uint32(binary.Size(s.SectionCompressionHeader))
 }
 
 // TypeHeader interface forces type specific headers to report their length
@@ -131,6 +174,7 @@ type TypeSpecificHeader struct {
 }
 
 var headerTypes = map[SectionType]func() TypeHeader{
+	SectionTypeCompression: func() TypeHeader { return &SectionCompression{} },
 	SectionTypeGUIDDefined: func() TypeHeader { return &SectionGUIDDefined{} },
 }
 
@@ -209,8 +253,13 @@ type Section struct {
 	// For EFI_SECTION_DXE_DEPEX, EFI_SECTION_PEI_DEPEX, and EFI_SECTION_MM_DEPEX
 	DepEx []DepExOp `json:",omitempty"`
 
+	// For EFI_SECTION_PE32 and EFI_SECTION_TE
+	PE *PEImage `json:",omitempty"`
+
 	// Encapsulated firmware
 	Encapsulated []*TypedFirmware `json:",omitempty"`
+
+	dirtyState
 }
 
 // String returns the String value of the section if it makes sense,
@@ -221,6 +270,14 @@ func (s *Section) String() string {
 		return s.Name
 	case SectionTypeVersion:
 		return "Version " + s.Version
+	case SectionTypePE32, SectionTypeTE:
+		if s.PE != nil {
+			return s.PE.String()
+		}
+	case SectionTypeDXEDepEx, SectionTypePEIDepEx, SectionMMDepEx:
+		if text, err := DepExText(s.DepEx); err == nil {
+			return text
+		}
 	}
 	return ""
 }
@@ -229,6 +286,7 @@ func (s *Section) String() string {
 func (s *Section) SetType(t SectionType) {
 	s.Header.Type = t
 	s.Type = t.String()
+	s.MarkDirty()
 }
 
 // Buf returns the buffer.
@@ -241,6 +299,7 @@ func (s *Section) Buf() []byte {
 // Used mostly for things interacting with the Firmware interface.
 func (s *Section) SetBuf(buf []byte) {
 	s.buf = buf
+	s.MarkDirty()
 }
 
 // Apply calls the visitor on the Section.
@@ -281,16 +340,23 @@ func CreateSection(t SectionType, buf []byte, encap []Firmware, g *guid.GUID) (*
 		}
 		guidDefHeader := &SectionGUIDDefined{}
 		guidDefHeader.GUID = *g
-		switch *g {
-		case compression.LZMAGUID:
-			guidDefHeader.Compression = "LZMA"
-		case compression.LZMAX86GUID:
-			guidDefHeader.Compression = "LZMAX86"
-		default:
+		if *g == *CRC32GUID {
+			guidDefHeader.CRC32 = crc32.ChecksumIEEE(s.buf)
+			guidDefHeader.Attributes = uint16(GUIDEDSectionAuthStatusValid)
+			s.TypeSpecific = &TypeSpecificHeader{SectionTypeGUIDDefined, guidDefHeader}
+			break
+		}
+		if compressor := compression.CompressorFromGUID(g); compressor != nil {
+			guidDefHeader.Compression = compressor.Name()
+		} else {
 			guidDefHeader.Compression = "UNKNOWN"
 		}
 		guidDefHeader.Attributes = uint16(GUIDEDSectionProcessingRequired)
 		s.TypeSpecific = &TypeSpecificHeader{SectionTypeGUIDDefined, guidDefHeader}
+
+	case SectionTypePE32, SectionTypeTE:
+		// Like NewSection, leave PE nil if the image can not be parsed.
+		s.PE, _ = ParsePEImage(s.buf)
 	}
 
 	return s, nil
@@ -302,6 +368,7 @@ func CreateSection(t SectionType, buf []byte, encap []Firmware, g *guid.GUID) (*
 // It modifies the calling Section.
 func (s *Section) GenSecHeader() error {
 	var err error
+	s.MarkDirty()
 	// Calculate size
 	headerLen := uint32(SectionMinLength)
 	if s.TypeSpecific != nil && s.TypeSpecific.Header != nil {
@@ -313,16 +380,29 @@ func (s *Section) GenSecHeader() error {
 		s.Header.ExtendedSize += 4
 	}
 
-	// Set the correct data offset for GUID Defined headers.
-	// This is terrible
-	if s.Header.Type == SectionTypeGUIDDefined {
+	// Append the type specific header in front of the data.
+	switch s.Header.Type {
+	case SectionTypeGUIDDefined:
+		// Set the correct data offset for GUID Defined headers.
+		// This is terrible
 		gd := s.TypeSpecific.Header.(*SectionGUIDDefined)
 		gd.DataOffset = uint16(headerLen)
-		// append type specific header in front of data
 		tsh := new(bytes.Buffer)
 		if err = binary.Write(tsh, binary.LittleEndian, &gd.SectionGUIDDefinedHeader); err != nil {
 			return err
 		}
+		if gd.GUID == *CRC32GUID {
+			if err = binary.Write(tsh, binary.LittleEndian, gd.CRC32); err != nil {
+				return err
+			}
+		}
+		s.buf = append(tsh.Bytes(), s.buf...)
+	case SectionTypeCompression:
+		c := s.TypeSpecific.Header.(*SectionCompression)
+		tsh := new(bytes.Buffer)
+		if err = binary.Write(tsh, binary.LittleEndian, &c.SectionCompressionHeader); err != nil {
+			return err
+		}
 		s.buf = append(tsh.Bytes(), s.buf...)
 	}
 
@@ -345,6 +425,7 @@ func (s *Section) GenSecHeader() error {
 // object, if a valid one is passed, or an error.
 func NewSection(buf []byte, fileOrder int) (*Section, error) {
 	s := Section{FileOrder: fileOrder}
+	s.markClean()
 	// Read in standard header.
 	r := bytes.NewReader(buf)
 	if err := binary.Read(r, binary.LittleEndian, &s.Header.SectionHeader); err != nil {
@@ -392,14 +473,27 @@ func NewSection(buf []byte, fileOrder int) (*Section, error) {
 			return nil, err
 		}
 		s.TypeSpecific = &TypeSpecificHeader{Type: SectionTypeGUIDDefined, Header: typeSpec}
+		if uint32(typeSpec.DataOffset) > s.Header.ExtendedSize {
+			return nil, fmt.Errorf("guid defined section data offset %#x is beyond section size %#x",
+				typeSpec.DataOffset, s.Header.ExtendedSize)
+		}
 
 		// Determine how to interpret the section based on the GUID.
 		var encapBuf []byte
-		if typeSpec.Attributes&uint16(GUIDEDSectionProcessingRequired) != 0 && !DisableDecompression {
+		if typeSpec.GUID == *CRC32GUID {
+			if err := binary.Read(r, binary.LittleEndian, &typeSpec.CRC32); err != nil {
+				return nil, err
+			}
+			encapBuf = s.buf[typeSpec.DataOffset:]
+			if sum := crc32.ChecksumIEEE(encapBuf); sum != typeSpec.CRC32 {
+				log.Warnf("CRC32 section checksum mismatch, header has %#08x, data has %#08x",
+					typeSpec.CRC32, sum)
+			}
+		} else if typeSpec.Attributes&uint16(GUIDEDSectionProcessingRequired) != 0 && !DisableDecompression {
 			if compressor := compression.CompressorFromGUID(&typeSpec.GUID); compressor != nil {
 				typeSpec.Compression = compressor.Name()
 				var err error
-				encapBuf, err = compressor.Decode(buf[typeSpec.DataOffset:])
+				encapBuf, err = compressor.Decode(s.buf[typeSpec.DataOffset:])
 				if err != nil {
 					log.Errorf("%v", err)
 					typeSpec.Compression = "UNKNOWN"
@@ -410,16 +504,61 @@ func NewSection(buf []byte, fileOrder int) (*Section, error) {
 			}
 		}
 
-		for i, offset := 0, uint64(0); offset < uint64(len(encapBuf)); i++ {
-			encapS, err := NewSection(encapBuf[offset:], i)
-			if err != nil {
-				return nil, fmt.Errorf("error parsing encapsulated section #%d at offset %d: %v",
-					i, offset, err)
+		if err := s.parseEncapsulated(encapBuf); err != nil {
+			return nil, err
+		}
+
+	case SectionTypeCompression:
+		typeSpec := &SectionCompression{}
+		if err := binary.Read(r, binary.LittleEndian, &typeSpec.SectionCompressionHeader); err != nil {
+			return nil, err
+		}
+		s.TypeSpecific = &TypeSpecificHeader{Type: SectionTypeCompression, Header: typeSpec}
+
+		dataOffset := uint32(headerSize) + typeSpec.GetBinHeaderLen()
+		if s.Header.ExtendedSize < dataOffset {
+			return nil, fmt.Errorf("compression section too small, has size %v, header needs %v bytes",
+				s.Header.ExtendedSize, dataOffset)
+		}
+		data := s.buf[dataOffset:]
+		switch typeSpec.CompressionType {
+		case CompressionTypeNone:
+			typeSpec.Compression = "NONE"
+			if err := s.parseEncapsulated(data); err != nil {
+				return nil, err
+			}
+		case CompressionTypeStandard:
+			if DisableDecompression {
+				break
+			}
+			// The header does not tell EFI and Tiano compression apart, so
+			// try both and keep the first one which yields valid sections.
+			typeSpec.Compression = "UNKNOWN"
+			// Both formats start with the compressed and original sizes.
+			// Skip decoding when the original size disagrees with the
+			// section header.
+			if len(data) < 8 || binary.LittleEndian.Uint32(data[4:8]) != typeSpec.UncompressedLength {
+				log.Errorf("compressed data does not match uncompressed length %#x of the section header",
+					typeSpec.UncompressedLength)
+				break
+			}
+			for _, compressor := range compression.StandardCompressors() {
+				encapBuf, err := compressor.Decode(data)
+				if err != nil || uint32(len(encapBuf)) != typeSpec.UncompressedLength {
+					continue
+				}
+				if err := s.parseEncapsulated(encapBuf); err != nil {
+					s.Encapsulated = nil
+					continue
+				}
+				typeSpec.Compression = compressor.Name()
+				break
+			}
+			if typeSpec.Compression == "UNKNOWN" {
+				log.Errorf("unable to decompress section with EFI or Tiano compression")
 			}
-			// Align to 4 bytes for now. The PI Spec doesn't say what alignment it should be
-			// but UEFITool aligns to 4 bytes, and this seems to work on everything I have.
-			offset = Align4(offset + uint64(encapS.Header.ExtendedSize))
-			s.Encapsulated = append(s.Encapsulated, MakeTyped(encapS))
+		default:
+			typeSpec.Compression = "UNKNOWN"
 		}
 
 	case SectionTypeUserInterface:
@@ -441,11 +580,41 @@ func NewSection(buf []byte, fileOrder int) (*Section, error) {
 		if s.DepEx, err = parseDepEx(s.buf[headerSize:]); err != nil {
 			log.Warnf("%v", err)
 		}
+
+	case SectionTypePE32, SectionTypeTE:
+		var err error
+		if s.PE, err = ParsePEImage(s.buf[headerSize:]); err != nil {
+			log.Warnf("%v", err)
+		}
 	}
 
 	return &s, nil
 }
 
+// parseEncapsulated parses the sections encapsulated in buf and appends them to
+// the section.
+func (s *Section) parseEncapsulated(buf []byte) error {
+	offsets := sectionOffsets(buf)
+	encap := make([]*TypedFirmware, len(offsets))
+	err := parseEach(len(offsets), func(i int) error {
+		encapS, err := NewSection(buf[offsets[i]:], i)
+		if err != nil {
+			return fmt.Errorf("error parsing encapsulated section #%d at offset %d: %v",
+				i, offsets[i], err)
+		}
+		if encapS.Header.ExtendedSize == 0 {
+			return fmt.Errorf("invalid length of encapsulated section #%d at offset %d", i, offsets[i])
+		}
+		encap[i] = MakeTyped(encapS)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	s.Encapsulated = append(s.Encapsulated, encap...)
+	return nil
+}
+
 func parseDepEx(b []byte) ([]DepExOp, error) {
 	depEx := []DepExOp{}
 	r := bytes.NewBuffer(b)
@@ -6,9 +6,11 @@ package uefi
 
 import (
 	"fmt"
+	"hash/crc32"
 	"reflect"
 	"testing"
 
+	"github.com/linuxboot/fiano/pkg/compression"
 	"github.com/linuxboot/fiano/pkg/guid"
 )
 
@@ -220,3 +222,137 @@ func TestParseDepEx(t *testing.T) {
 		})
 	}
 }
+
+func TestCompressionSection(t *testing.T) {
+	var tests = []struct {
+		name        string
+		compType    CompressionType
+		compressor  compression.Compressor
+		compression string
+	}{
+		{"none", CompressionTypeNone, nil, "NONE"},
+		{"EFI", CompressionTypeStandard, &compression.EFI{}, "EFI"},
+		{"Tiano", CompressionTypeStandard, &compression.Tiano{}, "TIANO"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := linuxSec
+			if test.compressor != nil {
+				var err error
+				if data, err = test.compressor.Encode(linuxSec); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Build the section by hand: common header, compression header, data.
+			size := SectionMinLength + 5 + len(data)
+			buf := []byte{byte(size), byte(size >> 8), byte(size >> 16), byte(SectionTypeCompression)}
+			buf = append(buf, byte(len(linuxSec)), 0, 0, 0, byte(test.compType))
+			buf = append(buf, data...)
+
+			s, err := NewSection(buf, 0)
+			if err != nil {
+				t.Fatalf("Unable to parse section object %v, got %v", buf, err)
+			}
+			ts, ok := s.TypeSpecific.Header.(*SectionCompression)
+			if !ok {
+				t.Fatalf("expected compression type specific header, got %T", s.TypeSpecific.Header)
+			}
+			if ts.Compression != test.compression {
+				t.Errorf("Compression mismatch, expected %q, got %q", test.compression, ts.Compression)
+			}
+			if len(s.Encapsulated) != 1 {
+				t.Fatalf("expected 1 encapsulated section, got %d", len(s.Encapsulated))
+			}
+			if name := s.Encapsulated[0].Value.(*Section).Name; name != "Linux" {
+				t.Errorf("encapsulated section name mismatch, expected \"Linux\", got %q", name)
+			}
+		})
+	}
+}
+
+// reverseCompressor is a trivial codec registered from outside the
+// compression package.
+type reverseCompressor struct{}
+
+func (c *reverseCompressor) Name() string {
+	return "REVERSE"
+}
+
+func (c *reverseCompressor) Decode(encodedData []byte) ([]byte, error) {
+	decodedData := make([]byte, len(encodedData))
+	for i, b := range encodedData {
+		decodedData[len(encodedData)-1-i] = b
+	}
+	return decodedData, nil
+}
+
+func (c *reverseCompressor) Encode(decodedData []byte) ([]byte, error) {
+	return c.Decode(decodedData)
+}
+
+func TestRegisteredGUIDDefinedSection(t *testing.T) {
+	reverseGUID := guid.MustParse("7E577E57-0123-4567-89AB-CDEF00000002")
+	compression.RegisterCompressor(*reverseGUID, func(cfg compression.Config) compression.Compressor {
+		return &reverseCompressor{}
+	})
+
+	data, _ := (&reverseCompressor{}).Encode(linuxSec)
+	size := SectionMinLength + 20 + len(data)
+	buf := []byte{byte(size), byte(size >> 8), byte(size >> 16), byte(SectionTypeGUIDDefined)}
+	buf = append(buf, reverseGUID[:]...)
+	buf = append(buf, SectionMinLength+20, 0, byte(GUIDEDSectionProcessingRequired), 0)
+	buf = append(buf, data...)
+
+	s, err := NewSection(buf, 0)
+	if err != nil {
+		t.Fatalf("Unable to parse section object %v, got %v", buf, err)
+	}
+	if c := s.TypeSpecific.Header.(*SectionGUIDDefined).Compression; c != "REVERSE" {
+		t.Errorf("Compression mismatch, expected \"REVERSE\", got %q", c)
+	}
+	if len(s.Encapsulated) != 1 {
+		t.Fatalf("expected 1 encapsulated section, got %d", len(s.Encapsulated))
+	}
+	if name := s.Encapsulated[0].Value.(*Section).Name; name != "Linux" {
+		t.Errorf("encapsulated section name mismatch, expected \"Linux\", got %q", name)
+	}
+}
+
+func TestCRC32Section(t *testing.T) {
+	size := SectionMinLength + 24 + len(linuxSec)
+	buf := []byte{byte(size), byte(size >> 8), byte(size >> 16), byte(SectionTypeGUIDDefined)}
+	buf = append(buf, CRC32GUID[:]...)
+	buf = append(buf, SectionMinLength+24, 0, byte(GUIDEDSectionAuthStatusValid), 0)
+	sum := crc32.ChecksumIEEE(linuxSec)
+	buf = append(buf, byte(sum), byte(sum>>8), byte(sum>>16), byte(sum>>24))
+	buf = append(buf, linuxSec...)
+
+	// The buffer passed to NewSection also holds the following sections,
+	// which must not be encapsulated.
+	for _, sibling := range [][]byte{nil, linuxSec} {
+		s, err := NewSection(append(append([]byte{}, buf...), sibling...), 0)
+		if err != nil {
+			t.Fatalf("Unable to parse section object %v, got %v", buf, err)
+		}
+		ts := s.TypeSpecific.Header.(*SectionGUIDDefined)
+		if ts.CRC32 != sum {
+			t.Errorf("CRC32 mismatch, expected %#08x, got %#08x", sum, ts.CRC32)
+		}
+		if ts.GetBinHeaderLen() != 24 {
+			t.Errorf("header length mismatch, expected 24, got %d", ts.GetBinHeaderLen())
+		}
+		if len(s.Encapsulated) != 1 {
+			t.Fatalf("expected 1 encapsulated section, got %d", len(s.Encapsulated))
+		}
+		if name := s.Encapsulated[0].Value.(*Section).Name; name != "Linux" {
+			t.Errorf("encapsulated section name mismatch, expected \"Linux\", got %q", name)
+		}
+	}
+
+	// The data offset must be within the section.
+	bad := append([]byte{}, buf...)
+	bad[20] = byte(size + 1)
+	if _, err := NewSection(append(bad, linuxSec...), 0); err == nil {
+		t.Error("expected an error for a data offset beyond the section")
+	}
+}
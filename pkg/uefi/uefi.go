@@ -12,6 +12,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"reflect"
+	"runtime"
 )
 
 var (
@@ -29,6 +30,11 @@ var (
 	// WILL MODIFY A FIRMWARE WITH THIS OPTION BEING ENABLED, THIS FIRMWARE
 	// MIGHT BRICK YOUR DEVICE.
 	DisableDecompression = false
+
+	// ParseJobs is the number of goroutines decompressing and parsing the
+	// files and sections of an image concurrently. Images are parsed
+	// serially if it is less than 2. The parsed tree does not depend on it.
+	ParseJobs = runtime.NumCPU()
 )
 
 // ROMAttributes is used to hold global variables that apply across the whole image.
@@ -0,0 +1,353 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Globally defined variables are described in the UEFI specification, section
+// 3.3 and the signature database in section 32.4.1.
+
+package uefi
+
+import (
+	"bytes"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+)
+
+// Variable vendor GUIDs
+var (
+	// EFIGlobalVariableGUID is the vendor GUID of the architecturally defined
+	// variables.
+	EFIGlobalVariableGUID = guid.MustParse("8BE4DF61-93CA-11D2-AA0D-00E098032B8C")
+	// ImageSecurityDatabaseGUID is the vendor GUID of the db and dbx
+	// variables.
+	ImageSecurityDatabaseGUID = guid.MustParse("D719B2CB-3D3A-4596-A3BC-DAD00E67656F")
+)
+
+// Signature types
+var (
+	CertSHA1GUID       = guid.MustParse("826CA512-CF10-4AC9-B187-BE01496631BD")
+	CertSHA256GUID     = guid.MustParse("C1C41626-504C-4092-ACA9-41F936934328")
+	CertSHA384GUID     = guid.MustParse("FF3E5307-9FD0-48C9-85F1-8AD56C701E01")
+	CertSHA512GUID     = guid.MustParse("093E0FAE-A6C4-4F50-9F1B-D41E2B89C19A")
+	CertRSA2048GUID    = guid.MustParse("3C5766E8-269C-4E34-AA14-ED776E85B3B6")
+	CertX509GUID       = guid.MustParse("A5C059A1-94E4-4AA7-87B5-AB155C2BF072")
+	CertX509SHA256GUID = guid.MustParse("3BD2A492-96C0-4079-B420-FCF98EF103ED")
+	CertX509SHA384GUID = guid.MustParse("7076876E-80C2-4EE6-AAD2-28B349A6865B")
+	CertX509SHA512GUID = guid.MustParse("446DBF63-2502-4CDA-BCFA-2465D2B0FE9D")
+)
+
+// SignatureTypeNames maps signature types to their names.
+var SignatureTypeNames = map[guid.GUID]string{
+	*CertSHA1GUID:       "SHA1",
+	*CertSHA256GUID:     "SHA256",
+	*CertSHA384GUID:     "SHA384",
+	*CertSHA512GUID:     "SHA512",
+	*CertRSA2048GUID:    "RSA2048",
+	*CertX509GUID:       "X509",
+	*CertX509SHA256GUID: "X509_SHA256",
+	*CertX509SHA384GUID: "X509_SHA384",
+	*CertX509SHA512GUID: "X509_SHA512",
+}
+
+// hashSignatureTypes are the signature types holding a plain hash.
+var hashSignatureTypes = map[guid.GUID]bool{
+	*CertSHA1GUID:   true,
+	*CertSHA256GUID: true,
+	*CertSHA384GUID: true,
+	*CertSHA512GUID: true,
+}
+
+// Signature is an EFI_SIGNATURE_DATA. Depending on the type of the list, the
+// data is a hash, a certificate or raw data.
+type Signature struct {
+	Owner guid.GUID
+	// Hex encoded hash for hash signature types.
+	Hash string `json:",omitempty"`
+	// DER encoded certificate for X509 signature types and its decoded
+	// subject and issuer.
+	Certificate []byte `json:",omitempty"`
+	Subject     string `json:",omitempty"`
+	Issuer      string `json:",omitempty"`
+	// Other signature types
+	Data []byte `json:",omitempty"`
+}
+
+// Bytes returns the signature data without the owner.
+func (s *Signature) Bytes() []byte {
+	switch {
+	case s.Hash != "":
+		b, _ := hex.DecodeString(s.Hash)
+		return b
+	case s.Certificate != nil:
+		return s.Certificate
+	}
+	return s.Data
+}
+
+// SignatureList is an EFI_SIGNATURE_LIST.
+type SignatureList struct {
+	Type       guid.GUID
+	TypeName   string `json:",omitempty"`
+	Header     []byte `json:",omitempty"`
+	Signatures []*Signature
+}
+
+type signatureListHeader struct {
+	Type       guid.GUID
+	ListSize   uint32
+	HeaderSize uint32
+	Size       uint32
+}
+
+// ParseSignatureLists parses a signature database, as found in the PK, KEK,
+// db and dbx variables.
+func ParseSignatureLists(buf []byte) ([]*SignatureList, error) {
+	var lists []*SignatureList
+	for len(buf) > 0 {
+		var h signatureListHeader
+		if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &h); err != nil {
+			return nil, fmt.Errorf("unable to read signature list header: %v", err)
+		}
+		hLen := uint32(binary.Size(h))
+		if h.ListSize > uint32(len(buf)) || h.ListSize < hLen || h.HeaderSize > h.ListSize-hLen {
+			return nil, fmt.Errorf("invalid signature list size %#x, header size %#x, %#x bytes remaining",
+				h.ListSize, h.HeaderSize, len(buf))
+		}
+		sigs := buf[hLen+h.HeaderSize : h.ListSize]
+		if h.Size < uint32(guid.Size) || uint32(len(sigs))%h.Size != 0 {
+			return nil, fmt.Errorf("invalid signature size %#x for signatures of %#x bytes", h.Size, len(sigs))
+		}
+		l := &SignatureList{
+			Type:     h.Type,
+			TypeName: SignatureTypeNames[h.Type],
+		}
+		if h.HeaderSize > 0 {
+			l.Header = append([]byte{}, buf[hLen:hLen+h.HeaderSize]...)
+		}
+		for ; len(sigs) > 0; sigs = sigs[h.Size:] {
+			s := &Signature{}
+			copy(s.Owner[:], sigs)
+			data := append([]byte{}, sigs[guid.Size:h.Size]...)
+			switch {
+			case hashSignatureTypes[h.Type]:
+				s.Hash = hex.EncodeToString(data)
+			case h.Type == *CertX509GUID:
+				s.Certificate = data
+				if c, err := x509.ParseCertificate(data); err == nil {
+					s.Subject = c.Subject.String()
+					s.Issuer = c.Issuer.String()
+				}
+			default:
+				s.Data = data
+			}
+			l.Signatures = append(l.Signatures, s)
+		}
+		lists = append(lists, l)
+		buf = buf[h.ListSize:]
+	}
+	return lists, nil
+}
+
+// AssembleSignatureLists returns the binary of a signature database. Lists
+// without signatures are skipped.
+func AssembleSignatureLists(lists []*SignatureList) ([]byte, error) {
+	buf := new(bytes.Buffer)
+	for _, l := range lists {
+		if len(l.Signatures) == 0 {
+			continue
+		}
+		size := len(l.Signatures[0].Bytes())
+		for _, s := range l.Signatures {
+			if len(s.Bytes()) != size {
+				return nil, fmt.Errorf("signatures of %v list have different sizes, %#x and %#x",
+					l.Type, size, len(s.Bytes()))
+			}
+		}
+		size += guid.Size
+		h := signatureListHeader{
+			Type:       l.Type,
+			HeaderSize: uint32(len(l.Header)),
+			Size:       uint32(size),
+		}
+		h.ListSize = uint32(binary.Size(h)+len(l.Header)) + h.Size*uint32(len(l.Signatures))
+		if err := binary.Write(buf, binary.LittleEndian, h); err != nil {
+			return nil, err
+		}
+		buf.Write(l.Header)
+		for _, s := range l.Signatures {
+			buf.Write(s.Owner[:])
+			buf.Write(s.Bytes())
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// Load option attributes
+const (
+	LoadOptionActive         uint32 = 0x00000001
+	LoadOptionForceReconnect uint32 = 0x00000002
+	LoadOptionHidden         uint32 = 0x00000008
+	LoadOptionCategoryApp    uint32 = 0x00000100
+)
+
+// LoadOption is an EFI_LOAD_OPTION, as found in the Boot####, Driver####,
+// SysPrep#### and PlatformRecovery#### variables.
+type LoadOption struct {
+	Attributes   uint32
+	Description  string
+	FilePaths    []string
+	OptionalData []byte `json:",omitempty"`
+}
+
+// ParseLoadOption parses a load option.
+func ParseLoadOption(buf []byte) (*LoadOption, error) {
+	if len(buf) < 6 {
+		return nil, fmt.Errorf("load option too small, got %#x bytes", len(buf))
+	}
+	o := &LoadOption{Attributes: binary.LittleEndian.Uint32(buf)}
+	pathLen := int(binary.LittleEndian.Uint16(buf[4:]))
+	buf = buf[6:]
+	end := -1
+	for i := 0; i+1 < len(buf); i += 2 {
+		if buf[i] == 0 && buf[i+1] == 0 {
+			end = i
+			break
+		}
+	}
+	if end == -1 {
+		return nil, errors.New("load option description is not terminated")
+	}
+	o.Description = ucs2String(buf[:end])
+	buf = buf[end+2:]
+	if pathLen > len(buf) {
+		return nil, fmt.Errorf("load option file path list length %#x bigger than remaining size %#x", pathLen, len(buf))
+	}
+	// The list holds several device paths, each with its end node.
+	for paths := buf[:pathLen]; len(paths) > 0; {
+		p, rest, err := parseDevicePaths(paths)
+		if err != nil {
+			return nil, err
+		}
+		for _, i := range p {
+			o.FilePaths = append(o.FilePaths, i.String())
+		}
+		paths = rest
+	}
+	if len(buf) > pathLen {
+		o.OptionalData = append([]byte{}, buf[pathLen:]...)
+	}
+	return o, nil
+}
+
+// VariableValue holds the decoded value of a well-known variable. Only the
+// field matching the variable is set.
+type VariableValue struct {
+	// BootOrder, DriverOrder and SysPrepOrder
+	Order []uint16 `json:",omitempty"`
+	// Boot####, Driver####, SysPrep#### and PlatformRecovery####
+	LoadOption *LoadOption `json:",omitempty"`
+	// Timeout
+	Timeout *uint16 `json:",omitempty"`
+	// ConIn, ConOut, ErrOut and the matching Dev variables
+	DevicePaths []string `json:",omitempty"`
+	// SecureBoot
+	SecureBoot *uint8 `json:",omitempty"`
+	// PK, KEK, db and dbx
+	SignatureLists []*SignatureList `json:",omitempty"`
+	// Lang and PlatformLang
+	Lang string `json:",omitempty"`
+
+	// Set when the data does not match the format of the variable.
+	Error string `json:",omitempty"`
+}
+
+var loadOptionName = regexp.MustCompile(`^(Boot|Driver|SysPrep|PlatformRecovery)[0-9A-F]{4}$`)
+
+// DecodeVariable decodes the data of well-known variables. It returns nil for
+// other variables.
+func DecodeVariable(name string, g guid.GUID, data []byte) *VariableValue {
+	var decode func(v *VariableValue, data []byte) error
+	switch g {
+	case *EFIGlobalVariableGUID:
+		switch {
+		case name == "BootOrder" || name == "DriverOrder" || name == "SysPrepOrder":
+			decode = decodeOrder
+		case loadOptionName.MatchString(name):
+			decode = func(v *VariableValue, data []byte) (err error) {
+				v.LoadOption, err = ParseLoadOption(data)
+				return err
+			}
+		case name == "Timeout":
+			decode = func(v *VariableValue, data []byte) error {
+				if len(data) != 2 {
+					return fmt.Errorf("expected 2 bytes, got %#x", len(data))
+				}
+				t := binary.LittleEndian.Uint16(data)
+				v.Timeout = &t
+				return nil
+			}
+		case name == "ConIn" || name == "ConOut" || name == "ErrOut" ||
+			name == "ConInDev" || name == "ConOutDev" || name == "ErrOutDev":
+			decode = func(v *VariableValue, data []byte) error {
+				p, err := ParseDevicePaths(data)
+				if err != nil {
+					return err
+				}
+				for _, i := range p {
+					v.DevicePaths = append(v.DevicePaths, i.String())
+				}
+				return nil
+			}
+		case name == "SecureBoot":
+			decode = func(v *VariableValue, data []byte) error {
+				if len(data) != 1 {
+					return fmt.Errorf("expected 1 byte, got %#x", len(data))
+				}
+				v.SecureBoot = &data[0]
+				return nil
+			}
+		case name == "PK" || name == "KEK":
+			decode = decodeSignatureLists
+		case name == "Lang" || name == "PlatformLang":
+			decode = func(v *VariableValue, data []byte) error {
+				v.Lang = strings.TrimRight(string(data), "\x00")
+				return nil
+			}
+		}
+	case *ImageSecurityDatabaseGUID:
+		if name == "db" || name == "dbx" {
+			decode = decodeSignatureLists
+		}
+	}
+	if decode == nil {
+		return nil
+	}
+	v := &VariableValue{}
+	if err := decode(v, append([]byte{}, data...)); err != nil {
+		return &VariableValue{Error: err.Error()}
+	}
+	return v
+}
+
+func decodeOrder(v *VariableValue, data []byte) error {
+	if len(data)%2 != 0 {
+		return fmt.Errorf("odd length %#x", len(data))
+	}
+	v.Order = make([]uint16, len(data)/2)
+	for i := range v.Order {
+		v.Order[i] = binary.LittleEndian.Uint16(data[2*i:])
+	}
+	return nil
+}
+
+func decodeSignatureLists(v *VariableValue, data []byte) (err error) {
+	v.SignatureLists, err = ParseSignatureLists(data)
+	return err
+}
@@ -0,0 +1,238 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefi
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/unicode"
+)
+
+// dpNode builds a device path node.
+func dpNode(t DevicePathType, subType uint8, data ...interface{}) []byte {
+	b := new(bytes.Buffer)
+	for _, d := range data {
+		binary.Write(b, binary.LittleEndian, d)
+	}
+	return append([]byte{byte(t), subType, byte(b.Len() + 4), byte((b.Len() + 4) >> 8)}, b.Bytes()...)
+}
+
+var (
+	dpEndInstance = dpNode(DevicePathTypeEnd, DevicePathEndInstance)
+	dpEnd         = dpNode(DevicePathTypeEnd, DevicePathEndEntire)
+	dpPartGUID    = guid.MustParse("01234567-89AB-CDEF-0123-456789ABCDEF")
+	dpFvGUID      = guid.MustParse("7C04A583-9E3E-4F1C-AD65-E05268D0B4D1")
+)
+
+func testDevicePath() []byte {
+	var p []byte
+	p = append(p, dpNode(DevicePathTypeACPI, 0x01, uint32(0x0A0341D0), uint32(0))...)
+	p = append(p, dpNode(DevicePathTypeHardware, 0x01, uint8(2), uint8(0x1F))...)
+	p = append(p, dpNode(DevicePathTypeMessaging, 0x12, uint16(0), uint16(0xFFFF), uint16(0))...)
+	p = append(p, dpNode(DevicePathTypeMedia, 0x01, uint32(1), uint64(0x800), uint64(0x100000), *dpPartGUID, uint8(2), uint8(2))...)
+	p = append(p, dpNode(DevicePathTypeMedia, 0x04, unicode.UTF8ToUCS2(`\EFI\BOOT\BOOTX64.EFI`))...)
+	return p
+}
+
+const testDevicePathText = `PciRoot(0x0)/Pci(0x1f,0x2)/Sata(0x0,0xffff,0x0)/HD(1,GPT,01234567-89AB-CDEF-0123-456789ABCDEF,0x800,0x100000)/\EFI\BOOT\BOOTX64.EFI`
+
+func TestParseDevicePaths(t *testing.T) {
+	var tests = []struct {
+		name  string
+		buf   []byte
+		paths []string
+		msg   string
+	}{
+		{"empty", []byte{}, nil, "device path end node not found"},
+		{"badLength", []byte{1, 1, 2, 0}, nil, "invalid device path node length 0x2, 0x4 bytes remaining"},
+		{"noEnd", dpNode(DevicePathTypeHardware, 0x05, uint32(1)), nil, "device path end node not found"},
+		{"file", append(testDevicePath(), dpEnd...), []string{testDevicePathText}, ""},
+		{"instances", append(append(append(
+			dpNode(DevicePathTypeACPI, 0x01, uint32(0x050141D0), uint32(1)),
+			dpEndInstance...),
+			dpNode(DevicePathTypeMedia, 0x07, *dpFvGUID)...),
+			append(dpNode(DevicePathTypeMedia, 0x06, *dpFvGUID), dpEnd...)...),
+			[]string{"Acpi(PNP0501,0x1)", "Fv(7C04A583-9E3E-4F1C-AD65-E05268D0B4D1)/FvFile(7C04A583-9E3E-4F1C-AD65-E05268D0B4D1)"}, ""},
+		{"unknown", append(append(
+			dpNode(DevicePathTypeMessaging, 0x05, uint8(1), uint8(0)),
+			dpNode(DevicePathType(0x42), 0x01, uint16(0xABCD))...),
+			dpEnd...),
+			[]string{"USB(0x1,0x0)/Path(66,1,CDAB)"}, ""},
+		{"short", append(dpNode(DevicePathTypeHardware, 0x01, uint8(2)), dpEnd...), []string{"Path(1,1,02)"}, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			paths, err := ParseDevicePaths(test.buf)
+			if err == nil && test.msg != "" {
+				t.Fatalf("Error was not returned, expected %v", test.msg)
+			} else if err != nil && err.Error() != test.msg {
+				t.Fatalf("Mismatched Error returned, expected \n%v\n got \n%v\n", test.msg, err.Error())
+			} else if err != nil {
+				return
+			}
+			var s []string
+			for _, p := range paths {
+				s = append(s, p.String())
+			}
+			if !reflect.DeepEqual(s, test.paths) {
+				t.Errorf("Wrong device paths, expected \n%q\n got \n%q", test.paths, s)
+			}
+		})
+	}
+}
+
+func loadOption(attributes uint32, desc string, paths []byte, optional []byte) []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, attributes)
+	binary.Write(b, binary.LittleEndian, uint16(len(paths)))
+	b.Write(unicode.UTF8ToUCS2(desc))
+	b.Write(paths)
+	b.Write(optional)
+	return b.Bytes()
+}
+
+func testCertificate(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test DB Key"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).AddDate(100, 0, 0),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// signatureList builds an EFI_SIGNATURE_LIST of same sized signatures.
+func signatureList(sigType *guid.GUID, owner *guid.GUID, sigs ...[]byte) []byte {
+	b := new(bytes.Buffer)
+	size := guid.Size + len(sigs[0])
+	binary.Write(b, binary.LittleEndian, signatureListHeader{
+		Type:     *sigType,
+		ListSize: uint32(28 + size*len(sigs)),
+		Size:     uint32(size),
+	})
+	for _, s := range sigs {
+		b.Write(owner[:])
+		b.Write(s)
+	}
+	return b.Bytes()
+}
+
+func TestDecodeVariable(t *testing.T) {
+	u16 := func(v uint16) *uint16 { return &v }
+	u8 := func(v uint8) *uint8 { return &v }
+	hash := bytes.Repeat([]byte{0xAB}, 32)
+	cert := testCertificate(t)
+	db := append(signatureList(CertSHA256GUID, EFIGlobalVariableGUID, hash, hash),
+		signatureList(CertX509GUID, ImageSecurityDatabaseGUID, cert)...)
+
+	var tests = []struct {
+		name  string
+		guid  *guid.GUID
+		data  []byte
+		value *VariableValue
+	}{
+		{"BootOrder", EFIGlobalVariableGUID, []byte{1, 0, 0, 0, 0x80, 0}, &VariableValue{Order: []uint16{1, 0, 0x80}}},
+		{"BootOrder", EFIGlobalVariableGUID, []byte{1, 0, 0}, &VariableValue{Error: "odd length 0x3"}},
+		{"BootOrder", FFGUID, []byte{1, 0}, nil},
+		{"Setup", EFIGlobalVariableGUID, []byte{1, 0}, nil},
+		{"Boot0001", EFIGlobalVariableGUID,
+			loadOption(LoadOptionActive, "UEFI OS", append(testDevicePath(), dpEnd...), []byte{1, 2}),
+			&VariableValue{LoadOption: &LoadOption{
+				Attributes:   LoadOptionActive,
+				Description:  "UEFI OS",
+				FilePaths:    []string{testDevicePathText},
+				OptionalData: []byte{1, 2},
+			}}},
+		{"Driver00A0", EFIGlobalVariableGUID,
+			loadOption(LoadOptionActive|LoadOptionForceReconnect, "Driver",
+				append(append(dpNode(DevicePathTypeMedia, 0x07, *dpFvGUID), dpEnd...),
+					append(dpNode(DevicePathTypeMedia, 0x06, *dpFvGUID), dpEnd...)...), nil),
+			&VariableValue{LoadOption: &LoadOption{
+				Attributes:  LoadOptionActive | LoadOptionForceReconnect,
+				Description: "Driver",
+				FilePaths:   []string{"Fv(7C04A583-9E3E-4F1C-AD65-E05268D0B4D1)", "FvFile(7C04A583-9E3E-4F1C-AD65-E05268D0B4D1)"},
+			}}},
+		{"Boot0002", EFIGlobalVariableGUID, loadOption(0, "Bad", []byte{1, 1, 4, 0}, nil),
+			&VariableValue{Error: "device path end node not found"}},
+		{"Bootabcd", EFIGlobalVariableGUID, []byte{}, nil},
+		{"Timeout", EFIGlobalVariableGUID, []byte{5, 0}, &VariableValue{Timeout: u16(5)}},
+		{"Timeout", EFIGlobalVariableGUID, []byte{5}, &VariableValue{Error: "expected 2 bytes, got 0x1"}},
+		{"ConOut", EFIGlobalVariableGUID, append(testDevicePath(), dpEnd...), &VariableValue{DevicePaths: []string{testDevicePathText}}},
+		{"SecureBoot", EFIGlobalVariableGUID, []byte{1}, &VariableValue{SecureBoot: u8(1)}},
+		{"Lang", EFIGlobalVariableGUID, []byte("eng"), &VariableValue{Lang: "eng"}},
+		{"PlatformLang", EFIGlobalVariableGUID, []byte("en-US\x00"), &VariableValue{Lang: "en-US"}},
+		{"db", ImageSecurityDatabaseGUID, db, &VariableValue{SignatureLists: []*SignatureList{
+			{Type: *CertSHA256GUID, TypeName: "SHA256", Signatures: []*Signature{
+				{Owner: *EFIGlobalVariableGUID, Hash: hex.EncodeToString(hash)},
+				{Owner: *EFIGlobalVariableGUID, Hash: hex.EncodeToString(hash)},
+			}},
+			{Type: *CertX509GUID, TypeName: "X509", Signatures: []*Signature{
+				{Owner: *ImageSecurityDatabaseGUID, Certificate: cert, Subject: "CN=Test DB Key", Issuer: "CN=Test DB Key"},
+			}},
+		}}},
+		{"dbx", ImageSecurityDatabaseGUID, db[:40], &VariableValue{Error: "invalid signature list size 0x7c, header size 0x0, 0x28 bytes remaining"}},
+		{"PK", EFIGlobalVariableGUID, []byte{}, &VariableValue{}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			value := DecodeVariable(test.name, *test.guid, test.data)
+			if !reflect.DeepEqual(value, test.value) {
+				t.Errorf("Wrong value, expected \n%+v\n got \n%+v", test.value, value)
+			}
+		})
+	}
+}
+
+func TestSignature_Bytes(t *testing.T) {
+	lists, err := ParseSignatureLists(signatureList(CertSHA256GUID, FFGUID, []byte{1, 2, 3}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := lists[0].Signatures[0].Bytes(); !bytes.Equal(b, []byte{1, 2, 3}) {
+		t.Errorf("Wrong signature bytes, expected [1 2 3] got %v", b)
+	}
+}
+
+func TestAssembleSignatureLists(t *testing.T) {
+	hash := bytes.Repeat([]byte{0xAB}, 32)
+	db := append(signatureList(CertSHA256GUID, EFIGlobalVariableGUID, hash, hash),
+		signatureList(CertX509GUID, ImageSecurityDatabaseGUID, testCertificate(t))...)
+	lists, err := ParseSignatureLists(db)
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := AssembleSignatureLists(append(lists, &SignatureList{Type: *CertSHA256GUID}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(buf, db) {
+		t.Errorf("Assembled signature lists differ from the original")
+	}
+
+	lists[0].Signatures[1].Hash = hex.EncodeToString(hash[:20])
+	if _, err = AssembleSignatureLists(lists); err == nil {
+		t.Errorf("signatures of different sizes in a list should fail")
+	}
+}
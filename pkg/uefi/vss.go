@@ -0,0 +1,539 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// VSS and FTW structures are described in the EDK2 sources:
+// https://github.com/tianocore/edk2/blob/master/MdeModulePkg/Include/Guid/VariableFormat.h
+// https://github.com/tianocore/edk2/blob/master/MdeModulePkg/Include/Guid/SystemNvDataGuid.h
+
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/unicode"
+)
+
+// Variable store and fault tolerant write signatures
+var (
+	// VariableStoreGUID is the signature of a VSS2 store of normal variables.
+	VariableStoreGUID = guid.MustParse("DDCF3616-3275-4164-98B6-FE85707FFE7D")
+	// AuthVariableStoreGUID is the signature of a VSS2 store of authenticated
+	// variables.
+	AuthVariableStoreGUID = guid.MustParse("AAF32C78-947B-439A-A180-2E144EC37792")
+	// FTWWorkingBlockGUID is the signature of a fault tolerant write working
+	// block. Older EDK2 versions use the EVSA GUID instead.
+	FTWWorkingBlockGUID = guid.MustParse("9E58292B-7C68-497D-A0CE-6500FD9F1B95")
+)
+
+// VSSSignature is the '$VSS' signature of a VSS store.
+const VSSSignature uint32 = 0x53535624
+
+// Variable store header values
+const (
+	VariableStoreFormatted uint8  = 0x5A
+	VariableStoreHealthy   uint8  = 0xFE
+	VariableStartID        uint16 = 0x55AA
+)
+
+// VariableStoreHeader represents the fields of a VARIABLE_STORE_HEADER
+// following the signature.
+type VariableStoreHeader struct {
+	Size      uint32
+	Format    uint8
+	State     uint8
+	Reserved  uint16
+	Reserved1 uint32
+}
+
+// VariableState holds the state of a VSS variable. States are reached by
+// clearing bits.
+type VariableState uint8
+
+// Variable states
+const (
+	VariableInDeletedTransition VariableState = 0xFE
+	VariableDeleted             VariableState = 0xFD
+	VariableHeaderValidOnly     VariableState = 0x7F
+	VariableAdded               VariableState = 0x3F
+)
+
+func (s VariableState) String() string {
+	switch s {
+	case VariableAdded:
+		return "Added"
+	case VariableAdded & VariableInDeletedTransition:
+		return "InDeletedTransition"
+	case VariableAdded & VariableDeleted, VariableAdded & VariableDeleted & VariableInDeletedTransition:
+		return "Deleted"
+	case VariableHeaderValidOnly:
+		return "HeaderValidOnly"
+	}
+	return fmt.Sprintf("UNKNOWN(%#02x)", uint8(s))
+}
+
+// VariableAttributes holds the EFI_VARIABLE attributes of a variable.
+type VariableAttributes uint32
+
+// Variable attributes
+const (
+	VariableNonVolatile                       VariableAttributes = 0x01
+	VariableBootServiceAccess                 VariableAttributes = 0x02
+	VariableRuntimeAccess                     VariableAttributes = 0x04
+	VariableHardwareErrorRecord               VariableAttributes = 0x08
+	VariableAuthenticatedWriteAccess          VariableAttributes = 0x10
+	VariableTimeBasedAuthenticatedWriteAccess VariableAttributes = 0x20
+	VariableAppendWrite                       VariableAttributes = 0x40
+)
+
+var variableAttributeNames = []struct {
+	a    VariableAttributes
+	name string
+}{
+	{VariableNonVolatile, "NV"},
+	{VariableBootServiceAccess, "BS"},
+	{VariableRuntimeAccess, "RT"},
+	{VariableHardwareErrorRecord, "HR"},
+	{VariableAuthenticatedWriteAccess, "AW"},
+	{VariableTimeBasedAuthenticatedWriteAccess, "AT"},
+	{VariableAppendWrite, "AP"},
+}
+
+// String returns the attributes in the short form used by the UEFI shell,
+// e.g. NV+BS+RT.
+func (a VariableAttributes) String() string {
+	var names []string
+	for _, n := range variableAttributeNames {
+		if a&n.a != 0 {
+			names = append(names, n.name)
+			a &^= n.a
+		}
+	}
+	if a != 0 {
+		names = append(names, fmt.Sprintf("%#x", uint32(a)))
+	}
+	return strings.Join(names, "+")
+}
+
+// EFITime represents an EFI_TIME.
+type EFITime struct {
+	Year       uint16
+	Month      uint8
+	Day        uint8
+	Hour       uint8
+	Minute     uint8
+	Second     uint8
+	Pad1       uint8
+	Nanosecond uint32
+	TimeZone   int16
+	Daylight   uint8
+	Pad2       uint8
+}
+
+// VariableHeader represents the fields common to the VARIABLE_HEADER and
+// AUTHENTICATED_VARIABLE_HEADER.
+type VariableHeader struct {
+	StartID    uint16 `json:"-"`
+	State      VariableState
+	Reserved   uint8
+	Attributes VariableAttributes
+}
+
+// AuthVariableHeader represents the fields of an AUTHENTICATED_VARIABLE_HEADER
+// following the Attributes.
+type AuthVariableHeader struct {
+	MonotonicCount uint64
+	TimeStamp      EFITime
+	PubKeyIndex    uint32
+}
+
+// variableSizes are the last fields of a variable header before the GUID.
+type variableSizes struct {
+	NameSize uint32
+	DataSize uint32
+}
+
+// Variable represents a variable of a VSS store.
+type Variable struct {
+	Header VariableHeader
+	// Only present in stores of authenticated variables.
+	AuthHeader *AuthVariableHeader `json:",omitempty"`
+	GUID       guid.GUID
+	Name       string
+	Value      *VariableValue `json:",omitempty"`
+
+	//Metadata for extraction and recovery
+	buf         []byte
+	ExtractPath string
+	Offset      uint64
+	DataOffset  int64
+
+	dirtyState
+}
+
+// String returns the state and name of the variable.
+func (v *Variable) String() string {
+	return fmt.Sprintf("[%v] %v", v.Header.State, v.Name)
+}
+
+// IsValid tells whether the variable holds the current value.
+func (v *Variable) IsValid() bool {
+	return v.Header.State == VariableAdded ||
+		v.Header.State == VariableAdded&VariableInDeletedTransition
+}
+
+// Buf returns the buffer.
+// Used mostly for things interacting with the Firmware interface.
+func (v *Variable) Buf() []byte {
+	return v.buf
+}
+
+// SetBuf sets the buffer.
+// Used mostly for things interacting with the Firmware interface.
+func (v *Variable) SetBuf(buf []byte) {
+	v.buf = buf
+	v.MarkDirty()
+}
+
+// Apply calls the visitor on the Variable.
+func (v *Variable) Apply(vr Visitor) error {
+	return vr.Visit(v)
+}
+
+// ApplyChildren calls the visitor on each child node of Variable.
+func (v *Variable) ApplyChildren(vr Visitor) error {
+	return nil
+}
+
+// headerLen returns the size of the binary header of the variable.
+func (v *Variable) headerLen() int64 {
+	l := binary.Size(v.Header) + binary.Size(variableSizes{}) + binary.Size(v.GUID)
+	if v.AuthHeader != nil {
+		l += binary.Size(v.AuthHeader)
+	}
+	return int64(l)
+}
+
+// newVariable parses a variable at the start of buf.
+func newVariable(buf []byte, offset uint64, auth bool) (*Variable, error) {
+	v := &Variable{Offset: offset}
+	v.markClean()
+	r := bytes.NewReader(buf)
+	if err := binary.Read(r, binary.LittleEndian, &v.Header); err != nil {
+		return nil, err
+	}
+	if v.Header.StartID != VariableStartID {
+		return nil, fmt.Errorf("variable start id not found, got %#04x", v.Header.StartID)
+	}
+	if auth {
+		v.AuthHeader = &AuthVariableHeader{}
+		if err := binary.Read(r, binary.LittleEndian, v.AuthHeader); err != nil {
+			return nil, err
+		}
+	}
+	var sizes variableSizes
+	if err := binary.Read(r, binary.LittleEndian, &sizes); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &v.GUID); err != nil {
+		return nil, err
+	}
+	v.DataOffset = v.headerLen() + int64(sizes.NameSize)
+	size := v.DataOffset + int64(sizes.DataSize)
+	if size > int64(len(buf)) {
+		return nil, fmt.Errorf("variable size %#x bigger than remaining size %#x", size, len(buf))
+	}
+	if sizes.NameSize > 0 {
+		v.Name = unicode.UCS2ToUTF8(buf[v.headerLen():v.DataOffset])
+	}
+
+	// Copy out the buffer.
+	v.buf = make([]byte, size)
+	copy(v.buf, buf)
+	v.DecodeValue()
+	return v, nil
+}
+
+// DecodeValue decodes the data of well-known variables into Value.
+func (v *Variable) DecodeValue() {
+	v.Value = DecodeVariable(v.Name, v.GUID, v.buf[v.DataOffset:])
+}
+
+// Assemble regenerates the binary of the variable from its header, name and
+// the given data.
+func (v *Variable) Assemble(data []byte) error {
+	vData := new(bytes.Buffer)
+	v.Header.StartID = VariableStartID
+	name := unicode.UTF8ToUCS2(v.Name)
+	if v.Name == "" {
+		name = nil
+	}
+	sizes := variableSizes{NameSize: uint32(len(name)), DataSize: uint32(len(data))}
+	fields := []interface{}{v.Header}
+	if v.AuthHeader != nil {
+		fields = append(fields, v.AuthHeader)
+	}
+	fields = append(fields, sizes, v.GUID)
+	for _, f := range fields {
+		if err := binary.Write(vData, binary.LittleEndian, f); err != nil {
+			return fmt.Errorf("unable to construct binary header of variable %v: got %v", v.Name, err)
+		}
+	}
+	vData.Write(name)
+	v.DataOffset = int64(vData.Len())
+	vData.Write(data)
+	v.SetBuf(vData.Bytes())
+	return nil
+}
+
+// VariableStore represents an EDK2 VSS or VSS2 variable store.
+type VariableStore struct {
+	// GUID is the signature of VSS2 stores. It is nil for VSS stores which
+	// have the '$VSS' signature.
+	GUID      *guid.GUID `json:",omitempty"`
+	Header    VariableStoreHeader
+	Variables []*Variable `json:",omitempty"`
+
+	//Metadata for extraction and recovery
+	buf             []byte
+	HeaderLen       uint64
+	FreeSpaceOffset uint64
+
+	dirtyState
+}
+
+// Type returns the type of the store, VSS or VSS2.
+func (s *VariableStore) Type() string {
+	if s.GUID == nil {
+		return "VSS"
+	}
+	return "VSS2"
+}
+
+// IsAuthenticated tells whether the store holds authenticated variables.
+func (s *VariableStore) IsAuthenticated() bool {
+	return s.GUID != nil && *s.GUID == *AuthVariableStoreGUID
+}
+
+// Buf returns the buffer.
+// Used mostly for things interacting with the Firmware interface.
+func (s *VariableStore) Buf() []byte {
+	return s.buf
+}
+
+// SetBuf sets the buffer.
+// Used mostly for things interacting with the Firmware interface.
+func (s *VariableStore) SetBuf(buf []byte) {
+	s.buf = buf
+	s.MarkDirty()
+}
+
+// Apply calls the visitor on the VariableStore.
+func (s *VariableStore) Apply(v Visitor) error {
+	return v.Visit(s)
+}
+
+// ApplyChildren calls the visitor on each child node of VariableStore.
+func (s *VariableStore) ApplyChildren(v Visitor) error {
+	for _, vr := range s.Variables {
+		if err := vr.Apply(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// HeaderBuf returns the binary representation of the signature and the header
+// of the store.
+func (s *VariableStore) HeaderBuf() ([]byte, error) {
+	h := new(bytes.Buffer)
+	var err error
+	if s.GUID != nil {
+		err = binary.Write(h, binary.LittleEndian, s.GUID)
+	} else {
+		err = binary.Write(h, binary.LittleEndian, VSSSignature)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err = binary.Write(h, binary.LittleEndian, s.Header); err != nil {
+		return nil, err
+	}
+	return h.Bytes(), nil
+}
+
+// IsVariableStore tells whether buf starts with a VSS or VSS2 store signature.
+func IsVariableStore(buf []byte) bool {
+	if len(buf) >= 4 && binary.LittleEndian.Uint32(buf) == VSSSignature {
+		return true
+	}
+	var g guid.GUID
+	if len(buf) < len(g) {
+		return false
+	}
+	copy(g[:], buf)
+	return g == *VariableStoreGUID || g == *AuthVariableStoreGUID
+}
+
+// NewVariableStore parses a sequence of bytes and returns a VariableStore
+// object, if a valid one is passed, or an error.
+func NewVariableStore(buf []byte) (*VariableStore, error) {
+	if !IsVariableStore(buf) {
+		return nil, errors.New("variable store signature not found")
+	}
+	s := VariableStore{}
+	s.markClean()
+	r := bytes.NewReader(buf)
+	if binary.LittleEndian.Uint32(buf) == VSSSignature {
+		if _, err := r.Seek(4, io.SeekStart); err != nil {
+			return nil, err
+		}
+	} else {
+		s.GUID = &guid.GUID{}
+		if err := binary.Read(r, binary.LittleEndian, s.GUID); err != nil {
+			return nil, err
+		}
+	}
+	if err := binary.Read(r, binary.LittleEndian, &s.Header); err != nil {
+		return nil, err
+	}
+	s.HeaderLen = uint64(len(buf) - r.Len())
+	if uint64(s.Header.Size) < s.HeaderLen || int(s.Header.Size) > len(buf) {
+		return nil, fmt.Errorf("invalid variable store size %#x, buffer is %#x bytes", s.Header.Size, len(buf))
+	}
+
+	// Copy out the buffer.
+	s.buf = make([]byte, s.Header.Size)
+	copy(s.buf, buf)
+
+	offset := s.HeaderLen
+	for {
+		offset = Align4(offset)
+		if offset+2 > uint64(len(s.buf)) || binary.LittleEndian.Uint16(s.buf[offset:]) != VariableStartID {
+			break
+		}
+		v, err := newVariable(s.buf[offset:], offset, s.IsAuthenticated())
+		if err != nil {
+			return nil, fmt.Errorf("error parsing variable at offset %#x: %v", offset, err)
+		}
+		s.Variables = append(s.Variables, v)
+		offset += uint64(len(v.buf))
+	}
+	s.FreeSpaceOffset = offset
+	return &s, nil
+}
+
+// FTWWorkingBlockHeader represents an EFI_FAULT_TOLERANT_WORKING_BLOCK_HEADER.
+type FTWWorkingBlockHeader struct {
+	Signature guid.GUID
+	CRC       uint32
+	// Bit 0 is WorkingBlockValid and bit 1 WorkingBlockInvalid.
+	State          uint8
+	Reserved       [3]uint8
+	WriteQueueSize uint64
+}
+
+// FTW working block states
+const (
+	FTWWorkingBlockValid   uint8 = 0x01
+	FTWWorkingBlockInvalid uint8 = 0x02
+)
+
+// FTWWorkingBlock represents the fault tolerant write working block which
+// follows the variable store in NVRAM volumes.
+type FTWWorkingBlock struct {
+	Header FTWWorkingBlockHeader
+	// Set when the CRC in the header does not match.
+	ExpectedCRC *uint32 `json:",omitempty"`
+
+	//Metadata for extraction and recovery
+	buf         []byte
+	ExtractPath string
+	Offset      uint64 // Byte offset from the start of the volume.
+
+	dirtyState
+}
+
+// Buf returns the buffer.
+// Used mostly for things interacting with the Firmware interface.
+func (w *FTWWorkingBlock) Buf() []byte {
+	return w.buf
+}
+
+// SetBuf sets the buffer.
+// Used mostly for things interacting with the Firmware interface.
+func (w *FTWWorkingBlock) SetBuf(buf []byte) {
+	w.buf = buf
+	w.MarkDirty()
+}
+
+// Apply calls the visitor on the FTWWorkingBlock.
+func (w *FTWWorkingBlock) Apply(v Visitor) error {
+	return v.Visit(w)
+}
+
+// ApplyChildren calls the visitor on each child node of FTWWorkingBlock.
+func (w *FTWWorkingBlock) ApplyChildren(v Visitor) error {
+	return nil
+}
+
+// IsValid tells whether the working block is marked valid.
+func (w *FTWWorkingBlock) IsValid() bool {
+	return w.Header.State&FTWWorkingBlockValid == 0 && w.Header.State&FTWWorkingBlockInvalid != 0
+}
+
+// CalculateCRC computes the CRC32 of the header as EDK2 does, with the CRC and
+// the state set to their erased values.
+func (w *FTWWorkingBlock) CalculateCRC() uint32 {
+	h := w.Header
+	h.CRC = 0xFFFFFFFF
+	h.State |= FTWWorkingBlockValid | FTWWorkingBlockInvalid
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, h)
+	return crc32.ChecksumIEEE(b.Bytes())
+}
+
+// IsFTWWorkingBlock tells whether buf starts with a working block signature.
+func IsFTWWorkingBlock(buf []byte) bool {
+	var g guid.GUID
+	if len(buf) < len(g) {
+		return false
+	}
+	copy(g[:], buf)
+	return g == *FTWWorkingBlockGUID || g == *EVSA
+}
+
+// NewFTWWorkingBlock parses a sequence of bytes and returns a FTWWorkingBlock
+// object, if a valid one is passed, or an error.
+func NewFTWWorkingBlock(buf []byte, offset uint64) (*FTWWorkingBlock, error) {
+	if !IsFTWWorkingBlock(buf) {
+		return nil, errors.New("FTW working block signature not found")
+	}
+	w := FTWWorkingBlock{Offset: offset}
+	w.markClean()
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &w.Header); err != nil {
+		return nil, err
+	}
+	size := uint64(binary.Size(w.Header))
+	if w.Header.WriteQueueSize > uint64(len(buf))-size {
+		return nil, fmt.Errorf("FTW write queue size %#x bigger than remaining size %#x",
+			w.Header.WriteQueueSize, uint64(len(buf))-size)
+	}
+	size += w.Header.WriteQueueSize
+
+	// Copy out the buffer.
+	w.buf = make([]byte, size)
+	copy(w.buf, buf)
+
+	if crc := w.CalculateCRC(); crc != w.Header.CRC {
+		w.ExpectedCRC = &crc
+	}
+	return &w, nil
+}
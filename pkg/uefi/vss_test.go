@@ -0,0 +1,210 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package uefi
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/unicode"
+)
+
+var testVarGUID = guid.MustParse("8BE4DF61-93CA-11D2-AA0D-00E098032B8C")
+
+// vssVariable builds the binary of a variable.
+func vssVariable(auth bool, state VariableState, name string, data []byte) []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, VariableHeader{
+		StartID:    VariableStartID,
+		State:      state,
+		Attributes: VariableNonVolatile | VariableBootServiceAccess | VariableRuntimeAccess,
+	})
+	if auth {
+		binary.Write(b, binary.LittleEndian, AuthVariableHeader{MonotonicCount: 1})
+	}
+	n := unicode.UTF8ToUCS2(name)
+	binary.Write(b, binary.LittleEndian, variableSizes{NameSize: uint32(len(n)), DataSize: uint32(len(data))})
+	b.Write(testVarGUID[:])
+	b.Write(n)
+	b.Write(data)
+	return b.Bytes()
+}
+
+// vssStore builds an erased variable store of the given size holding vars.
+func vssStore(signature *guid.GUID, size uint32, vars ...[]byte) []byte {
+	b := new(bytes.Buffer)
+	if signature != nil {
+		b.Write(signature[:])
+	} else {
+		binary.Write(b, binary.LittleEndian, VSSSignature)
+	}
+	binary.Write(b, binary.LittleEndian, VariableStoreHeader{
+		Size:   size,
+		Format: VariableStoreFormatted,
+		State:  VariableStoreHealthy,
+	})
+	for _, v := range vars {
+		for b.Len()%4 != 0 {
+			b.WriteByte(0xFF)
+		}
+		b.Write(v)
+	}
+	buf := make([]byte, size)
+	Erase(buf, 0xFF)
+	copy(buf, b.Bytes())
+	return buf
+}
+
+func TestNewVariableStore(t *testing.T) {
+	var tests = []struct {
+		name      string
+		buf       []byte
+		msg       string
+		storeType string
+		auth      bool
+		vars      []string
+		states    []VariableState
+	}{
+		{"erased", bytes.Repeat([]byte{0xFF}, 64), "variable store signature not found", "", false, nil, nil},
+		{"tooBig", vssStore(VariableStoreGUID, 0x100)[:0x80], "invalid variable store size 0x100, buffer is 0x80 bytes", "", false, nil, nil},
+		{"emptyVSS", vssStore(nil, 0x100), "", "VSS", false, nil, nil},
+		{"VSS2", vssStore(VariableStoreGUID, 0x100,
+			vssVariable(false, VariableAdded, "Lang", []byte("eng")),
+			vssVariable(false, VariableAdded&VariableDeleted, "Timeout", []byte{5, 0}),
+		), "", "VSS2", false, []string{"Lang", "Timeout"}, []VariableState{VariableAdded, VariableAdded & VariableDeleted}},
+		{"authVSS2", vssStore(AuthVariableStoreGUID, 0x200,
+			vssVariable(true, VariableAdded, "BootOrder", []byte{0, 0, 1, 0}),
+			vssVariable(true, VariableAdded, "Timeout", []byte{5}),
+			vssVariable(true, VariableAdded, "Lang", []byte("eng")),
+		), "", "VSS2", true, []string{"BootOrder", "Timeout", "Lang"}, []VariableState{VariableAdded, VariableAdded, VariableAdded}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s, err := NewVariableStore(test.buf)
+			if err == nil && test.msg != "" {
+				t.Fatalf("Error was not returned, expected %v", test.msg)
+			} else if err != nil && err.Error() != test.msg {
+				t.Fatalf("Mismatched Error returned, expected \n%v\n got \n%v\n", test.msg, err.Error())
+			} else if err != nil {
+				return
+			}
+			if s.Type() != test.storeType {
+				t.Errorf("Wrong store type, expected %v got %v", test.storeType, s.Type())
+			}
+			if s.IsAuthenticated() != test.auth {
+				t.Errorf("Wrong IsAuthenticated, expected %v got %v", test.auth, s.IsAuthenticated())
+			}
+			if len(s.Variables) != len(test.vars) {
+				t.Fatalf("Wrong number of variables, expected %v got %v", len(test.vars), len(s.Variables))
+			}
+			for i, v := range s.Variables {
+				if v.Name != test.vars[i] {
+					t.Errorf("Wrong name for variable %d, expected %v got %v", i, test.vars[i], v.Name)
+				}
+				if v.Header.State != test.states[i] {
+					t.Errorf("Wrong state for variable %v, expected %v got %v", v.Name, test.states[i], v.Header.State)
+				}
+				if v.GUID != *testVarGUID {
+					t.Errorf("Wrong GUID for variable %v, expected %v got %v", v.Name, testVarGUID, v.GUID)
+				}
+				if (v.AuthHeader != nil) != test.auth {
+					t.Errorf("Wrong AuthHeader for variable %v, expected present %v", v.Name, test.auth)
+				}
+				if !bytes.Equal(s.Buf()[v.Offset:v.Offset+uint64(len(v.Buf()))], v.Buf()) {
+					t.Errorf("Variable %v buffer does not match store at offset %#x", v.Name, v.Offset)
+				}
+			}
+		})
+	}
+}
+
+func TestVariable_Assemble(t *testing.T) {
+	for _, auth := range []bool{false, true} {
+		buf := vssVariable(auth, VariableAdded, "Lang", []byte("eng"))
+		v, err := newVariable(buf, 0, auth)
+		if err != nil {
+			t.Fatalf("Unable to parse variable: %v", err)
+		}
+		if err := v.Assemble(v.Buf()[v.DataOffset:]); err != nil {
+			t.Fatalf("Unable to assemble variable: %v", err)
+		}
+		if !bytes.Equal(v.Buf(), buf) {
+			t.Errorf("Assembled variable mismatch (auth %v), expected\n%x\ngot\n%x", auth, buf, v.Buf())
+		}
+		if err := v.Assemble([]byte("fra")); err != nil {
+			t.Fatalf("Unable to assemble variable: %v", err)
+		}
+		if expected := vssVariable(auth, VariableAdded, "Lang", []byte("fra")); !bytes.Equal(v.Buf(), expected) {
+			t.Errorf("Assembled variable mismatch (auth %v), expected\n%x\ngot\n%x", auth, expected, v.Buf())
+		}
+	}
+}
+
+func TestVariableAttributes_String(t *testing.T) {
+	var tests = []struct {
+		attr VariableAttributes
+		res  string
+	}{
+		{0, ""},
+		{VariableNonVolatile | VariableBootServiceAccess | VariableRuntimeAccess, "NV+BS+RT"},
+		{VariableBootServiceAccess | VariableTimeBasedAuthenticatedWriteAccess | 0x100, "BS+AT+0x100"},
+	}
+	for _, test := range tests {
+		if res := test.attr.String(); res != test.res {
+			t.Errorf("String wrong result for %#x, expected %q got %q", uint32(test.attr), test.res, res)
+		}
+	}
+}
+
+func TestNewFTWWorkingBlock(t *testing.T) {
+	w := FTWWorkingBlock{Header: FTWWorkingBlockHeader{
+		Signature:      *FTWWorkingBlockGUID,
+		State:          0xFE,
+		Reserved:       [3]uint8{0xFF, 0xFF, 0xFF},
+		WriteQueueSize: 0x10,
+	}}
+	w.Header.CRC = w.CalculateCRC()
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, w.Header)
+	buf := append(b.Bytes(), bytes.Repeat([]byte{0xFF}, 0x20)...)
+
+	parsed, err := NewFTWWorkingBlock(buf, 0x48)
+	if err != nil {
+		t.Fatalf("Unable to parse FTW working block: %v", err)
+	}
+	if parsed.ExpectedCRC != nil {
+		t.Errorf("Unexpected CRC mismatch, expected %#x", *parsed.ExpectedCRC)
+	}
+	if !parsed.IsValid() {
+		t.Errorf("Working block should be valid")
+	}
+	if len(parsed.Buf()) != 0x20+0x10 {
+		t.Errorf("Wrong working block size, expected %#x got %#x", 0x30, len(parsed.Buf()))
+	}
+
+	// The CRC does not cover the state.
+	buf[20] = 0xFC
+	if parsed, err = NewFTWWorkingBlock(buf, 0x48); err != nil {
+		t.Fatalf("Unable to parse FTW working block: %v", err)
+	}
+	if parsed.ExpectedCRC != nil {
+		t.Errorf("Unexpected CRC mismatch after state change, expected %#x", *parsed.ExpectedCRC)
+	}
+
+	buf[24] = 0x21
+	if _, err = NewFTWWorkingBlock(buf, 0x48); err == nil {
+		t.Errorf("Expected an error with a write queue bigger than the buffer")
+	}
+	buf[24] = 0x10
+	buf[16] ^= 0xFF
+	if parsed, err = NewFTWWorkingBlock(buf, 0x48); err != nil {
+		t.Fatalf("Unable to parse FTW working block: %v", err)
+	}
+	if parsed.ExpectedCRC == nil || *parsed.ExpectedCRC != w.Header.CRC {
+		t.Errorf("Expected CRC mismatch to be reported")
+	}
+}
@@ -10,12 +10,20 @@ import (
 	"io/ioutil"
 	"os"
 
+	"github.com/linuxboot/fiano/pkg/compression"
 	"github.com/linuxboot/fiano/pkg/uefi"
 	"github.com/linuxboot/fiano/pkg/visitors"
 )
 
 // Run runs the utk command with the given arguments.
 func Run(args ...string) error {
+	return RunWithCompression(nil, args...)
+}
+
+// RunWithCompression runs the utk command with the given arguments. The
+// visitors assembling the firmware use the compression config. If it is nil,
+// compression.DefaultConfig() is used.
+func RunWithCompression(cfg *compression.Config, args ...string) error {
 	if len(args) == 0 {
 		return errors.New("at least one argument is required")
 	}
@@ -24,6 +32,7 @@ func Run(args ...string) error {
 	if err != nil {
 		return err
 	}
+	visitors.SetCompression(v, cfg)
 
 	// Load and parse the image.
 	path := args[0]
@@ -39,7 +48,7 @@ func Run(args ...string) error {
 			return err
 		}
 		// Assemble the tree from the bottom up
-		a := visitors.Assemble{}
+		a := visitors.Assemble{Compression: cfg}
 		if err = a.Run(parsedRoot); err != nil {
 			return err
 		}
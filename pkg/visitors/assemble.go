@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"hash/crc32"
 	"sort"
 
 	"github.com/linuxboot/fiano/pkg/compression"
@@ -26,6 +27,55 @@ type Assemble struct {
 	// also use the FFSV3 GUID? In that case we should fix this since only the innermost
 	// enclosing FV changes to FFSV3
 	useFFS3 bool
+
+	// Compression configures the compressors used to re-encode GUIDed
+	// sections. If nil, compression.DefaultConfig() is used.
+	Compression *compression.Config
+
+	// This is set when a node was rebuilt. Clean nodes whose children were
+	// not rebuilt keep the bytes they were parsed from.
+	rebuilt bool
+}
+
+// compressorFromGUID returns the Compressor for the GUIDed section using the
+// configured compression settings.
+func (v *Assemble) compressorFromGUID(g *guid.GUID) compression.Compressor {
+	if v.Compression == nil {
+		return compression.CompressorFromGUID(g)
+	}
+	return v.Compression.CompressorFromGUID(g)
+}
+
+// encodedPayload returns the encoded data of the section buffer if it decodes
+// to data, or nil otherwise. Encoders do not reproduce the output of other
+// tools byte for byte, so the parsed data is kept when the payload did not
+// change.
+func encodedPayload(s *uefi.Section, c compression.Compressor, data []byte) []byte {
+	var offset uint64
+	switch ts := s.TypeSpecific.Header.(type) {
+	case *uefi.SectionGUIDDefined:
+		offset = uint64(ts.DataOffset)
+	case *uefi.SectionCompression:
+		offset = uefi.SectionMinLength
+		if s.Header.Size == [3]uint8{0xFF, 0xFF, 0xFF} {
+			offset = uefi.SectionExtMinLength
+		}
+		offset += uint64(ts.GetBinHeaderLen())
+	}
+	buf := s.Buf()
+	if offset == 0 || offset >= uint64(len(buf)) {
+		return nil
+	}
+	decoded, err := c.Decode(buf[offset:])
+	if err != nil || !bytes.Equal(decoded, data) {
+		return nil
+	}
+	return buf[offset:]
+}
+
+// SetCompression implements CompressionSetter.
+func (v *Assemble) SetCompression(cfg *compression.Config) {
+	v.Compression = cfg
 }
 
 // Run just applies the visitor.
@@ -47,13 +97,43 @@ func (v *Assemble) Visit(f uefi.Firmware) error {
 
 	// We first assemble the children.
 	// Sounds horrible but has to be done =(
+	parentRebuilt := v.rebuilt
+	v.rebuilt = false
 	if err = f.ApplyChildren(v); err != nil {
 		return err
 	}
+	if !v.rebuilt && !uefi.IsDirty(f) {
+		v.rebuilt = parentRebuilt
+		return nil
+	}
+	v.rebuilt = true
 
 	switch f := f.(type) {
 
 	case *uefi.FirmwareVolume:
+		if f.VarStore != nil || f.FTW != nil {
+			// NVRAM volume, the children are at fixed offsets so we put
+			// them back in place.
+			fBuf := f.Buf()
+			if f.VarStore != nil {
+				vsBuf := f.VarStore.Buf()
+				if f.DataOffset+uint64(len(vsBuf)) > uint64(len(fBuf)) {
+					return fmt.Errorf("variable store of size %#x does not fit in firmware volume of size %#x",
+						len(vsBuf), len(fBuf))
+				}
+				copy(fBuf[f.DataOffset:], vsBuf)
+			}
+			if f.FTW != nil {
+				ftwBuf := f.FTW.Buf()
+				if f.FTW.Offset+uint64(len(ftwBuf)) > uint64(len(fBuf)) {
+					return fmt.Errorf("FTW working block of size %#x at offset %#x does not fit in firmware volume of size %#x",
+						len(ftwBuf), f.FTW.Offset, len(fBuf))
+				}
+				copy(fBuf[f.FTW.Offset:], ftwBuf)
+			}
+			f.SetBuf(fBuf)
+			return nil
+		}
 		if len(f.Files) == 0 {
 			// No children, buffer should already contain data.
 			return nil
@@ -309,17 +389,48 @@ func (v *Assemble) Visit(f uefi.Firmware) error {
 		switch f.Header.Type {
 		case uefi.SectionTypeGUIDDefined:
 			ts := f.TypeSpecific.Header.(*uefi.SectionGUIDDefined)
-			if ts.Attributes&uint16(uefi.GUIDEDSectionProcessingRequired) != 0 {
-				compressor := compression.CompressorFromGUID(&ts.GUID)
+			if ts.GUID == *uefi.CRC32GUID {
+				ts.CRC32 = crc32.ChecksumIEEE(secData)
+				f.SetBuf(secData)
+			} else if ts.Attributes&uint16(uefi.GUIDEDSectionProcessingRequired) != 0 {
+				compressor := v.compressorFromGUID(&ts.GUID)
 				if compressor == nil {
 					return fmt.Errorf("unknown guid defined from section %v, should not have encapsulated sections", f)
 				}
-				if fBuf, err := compressor.Encode(secData); err == nil {
+				if fBuf := encodedPayload(f, compressor, secData); fBuf != nil {
+					f.SetBuf(fBuf)
+				} else if fBuf, err := compressor.Encode(secData); err == nil {
 					f.SetBuf(fBuf)
 				} else {
 					return err
 				}
 			}
+		case uefi.SectionTypeCompression:
+			ts := f.TypeSpecific.Header.(*uefi.SectionCompression)
+			ts.UncompressedLength = uint32(len(secData))
+			switch ts.CompressionType {
+			case uefi.CompressionTypeNone:
+				f.SetBuf(secData)
+			case uefi.CompressionTypeStandard:
+				var compressor compression.Compressor
+				for _, c := range compression.StandardCompressors() {
+					if c.Name() == ts.Compression {
+						compressor = c
+					}
+				}
+				if compressor == nil {
+					return fmt.Errorf("unknown compression %v from section %v, should not have encapsulated sections", ts.Compression, f)
+				}
+				fBuf := encodedPayload(f, compressor, secData)
+				if fBuf == nil {
+					if fBuf, err = compressor.Encode(secData); err != nil {
+						return err
+					}
+				}
+				f.SetBuf(fBuf)
+			default:
+				return fmt.Errorf("unknown compression type %v from section %v, should not have encapsulated sections", ts.CompressionType, f)
+			}
 		default:
 			f.SetBuf(secData)
 		}
@@ -370,7 +481,49 @@ func (v *Assemble) Visit(f uefi.Firmware) error {
 			}
 
 			err = f.Assemble(content, true)
+			f.DecodeValue()
+		}
+
+	case *uefi.VariableStore:
+		vsData, err := f.HeaderBuf()
+		if err != nil {
+			return err
+		}
+		for _, v := range f.Variables {
+			// Variables are aligned to 4 bytes.
+			for count := uefi.Align4(uint64(len(vsData))) - uint64(len(vsData)); count > 0; count-- {
+				vsData = append(vsData, uefi.Attributes.ErasePolarity)
+			}
+			v.Offset = uint64(len(vsData))
+			vsData = append(vsData, v.Buf()...)
+		}
+		f.FreeSpaceOffset = uefi.Align4(uint64(len(vsData)))
+		if uint64(len(vsData)) > uint64(f.Header.Size) {
+			return fmt.Errorf("out of space in variable store. space available: %v bytes, new size: %v",
+				f.Header.Size, len(vsData))
+		}
+		// Erase Empty space
+		erased := make([]byte, uint64(f.Header.Size)-uint64(len(vsData)))
+		uefi.Erase(erased, uefi.Attributes.ErasePolarity)
+		f.SetBuf(append(vsData, erased...))
+
+	case *uefi.Variable:
+		err = f.Assemble(f.Buf()[f.DataOffset:])
+		f.DecodeValue()
+
+	case *uefi.FTWWorkingBlock:
+		fBuf := f.Buf()
+		// EDK2 rejects working blocks whose header does not match the CRC.
+		f.Header.CRC = f.CalculateCRC()
+		header := new(bytes.Buffer)
+		if err = binary.Write(header, binary.LittleEndian, f.Header); err != nil {
+			return fmt.Errorf("unable to construct binary header of FTW working block: got %v", err)
+		}
+		if len(fBuf) < header.Len() {
+			fBuf = append(fBuf, make([]byte, header.Len()-len(fBuf))...)
 		}
+		copy(fBuf, header.Bytes())
+		f.SetBuf(fBuf)
 
 	case *uefi.FlashDescriptor:
 		// We only parse Descriptor, Region and Master, so regenerate only that and keep the rest of the buffer.
@@ -5,6 +5,7 @@
 package visitors
 
 import (
+	"bytes"
 	"fmt"
 	"testing"
 
@@ -46,3 +47,149 @@ func TestBadDepex(t *testing.T) {
 		})
 	}
 }
+
+func TestAssembleCompressionSection(t *testing.T) {
+	for _, name := range []string{"EFI", "TIANO"} {
+		t.Run(name, func(t *testing.T) {
+			ui, err := uefi.CreateSection(uefi.SectionTypeUserInterface, nil, nil, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ui.Name = "Linux"
+			s, err := uefi.CreateSection(uefi.SectionTypeCompression, nil, []uefi.Firmware{ui}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.TypeSpecific = &uefi.TypeSpecificHeader{
+				Type: uefi.SectionTypeCompression,
+				Header: &uefi.SectionCompression{
+					SectionCompressionHeader: uefi.SectionCompressionHeader{
+						CompressionType: uefi.CompressionTypeStandard,
+					},
+					Compression: name,
+				},
+			}
+
+			a := &Assemble{}
+			if err := a.Run(s); err != nil {
+				t.Fatal(err)
+			}
+
+			parsed, err := uefi.NewSection(s.Buf(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := parsed.TypeSpecific.Header.(*uefi.SectionCompression).Compression; c != name {
+				t.Errorf("compression mismatch, expected %v, got %v", name, c)
+			}
+			if len(parsed.Encapsulated) != 1 {
+				t.Fatalf("expected 1 encapsulated section, got %d", len(parsed.Encapsulated))
+			}
+			if got := parsed.Encapsulated[0].Value.(*uefi.Section).Name; got != "Linux" {
+				t.Errorf("expected encapsulated section named Linux, got %q", got)
+			}
+		})
+	}
+}
+
+func TestAssembleCRC32Section(t *testing.T) {
+	ui, err := uefi.CreateSection(uefi.SectionTypeUserInterface, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui.Name = "Linux"
+	s, err := uefi.CreateSection(uefi.SectionTypeGUIDDefined, nil, []uefi.Firmware{ui}, uefi.CRC32GUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Assemble{}).Run(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// Change the payload and check the checksum follows it.
+	ui.Name = "Linux2"
+	if err := (&Assemble{}).Run(s); err != nil {
+		t.Fatal(err)
+	}
+	v := &Validate{}
+	if err := v.Run(s); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Errors) != 0 {
+		t.Errorf("expected no validation errors, got %v", v.Errors)
+	}
+
+	parsed, err := uefi.NewSection(s.Buf(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parsed.Encapsulated[0].Value.(*uefi.Section).Name; got != "Linux2" {
+		t.Errorf("expected encapsulated section named Linux2, got %q", got)
+	}
+}
+
+// dirtyNodes lists the dirty nodes of a tree, or marks them all dirty.
+type dirtyNodes struct {
+	mark  bool
+	nodes []uefi.Firmware
+}
+
+func (v *dirtyNodes) Run(f uefi.Firmware) error {
+	return f.Apply(v)
+}
+
+func (v *dirtyNodes) Visit(f uefi.Firmware) error {
+	if v.mark {
+		uefi.MarkDirty(f)
+	}
+	if uefi.IsDirty(f) {
+		v.nodes = append(v.nodes, f)
+	}
+	return f.ApplyChildren(v)
+}
+
+func TestAssembleClean(t *testing.T) {
+	fv := patchTestFV(t, "A", "B")
+	orig := append([]byte{}, fv.Buf()...)
+	if err := (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fv.Buf(), orig) {
+		t.Error("assembling a parsed volume changed it")
+	}
+	dirty := &dirtyNodes{}
+	if err := dirty.Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if len(dirty.nodes) != 0 {
+		t.Errorf("assembling a parsed volume rebuilt %v", dirty.nodes)
+	}
+
+	// Editing a file only rebuilds it and the volume.
+	b := fv.Files[1].Buf()
+	ops := []uefi.DepExOp{{OpCode: "TRUE"}, {OpCode: "END"}}
+	if err := (&SetDepEx{Predicate: FindFileGUIDPredicate(patchTestGUID("A")), DepEx: ops}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if &fv.Files[1].Buf()[0] != &b[0] || uefi.IsDirty(fv.Files[1]) {
+		t.Error("assembling rebuilt a file which did not change")
+	}
+	if !uefi.IsDirty(fv.Files[0]) || !uefi.IsDirty(fv) {
+		t.Error("the edited file and its volume should be dirty")
+	}
+
+	// The result is the same as rebuilding everything.
+	incremental := append([]byte{}, fv.Buf()...)
+	if err := (&dirtyNodes{mark: true}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fv.Buf(), incremental) {
+		t.Error("incremental assembly differs from a full rebuild")
+	}
+}
@@ -65,8 +65,8 @@ func (v *Cat) Visit(f uefi.Firmware) error {
 }
 
 func init() {
-	RegisterCLI("cat", "cat a file with a regexp that matches a GUID", 1, func(args []string) (uefi.Visitor, error) {
-		pred, err := FindFilePredicate(args[0])
+	RegisterCLI("cat", "cat a file with a regexp that matches a GUID or a query", 1, func(args []string) (uefi.Visitor, error) {
+		pred, err := FindQueryPredicate(args[0])
 		if err != nil {
 			return nil, err
 		}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"sort"
 
+	"github.com/linuxboot/fiano/pkg/compression"
 	"github.com/linuxboot/fiano/pkg/uefi"
 )
 
@@ -65,6 +66,22 @@ func ParseCLI(args []string) ([]uefi.Visitor, error) {
 	return visitors, nil
 }
 
+// CompressionSetter is implemented by visitors which compress sections when
+// they assemble the firmware.
+type CompressionSetter interface {
+	SetCompression(cfg *compression.Config)
+}
+
+// SetCompression configures the compressors of the visitors implementing
+// CompressionSetter.
+func SetCompression(v []uefi.Visitor, cfg *compression.Config) {
+	for i := range v {
+		if s, ok := v[i].(CompressionSetter); ok {
+			s.SetCompression(cfg)
+		}
+	}
+}
+
 // ExecuteCLI applies each Visitor over the firmware in sequence.
 func ExecuteCLI(f uefi.Firmware, v []uefi.Visitor) error {
 	for i := range v {
@@ -0,0 +1,30 @@
+// Copyright 2018 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/compression"
+)
+
+func TestSetCompression(t *testing.T) {
+	v, err := ParseCLI([]string{"rebase", "repack", "FV", "save", "out.rom", "count"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg := &compression.Config{XZPath: "/path/to/xz"}
+	SetCompression(v, cfg)
+
+	if got := v[0].(*Rebase).Compression; got != cfg {
+		t.Errorf("rebase compression config is %v, want %v", got, cfg)
+	}
+	if got := v[1].(*Repack).Compression; got != cfg {
+		t.Errorf("repack compression config is %v, want %v", got, cfg)
+	}
+	if got := v[2].(*Save).Compression; got != cfg {
+		t.Errorf("save compression config is %v, want %v", got, cfg)
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// isDepExSection reports whether a section holds a dependency expression.
+func isDepExSection(s *uefi.Section) bool {
+	switch s.Header.Type {
+	case uefi.SectionTypeDXEDepEx, uefi.SectionTypePEIDepEx, uefi.SectionMMDepEx:
+		return true
+	}
+	return false
+}
+
+// depExSectionType returns the type of the dependency expression section of a
+// file type.
+func depExSectionType(t uefi.FVFileType) uefi.SectionType {
+	switch t {
+	case uefi.FVFileTypePEIM:
+		return uefi.SectionTypePEIDepEx
+	case uefi.FVFileTypeSMM, uefi.FVFileTypeSMMStandalone:
+		return uefi.SectionMMDepEx
+	}
+	return uefi.SectionTypeDXEDepEx
+}
+
+// SetDepEx sets the dependency expression of the matching files. All the
+// dependency expression sections of a file are replaced. A file without one
+// gets a new section whose type depends on the file type.
+type SetDepEx struct {
+	// Input
+	Predicate FindPredicate
+	DepEx     []uefi.DepExOp
+
+	// Output
+	Matches []uefi.Firmware
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *SetDepEx) Run(f uefi.Firmware) error {
+	find := Find{
+		Predicate: v.Predicate,
+	}
+	if err := find.Run(f); err != nil {
+		return err
+	}
+	if len(find.Matches) == 0 {
+		return errors.New("no matches found")
+	}
+	v.Matches = find.Matches
+	for _, m := range v.Matches {
+		if err := m.Apply(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Visit applies the SetDepEx visitor to any Firmware type.
+func (v *SetDepEx) Visit(f uefi.Firmware) error {
+	file, ok := f.(*uefi.File)
+	if !ok {
+		return fmt.Errorf("set_depex only applies to files, got %T", f)
+	}
+	if len(file.Sections) == 0 {
+		return fmt.Errorf("sections of file %v are not parsed", file.Header.GUID)
+	}
+
+	var found bool
+	for _, s := range querySections(file.Sections) {
+		if isDepExSection(s) {
+			s.DepEx = v.DepEx
+			s.MarkDirty()
+			found = true
+		}
+	}
+	if !found {
+		s := &uefi.Section{}
+		s.SetType(depExSectionType(file.Header.Type))
+		s.DepEx = v.DepEx
+		file.Sections = append([]*uefi.Section{s}, file.Sections...)
+		file.MarkDirty()
+	}
+	return nil
+}
+
+// PrintDepEx prints the dependency expressions of the matching files.
+type PrintDepEx struct {
+	// Input
+	Predicate FindPredicate
+
+	// Output
+	// The expressions are written to this writer.
+	W io.Writer
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *PrintDepEx) Run(f uefi.Firmware) error {
+	find := Find{
+		Predicate: v.Predicate,
+	}
+	if err := find.Run(f); err != nil {
+		return err
+	}
+	for _, m := range find.Matches {
+		if err := m.Apply(v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Visit applies the PrintDepEx visitor to any Firmware type.
+func (v *PrintDepEx) Visit(f uefi.Firmware) error {
+	file, ok := f.(*uefi.File)
+	if !ok {
+		return nil
+	}
+	for _, s := range querySections(file.Sections) {
+		if !isDepExSection(s) {
+			continue
+		}
+		text, err := uefi.DepExText(s.DepEx)
+		if err != nil {
+			text = err.Error()
+		}
+		name := fileName(file)
+		if name == "" {
+			name = file.Header.GUID.String()
+		}
+		fmt.Fprintf(v.W, "%v %s %v: %s\n", file.Header.GUID, name, s.Header.Type, text)
+	}
+	return nil
+}
+
+func init() {
+	RegisterCLI("set_depex", "set_depex (GUID|NAME|QUERY) depex\n set the dependency expression of the matching files, such as 'GUID1 AND (GUID2 OR NOT GUID3)'", 2, func(args []string) (uefi.Visitor, error) {
+		pred, err := FindQueryPredicate(args[0])
+		if err != nil {
+			return nil, err
+		}
+		ops, err := uefi.ParseDepExText(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return &SetDepEx{
+			Predicate: pred,
+			DepEx:     ops,
+		}, nil
+	})
+	RegisterCLI("depex", "depex (GUID|NAME|QUERY)\n print the dependency expressions of the matching files", 1, func(args []string) (uefi.Visitor, error) {
+		pred, err := FindQueryPredicate(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &PrintDepEx{
+			Predicate: pred,
+			W:         os.Stdout,
+		}, nil
+	})
+}
@@ -0,0 +1,84 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+func TestSetDepEx(t *testing.T) {
+	fv := patchTestFV(t, "A", "B")
+	set := func(name, text string) {
+		ops, err := uefi.ParseDepExText(text)
+		if err != nil {
+			t.Fatal(err)
+		}
+		v := &SetDepEx{Predicate: FindFileGUIDPredicate(patchTestGUID(name)), DepEx: ops}
+		if err := v.Run(fv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The first call adds a section, the second replaces it.
+	set("A", "TRUE")
+	set("A", "NOT "+patchTestGUID("B").String()+" OR FALSE")
+	if err := (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	fv, err := uefi.NewFirmwareVolume(fv.Buf(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	w := &bytes.Buffer{}
+	if err := (&PrintDepEx{Predicate: FindFileGUIDPredicate(patchTestGUID("A")), W: w}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	a := patchTestGUID("A")
+	want := a.String() + " " + a.String() + " EFI_SECTION_DXE_DEPEX: NOT " + patchTestGUID("B").String() + " OR FALSE\n"
+	if w.String() != want {
+		t.Errorf("got %q, want %q", w.String(), want)
+	}
+
+	var types []uefi.SectionType
+	for _, s := range fv.Files[0].Sections {
+		types = append(types, s.Header.Type)
+	}
+	if want := []uefi.SectionType{uefi.SectionTypeDXEDepEx, uefi.SectionTypeRaw}; !reflect.DeepEqual(types, want) {
+		t.Errorf("got sections %v, want %v", types, want)
+	}
+}
+
+func TestSetDepExSectionType(t *testing.T) {
+	var tests = []struct {
+		fileType uefi.FVFileType
+		want     uefi.SectionType
+	}{
+		{uefi.FVFileTypePEIM, uefi.SectionTypePEIDepEx},
+		{uefi.FVFileTypeDriver, uefi.SectionTypeDXEDepEx},
+		{uefi.FVFileTypeSMM, uefi.SectionMMDepEx},
+		{uefi.FVFileTypeSMMStandalone, uefi.SectionMMDepEx},
+	}
+	for _, test := range tests {
+		f := queryTestFile("File", test.fileType, 0x100)
+		v := &SetDepEx{DepEx: []uefi.DepExOp{{OpCode: "TRUE"}, {OpCode: "END"}}}
+		if err := v.Visit(f); err != nil {
+			t.Fatal(err)
+		}
+		if got := f.Sections[0].Header.Type; got != test.want {
+			t.Errorf("%v: got depex section %v, want %v", test.fileType, got, test.want)
+		}
+	}
+}
+
+func TestSetDepExNoMatch(t *testing.T) {
+	v := &SetDepEx{Predicate: FindFileGUIDPredicate(patchTestGUID("Missing"))}
+	if err := v.Run(patchTestFV(t, "A")); err == nil {
+		t.Error("expected an error")
+	}
+}
@@ -0,0 +1,395 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+
+	"github.com/linuxboot/fiano/pkg/compression"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// DiffNode is a node of a firmware tree compared by the Diff visitor.
+type DiffNode struct {
+	// Key identifies the node in its tree: regions by type, volumes and
+	// files by GUID, sections by type and position in their parent and NVARs
+	// and VSS variables by GUID and name. Nodes with the same identity are
+	// numbered in tree order, and are matched with the nodes of the other
+	// tree by content, then by name and then in order.
+	Key  string
+	Kind string
+	Name string `json:",omitempty"`
+	// Parent is the key of the closest ancestor node.
+	Parent string `json:",omitempty"`
+	// Offset of the node, relative to the image or, in encapsulation
+	// sections, to the section content.
+	Offset uint64
+	Size   uint64
+	SHA256 string
+
+	// id is the identity of the node, sections are only compared with the
+	// sections of the matching parent.
+	id     string
+	parent *DiffNode
+}
+
+// DiffChange is the kind of change of a node between two firmware trees.
+type DiffChange string
+
+// Changes reported by the Diff visitor.
+const (
+	DiffAdded   DiffChange = "added"
+	DiffRemoved DiffChange = "removed"
+	DiffMoved   DiffChange = "moved"
+	DiffChanged DiffChange = "changed"
+)
+
+// DiffEntry is a difference between two firmware trees. Old is nil for added
+// nodes and New is nil for removed nodes.
+type DiffEntry struct {
+	Change DiffChange
+	Old    *DiffNode `json:",omitempty"`
+	New    *DiffNode `json:",omitempty"`
+}
+
+// Diff compares the firmware with another firmware. It reports the added,
+// removed, moved and changed regions, firmware volumes, files, sections and
+// NVARs. A node is moved when its parent changed. Pad files are ignored as
+// they change with the layout of the volume.
+type Diff struct {
+	// Input
+	Other uefi.Firmware
+	JSON  bool
+	// Compression configures the compressors used to assemble the other
+	// firmware when it is an extracted directory. If nil,
+	// compression.DefaultConfig() is used.
+	Compression *compression.Config
+
+	// Output
+	Entries []DiffEntry
+	// The differences are written to this writer.
+	W io.Writer
+
+	// If Other is nil, it is opened from this path by Run.
+	otherPath string
+}
+
+// SetCompression implements CompressionSetter.
+func (v *Diff) SetCompression(cfg *compression.Config) {
+	v.Compression = cfg
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *Diff) Run(f uefi.Firmware) error {
+	if v.Other == nil {
+		other, err := openImage(v.otherPath, v.Compression)
+		if err != nil {
+			return err
+		}
+		v.Other = other
+	}
+	return f.Apply(v)
+}
+
+// Visit applies the Diff visitor to any Firmware type.
+func (v *Diff) Visit(f uefi.Firmware) error {
+	oldNodes, err := diffNodes(f)
+	if err != nil {
+		return err
+	}
+	newNodes, err := diffNodes(v.Other)
+	if err != nil {
+		return err
+	}
+	v.Entries = diffEntries(oldNodes, newNodes)
+	if v.W == nil {
+		return nil
+	}
+	if v.JSON {
+		b, err := json.MarshalIndent(v.Entries, "", "\t")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(v.W, string(b))
+		return err
+	}
+	w := tabwriter.NewWriter(v.W, 0, 0, 2, ' ', 0)
+	for _, e := range v.Entries {
+		n := e.New
+		if n == nil {
+			n = e.Old
+		}
+		var detail string
+		switch e.Change {
+		case DiffAdded, DiffRemoved:
+			detail = fmt.Sprintf("%#x+%#x %v", n.Offset, n.Size, n.SHA256)
+		case DiffMoved:
+			detail = fmt.Sprintf("%v -> %v", e.Old.Parent, e.New.Parent)
+		case DiffChanged:
+			detail = fmt.Sprintf("%#x+%#x %v -> %#x+%#x %v", e.Old.Offset, e.Old.Size, e.Old.SHA256,
+				e.New.Offset, e.New.Size, e.New.SHA256)
+		}
+		fmt.Fprintf(w, "%v\t%v\t%v\t%v\t%v\n", e.Change, n.Kind, n.Key, n.Name, detail)
+	}
+	return w.Flush()
+}
+
+// diffEntries compares the nodes of two trees. Removed and changed nodes are
+// listed in the order of the old tree, followed by the added nodes.
+func diffEntries(oldNodes, newNodes []*DiffNode) []DiffEntry {
+	type group struct {
+		parent *DiffNode
+		id     string
+	}
+	groupOf := func(n, parent *DiffNode) group {
+		if n.Kind != "Section" {
+			return group{id: n.id}
+		}
+		return group{parent, n.id}
+	}
+	olds := make(map[group][]*DiffNode)
+	for _, o := range oldNodes {
+		g := groupOf(o, o.parent)
+		olds[g] = append(olds[g], o)
+	}
+	news := make(map[group][]*DiffNode)
+	for _, n := range newNodes {
+		g := groupOf(n, n.parent)
+		news[g] = append(news[g], n)
+	}
+
+	// Parents come before their children, so they are matched before their
+	// sections are paired with the sections of the matching parent.
+	matches := make(map[*DiffNode]*DiffNode)
+	matched := make(map[*DiffNode]bool)
+	for _, o := range oldNodes {
+		g := groupOf(o, o.parent)
+		if o != olds[g][0] {
+			continue
+		}
+		candidates := news[groupOf(o, matches[o.parent])]
+		for _, same := range []func(o, n *DiffNode) bool{
+			func(o, n *DiffNode) bool { return o.SHA256 == n.SHA256 },
+			func(o, n *DiffNode) bool { return o.Name != "" && o.Name == n.Name },
+			func(o, n *DiffNode) bool { return true },
+		} {
+			for _, old := range olds[g] {
+				if matches[old] != nil {
+					continue
+				}
+				for _, n := range candidates {
+					if !matched[n] && same(old, n) {
+						matches[old] = n
+						matched[n] = true
+						break
+					}
+				}
+			}
+		}
+	}
+
+	var entries []DiffEntry
+	for _, o := range oldNodes {
+		n := matches[o]
+		if n == nil {
+			entries = append(entries, DiffEntry{Change: DiffRemoved, Old: o})
+			continue
+		}
+		if (o.parent == nil) != (n.parent == nil) || o.parent != nil && matches[o.parent] != n.parent {
+			entries = append(entries, DiffEntry{Change: DiffMoved, Old: o, New: n})
+		}
+		if o.SHA256 != n.SHA256 {
+			entries = append(entries, DiffEntry{Change: DiffChanged, Old: o, New: n})
+		}
+	}
+	for _, n := range newNodes {
+		if !matched[n] {
+			entries = append(entries, DiffEntry{Change: DiffAdded, New: n})
+		}
+	}
+	return entries
+}
+
+// diffNodes lists the nodes of a firmware tree.
+func diffNodes(f uefi.Firmware) ([]*DiffNode, error) {
+	c := &diffCollector{nodes: &[]*DiffNode{}, count: make(map[string]int)}
+	if err := c.Run(f); err != nil {
+		return nil, err
+	}
+	return *c.nodes, nil
+}
+
+// diffCollector walks a firmware tree and collects its nodes. It tracks the
+// offsets the way the Table visitor does.
+type diffCollector struct {
+	nodes     *[]*DiffNode
+	count     map[string]int
+	parent    *DiffNode
+	offset    uint64
+	curOffset uint64
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *diffCollector) Run(f uefi.Firmware) error {
+	return f.Apply(v)
+}
+
+// Visit applies the diffCollector visitor to any Firmware type.
+func (v *diffCollector) Visit(f uefi.Firmware) error {
+	var offset uint64
+	switch f := f.(type) {
+	case *uefi.FlashDescriptor:
+		return v.add(f, "Region", "IFD", "", 0, 0)
+	case *uefi.BIOSRegion:
+		if f.FRegion != nil {
+			offset = uint64(f.FRegion.BaseOffset())
+		}
+		return v.add(f, "Region", f.Type().String(), "", offset, offset)
+	case *uefi.MERegion:
+		if f.FRegion != nil {
+			offset = uint64(f.FRegion.BaseOffset())
+		}
+		return v.add(f, "Region", f.Type().String(), "", offset, offset)
+	case *uefi.RawRegion:
+		if f.FRegion != nil {
+			offset = uint64(f.FRegion.BaseOffset())
+		}
+		return v.add(f, "Region", f.Type().String(), "", offset, offset)
+	case *uefi.FirmwareVolume:
+		return v.add(f, "FV", f.String(), f.FVType, v.offset+f.FVOffset, v.offset+f.FVOffset+f.DataOffset)
+	case *uefi.File:
+		if f.Header.Type == uefi.FVFileTypePad {
+			v.curOffset = uefi.Align8(v.curOffset + uint64(len(f.Buf())))
+			return nil
+		}
+		err := v.add(f, "File", f.Header.GUID.String(), fileName(f), v.curOffset, v.curOffset+f.DataOffset)
+		v.curOffset = uefi.Align8(v.curOffset)
+		return err
+	case *uefi.Section:
+		// Sections are identified by their position in the parent.
+		return v.add(f, "Section", f.Type, f.String(), v.curOffset, 0)
+	case *uefi.NVarStore:
+		v2 := *v
+		v2.offset = v.curOffset
+		v2.curOffset = v.curOffset
+		if err := f.ApplyChildren(&v2); err != nil {
+			return err
+		}
+		v.curOffset += uint64(len(f.Buf()))
+		return nil
+	case *uefi.NVar:
+		return v.add(f, "NVAR", f.GUID.String()+":"+f.Name, f.Type.String(), v.curOffset, v.curOffset+uint64(f.DataOffset))
+	case *uefi.VariableStore:
+		v2 := *v
+		v2.offset = v.curOffset
+		v2.curOffset = v.curOffset
+		if err := f.ApplyChildren(&v2); err != nil {
+			return err
+		}
+		v.curOffset += uint64(len(f.Buf()))
+		return nil
+	case *uefi.Variable:
+		return v.add(f, "VSS", f.GUID.String()+":"+f.Name, f.Header.State.String(), v.offset+f.Offset, 0)
+	case *uefi.BIOSPadding, *uefi.FTWWorkingBlock:
+		v.curOffset += uint64(len(f.Buf()))
+		return nil
+	}
+	return f.ApplyChildren(v)
+}
+
+// add records a node and visits its children.
+func (v *diffCollector) add(f uefi.Firmware, kind, id, name string, offset, dataOffset uint64) error {
+	key := kind + " " + id
+	var parent string
+	if v.parent != nil {
+		parent = v.parent.Key
+		if kind == "Section" {
+			key = kind + " " + parent + "/" + id
+		}
+	}
+	if n := v.count[key]; n > 0 {
+		v.count[key]++
+		key = fmt.Sprintf("%v#%d", key, n)
+	} else {
+		v.count[key] = 1
+	}
+	sum := sha256.Sum256(f.Buf())
+	node := &DiffNode{
+		Key:    key,
+		Kind:   kind,
+		Name:   name,
+		Parent: parent,
+		Offset: offset,
+		Size:   uint64(len(f.Buf())),
+		SHA256: hex.EncodeToString(sum[:]),
+		id:     kind + " " + id,
+		parent: v.parent,
+	}
+	*v.nodes = append(*v.nodes, node)
+
+	v2 := *v
+	v2.parent = node
+	v2.offset = dataOffset
+	v2.curOffset = dataOffset
+	if err := f.ApplyChildren(&v2); err != nil {
+		return err
+	}
+	v.curOffset += uint64(len(f.Buf()))
+	return nil
+}
+
+// fileName returns the name of the file from its user interface section.
+func fileName(f *uefi.File) string {
+	for _, s := range f.Sections {
+		if s.Header.Type == uefi.SectionTypeUserInterface {
+			return s.Name
+		}
+	}
+	return ""
+}
+
+// openImage parses an image file or a directory extracted by the Extract
+// visitor, which is assembled with the compression config.
+func openImage(path string, cfg *compression.Config) (uefi.Firmware, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if fi.IsDir() {
+		f, err := (&ParseDir{BasePath: path}).Parse()
+		if err != nil {
+			return nil, err
+		}
+		// Assemble the tree from the bottom up
+		return f, (&Assemble{Compression: cfg}).Run(f)
+	}
+	image, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return uefi.Parse(image)
+}
+
+func init() {
+	RegisterCLI("diff", "print the differences with the firmware in FILE (image or extracted directory)", 1, func(args []string) (uefi.Visitor, error) {
+		if _, err := os.Stat(args[0]); err != nil {
+			return nil, err
+		}
+		return &Diff{W: os.Stdout, otherPath: args[0]}, nil
+	})
+	RegisterCLI("diff-json", "print the differences with the firmware in FILE (image or extracted directory) as JSON", 1, func(args []string) (uefi.Visitor, error) {
+		if _, err := os.Stat(args[0]); err != nil {
+			return nil, err
+		}
+		return &Diff{JSON: true, W: os.Stdout, otherPath: args[0]}, nil
+	})
+}
@@ -0,0 +1,149 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+func diffChanges(entries []DiffEntry) []string {
+	var changes []string
+	for _, e := range entries {
+		n := e.New
+		if n == nil {
+			n = e.Old
+		}
+		changes = append(changes, string(e.Change)+" "+n.Key)
+	}
+	return changes
+}
+
+func TestDiff(t *testing.T) {
+	oldFV, err := uefi.NewFirmwareVolume(sampleFV, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newFV, err := uefi.NewFirmwareVolume(sampleFV, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff := &Diff{Other: newFV}
+	if err = diff.Run(oldFV); err != nil {
+		t.Fatal(err)
+	}
+	if len(diff.Entries) != 0 {
+		t.Fatalf("identical volumes differ: %v", diffChanges(diff.Entries))
+	}
+
+	// Remove the last file.
+	var removed *uefi.File
+	for _, f := range newFV.Files {
+		if f.Header.Type != uefi.FVFileTypePad {
+			removed = f
+		}
+	}
+	remove := &Remove{Predicate: FindFileGUIDPredicate(removed.Header.GUID)}
+	if err = remove.Run(newFV); err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Assemble{}).Run(newFV); err != nil {
+		t.Fatal(err)
+	}
+
+	b := &bytes.Buffer{}
+	diff = &Diff{Other: newFV, W: b}
+	if err = diff.Run(oldFV); err != nil {
+		t.Fatal(err)
+	}
+	changes := diffChanges(diff.Entries)
+	want := []string{"changed FV " + oldFV.String(), "removed File " + removed.Header.GUID.String()}
+	if !reflect.DeepEqual(changes, want) {
+		t.Errorf("wrong changes, expected %v got %v", want, changes)
+	}
+	if !strings.HasPrefix(b.String(), "changed  FV") {
+		t.Errorf("wrong text output, got\n%v", b.String())
+	}
+
+	b.Reset()
+	diff = &Diff{Other: newFV, JSON: true, W: b}
+	if err = diff.Run(oldFV); err != nil {
+		t.Fatal(err)
+	}
+	var entries []DiffEntry
+	if err = json.Unmarshal(b.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != len(changes) || entries[0].Old.SHA256 == entries[0].New.SHA256 {
+		t.Errorf("wrong JSON output, got\n%v", b.String())
+	}
+}
+
+func TestDiffNVar(t *testing.T) {
+	parse := func() uefi.Firmware {
+		f, err := (&ParseDir{BasePath: "../../integration/roms/nvartest/"}).Parse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = (&Assemble{}).Run(f); err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	oldRoot, newRoot := parse(), parse()
+	set := &NVarSet{Name: "DiffTest", GUID: *newNVarGUID, Content: []byte("diff")}
+	if err := set.Run(newRoot); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Assemble{}).Run(newRoot); err != nil {
+		t.Fatal(err)
+	}
+	diff := &Diff{Other: newRoot}
+	if err := diff.Run(oldRoot); err != nil {
+		t.Fatal(err)
+	}
+	changes := diffChanges(diff.Entries)
+	want := "added NVAR " + newNVarGUID.String() + ":DiffTest"
+	if len(changes) == 0 || changes[len(changes)-1] != want {
+		t.Errorf("expected %q as the last change, got %v", want, changes)
+	}
+}
+
+func TestDiffDuplicates(t *testing.T) {
+	oldFV := patchTestFV(t, "A:1", "B", "A:2", "A:3")
+	a := "File " + patchTestGUID("A").String()
+
+	// Adding a file in front of files with the same GUID does not renumber
+	// them.
+	newFV := patchTestFV(t, "A:0", "A:1", "B", "A:2", "A:3")
+	diff := &Diff{Other: newFV}
+	if err := diff.Run(oldFV); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"changed FV " + oldFV.String(), "added " + a, "added Section " + a + "/EFI_SECTION_RAW"}
+	if changes := diffChanges(diff.Entries); !reflect.DeepEqual(changes, want) {
+		t.Errorf("wrong changes, expected %v got %v", want, changes)
+	}
+	if sum := sha256.Sum256(newFV.Files[0].Buf()); diff.Entries[1].New.SHA256 != hex.EncodeToString(sum[:]) {
+		t.Errorf("added %v, expected the first file", diff.Entries[1].New)
+	}
+
+	// Changed files are matched in order once the identical files are.
+	diff = &Diff{Other: patchTestFV(t, "A:1", "B", "A:4", "A:3")}
+	if err := diff.Run(oldFV); err != nil {
+		t.Fatal(err)
+	}
+	want = []string{"changed FV " + oldFV.String(), "changed " + a + "#1", "changed Section " + a + "#1/EFI_SECTION_RAW"}
+	if changes := diffChanges(diff.Entries); !reflect.DeepEqual(changes, want) {
+		t.Errorf("wrong changes, expected %v got %v", want, changes)
+	}
+}
@@ -0,0 +1,533 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/knownguids"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// DispatchDB lists the protocols and PPIs installed by files. Files do not
+// record what they install, so it has to come from a database.
+type DispatchDB struct {
+	// Preinstalled lists the GUIDs installed before the first file of each
+	// phase is dispatched, such as the PPIs of SEC and the protocols of the
+	// DXE core.
+	Preinstalled []guid.GUID
+
+	// Files lists the GUIDs installed by each file.
+	Files []DispatchFile
+
+	// ArchProtocols lists the architectural protocols. DXE drivers without
+	// a dependency expression wait for all of them. When empty, the
+	// architectural protocols of the PI specification are used.
+	ArchProtocols []guid.GUID `json:",omitempty"`
+
+	// Names maps GUIDs to names in the report.
+	Names map[string]string `json:",omitempty"`
+}
+
+// DispatchFile lists the GUIDs installed by a file.
+type DispatchFile struct {
+	GUID     guid.GUID
+	Installs []guid.GUID
+}
+
+// DispatchArchProtocols are the DXE architectural protocols of the PI
+// specification.
+var DispatchArchProtocols = []guid.GUID{
+	*guid.MustParse("A46423E3-4617-49F1-B9FF-D1BFA9115839"), // Security
+	*guid.MustParse("26BACCB1-6F42-11D4-BCE7-0080C73C8881"), // CPU
+	*guid.MustParse("26BACCB2-6F42-11D4-BCE7-0080C73C8881"), // Metronome
+	*guid.MustParse("26BACCB3-6F42-11D4-BCE7-0080C73C8881"), // Timer
+	*guid.MustParse("665E3FF6-46CC-11D4-9A38-0090273FC14D"), // BDS
+	*guid.MustParse("665E3FF5-46CC-11D4-9A38-0090273FC14D"), // Watchdog timer
+	*guid.MustParse("B7DFB4E1-052F-449F-87BE-9818FC91B733"), // Runtime
+	*guid.MustParse("1E5668E2-8481-11D4-BCF1-0080C73C8881"), // Variable
+	*guid.MustParse("6441F818-6362-4E44-B570-7DBA31DD2453"), // Variable write
+	*guid.MustParse("5053697E-2CBC-4819-90D9-0580DEEE5754"), // Capsule
+	*guid.MustParse("1DA97072-BDDC-4B30-99F1-72A0B56FFF2A"), // Monotonic counter
+	*guid.MustParse("27CFAC88-46CC-11D4-9A38-0090273FC14D"), // Reset
+	*guid.MustParse("27CFAC87-46CC-11D4-9A38-0090273FC14D"), // Real time clock
+}
+
+// LoadDispatchDB reads a DispatchDB from a JSON file.
+func LoadDispatchDB(path string) (*DispatchDB, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	db := &DispatchDB{}
+	if err := json.Unmarshal(b, db); err != nil {
+		return nil, fmt.Errorf("cannot parse dispatch database %q: %v", path, err)
+	}
+	return db, nil
+}
+
+// DispatchPhase is the result of the dispatch of one phase.
+type DispatchPhase struct {
+	Name string
+
+	// Order lists the dispatched files in dispatch order.
+	Order []guid.GUID
+
+	// Undispatched lists the files which are never dispatched.
+	Undispatched []DispatchFailure
+}
+
+// DispatchFailure tells why a file is never dispatched.
+type DispatchFailure struct {
+	GUID guid.GUID
+
+	// OnRequest is set for SOR files, which are only dispatched when another
+	// file requests it.
+	OnRequest bool `json:",omitempty"`
+
+	// Missing lists the GUIDs of the dependency expression which are not
+	// installed. For BEFORE and AFTER expressions, it holds the GUID of the
+	// file which is not dispatched.
+	Missing []guid.GUID `json:",omitempty"`
+
+	// BrokenBy lists the removed files installing a missing GUID, directly
+	// or through other files which are not dispatched.
+	BrokenBy []guid.GUID `json:",omitempty"`
+
+	// Err is set when the dependency expression is invalid.
+	Err string `json:",omitempty"`
+
+	// order is set for BEFORE and AFTER expressions.
+	order bool
+}
+
+// dispatchPhases are the phases dispatching files, in order. Files without a
+// dependency expression are always dispatched in PEI, wait for the
+// architectural protocols in DXE and are never dispatched in MM.
+var dispatchPhases = []struct {
+	name  string
+	types []uefi.FVFileType
+	depex uefi.SectionType
+}{
+	{"PEI", []uefi.FVFileType{uefi.FVFileTypePEIM, uefi.FVFileTypeCombinedPEIMDriver}, uefi.SectionTypePEIDepEx},
+	{"DXE", []uefi.FVFileType{uefi.FVFileTypeDriver, uefi.FVFileTypeCombinedPEIMDriver, uefi.FVFileTypeCombinedSMMDXE}, uefi.SectionTypeDXEDepEx},
+	{"MM", []uefi.FVFileType{uefi.FVFileTypeSMM, uefi.FVFileTypeCombinedSMMDXE, uefi.FVFileTypeSMMStandalone}, uefi.SectionMMDepEx},
+}
+
+// Dispatch simulates the dispatch of the PEI, DXE and MM files. It evaluates
+// their dependency expressions with the GUIDs installed by the files which
+// are already dispatched. MM files also see the GUIDs installed in DXE.
+type Dispatch struct {
+	// Input
+	DB *DispatchDB
+
+	// Files matching Removed are left out of the simulation. Files of the
+	// database missing in the image are removed too.
+	Removed FindPredicate
+
+	// Output
+	Phases []DispatchPhase
+
+	// The report is written to this writer.
+	W io.Writer
+
+	// Private
+	names map[guid.GUID]string
+}
+
+// dispatchDriver is a file taking part in the dispatch of a phase.
+type dispatchDriver struct {
+	guid       guid.GUID
+	depex      []uefi.DepExOp
+	hasDepex   bool
+	dispatched bool
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *Dispatch) Run(f uefi.Firmware) error {
+	if v.DB == nil {
+		v.DB = &DispatchDB{}
+	}
+	v.names = map[guid.GUID]string{}
+	for g, name := range v.DB.Names {
+		parsed, err := guid.Parse(g)
+		if err != nil {
+			return fmt.Errorf("invalid GUID in dispatch database names: %v", err)
+		}
+		v.names[*parsed] = name
+	}
+
+	find := &Find{Predicate: func(f uefi.Firmware) bool {
+		_, ok := f.(*uefi.File)
+		return ok
+	}}
+	if err := find.Run(f); err != nil {
+		return err
+	}
+	removed := map[guid.GUID]bool{}
+	if v.Removed != nil {
+		rfind := &Find{Predicate: v.Removed}
+		if err := rfind.Run(f); err != nil {
+			return err
+		}
+		for _, m := range rfind.Matches {
+			if file, ok := m.(*uefi.File); ok {
+				removed[file.Header.GUID] = true
+			}
+		}
+	}
+	present := map[guid.GUID]bool{}
+	for _, m := range find.Matches {
+		file := m.(*uefi.File)
+		present[file.Header.GUID] = true
+		if name := fileName(file); name != "" {
+			v.names[file.Header.GUID] = name
+		}
+	}
+	installs := map[guid.GUID][]guid.GUID{}
+	for _, df := range v.DB.Files {
+		installs[df.GUID] = append(installs[df.GUID], df.Installs...)
+		if !present[df.GUID] {
+			removed[df.GUID] = true
+		}
+	}
+
+	installed := map[guid.GUID]bool{}
+	v.Phases = nil
+	for _, phase := range dispatchPhases {
+		// MM files see the GUIDs installed in DXE.
+		if phase.name != "MM" {
+			installed = map[guid.GUID]bool{}
+		}
+		for _, g := range v.DB.Preinstalled {
+			installed[g] = true
+		}
+
+		var drivers []*dispatchDriver
+		for _, m := range find.Matches {
+			file := m.(*uefi.File)
+			if removed[file.Header.GUID] || !dispatchHasType(phase.types, file.Header.Type) {
+				continue
+			}
+			d := &dispatchDriver{guid: file.Header.GUID}
+			d.depex, d.hasDepex = fileDepEx(file, phase.depex)
+			drivers = append(drivers, d)
+		}
+		v.Phases = append(v.Phases, v.simulate(phase.name, drivers, installed, installs))
+	}
+	v.blame(installs, removed)
+
+	if v.W != nil {
+		v.report()
+	}
+	return nil
+}
+
+// Visit applies the Dispatch visitor to any Firmware type.
+func (v *Dispatch) Visit(f uefi.Firmware) error {
+	return nil
+}
+
+func dispatchHasType(types []uefi.FVFileType, t uefi.FVFileType) bool {
+	for _, tt := range types {
+		if tt == t {
+			return true
+		}
+	}
+	return false
+}
+
+// simulate dispatches the drivers of a phase until no more can be
+// dispatched. Like the EDK2 dispatchers, each pass evaluates all the
+// dependency expressions before dispatching the drivers which are ready.
+func (v *Dispatch) simulate(name string, drivers []*dispatchDriver, installed map[guid.GUID]bool,
+	installs map[guid.GUID][]guid.GUID) DispatchPhase {
+	phase := DispatchPhase{Name: name}
+	isInstalled := func(g guid.GUID) bool {
+		return installed[g]
+	}
+	archProtocols := v.DB.ArchProtocols
+	if len(archProtocols) == 0 {
+		archProtocols = DispatchArchProtocols
+	}
+
+	// Files with a BEFORE or AFTER expression are dispatched right before or
+	// after the file they name.
+	var dispatch func(d *dispatchDriver)
+	dispatch = func(d *dispatchDriver) {
+		d.dispatched = true
+		for _, b := range drivers {
+			if op, g := uefi.DepExOrder(b.depex); op == "BEFORE" && *g == d.guid && !b.dispatched {
+				dispatch(b)
+			}
+		}
+		phase.Order = append(phase.Order, d.guid)
+		for _, g := range installs[d.guid] {
+			installed[g] = true
+		}
+		for _, a := range drivers {
+			if op, g := uefi.DepExOrder(a.depex); op == "AFTER" && *g == d.guid && !a.dispatched {
+				dispatch(a)
+			}
+		}
+	}
+
+	// ready reports whether a driver can be dispatched, and the GUIDs it
+	// misses otherwise.
+	ready := func(d *dispatchDriver) (bool, []guid.GUID, error) {
+		if !d.hasDepex {
+			switch name {
+			case "PEI":
+				return true, nil, nil
+			case "DXE":
+				var missing []guid.GUID
+				for _, g := range archProtocols {
+					if !installed[g] {
+						missing = append(missing, g)
+					}
+				}
+				return len(missing) == 0, missing, nil
+			}
+			return false, nil, nil
+		}
+		ok, err := uefi.EvalDepEx(d.depex, isInstalled)
+		if ok || err != nil {
+			return ok, nil, err
+		}
+		var missing []guid.GUID
+		for _, op := range d.depex {
+			if op.OpCode == "PUSH" && !installed[*op.GUID] {
+				missing = append(missing, *op.GUID)
+			}
+		}
+		return false, missing, nil
+	}
+
+	for {
+		var scheduled []*dispatchDriver
+		for _, d := range drivers {
+			if d.dispatched || uefi.DepExOnRequest(d.depex) {
+				continue
+			}
+			if op, _ := uefi.DepExOrder(d.depex); op != "" {
+				continue
+			}
+			if ok, _, _ := ready(d); ok {
+				scheduled = append(scheduled, d)
+			}
+		}
+		if len(scheduled) == 0 {
+			break
+		}
+		for _, d := range scheduled {
+			if !d.dispatched {
+				dispatch(d)
+			}
+		}
+	}
+
+	for _, d := range drivers {
+		if d.dispatched {
+			continue
+		}
+		failure := DispatchFailure{GUID: d.guid, OnRequest: uefi.DepExOnRequest(d.depex)}
+		if op, g := uefi.DepExOrder(d.depex); op != "" {
+			failure.Missing = []guid.GUID{*g}
+			failure.order = true
+		} else {
+			_, missing, err := ready(d)
+			failure.Missing = missing
+			if err != nil {
+				failure.Err = err.Error()
+			}
+		}
+		phase.Undispatched = append(phase.Undispatched, failure)
+	}
+	return phase
+}
+
+// blame finds the removed files which keep the files of the phases from
+// being dispatched. It follows the files which are not dispatched, which
+// may belong to an earlier phase.
+func (v *Dispatch) blame(installs map[guid.GUID][]guid.GUID, removed map[guid.GUID]bool) {
+	installers := map[guid.GUID][]guid.GUID{}
+	for file, gs := range installs {
+		for _, g := range gs {
+			installers[g] = append(installers[g], file)
+		}
+	}
+	failures := map[guid.GUID]*DispatchFailure{}
+	for i := range v.Phases {
+		for j := range v.Phases[i].Undispatched {
+			f := &v.Phases[i].Undispatched[j]
+			failures[f.GUID] = f
+		}
+	}
+
+	var blame func(f *DispatchFailure, visited map[guid.GUID]bool) []guid.GUID
+	blame = func(f *DispatchFailure, visited map[guid.GUID]bool) []guid.GUID {
+		visited[f.GUID] = true
+		var culprits []guid.GUID
+		add := func(file guid.GUID) {
+			if removed[file] {
+				culprits = appendGUID(culprits, file)
+			} else if other, ok := failures[file]; ok && !visited[file] {
+				for _, c := range blame(other, visited) {
+					culprits = appendGUID(culprits, c)
+				}
+			}
+		}
+		for _, m := range f.Missing {
+			if f.order {
+				add(m)
+				continue
+			}
+			for _, file := range sortedGUIDs(installers[m]) {
+				add(file)
+			}
+		}
+		return culprits
+	}
+	for _, f := range failures {
+		f.BrokenBy = blame(f, map[guid.GUID]bool{})
+	}
+}
+
+// appendGUID appends a GUID to a list if it is not in the list yet.
+func appendGUID(gs []guid.GUID, g guid.GUID) []guid.GUID {
+	for _, o := range gs {
+		if o == g {
+			return gs
+		}
+	}
+	return append(gs, g)
+}
+
+// sortedGUIDs sorts GUIDs by their string, which keeps the reports stable.
+func sortedGUIDs(gs []guid.GUID) []guid.GUID {
+	sorted := append([]guid.GUID{}, gs...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].String() < sorted[j].String()
+	})
+	return sorted
+}
+
+// fileDepEx returns the dependency expression section of type t of a file.
+// The sections of files which are not parsed, such as PEIMs, are scanned in
+// the file buffer.
+func fileDepEx(f *uefi.File, t uefi.SectionType) ([]uefi.DepExOp, bool) {
+	if len(f.Sections) != 0 {
+		for _, s := range querySections(f.Sections) {
+			if s.Header.Type == t {
+				return s.DepEx, true
+			}
+		}
+		return nil, false
+	}
+
+	buf := f.Buf()
+	for offset := f.HeaderLen(); offset+uefi.SectionMinLength <= uint64(len(buf)); {
+		size := uefi.Read3Size([3]uint8{buf[offset], buf[offset+1], buf[offset+2]})
+		if size < uefi.SectionMinLength || offset+size > uint64(len(buf)) {
+			// Large sections are never dependency expressions.
+			break
+		}
+		if uefi.SectionType(buf[offset+3]) == t {
+			s, err := uefi.NewSection(buf[offset:offset+size], 0)
+			if err != nil {
+				return nil, false
+			}
+			return s.DepEx, true
+		}
+		offset = uefi.Align4(offset + size)
+	}
+	return nil, false
+}
+
+// name returns the name of a GUID for the report.
+func (v *Dispatch) name(g guid.GUID) string {
+	if name, ok := v.names[g]; ok {
+		return fmt.Sprintf("%v (%s)", g, name)
+	}
+	if name, ok := knownguids.GUIDs[g]; ok {
+		return fmt.Sprintf("%v (%s)", g, name)
+	}
+	return g.String()
+}
+
+// guidNames returns the names of GUIDs for the report.
+func (v *Dispatch) guidNames(gs []guid.GUID) string {
+	var names []string
+	for _, g := range gs {
+		names = append(names, v.name(g))
+	}
+	return strings.Join(names, ", ")
+}
+
+func (v *Dispatch) report() {
+	for _, phase := range v.Phases {
+		if len(phase.Order) == 0 && len(phase.Undispatched) == 0 {
+			continue
+		}
+		fmt.Fprintf(v.W, "%s dispatch order:\n", phase.Name)
+		for i, g := range phase.Order {
+			fmt.Fprintf(v.W, "  %3d %s\n", i+1, v.name(g))
+		}
+		if len(phase.Undispatched) == 0 {
+			continue
+		}
+		fmt.Fprintf(v.W, "%s files never dispatched:\n", phase.Name)
+		for _, f := range phase.Undispatched {
+			fmt.Fprintf(v.W, "  %s\n", v.name(f.GUID))
+			if f.OnRequest {
+				fmt.Fprintf(v.W, "    only dispatched on request\n")
+			}
+			if f.Err != "" {
+				fmt.Fprintf(v.W, "    error: %s\n", f.Err)
+			}
+			if len(f.Missing) != 0 {
+				fmt.Fprintf(v.W, "    missing: %s\n", v.guidNames(f.Missing))
+			}
+			if len(f.BrokenBy) != 0 {
+				fmt.Fprintf(v.W, "    broken by removed: %s\n", v.guidNames(f.BrokenBy))
+			}
+		}
+	}
+}
+
+func init() {
+	RegisterCLI("dispatch", "dispatch db\n simulate the dispatch of the PEI, DXE and MM files with the installed GUIDs of the JSON database `db`", 1, func(args []string) (uefi.Visitor, error) {
+		db, err := LoadDispatchDB(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &Dispatch{
+			DB: db,
+			W:  os.Stdout,
+		}, nil
+	})
+	RegisterCLI("dispatch_remove", "dispatch_remove db (GUID|NAME|QUERY)\n simulate the dispatch without the matching files and report the dependency expressions they break", 2, func(args []string) (uefi.Visitor, error) {
+		db, err := LoadDispatchDB(args[0])
+		if err != nil {
+			return nil, err
+		}
+		pred, err := FindQueryPredicate(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return &Dispatch{
+			DB:      db,
+			Removed: pred,
+			W:       os.Stdout,
+		}, nil
+	})
+}
@@ -0,0 +1,175 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+var (
+	dispatchArch = *guid.MustParse("DDDDDDDD-0000-4000-8000-000000000000")
+	dispatchP1   = *guid.MustParse("DDDDDDDD-0000-4000-8000-000000000001")
+	dispatchP2   = *guid.MustParse("DDDDDDDD-0000-4000-8000-000000000002")
+	dispatchP3   = *guid.MustParse("DDDDDDDD-0000-4000-8000-000000000003")
+	dispatchPPI  = *guid.MustParse("DDDDDDDD-0000-4000-8000-000000000004")
+)
+
+// dispatchTestFile creates a file with a dependency expression section.
+func dispatchTestFile(name string, t uefi.FVFileType, depexType uefi.SectionType, ops ...uefi.DepExOp) *uefi.File {
+	var sections []*uefi.Section
+	if len(ops) != 0 {
+		s := &uefi.Section{DepEx: ops}
+		s.Header.Type = depexType
+		sections = append(sections, s)
+	}
+	return queryTestFile(name, t, 0x1000, sections...)
+}
+
+// dispatchTestPEIM creates a PEIM with a dependency expression pushing g. Like
+// the PEIMs of parsed images, its sections are only in its buffer.
+func dispatchTestPEIM(name string, g guid.GUID) *uefi.File {
+	f := &uefi.File{}
+	f.Header.GUID = patchTestGUID(name)
+	f.Header.Type = uefi.FVFileTypePEIM
+	buf := make([]byte, f.HeaderLen())
+	buf = append(buf, 22, 0, 0, byte(uefi.SectionTypePEIDepEx), 0x02)
+	buf = append(buf, g[:]...)
+	buf = append(buf, 0x08)
+	f.SetBuf(buf)
+	return f
+}
+
+func dispatchPush(g guid.GUID) uefi.DepExOp {
+	return uefi.DepExOp{OpCode: "PUSH", GUID: &g}
+}
+
+func dispatchOp(code uefi.DepExOpCode, g guid.GUID) uefi.DepExOp {
+	return uefi.DepExOp{OpCode: code, GUID: &g}
+}
+
+var dispatchEnd = uefi.DepExOp{OpCode: "END"}
+
+func dispatchTestFV() *uefi.FirmwareVolume {
+	dxe := func(name string, ops ...uefi.DepExOp) *uefi.File {
+		return dispatchTestFile(name, uefi.FVFileTypeDriver, uefi.SectionTypeDXEDepEx, ops...)
+	}
+	return &uefi.FirmwareVolume{Files: []*uefi.File{
+		dispatchTestPEIM("PeiA", dispatchPPI),
+		dispatchTestFile("PeiB", uefi.FVFileTypePEIM, uefi.SectionTypePEIDepEx),
+		dxe("A", dispatchPush(dispatchP1), dispatchPush(dispatchP2), uefi.DepExOp{OpCode: "AND"}, dispatchEnd),
+		dxe("B", dispatchPush(dispatchP1), dispatchEnd),
+		dxe("Core", uefi.DepExOp{OpCode: "TRUE"}, dispatchEnd),
+		dxe("C", dispatchOp("AFTER", patchTestGUID("A")), dispatchEnd),
+		dxe("D", dispatchOp("BEFORE", patchTestGUID("B")), dispatchEnd),
+		dxe("NoDepex"),
+		dxe("Sor", uefi.DepExOp{OpCode: "SOR"}, uefi.DepExOp{OpCode: "TRUE"}, dispatchEnd),
+		dxe("Bad", uefi.DepExOp{OpCode: "AND"}, dispatchEnd),
+		dispatchTestFile("Mm", uefi.FVFileTypeSMM, uefi.SectionMMDepEx, dispatchPush(dispatchP3), dispatchEnd),
+	}}
+}
+
+func dispatchTestDB() *DispatchDB {
+	return &DispatchDB{
+		Preinstalled:  []guid.GUID{dispatchPPI},
+		ArchProtocols: []guid.GUID{dispatchArch},
+		Files: []DispatchFile{
+			{GUID: patchTestGUID("Core"), Installs: []guid.GUID{dispatchP1}},
+			{GUID: patchTestGUID("B"), Installs: []guid.GUID{dispatchP2}},
+			{GUID: patchTestGUID("A"), Installs: []guid.GUID{dispatchP3}},
+			{GUID: patchTestGUID("Arch"), Installs: []guid.GUID{dispatchArch}},
+		},
+	}
+}
+
+// dispatchNames converts GUIDs to the names of the test files.
+func dispatchNames(gs []guid.GUID) []string {
+	var names []string
+	for _, g := range gs {
+		name := g.String()
+		for n, pg := range patchGUIDs {
+			if pg == g {
+				name = n
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestDispatch(t *testing.T) {
+	w := &bytes.Buffer{}
+	v := &Dispatch{DB: dispatchTestDB(), W: w}
+	if err := v.Run(dispatchTestFV()); err != nil {
+		t.Fatal(err)
+	}
+
+	var order [][]string
+	for _, phase := range v.Phases {
+		order = append(order, dispatchNames(phase.Order))
+	}
+	want := [][]string{
+		{"PeiA", "PeiB"},
+		{"Core", "D", "B", "A", "C"},
+		{"Mm"},
+	}
+	if !reflect.DeepEqual(order, want) {
+		t.Errorf("dispatch order is %v, want %v", order, want)
+	}
+
+	dxe := v.Phases[1].Undispatched
+	if len(dxe) != 3 {
+		t.Fatalf("expected 3 undispatched DXE files, got %+v", dxe)
+	}
+	if dxe[0].GUID != patchTestGUID("NoDepex") || !reflect.DeepEqual(dxe[0].Missing, []guid.GUID{dispatchArch}) ||
+		!reflect.DeepEqual(dispatchNames(dxe[0].BrokenBy), []string{"Arch"}) {
+		t.Errorf("file without depex should wait for the missing Arch file, got %+v", dxe[0])
+	}
+	if dxe[1].GUID != patchTestGUID("Sor") || !dxe[1].OnRequest {
+		t.Errorf("SOR file should only be dispatched on request, got %+v", dxe[1])
+	}
+	if dxe[2].GUID != patchTestGUID("Bad") || dxe[2].Err == "" {
+		t.Errorf("invalid depex should be reported, got %+v", dxe[2])
+	}
+	for _, s := range []string{"DXE dispatch order:", "DXE files never dispatched:", "only dispatched on request", "broken by removed"} {
+		if !strings.Contains(w.String(), s) {
+			t.Errorf("report is missing %q:\n%s", s, w.String())
+		}
+	}
+}
+
+func TestDispatchRemove(t *testing.T) {
+	v := &Dispatch{DB: dispatchTestDB(), Removed: FindFileGUIDPredicate(patchTestGUID("B"))}
+	if err := v.Run(dispatchTestFV()); err != nil {
+		t.Fatal(err)
+	}
+	if order := dispatchNames(v.Phases[1].Order); !reflect.DeepEqual(order, []string{"Core"}) {
+		t.Errorf("DXE dispatch order is %v, want [Core]", order)
+	}
+
+	broken := map[string][]string{}
+	for _, phase := range v.Phases {
+		for _, f := range phase.Undispatched {
+			if len(f.BrokenBy) != 0 {
+				broken[dispatchNames([]guid.GUID{f.GUID})[0]] = dispatchNames(f.BrokenBy)
+			}
+		}
+	}
+	want := map[string][]string{
+		"A":       {"B"},
+		"C":       {"B"},
+		"D":       {"B"},
+		"Mm":      {"B"},
+		"NoDepex": {"Arch"},
+	}
+	if !reflect.DeepEqual(broken, want) {
+		t.Errorf("broken files are %v, want %v", broken, want)
+	}
+}
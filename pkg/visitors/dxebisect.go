@@ -0,0 +1,307 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// dxeCleanerState is the progress of the bisect strategy. It is saved to the
+// checkpoint file after each round of tests.
+type dxeCleanerState struct {
+	// Removals are the DXEs removed so far.
+	Removals []guid.GUID
+	// Pending are the groups of DXEs left to test, in order.
+	Pending [][]guid.GUID
+	// Kept are the DXEs which could not be removed during this pass.
+	Kept []guid.GUID
+	// Retry is set when DXEs were removed after others were kept. The kept
+	// DXEs are then tried again in another pass.
+	Retry bool
+}
+
+// findFileGUIDsPredicate matches the files with one of the GUIDs.
+func findFileGUIDsPredicate(gs []guid.GUID) FindPredicate {
+	set := map[guid.GUID]bool{}
+	for _, g := range gs {
+		set[g] = true
+	}
+	return func(f uefi.Firmware) bool {
+		if f, ok := f.(*uefi.File); ok {
+			return set[f.Header.GUID]
+		}
+		return false
+	}
+}
+
+// splitGUIDs splits the GUIDs into at most n groups of about the same size.
+func splitGUIDs(gs []guid.GUID, n int) [][]guid.GUID {
+	if n > len(gs) {
+		n = len(gs)
+	}
+	var groups [][]guid.GUID
+	for i := 0; i < n; i++ {
+		groups = append(groups, gs[i*len(gs)/n:(i+1)*len(gs)/n])
+	}
+	return groups
+}
+
+// dispatchOrder orders the DXEs by their dependency expressions. The files
+// which are never dispatched come first, followed by the others in the reverse
+// of their dispatch order. That way a file is tried before the files it
+// depends on, and files depending on each other end up in the same groups.
+func (v *DXECleaner) dispatchOrder(f uefi.Firmware, dxes []guid.GUID) ([]guid.GUID, error) {
+	if v.DB == nil {
+		return dxes, nil
+	}
+	dispatch := &Dispatch{DB: v.DB}
+	if err := dispatch.Run(f); err != nil {
+		return nil, err
+	}
+	rank := map[guid.GUID]int{}
+	for _, phase := range dispatch.Phases {
+		for _, u := range phase.Undispatched {
+			rank[u.GUID] = len(rank)
+		}
+	}
+	var order []guid.GUID
+	for _, phase := range dispatch.Phases {
+		order = append(order, phase.Order...)
+	}
+	for i := len(order) - 1; i >= 0; i-- {
+		if _, ok := rank[order[i]]; !ok {
+			rank[order[i]] = len(rank)
+		}
+	}
+
+	ordered := append([]guid.GUID{}, dxes...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		ri, ok := rank[ordered[i]]
+		if !ok {
+			ri = len(rank)
+		}
+		rj, ok := rank[ordered[j]]
+		if !ok {
+			rj = len(rank)
+		}
+		return ri < rj
+	})
+	return ordered, nil
+}
+
+// loadCheckpoint returns the state saved to the checkpoint file, or nil if
+// there is none.
+func (v *DXECleaner) loadCheckpoint() (*dxeCleanerState, error) {
+	if v.Checkpoint == "" {
+		return nil, nil
+	}
+	buf, err := ioutil.ReadFile(v.Checkpoint)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	state := &dxeCleanerState{}
+	if err := json.Unmarshal(buf, state); err != nil {
+		return nil, fmt.Errorf("cannot parse checkpoint %q: %v", v.Checkpoint, err)
+	}
+	return state, nil
+}
+
+// saveCheckpoint writes the state to the checkpoint file. The file is
+// replaced atomically so that an interrupted run leaves the previous state.
+func (v *DXECleaner) saveCheckpoint(state *dxeCleanerState) error {
+	if v.Checkpoint == "" {
+		return nil
+	}
+	buf, err := json.MarshalIndent(state, "", "\t")
+	if err != nil {
+		return err
+	}
+	tmp := v.Checkpoint + ".tmp"
+	if err := ioutil.WriteFile(tmp, buf, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, v.Checkpoint)
+}
+
+// testGroups tests the removal of each group of DXEs, on top of the removals
+// already applied to f. With TestImage, the images are saved to temporary
+// files and up to len(groups) tests run concurrently. Otherwise, Test is
+// called on each image in turn. f is left unchanged.
+func (v *DXECleaner) testGroups(f uefi.Firmware, groups [][]guid.GUID) ([]bool, error) {
+	results := make([]bool, len(groups))
+	errs := make([]error, len(groups))
+	var wg sync.WaitGroup
+
+	tmpDir, err := ioutil.TempDir("", "dxecleaner")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for i, group := range groups {
+		v.printf("Trying to remove %d DXEs: %v\n", len(group), group)
+		remove := &Remove{Predicate: findFileGUIDsPredicate(group)}
+		if err := remove.Run(f); err != nil {
+			wg.Wait()
+			return nil, err
+		}
+		undo := func() {
+			for remove.Undo != nil {
+				remove.Undo()
+			}
+		}
+
+		if v.TestImage == nil {
+			results[i], errs[i] = v.Test(f)
+			undo()
+			continue
+		}
+		path := filepath.Join(tmpDir, fmt.Sprintf("bios%d.bin", i))
+		err := (&Save{DirPath: path, Compression: v.Compression}).Run(f)
+		undo()
+		if err != nil {
+			wg.Wait()
+			return nil, err
+		}
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			results[i], errs[i] = v.TestImage(path)
+		}(i)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err == context.Canceled {
+			return nil, err
+		} else if results[i] && err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// bisect removes the DXEs in groups. A group which cannot be removed is split
+// in two until the DXEs which are needed are found. Up to Jobs groups are
+// tested in each round.
+func (v *DXECleaner) bisect(f uefi.Firmware, dxes []guid.GUID) error {
+	jobs := v.Jobs
+	if jobs < 1 {
+		jobs = 1
+	}
+
+	state, err := v.loadCheckpoint()
+	if err != nil {
+		return err
+	}
+	if state == nil {
+		if dxes, err = v.dispatchOrder(f, dxes); err != nil {
+			return err
+		}
+		state = &dxeCleanerState{Pending: splitGUIDs(dxes, jobs)}
+	} else {
+		v.printf("Resuming from %s with %d DXEs removed\n", v.Checkpoint, len(state.Removals))
+		for _, r := range state.Removals {
+			remove := &Remove{Predicate: FindFileGUIDPredicate(r)}
+			if err := remove.Run(f); err != nil {
+				return err
+			}
+			if len(remove.Matches) == 0 {
+				return fmt.Errorf("checkpoint %q does not match the image, %v not found", v.Checkpoint, r)
+			}
+		}
+	}
+	v.Removals = state.Removals
+
+	for round := 1; ; round++ {
+		if len(state.Pending) == 0 {
+			if !state.Retry || len(state.Kept) == 0 {
+				return nil
+			}
+			state.Pending = splitGUIDs(state.Kept, jobs)
+			state.Kept, state.Retry = nil, false
+		}
+		v.printf("Beginning of round %d, %d groups left\n", round, len(state.Pending))
+
+		n := jobs
+		if n > len(state.Pending) {
+			n = len(state.Pending)
+		}
+		groups := state.Pending[:n]
+		results, err := v.testGroups(f, groups)
+		if err == context.Canceled {
+			v.printf("Canceled by user!\n")
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		var passed, requeue [][]guid.GUID
+		for i, group := range groups {
+			switch {
+			case results[i]:
+				passed = append(passed, group)
+			case len(group) == 1:
+				v.printf("  Failed %v!\n", group[0])
+				state.Kept = append(state.Kept, group[0])
+			default:
+				v.printf("  Failed group of %d DXEs, splitting it\n", len(group))
+				requeue = append(requeue, group[:len(group)/2], group[len(group)/2:])
+			}
+		}
+
+		// The groups were tested separately, so make sure they can also be
+		// removed together. Otherwise only the first one is removed and the
+		// others are tested again.
+		if len(passed) > 1 {
+			var all []guid.GUID
+			for _, group := range passed {
+				all = append(all, group...)
+			}
+			results, err := v.testGroups(f, [][]guid.GUID{all})
+			if err == context.Canceled {
+				v.printf("Canceled by user!\n")
+				return nil
+			} else if err != nil {
+				return err
+			}
+			if !results[0] {
+				requeue = append(requeue, passed[1:]...)
+				passed = passed[:1]
+			}
+		}
+
+		for _, group := range passed {
+			if err := (&Remove{Predicate: findFileGUIDsPredicate(group)}).Run(f); err != nil {
+				return err
+			}
+			for _, g := range group {
+				v.printf("  Success %v!\n", g)
+			}
+			state.Removals = append(state.Removals, group...)
+			if len(state.Kept) != 0 {
+				state.Retry = true
+			}
+		}
+		state.Pending = append(requeue, state.Pending[n:]...)
+		v.Removals = state.Removals
+
+		if err := v.saveCheckpoint(state); err != nil {
+			return err
+		}
+	}
+}
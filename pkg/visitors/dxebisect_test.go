@@ -0,0 +1,213 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// bisectDependencies is a test of the firmware "booting" with fake
+// dependencies between the DXEs: D5 is required and needs D4, D3 needs D2 and
+// D2 needs D1. has reports whether a DXE is in the firmware.
+func bisectDependencies(has func(name string) bool) bool {
+	return has("D5") && has("D4") &&
+		(!has("D2") || has("D1")) &&
+		(!has("D3") || has("D2"))
+}
+
+func bisectTestFV(t *testing.T) *uefi.FirmwareVolume {
+	return patchTestFV(t, "D1", "D2", "D3", "D4", "D5", "D6")
+}
+
+func bisectTest(t *testing.T) func(f uefi.Firmware) (bool, error) {
+	return func(f uefi.Firmware) (bool, error) {
+		return bisectDependencies(func(name string) bool {
+			g := patchTestGUID(name)
+			return contains(t, f, &g)
+		}), nil
+	}
+}
+
+func bisectRemovals(v *DXECleaner) []string {
+	names := dispatchNames(v.Removals)
+	sort.Strings(names)
+	return names
+}
+
+var bisectWant = []string{"D1", "D2", "D3", "D6"}
+
+func TestDXECleanerBisect(t *testing.T) {
+	f := bisectTestFV(t)
+	v := &DXECleaner{
+		Test:      bisectTest(t),
+		Predicate: FindFileTypePredicate(uefi.FVFileTypeFreeForm),
+		Bisect:    true,
+	}
+	if err := v.Run(f); err != nil {
+		t.Fatal(err)
+	}
+	if got := bisectRemovals(v); !reflect.DeepEqual(got, bisectWant) {
+		t.Errorf("removed %v, want %v", got, bisectWant)
+	}
+	if ok, _ := v.Test(f); !ok {
+		t.Error("the cleaned firmware does not boot")
+	}
+}
+
+func TestDXECleanerBisectParallel(t *testing.T) {
+	f := bisectTestFV(t)
+	v := &DXECleaner{
+		TestImage: func(path string) (bool, error) {
+			buf, err := ioutil.ReadFile(path)
+			if err != nil {
+				return true, err
+			}
+			return bisectDependencies(func(name string) bool {
+				g := patchTestGUID(name)
+				return bytes.Contains(buf, g[:])
+			}), nil
+		},
+		Predicate: FindFileTypePredicate(uefi.FVFileTypeFreeForm),
+		Bisect:    true,
+		Jobs:      3,
+	}
+	if err := v.Run(f); err != nil {
+		t.Fatal(err)
+	}
+	if got := bisectRemovals(v); !reflect.DeepEqual(got, bisectWant) {
+		t.Errorf("removed %v, want %v", got, bisectWant)
+	}
+}
+
+func TestDXECleanerCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dxecleaner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	checkpoint := filepath.Join(dir, "checkpoint.json")
+
+	// Interrupt the first run after a few tests.
+	test := bisectTest(t)
+	calls := 0
+	v := &DXECleaner{
+		Test: func(f uefi.Firmware) (bool, error) {
+			if calls++; calls == 4 {
+				return true, context.Canceled
+			}
+			return test(f)
+		},
+		Predicate:  FindFileTypePredicate(uefi.FVFileTypeFreeForm),
+		Bisect:     true,
+		Checkpoint: checkpoint,
+	}
+	if err := v.Run(bisectTestFV(t)); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Removals) == 0 {
+		t.Fatal("expected the first run to remove DXEs before being canceled")
+	}
+	if _, err := os.Stat(checkpoint); err != nil {
+		t.Fatal(err)
+	}
+
+	// The second run resumes from the checkpoint.
+	f := bisectTestFV(t)
+	v = &DXECleaner{
+		Test:       test,
+		Predicate:  FindFileTypePredicate(uefi.FVFileTypeFreeForm),
+		Bisect:     true,
+		Checkpoint: checkpoint,
+	}
+	if err := v.Run(f); err != nil {
+		t.Fatal(err)
+	}
+	if got := bisectRemovals(v); !reflect.DeepEqual(got, bisectWant) {
+		t.Errorf("removed %v, want %v", got, bisectWant)
+	}
+	for _, name := range bisectWant {
+		if g := patchTestGUID(name); contains(t, f, &g) {
+			t.Errorf("expected %s to be removed", name)
+		}
+	}
+
+	// A checkpoint of another image is rejected.
+	v.Checkpoint = checkpoint
+	if err := v.Run(patchTestFV(t, "D4", "D5")); err == nil {
+		t.Error("expected an error resuming on another image")
+	}
+}
+
+func TestDXECleanerBisectCLI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dxecleaner")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blacklist := filepath.Join(dir, "blacklist")
+	if err := ioutil.WriteFile(blacklist, []byte(patchTestGUID("D2").String()+"\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	driver := func(name string) *uefi.File {
+		f := &uefi.File{}
+		f.Header.GUID = patchTestGUID(name)
+		f.Header.Type = uefi.FVFileTypeDriver
+		return f
+	}
+	var tests = []struct {
+		args        []string
+		match, skip string
+	}{
+		{[]string{"dxecleaner_bisect", "script", "-", "2", "checkpoint"}, "D2", ""},
+		{[]string{"dxecleaner_bisect_blacklist", "script", blacklist, "-", "2", "checkpoint"}, "D1", "D2"},
+		{[]string{"dxecleaner_bisect_query", "script", "guid==" + patchTestGUID("D2").String(), "-", "2", "checkpoint"}, "D2", "D1"},
+	}
+	for _, test := range tests {
+		t.Run(test.args[0], func(t *testing.T) {
+			visitors, err := ParseCLI(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := visitors[0].(*DXECleaner)
+			if !v.Bisect || v.Jobs != 2 || v.Checkpoint != "checkpoint" {
+				t.Errorf("got bisect %v, %d jobs and checkpoint %q, want true, 2 and \"checkpoint\"", v.Bisect, v.Jobs, v.Checkpoint)
+			}
+			if !v.Predicate(driver(test.match)) {
+				t.Errorf("%s should be removed", test.match)
+			}
+			if test.skip != "" && v.Predicate(driver(test.skip)) {
+				t.Errorf("%s should be kept", test.skip)
+			}
+		})
+	}
+}
+
+func TestDXECleanerDispatchOrder(t *testing.T) {
+	fv := dispatchTestFV()
+	var dxes []guid.GUID
+	for _, f := range fv.Files {
+		dxes = append(dxes, f.Header.GUID)
+	}
+	v := &DXECleaner{DB: dispatchTestDB()}
+	order, err := v.dispatchOrder(fv, dxes)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"NoDepex", "Sor", "Bad", "Mm", "C", "A", "B", "D", "Core", "PeiB", "PeiA"}
+	if got := dispatchNames(order); !reflect.DeepEqual(got, want) {
+		t.Errorf("got order %v, want %v", got, want)
+	}
+}
@@ -15,9 +15,11 @@ import (
 	"os/signal"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"syscall"
 
+	"github.com/linuxboot/fiano/pkg/compression"
 	"github.com/linuxboot/fiano/pkg/guid"
 	"github.com/linuxboot/fiano/pkg/uefi"
 )
@@ -26,6 +28,9 @@ import (
 // attempt is made to remove each DXE. The Test function determines if the
 // removal was successful. Additional rounds are performed until all DXEs are
 // removed.
+//
+// With Bisect, DXEs are removed in groups instead, optionally ordered by
+// their dependency expressions, and several tests may run concurrently.
 type DXECleaner struct {
 	// This function tests whether the firmware boots. The return values can be:
 	//
@@ -35,6 +40,11 @@ type DXECleaner struct {
 	//     - (true, err):  Failed to test the firmware due to err.
 	Test func(f uefi.Firmware) (bool, error)
 
+	// TestImage is like Test, but tests the firmware saved to a file. When
+	// set, the bisect strategy uses it to run up to Jobs tests concurrently
+	// on separate images, so it must be safe for concurrent use.
+	TestImage func(path string) (bool, error)
+
 	// Predicate to determine whether a DXE can be removed.
 	Predicate FindPredicate
 
@@ -43,16 +53,42 @@ type DXECleaner struct {
 
 	// Logs are written to this writer.
 	W io.Writer
+
+	// Compression configures the compressors used by Test functions which
+	// save the firmware. If nil, compression.DefaultConfig() is used.
+	Compression *compression.Config
+
+	// Bisect selects the bisect strategy: groups of DXEs are removed at
+	// once, and a group which cannot be removed is split in two.
+	Bisect bool
+
+	// Jobs is the number of groups tested in each round of the bisect
+	// strategy.
+	Jobs int
+
+	// DB lists the GUIDs installed by the files. If set, the bisect
+	// strategy uses the dispatch order to try the DXEs before the DXEs they
+	// depend on.
+	DB *DispatchDB
+
+	// Checkpoint is the file where the bisect strategy saves its progress.
+	// If the file exists, the run resumes from it.
+	Checkpoint string
 }
 
-// Run wraps Visit and performs some setup and teardown tasks.
-func (v *DXECleaner) Run(f uefi.Firmware) error {
-	var printf = func(format string, a ...interface{}) {
-		if v.W != nil {
-			fmt.Fprintf(v.W, format, a...)
-		}
+func (v *DXECleaner) printf(format string, a ...interface{}) {
+	if v.W != nil {
+		fmt.Fprintf(v.W, format, a...)
 	}
+}
+
+// SetCompression implements CompressionSetter.
+func (v *DXECleaner) SetCompression(cfg *compression.Config) {
+	v.Compression = cfg
+}
 
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *DXECleaner) Run(f uefi.Firmware) error {
 	// Find list of DXEs.
 	find := (&Find{Predicate: v.Predicate})
 	if err := find.Run(f); err != nil {
@@ -68,42 +104,46 @@ func (v *DXECleaner) Run(f uefi.Firmware) error {
 
 	// Print list of removals in a format which can be passed back into UTK.
 	defer func() {
-		printf("Summary of removed DXEs:\n")
+		v.printf("Summary of removed DXEs:\n")
 		if len(v.Removals) == 0 {
-			printf("  Could not remove any DXEs\n")
+			v.printf("  Could not remove any DXEs\n")
 		} else {
 			for _, r := range v.Removals {
-				printf("  remove %s \\\n", r)
+				v.printf("  remove %s \\\n", r)
 			}
 		}
 	}()
 
+	if v.Bisect {
+		return v.bisect(f, dxes)
+	}
+
 	// Main algorithm to remove DXEs.
 	moreRoundsNeeded := true
 	for i := 0; moreRoundsNeeded; i++ {
-		printf("Beginning of round %d\n", i+1)
+		v.printf("Beginning of round %d\n", i+1)
 		moreRoundsNeeded = false
 		for i := 0; i < len(dxes); i++ {
 			// Remove the DXE from the image.
-			printf("Trying to remove %v\n", dxes[i])
+			v.printf("Trying to remove %v\n", dxes[i])
 			remove := &Remove{Predicate: FindFileGUIDPredicate(dxes[i])}
 			if err := remove.Run(f); err != nil {
 				return err
 			}
 
 			if removedSuccessfully, err := v.Test(f); err == context.Canceled {
-				printf("Canceled by user %v!\n", dxes[i])
+				v.printf("Canceled by user %v!\n", dxes[i])
 				return nil
 			} else if removedSuccessfully && err != nil {
 				return err
 			} else if removedSuccessfully {
-				printf("  Success %v!\n", dxes[i])
+				v.printf("  Success %v!\n", dxes[i])
 				v.Removals = append(v.Removals, dxes[i])
 				dxes = append(dxes[:i], dxes[i+1:]...)
 				i--
 				moreRoundsNeeded = true
 			} else {
-				printf("  Failed %v!\n", dxes[i])
+				v.printf("  Failed %v!\n", dxes[i])
 				remove.Undo()
 			}
 		}
@@ -141,79 +181,172 @@ func parseBlackList(fileName, fileContents string) (string, error) {
 	return blackList, nil
 }
 
-func init() {
-	register := func(args []string) (uefi.Visitor, error) {
-		// When the user enters CTRL-C, the DXECleaner should stop, but
-		// also output the current progress.
-		ctx, cancel := context.WithCancel(context.Background())
-		c := make(chan os.Signal, 1)
-		signal.Notify(c, os.Interrupt)
-		go func() {
-			<-c
-			cancel()
-		}()
-
-		predicate := FindFileTypePredicate(uefi.FVFileTypeDriver)
-
-		// Create blacklist for DXEs which can be skipped.
-		useBlackList := len(args) == 2
-		if useBlackList {
-			fileName := args[1]
-			fileContents, err := ioutil.ReadFile(fileName)
-			if err != nil {
-				return nil, fmt.Errorf("cannot read blacklist file %q: %v", fileName, err)
+// scriptTest returns a test running script on the image. The exit status of
+// the script is 0 if the image boots, 1 if it could not be tested and 2 if it
+// fails to boot.
+func scriptTest(script string) func(ctx context.Context, path string) (bool, error) {
+	return func(ctx context.Context, path string) (bool, error) {
+		cmd := exec.CommandContext(ctx, script, path)
+		cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
+		if err := cmd.Run(); err != nil {
+			if ctx.Err() != nil {
+				return true, ctx.Err()
 			}
-			blackListRegex, err := parseBlackList(fileName, string(fileContents))
-			if err != nil {
-				return nil, err
+			if _, ok := err.(*exec.ExitError); !ok {
+				return true, err
 			}
-			if blackListRegex != "" {
-				blackListPredicate, err := FindFilePredicate(blackListRegex)
-				if err != nil {
-					return nil, err
-				}
-				predicate = FindAndPredicate(predicate, FindNotPredicate(blackListPredicate))
+			status, ok := err.(*exec.ExitError).Sys().(syscall.WaitStatus)
+			if !ok {
+				return true, err
 			}
+			switch status.ExitStatus() {
+			case 1:
+				return true, err
+			case 2:
+				return false, err
+			default:
+				return true, fmt.Errorf("unexpected exit status %d", status.ExitStatus())
+			}
+		}
+		return true, nil
+	}
+}
+
+// newCLIDXECleaner creates a DXECleaner removing the DXEs matching predicate
+// and testing the firmware images with test.
+func newCLIDXECleaner(test func(ctx context.Context, path string) (bool, error), predicate FindPredicate) *DXECleaner {
+	// When the user enters CTRL-C, the DXECleaner should stop, but
+	// also output the current progress.
+	ctx, cancel := context.WithCancel(context.Background())
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt)
+	go func() {
+		<-c
+		cancel()
+	}()
+
+	v := &DXECleaner{
+		Predicate: predicate,
+		W:         os.Stdout,
+	}
+	v.TestImage = func(path string) (bool, error) {
+		return test(ctx, path)
+	}
+	v.Test = func(f uefi.Firmware) (bool, error) {
+		tmpDir, err := ioutil.TempDir("", "dxecleaner")
+		if err != nil {
+			return true, err
+		}
+		defer os.RemoveAll(tmpDir)
+		tmpFile := filepath.Join(tmpDir, "bios.bin")
+
+		if err := (&Save{DirPath: tmpFile, Compression: v.Compression}).Run(f); err != nil {
+			return true, err
 		}
+		return v.TestImage(tmpFile)
+	}
+	return v
+}
+
+// newCLIBisectDXECleaner creates a DXECleaner removing the DXEs matching
+// predicate using the bisect strategy from the DB, JOBS and CHECKPOINT
+// arguments.
+func newCLIBisectDXECleaner(test func(ctx context.Context, path string) (bool, error), predicate FindPredicate, args []string) (*DXECleaner, error) {
+	v := newCLIDXECleaner(test, predicate)
+	v.Bisect = true
+	if args[0] != "-" {
+		db, err := LoadDispatchDB(args[0])
+		if err != nil {
+			return nil, err
+		}
+		v.DB = db
+	}
+	jobs, err := strconv.Atoi(args[1])
+	if err != nil || jobs < 1 {
+		return nil, fmt.Errorf("invalid number of jobs %q", args[1])
+	}
+	v.Jobs = jobs
+	v.Checkpoint = args[2]
+	return v, nil
+}
+
+// driversPredicate returns the predicate of the drivers not listed in the
+// blacklist file, or of all the drivers when fileName is empty.
+func driversPredicate(fileName string) (FindPredicate, error) {
+	predicate := FindFileTypePredicate(uefi.FVFileTypeDriver)
+	if fileName == "" {
+		return predicate, nil
+	}
+	fileContents, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, fmt.Errorf("cannot read blacklist file %q: %v", fileName, err)
+	}
+	blackListRegex, err := parseBlackList(fileName, string(fileContents))
+	if err != nil {
+		return nil, err
+	}
+	if blackListRegex == "" {
+		return predicate, nil
+	}
+	blackListPredicate, err := FindFilePredicate(blackListRegex)
+	if err != nil {
+		return nil, err
+	}
+	return FindAndPredicate(predicate, FindNotPredicate(blackListPredicate)), nil
+}
 
-		return &DXECleaner{
-			Test: func(f uefi.Firmware) (bool, error) {
-				tmpDir, err := ioutil.TempDir("", "dxecleaner")
-				if err != nil {
-					return true, err
-				}
-				defer os.RemoveAll(tmpDir)
-				tmpFile := filepath.Join(tmpDir, "bios.bin")
-
-				if err := (&Save{tmpFile}).Run(f); err != nil {
-					return true, err
-				}
-				cmd := exec.CommandContext(ctx, args[0], tmpFile)
-				cmd.Stdin, cmd.Stdout, cmd.Stderr = os.Stdin, os.Stdout, os.Stderr
-				if err := cmd.Run(); err != nil {
-					if _, ok := err.(*exec.ExitError); !ok {
-						return true, err
-					}
-					status, ok := err.(*exec.ExitError).Sys().(syscall.WaitStatus)
-					if !ok {
-						return true, err
-					}
-					switch status.ExitStatus() {
-					case 1:
-						return true, err
-					case 2:
-						return false, err
-					default:
-						return true, fmt.Errorf("unexpected exit status %d", status.ExitStatus())
-					}
-				}
-				return true, nil
-			},
-			Predicate: predicate,
-			W:         os.Stdout,
-		}, nil
-	}
-
-	RegisterCLI("dxecleaner", "automates removal of UEFI drivers", 1, register)
-	RegisterCLI("dxecleaner_blacklist", "automates removal of UEFI drivers with a blacklist file", 2, register)
+// registerDXECleaner registers the command name, removing the drivers, and
+// its _blacklist and _query variants, which take a blacklist file of drivers
+// to keep or a query of the files to remove after the first argument.
+func registerDXECleaner(name, args, help string, create func(args []string, predicate FindPredicate) (uefi.Visitor, error)) {
+	params := strings.Fields(args)
+	synopsis := func(name, param string) string {
+		return strings.Join(append([]string{name, params[0], param}, params[1:]...), " ")
+	}
+	RegisterCLI(name, name+" "+args+"\n "+help, len(params), func(args []string) (uefi.Visitor, error) {
+		predicate, err := driversPredicate("")
+		if err != nil {
+			return nil, err
+		}
+		return create(args, predicate)
+	})
+	RegisterCLI(name+"_blacklist", synopsis(name+"_blacklist", "BLACKLIST")+"\n like "+name+", keeping the drivers listed in the BLACKLIST file", len(params)+1, func(args []string) (uefi.Visitor, error) {
+		predicate, err := driversPredicate(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return create(append(args[:1:1], args[2:]...), predicate)
+	})
+	RegisterCLI(name+"_query", synopsis(name+"_query", "QUERY")+"\n like "+name+", removing the files matching QUERY instead of the drivers", len(params)+1, func(args []string) (uefi.Visitor, error) {
+		predicate, err := ParseQuery(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return create(append(args[:1:1], args[2:]...), predicate)
+	})
+}
+
+func init() {
+	registerDXECleaner("dxecleaner", "SCRIPT", "automates removal of UEFI drivers, testing the images with SCRIPT", func(args []string, predicate FindPredicate) (uefi.Visitor, error) {
+		return newCLIDXECleaner(scriptTest(args[0]), predicate), nil
+	})
+	registerDXECleaner("dxecleaner_bisect", "SCRIPT DB JOBS CHECKPOINT", "automates removal of UEFI drivers in groups, running JOBS tests concurrently.\n DB lists the GUIDs installed by the files to order the drivers, or is '-'.\n Progress is saved to CHECKPOINT and resumed from it", func(args []string, predicate FindPredicate) (uefi.Visitor, error) {
+		return newCLIBisectDXECleaner(scriptTest(args[0]), predicate, args[1:])
+	})
+	registerDXECleaner("dxecleaner_qemu", "CONFIG", "automates removal of UEFI drivers, booting the images in QEMU as configured in CONFIG", func(args []string, predicate FindPredicate) (uefi.Visitor, error) {
+		q, err := LoadQEMUTester(args[0])
+		if err != nil {
+			return nil, err
+		}
+		q.Log = os.Stdout
+		return newCLIDXECleaner(q.Test, predicate), nil
+	})
+	registerDXECleaner("dxecleaner_qemu_bisect", "CONFIG DB JOBS CHECKPOINT", "like dxecleaner_bisect, booting the images in QEMU as configured in CONFIG", func(args []string, predicate FindPredicate) (uefi.Visitor, error) {
+		q, err := LoadQEMUTester(args[0])
+		if err != nil {
+			return nil, err
+		}
+		q.Log = os.Stdout
+		return newCLIBisectDXECleaner(q.Test, predicate, args[1:])
+	})
 }
@@ -25,6 +25,14 @@ type Extract struct {
 	BasePath string
 	DirPath  string
 	Index    *uint64
+
+	// When Predicate is set, only the matches of the Find visitor and their
+	// children are extracted. The directory cannot be re-assembled.
+	Predicate FindPredicate
+
+	// Private
+	matches []uefi.Firmware
+	skip    bool
 }
 
 // extractBinary simply dumps the binary to a specified directory and filename.
@@ -32,6 +40,9 @@ type Extract struct {
 // It returns the filepath of the binary, and an error if it exists.
 // This is meant as a helper function for other Extract functions.
 func (v *Extract) extractBinary(buf []byte, filename string) (string, error) {
+	if v.skip {
+		return "", nil
+	}
 	// Create the directory if it doesn't exist
 	dirPath := filepath.Join(v.BasePath, v.DirPath)
 	if err := os.MkdirAll(dirPath, 0755); err != nil {
@@ -75,6 +86,19 @@ func (v *Extract) Run(f uefi.Firmware) error {
 		return err
 	}
 
+	// Find the nodes to extract.
+	v.skip = v.Predicate != nil
+	if v.skip {
+		find := &Find{Predicate: v.Predicate}
+		if err := find.Run(f); err != nil {
+			return err
+		}
+		if len(find.Matches) == 0 {
+			return errors.New("no matches found")
+		}
+		v.matches = find.Matches
+	}
+
 	// Reset the index
 	*v.Index = 0
 	if err := f.Apply(v); err != nil {
@@ -94,6 +118,11 @@ func (v *Extract) Visit(f uefi.Firmware) error {
 	// The visitor must be cloned before modification; otherwise, the
 	// sibling's values are modified.
 	v2 := *v
+	for _, m := range v.matches {
+		if m == f {
+			v2.skip = false
+		}
+	}
 
 	var err error
 	switch f := f.(type) {
@@ -138,6 +167,22 @@ func (v *Extract) Visit(f uefi.Firmware) error {
 			f.ExtractPath, err = v2.extractBinary(f.Buf(), fmt.Sprintf("%#x.nvar", f.Offset))
 		}
 
+	case *uefi.VariableStore:
+		v2.DirPath = filepath.Join(v.DirPath, "vss")
+
+	case *uefi.Variable:
+		// For variables we use the GUID as the folder name and the Name as file name,
+		// adding the offset to variables which are not current to make them unique.
+		v2.DirPath = filepath.Join(v.DirPath, f.GUID.String())
+		if f.Header.State == uefi.VariableAdded {
+			f.ExtractPath, err = v2.extractBinary(f.Buf()[f.DataOffset:], fmt.Sprintf("%v.bin", f.Name))
+		} else {
+			f.ExtractPath, err = v2.extractBinary(f.Buf()[f.DataOffset:], fmt.Sprintf("%v-%#x.bin", f.Name, f.Offset))
+		}
+
+	case *uefi.FTWWorkingBlock:
+		f.ExtractPath, err = v2.extractBinary(f.Buf(), "ftw.bin")
+
 	case *uefi.FlashDescriptor:
 		v2.DirPath = filepath.Join(v.DirPath, "ifd")
 		f.ExtractPath, err = v2.extractBinary(f.Buf(), "flashdescriptor.bin")
@@ -176,4 +221,16 @@ func init() {
 			Index:    &fileIndex,
 		}, nil
 	})
+	RegisterCLI("extract_query", "extract_query query dir\n extract the files matching the GUID, Name or query to directory `dir`", 2, func(args []string) (uefi.Visitor, error) {
+		pred, err := FindQueryPredicate(args[0])
+		if err != nil {
+			return nil, err
+		}
+		return &Extract{
+			BasePath:  args[1],
+			DirPath:   ".",
+			Index:     &fileIndex,
+			Predicate: pred,
+		}, nil
+	})
 }
@@ -239,8 +239,8 @@ func FindNVarPredicate(r string) (func(f uefi.Firmware) bool, error) {
 }
 
 func init() {
-	RegisterCLI("find", "find a file by GUID or Name", 1, func(args []string) (uefi.Visitor, error) {
-		pred, err := FindFilePredicate(args[0])
+	RegisterCLI("find", "find a file by GUID, Name or query", 1, func(args []string) (uefi.Visitor, error) {
+		pred, err := FindQueryPredicate(args[0])
 		if err != nil {
 			return nil, err
 		}
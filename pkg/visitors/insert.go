@@ -99,6 +99,7 @@ func (v *Insert) Run(f uefi.Firmware) error {
 			return fmt.Errorf("matched FV but insert operation was %s, which only matches Files",
 				v.InsertType.String())
 		}
+		fvMatch.MarkDirty()
 		return nil
 	}
 	var ok bool
@@ -129,6 +130,7 @@ func (v *Insert) Visit(f uefi.Firmware) error {
 				case ReplaceFFS:
 					f.Files = append(f.Files[:i], append([]*uefi.File{v.NewFile}, f.Files[i+1:]...)...)
 				}
+				f.MarkDirty()
 				return nil
 			}
 		}
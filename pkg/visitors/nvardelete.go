@@ -0,0 +1,90 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// NVarDelete deletes an NVar from the NVAR stores of the firmware. Like the
+// firmware does, all the entries of the variable are marked invalid; use
+// nvram-compact to reclaim their space.
+type NVarDelete struct {
+	// Input
+	Name string
+	GUID guid.GUID
+
+	// Output
+	Matches []*uefi.NVar
+	// logs are written to this writer.
+	W io.Writer
+}
+
+func (v *NVarDelete) printf(format string, a ...interface{}) {
+	if v.W != nil {
+		fmt.Fprintf(v.W, format, a...)
+	}
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *NVarDelete) Run(f uefi.Firmware) error {
+	v.Matches = nil
+	if err := f.Apply(v); err != nil {
+		return err
+	}
+	if len(v.Matches) == 0 {
+		return fmt.Errorf("NVar %v %v not found", v.GUID, v.Name)
+	}
+	return nil
+}
+
+// Visit applies the NVarDelete visitor to any Firmware type.
+func (v *NVarDelete) Visit(f uefi.Firmware) error {
+	switch f := f.(type) {
+	case *uefi.File:
+		// Only update top level stores, not the ones nested in variables.
+		if f.NVarStore != nil {
+			return v.delete(f.NVarStore)
+		}
+	}
+	return f.ApplyChildren(v)
+}
+
+func (v *NVarDelete) delete(s *uefi.NVarStore) error {
+	chains := nvarChains(s, v.Name, v.GUID)
+	if len(chains) == 0 {
+		return nil
+	}
+	for _, chain := range chains {
+		v.printf("Delete: %v  %v\n", chain[0].GUID, chain[0])
+		for _, e := range chain {
+			e.Invalidate()
+			v.Matches = append(v.Matches, e)
+		}
+	}
+
+	// Assemble the store to update its buffer
+	a := &Assemble{}
+	return a.Run(s)
+}
+
+func init() {
+	RegisterCLI("delete_nvar", "delete NVar NAME GUID", 2, func(args []string) (uefi.Visitor, error) {
+		g, err := guid.Parse(args[1])
+		if err != nil {
+			return nil, err
+		}
+		return &NVarDelete{
+			Name: args[0],
+			GUID: *g,
+			W:    os.Stdout,
+		}, nil
+	})
+}
@@ -55,6 +55,7 @@ func (v *NVarInvalidate) Visit(f uefi.Firmware) error {
 	case *uefi.NVar:
 		v.printf("Invalidate: %v  %v\n", f.GUID, f)
 		f.Type = uefi.InvalidNVarEntry
+		f.MarkDirty()
 	}
 	return nil
 }
@@ -0,0 +1,208 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// NVarSet creates or updates an NVar in the NVAR stores of the firmware.
+// Updates are appended as data entries linked from the current value, like
+// the firmware does.
+type NVarSet struct {
+	// Input
+	Name    string
+	GUID    guid.GUID
+	Content []byte
+	// Attributes of new variables, the attributes describing the layout of
+	// the entry are set as needed.
+	Attributes uefi.NVarAttribute
+
+	// Output
+	Matches []*uefi.NVarStore
+	// logs are written to this writer.
+	W io.Writer
+}
+
+func (v *NVarSet) printf(format string, a ...interface{}) {
+	if v.W != nil {
+		fmt.Fprintf(v.W, format, a...)
+	}
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *NVarSet) Run(f uefi.Firmware) error {
+	v.Matches = nil
+	if err := f.Apply(v); err != nil {
+		return err
+	}
+	if len(v.Matches) == 0 {
+		return errors.New("no NVAR store found")
+	}
+	return nil
+}
+
+// Visit applies the NVarSet visitor to any Firmware type.
+func (v *NVarSet) Visit(f uefi.Firmware) error {
+	switch f := f.(type) {
+	case *uefi.File:
+		// Only update top level stores, not the ones nested in variables.
+		if f.NVarStore != nil {
+			v.Matches = append(v.Matches, f.NVarStore)
+			return v.set(f.NVarStore)
+		}
+	}
+	return f.ApplyChildren(v)
+}
+
+func (v *NVarSet) set(s *uefi.NVarStore) error {
+	var last *uefi.NVar
+	if chains := nvarChains(s, v.Name, v.GUID); len(chains) > 0 {
+		chain := chains[len(chains)-1]
+		last = chain[len(chain)-1]
+	}
+
+	var offset uint64
+	for _, e := range s.Entries {
+		offset += uint64(len(e.Buf()))
+	}
+	n := &uefi.NVar{GUID: v.GUID, Name: v.Name, Offset: offset}
+	content := append([]byte{}, v.Content...)
+	var extLen int
+	guidStore := s.GUIDStore
+	if last != nil {
+		// Append a data entry with the same attributes and extended header
+		// format and link the current value to it.
+		n.Type = uefi.DataNVarEntry
+		n.Header.Attributes = last.Header.Attributes | uefi.NVarEntryDataOnly
+		if last.ExtAttributes != nil {
+			ext := last.Buf()[last.ExtOffset:]
+			extLen = len(ext)
+			content = append(content, ext...)
+			extAttributes := *last.ExtAttributes
+			n.ExtAttributes = &extAttributes
+		}
+	} else {
+		n.Type = uefi.FullNVarEntry
+		layout := uefi.NVarEntryASCIIName | uefi.NVarEntryGUID | uefi.NVarEntryDataOnly | uefi.NVarEntryExtHeader
+		n.Header.Attributes = v.Attributes&^layout | uefi.NVarEntryValid
+		if isASCII(v.Name) {
+			n.Header.Attributes |= uefi.NVarEntryASCIIName
+		}
+		// Reference the GUID from the GUID store, adding it if needed.
+		guidIndex := -1
+		for i, g := range guidStore {
+			if g == v.GUID {
+				guidIndex = i
+				break
+			}
+		}
+		if guidIndex == -1 {
+			if len(guidStore) > 0xFF {
+				return errors.New("GUID store of NVAR store is full")
+			}
+			guidIndex = len(guidStore)
+			guidStore = append(guidStore[:len(guidStore):len(guidStore)], v.GUID)
+		}
+		i := uint8(guidIndex)
+		n.GUIDIndex = &i
+	}
+	if err := n.Assemble(content, false); err != nil {
+		return err
+	}
+	// Second pass to fix the header content
+	if err := n.Assemble(n.Buf()[n.DataOffset:], true); err != nil {
+		return err
+	}
+	if n.ExtAttributes != nil {
+		n.ExtOffset = int64(len(n.Buf()) - extLen)
+		n.UpdateChecksum()
+	}
+
+	guidStoreLen := uint64(len(guidStore) * len(guid.GUID{}))
+	if end := offset + uint64(len(n.Buf())); end+guidStoreLen > s.Length {
+		return fmt.Errorf("out of space in NVAR store. space available: %v bytes, new entry size: %v",
+			s.Length-guidStoreLen-offset, len(n.Buf()))
+	}
+	if last != nil {
+		last.NextOffset = n.Offset
+		last.Type = uefi.LinkNVarEntry
+		if err := last.Assemble(last.Buf()[last.DataOffset:], true); err != nil {
+			return err
+		}
+	}
+	s.GUIDStore = guidStore
+	s.Entries = append(s.Entries, n)
+	s.MarkDirty()
+	v.printf("Set: %v  %v\n", n.GUID, n)
+
+	// Assemble the store to update its buffer
+	a := &Assemble{}
+	return a.Run(s)
+}
+
+// nvarChains returns the chains of valid entries of a variable in a store,
+// from the entry holding the name and GUID to the one holding the current
+// value.
+func nvarChains(s *uefi.NVarStore, name string, g guid.GUID) [][]*uefi.NVar {
+	byOffset := make(map[uint64]*uefi.NVar)
+	for _, e := range s.Entries {
+		byOffset[e.Offset] = e
+	}
+	var chains [][]*uefi.NVar
+	for _, e := range s.Entries {
+		if !e.IsValid() || e.Header.Attributes&uefi.NVarEntryDataOnly != 0 || e.Name != name || e.GUID != g {
+			continue
+		}
+		chain := []*uefi.NVar{e}
+		// Links only go forward, the length check stops on broken stores.
+		for n := e; n.NextOffset != 0 && len(chain) <= len(s.Entries); {
+			next, ok := byOffset[n.NextOffset]
+			if !ok || !next.IsValid() {
+				break
+			}
+			chain = append(chain, next)
+			n = next
+		}
+		chains = append(chains, chain)
+	}
+	return chains
+}
+
+func isASCII(s string) bool {
+	for _, r := range s {
+		if r >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
+
+func init() {
+	RegisterCLI("set_nvar", "create or update NVar NAME GUID with the content of FILE", 3, func(args []string) (uefi.Visitor, error) {
+		g, err := guid.Parse(args[1])
+		if err != nil {
+			return nil, err
+		}
+		content, err := ioutil.ReadFile(args[2])
+		if err != nil {
+			return nil, err
+		}
+		return &NVarSet{
+			Name:       args[0],
+			GUID:       *g,
+			Content:    content,
+			Attributes: uefi.NVarEntryRuntime,
+			W:          os.Stdout,
+		}, nil
+	})
+}
@@ -0,0 +1,140 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+var (
+	test0GUID   = guid.MustParse("7E577E57-0123-4567-89AB-CDEF00000000")
+	newNVarGUID = guid.MustParse("7E577E57-0123-4567-89AB-CDEF00000002")
+)
+
+// reparseNVarTest assembles the firmware and parses it again to make sure the
+// binary holds the changes.
+func reparseNVarTest(t *testing.T, f uefi.Firmware) *uefi.NVarStore {
+	if err := (&Assemble{}).Run(f); err != nil {
+		t.Fatal(err)
+	}
+	parsedRoot, err := uefi.Parse(f.Buf())
+	if err != nil {
+		t.Fatal(err)
+	}
+	find := &Find{
+		Predicate: func(f uefi.Firmware) bool {
+			file, ok := f.(*uefi.File)
+			return ok && file.NVarStore != nil
+		},
+	}
+	if err := find.Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	if len(find.Matches) != 1 {
+		t.Fatalf("found %d NVAR stores, want 1", len(find.Matches))
+	}
+	return find.Matches[0].(*uefi.File).NVarStore
+}
+
+// nvarValue returns the current value of a variable in a store.
+func nvarValue(t *testing.T, s *uefi.NVarStore, name string, g *guid.GUID) []byte {
+	chains := nvarChains(s, name, *g)
+	if len(chains) != 1 {
+		t.Fatalf("found %d chains for NVar %v, want 1", len(chains), name)
+	}
+	last := chains[0][len(chains[0])-1]
+	if last.NextOffset != 0 {
+		t.Fatalf("NVar %v chain ends with a link to %#x", name, last.NextOffset)
+	}
+	return last.Buf()[last.DataOffset:]
+}
+
+func TestNVarSet(t *testing.T) {
+	pd := ParseDir{BasePath: "../../integration/roms/nvartest/"}
+	parsedRoot, err := pd.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Assemble{}).Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+
+	// Update an existing variable
+	set := &NVarSet{Name: "Test0", GUID: *test0GUID, Content: []byte("new0")}
+	if err = set.Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	s := reparseNVarTest(t, parsedRoot)
+	if got := nvarValue(t, s, "Test0", test0GUID); !bytes.Equal(got, []byte("new0")) {
+		t.Errorf("Test0 is %q, want %q", got, "new0")
+	}
+	if chain := nvarChains(s, "Test0", *test0GUID)[0]; len(chain) != 3 {
+		t.Errorf("Test0 chain has %d entries, want 3", len(chain))
+	}
+
+	// Create a variable with a new GUID
+	set = &NVarSet{Name: "Test2", GUID: *newNVarGUID, Content: []byte("new2"), Attributes: uefi.NVarEntryRuntime}
+	if err = set.Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	s = reparseNVarTest(t, parsedRoot)
+	if got := nvarValue(t, s, "Test2", newNVarGUID); !bytes.Equal(got, []byte("new2")) {
+		t.Errorf("Test2 is %q, want %q", got, "new2")
+	}
+	if len(s.GUIDStore) != 4 || s.GUIDStore[3] != *newNVarGUID {
+		t.Errorf("GUID store not updated, got %v", s.GUIDStore)
+	}
+	count := &Count{}
+	if err = count.Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	if got := count.FirmwareTypeCount["NVar"]; got != 8 {
+		t.Fatalf("counted %d NVar, want %d", got, 8)
+	}
+
+	// Delete the updated variable and compact
+	del := &NVarDelete{Name: "Test0", GUID: *test0GUID}
+	if err = del.Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	if len(del.Matches) != 3 {
+		t.Errorf("deleted %d entries, want 3", len(del.Matches))
+	}
+	s = reparseNVarTest(t, parsedRoot)
+	if chains := nvarChains(s, "Test0", *test0GUID); len(chains) != 0 {
+		t.Errorf("Test0 still present after delete")
+	}
+	if err = del.Run(parsedRoot); err == nil {
+		t.Errorf("deleting a missing NVar should fail")
+	}
+	if err = (&NVRamCompact{}).Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	if err = count.Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	if got := count.FirmwareTypeCount["NVar"]; got != 5 {
+		t.Fatalf("counted %d NVar, want %d", got, 5)
+	}
+}
+
+func TestNVarSetOutOfSpace(t *testing.T) {
+	pd := ParseDir{BasePath: "../../integration/roms/nvartest/"}
+	parsedRoot, err := pd.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Assemble{}).Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	set := &NVarSet{Name: "Test0", GUID: *test0GUID, Content: make([]byte, 0x10000)}
+	if err = set.Run(parsedRoot); err == nil {
+		t.Errorf("setting a NVar bigger than the store should fail")
+	}
+}
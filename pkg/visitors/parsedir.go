@@ -71,6 +71,14 @@ func (v *ParseDir) Visit(f uefi.Firmware) error {
 			fBuf, err = v.readBuf(f.ExtractPath)
 		}
 
+	case *uefi.Variable:
+		var fValBuf []byte
+		fValBuf, err = v.readBuf(f.ExtractPath)
+		fBuf = append(make([]byte, f.DataOffset), fValBuf...)
+
+	case *uefi.FTWWorkingBlock:
+		fBuf, err = v.readBuf(f.ExtractPath)
+
 	case *uefi.FlashDescriptor:
 		fBuf, err = v.readBuf(f.ExtractPath)
 
@@ -0,0 +1,287 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/linuxboot/fiano/pkg/compression"
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// PatchOp is a file level operation of a Patch. Op is the name of the utk
+// command performing the same operation: remove, replace_ffs, insert_after,
+// insert_before or insert_front.
+type PatchOp struct {
+	Op string
+	// Target is the GUID of the file the operation applies to or, for
+	// insert_front, the name of the firmware volume.
+	Target guid.GUID
+	// File is the new FFS file of replace and insert operations.
+	File []byte `json:",omitempty"`
+}
+
+// Patch is a list of file level operations. Files are located by GUID
+// rather than by offset, so a patch exported between two builds of a board
+// can be applied to another build of the same board.
+type Patch struct {
+	Ops []PatchOp
+}
+
+// ExportPatch creates the patch turning the firmware into another firmware.
+// Removals come first, then replacements, then insertions in the order of
+// the other firmware. Inserted files are anchored on the closest preceding
+// file of their volume. Pad files are ignored.
+type ExportPatch struct {
+	// Input
+	Other uefi.Firmware
+	// Compression configures the compressors used to assemble the other
+	// firmware when it is an extracted directory. If nil,
+	// compression.DefaultConfig() is used.
+	Compression *compression.Config
+
+	// Output
+	Patch Patch
+	// The patch is written to this writer as JSON.
+	W io.Writer
+
+	// If Other is nil, it is opened from this path by Run.
+	otherPath string
+}
+
+// SetCompression implements CompressionSetter.
+func (v *ExportPatch) SetCompression(cfg *compression.Config) {
+	v.Compression = cfg
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *ExportPatch) Run(f uefi.Firmware) error {
+	if v.Other == nil {
+		other, err := openImage(v.otherPath, v.Compression)
+		if err != nil {
+			return err
+		}
+		v.Other = other
+	}
+	return f.Apply(v)
+}
+
+// Visit applies the ExportPatch visitor to any Firmware type.
+func (v *ExportPatch) Visit(f uefi.Firmware) error {
+	oldFVs, err := patchVolumes(f)
+	if err != nil {
+		return err
+	}
+	newFVs, err := patchVolumes(v.Other)
+	if err != nil {
+		return err
+	}
+	oldFiles, oldCount := patchFiles(oldFVs)
+	newFiles, newCount := patchFiles(newFVs)
+	unique := func(g guid.GUID) error {
+		if oldCount[g] > 1 || newCount[g] > 1 {
+			return fmt.Errorf("file %v is not unique, unable to locate it by GUID", g)
+		}
+		return nil
+	}
+
+	var removes, replaces, inserts []PatchOp
+	for _, fv := range oldFVs {
+		for _, o := range fv.Files {
+			if _, ok := newFiles[o.Header.GUID]; ok || o.Header.Type == uefi.FVFileTypePad {
+				continue
+			}
+			if err := unique(o.Header.GUID); err != nil {
+				return err
+			}
+			removes = append(removes, PatchOp{Op: "remove", Target: o.Header.GUID})
+		}
+	}
+	for _, fv := range newFVs {
+		for i, n := range fv.Files {
+			if n.Header.Type == uefi.FVFileTypePad {
+				continue
+			}
+			g := n.Header.GUID
+			if o, ok := oldFiles[g]; ok {
+				if bytes.Equal(o.Buf(), n.Buf()) {
+					continue
+				}
+				if err := unique(g); err != nil {
+					return err
+				}
+				replaces = append(replaces, PatchOp{Op: insertTypeNames[ReplaceFFS], Target: g, File: n.Buf()})
+				continue
+			}
+			if err := unique(g); err != nil {
+				return err
+			}
+			op, err := patchAnchor(fv, i, oldFiles, newCount, oldCount)
+			if err != nil {
+				return err
+			}
+			op.File = n.Buf()
+			inserts = append(inserts, op)
+		}
+	}
+	v.Patch.Ops = append(append(removes, replaces...), inserts...)
+
+	if v.W == nil {
+		return nil
+	}
+	b, err := json.MarshalIndent(v.Patch, "", "\t")
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(v.W, string(b))
+	return err
+}
+
+// patchAnchor finds where to insert the i-th file of a volume: after the
+// closest preceding file, before the closest following file present in both
+// firmwares or at the front of the volume.
+func patchAnchor(fv *uefi.FirmwareVolume, i int, oldFiles map[guid.GUID]*uefi.File, newCount, oldCount map[guid.GUID]int) (PatchOp, error) {
+	usable := func(f *uefi.File) bool {
+		g := f.Header.GUID
+		return f.Header.Type != uefi.FVFileTypePad && newCount[g] == 1 && oldCount[g] <= 1
+	}
+	for j := i - 1; j >= 0; j-- {
+		if usable(fv.Files[j]) {
+			return PatchOp{Op: insertTypeNames[InsertAfter], Target: fv.Files[j].Header.GUID}, nil
+		}
+	}
+	for _, f := range fv.Files[i+1:] {
+		if _, ok := oldFiles[f.Header.GUID]; ok && usable(f) {
+			return PatchOp{Op: insertTypeNames[InsertBefore], Target: f.Header.GUID}, nil
+		}
+	}
+	if fv.FVName != (guid.GUID{}) {
+		return PatchOp{Op: insertTypeNames[InsertFront], Target: fv.FVName}, nil
+	}
+	return PatchOp{}, fmt.Errorf("no anchor to insert file %v: volume %v has no other file and no name",
+		fv.Files[i].Header.GUID, fv)
+}
+
+// patchVolumes lists the firmware volumes of a tree, including nested ones.
+func patchVolumes(f uefi.Firmware) ([]*uefi.FirmwareVolume, error) {
+	find := &Find{
+		Predicate: func(f uefi.Firmware) bool {
+			_, ok := f.(*uefi.FirmwareVolume)
+			return ok
+		},
+	}
+	if err := find.Run(f); err != nil {
+		return nil, err
+	}
+	var fvs []*uefi.FirmwareVolume
+	for _, m := range find.Matches {
+		fvs = append(fvs, m.(*uefi.FirmwareVolume))
+	}
+	return fvs, nil
+}
+
+// patchFiles indexes the files of the volumes by GUID and counts the files
+// sharing a GUID. Pad files are skipped.
+func patchFiles(fvs []*uefi.FirmwareVolume) (map[guid.GUID]*uefi.File, map[guid.GUID]int) {
+	files := make(map[guid.GUID]*uefi.File)
+	count := make(map[guid.GUID]int)
+	for _, fv := range fvs {
+		for _, f := range fv.Files {
+			if f.Header.Type == uefi.FVFileTypePad {
+				continue
+			}
+			if _, ok := files[f.Header.GUID]; !ok {
+				files[f.Header.GUID] = f
+			}
+			count[f.Header.GUID]++
+		}
+	}
+	return files, count
+}
+
+// ApplyPatch applies a Patch to the firmware. Every target must match
+// exactly one file or firmware volume.
+type ApplyPatch struct {
+	// Input
+	Patch Patch
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *ApplyPatch) Run(f uefi.Firmware) error {
+	return f.Apply(v)
+}
+
+// Visit applies the ApplyPatch visitor to any Firmware type.
+func (v *ApplyPatch) Visit(f uefi.Firmware) error {
+	for i, op := range v.Patch.Ops {
+		if err := applyPatchOp(f, op); err != nil {
+			return fmt.Errorf("patch operation %d (%v %v): %v", i, op.Op, op.Target, err)
+		}
+	}
+	return nil
+}
+
+func applyPatchOp(f uefi.Firmware, op PatchOp) error {
+	pred := FindFileGUIDPredicate(op.Target)
+	if op.Op == "remove" {
+		if _, err := FindExactlyOne(f, pred); err != nil {
+			return err
+		}
+		return (&Remove{Predicate: pred}).Run(f)
+	}
+
+	var iType InsertType
+	switch op.Op {
+	case insertTypeNames[ReplaceFFS]:
+		iType = ReplaceFFS
+	case insertTypeNames[InsertAfter]:
+		iType = InsertAfter
+	case insertTypeNames[InsertBefore]:
+		iType = InsertBefore
+	case insertTypeNames[InsertFront]:
+		iType = InsertFront
+		pred = func(f uefi.Firmware) bool {
+			fv, ok := f.(*uefi.FirmwareVolume)
+			return ok && fv.FVName == op.Target
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", op.Op)
+	}
+	file, err := uefi.NewFile(op.File)
+	if err != nil {
+		return err
+	}
+	return (&Insert{
+		Predicate:  pred,
+		NewFile:    file,
+		InsertType: iType,
+	}).Run(f)
+}
+
+func init() {
+	RegisterCLI("export_patch", "print as JSON the file operations turning the firmware into the firmware in FILE (image or extracted directory)", 1, func(args []string) (uefi.Visitor, error) {
+		if _, err := os.Stat(args[0]); err != nil {
+			return nil, err
+		}
+		return &ExportPatch{W: os.Stdout, otherPath: args[0]}, nil
+	})
+	RegisterCLI("apply_patch", "apply the file operations in PATCH, locating files by GUID", 1, func(args []string) (uefi.Visitor, error) {
+		b, err := ioutil.ReadFile(args[0])
+		if err != nil {
+			return nil, err
+		}
+		var p Patch
+		if err := json.Unmarshal(b, &p); err != nil {
+			return nil, fmt.Errorf("cannot parse patch %q: %v", args[0], err)
+		}
+		return &ApplyPatch{Patch: p}, nil
+	})
+}
@@ -0,0 +1,182 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+var (
+	patchFVName = guid.MustParse("9A7C2E61-1E24-4B0A-8F2E-3D4C5B6A7980")
+	patchGUIDs  = map[string]guid.GUID{}
+)
+
+// patchTestGUID returns a GUID for a file name of the tests.
+func patchTestGUID(name string) guid.GUID {
+	if g, ok := patchGUIDs[name]; ok {
+		return g
+	}
+	g := *guid.MustParse("D1E2F3A4-0000-4000-8000-000000000000")
+	g[15] = byte(len(patchGUIDs) + 1)
+	patchGUIDs[name] = g
+	return g
+}
+
+// patchTestFV builds a volume holding freeform files. A file is named by its
+// GUID name, optionally followed by a colon and a content version.
+func patchTestFV(t *testing.T, files ...string) *uefi.FirmwareVolume {
+	uefi.Attributes.ErasePolarity = 0xFF
+	fv, err := createEmptyFirmwareVolume(0, 0x10000, patchFVName)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range files {
+		f := &uefi.File{}
+		f.Header.GUID = patchTestGUID(strings.Split(name, ":")[0])
+		f.Header.Type = uefi.FVFileTypeFreeForm
+		f.Header.State = 0xF8
+		s := &uefi.Section{}
+		s.SetType(uefi.SectionTypeRaw)
+		s.SetBuf([]byte(name))
+		if err := s.GenSecHeader(); err != nil {
+			t.Fatal(err)
+		}
+		f.Sections = append(f.Sections, s)
+		fv.Files = append(fv.Files, f)
+	}
+	if err = (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	fv, err = uefi.NewFirmwareVolume(fv.Buf(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fv
+}
+
+// patchTestFiles lists the files of a volume, skipping pad files.
+func patchTestFiles(t *testing.T, fv *uefi.FirmwareVolume) []string {
+	var files []string
+	for _, f := range fv.Files {
+		if f.Header.Type == uefi.FVFileTypePad {
+			continue
+		}
+		files = append(files, string(f.Sections[0].Buf()[4:]))
+	}
+	return files
+}
+
+func patchOps(p Patch) []string {
+	var ops []string
+	for _, op := range p.Ops {
+		target := op.Target.String()
+		for name, g := range patchGUIDs {
+			if g == op.Target {
+				target = name
+			}
+		}
+		if op.Target == *patchFVName {
+			target = "FV"
+		}
+		ops = append(ops, op.Op+" "+target)
+	}
+	return ops
+}
+
+func TestPatch(t *testing.T) {
+	var tests = []struct {
+		name  string
+		old   []string
+		new   []string
+		third []string
+		ops   []string
+		want  []string
+	}{
+		{
+			name:  "files",
+			old:   []string{"A", "B", "C", "D"},
+			new:   []string{"N0", "A", "B:2", "N1", "D", "N2"},
+			third: []string{"A", "X", "B", "C", "D"},
+			ops: []string{
+				"remove C",
+				"replace_ffs B",
+				"insert_before A",
+				"insert_after B",
+				"insert_after D",
+			},
+			want: []string{"N0", "A", "X", "B:2", "N1", "D", "N2"},
+		},
+		{
+			name:  "new volume content",
+			old:   []string{"A"},
+			new:   []string{"N0", "N1"},
+			third: []string{"A:2"},
+			ops:   []string{"remove A", "insert_front FV", "insert_after N0"},
+			want:  []string{"N0", "N1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			oldFV := patchTestFV(t, test.old...)
+			newFV := patchTestFV(t, test.new...)
+			b := &bytes.Buffer{}
+			export := &ExportPatch{Other: newFV, W: b}
+			if err := export.Run(oldFV); err != nil {
+				t.Fatal(err)
+			}
+			if ops := patchOps(export.Patch); !reflect.DeepEqual(ops, test.ops) {
+				t.Errorf("wrong operations, expected %v got %v", test.ops, ops)
+			}
+
+			// Replay the JSON patch on another build.
+			var p Patch
+			if err := json.Unmarshal(b.Bytes(), &p); err != nil {
+				t.Fatal(err)
+			}
+			thirdFV := patchTestFV(t, test.third...)
+			if err := (&ApplyPatch{Patch: p}).Run(thirdFV); err != nil {
+				t.Fatal(err)
+			}
+			if err := (&Assemble{}).Run(thirdFV); err != nil {
+				t.Fatal(err)
+			}
+			patched, err := uefi.NewFirmwareVolume(thirdFV.Buf(), 0, false)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if files := patchTestFiles(t, patched); !reflect.DeepEqual(files, test.want) {
+				t.Errorf("wrong patched files, expected %v got %v", test.want, files)
+			}
+		})
+	}
+}
+
+func TestPatchNotUnique(t *testing.T) {
+	// Two files share the GUID of A.
+	oldFV := patchTestFV(t, "A", "A:2", "B")
+	newFV := patchTestFV(t, "A:3", "B")
+	export := &ExportPatch{Other: newFV}
+	if err := export.Run(oldFV); err == nil || !strings.Contains(err.Error(), "not unique") {
+		t.Errorf("expected a GUID not unique error, got %v", err)
+	}
+
+	oldFV = patchTestFV(t, "A", "B")
+	newFV = patchTestFV(t, "B")
+	export = &ExportPatch{Other: newFV}
+	if err := export.Run(oldFV); err != nil {
+		t.Fatal(err)
+	}
+	thirdFV := patchTestFV(t, "A", "A:2", "B")
+	if err := (&ApplyPatch{Patch: export.Patch}).Run(thirdFV); err == nil {
+		t.Errorf("removing a file whose GUID is not unique should fail")
+	}
+}
@@ -0,0 +1,181 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"regexp"
+	"strings"
+	"time"
+)
+
+const (
+	// DefaultQEMU is the QEMU binary used when none is configured.
+	DefaultQEMU = "qemu-system-x86_64"
+	// DefaultQEMUTimeout is how long to wait for the firmware to boot when
+	// no timeout is configured.
+	DefaultQEMUTimeout = 2 * time.Minute
+
+	// qemuMatchWindow is the amount of serial output kept for matching. The
+	// patterns should match less than this.
+	qemuMatchWindow = 4096
+)
+
+// QEMUTester tests whether a firmware image boots in QEMU. The image is
+// attached as the first pflash drive and the serial output is searched for
+// the Success pattern. Its Test method can be used by the DXECleaner.
+type QEMUTester struct {
+	// QEMU is the QEMU binary. If empty, DefaultQEMU is used.
+	QEMU string
+	// Args are the arguments configuring the machine, such as:
+	//
+	//     -machine q35 -m 2G
+	//
+	// The arguments attaching the image and the serial port are added.
+	Args []string
+	// Success matches the serial output of a firmware which booted.
+	Success *regexp.Regexp
+	// Failure, if set, matches the serial output of a firmware which failed
+	// to boot, such as an assertion, to stop the test early.
+	Failure *regexp.Regexp
+	// Timeout is how long to wait for Success. If zero, DefaultQEMUTimeout
+	// is used.
+	Timeout time.Duration
+	// The serial output is written to this writer.
+	Log io.Writer
+}
+
+// LoadQEMUTester reads the configuration of a QEMUTester from a JSON file
+// such as:
+//
+//     {
+//       "QEMU": "qemu-system-x86_64",
+//       "Args": ["-machine", "q35", "-m", "2G"],
+//       "Success": "Shell> ",
+//       "Failure": "ASSERT",
+//       "Timeout": "90s"
+//     }
+//
+// Only Success is required.
+func LoadQEMUTester(path string) (*QEMUTester, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config struct {
+		QEMU    string
+		Args    []string
+		Success string
+		Failure string
+		Timeout string
+	}
+	if err := json.Unmarshal(buf, &config); err != nil {
+		return nil, fmt.Errorf("cannot parse QEMU configuration %q: %v", path, err)
+	}
+
+	q := &QEMUTester{QEMU: config.QEMU, Args: config.Args}
+	if config.Success == "" {
+		return nil, fmt.Errorf("QEMU configuration %q has no Success pattern", path)
+	}
+	if q.Success, err = regexp.Compile(config.Success); err != nil {
+		return nil, fmt.Errorf("invalid Success pattern in %q: %v", path, err)
+	}
+	if config.Failure != "" {
+		if q.Failure, err = regexp.Compile(config.Failure); err != nil {
+			return nil, fmt.Errorf("invalid Failure pattern in %q: %v", path, err)
+		}
+	}
+	if config.Timeout != "" {
+		if q.Timeout, err = time.ParseDuration(config.Timeout); err != nil {
+			return nil, fmt.Errorf("invalid Timeout in %q: %v", path, err)
+		}
+	}
+	return q, nil
+}
+
+// Test boots the image at path. Like the DXECleaner tests, it returns:
+//
+//     - (true, nil):   Success matched.
+//     - (false, err):  Failure matched, the timeout expired or QEMU exited.
+//     - (true, err):   QEMU could not be started or ctx was canceled.
+func (q *QEMUTester) Test(ctx context.Context, path string) (bool, error) {
+	if q.Success == nil {
+		return true, errors.New("no QEMU success pattern")
+	}
+	timeout := q.Timeout
+	if timeout == 0 {
+		timeout = DefaultQEMUTimeout
+	}
+	qemu := q.QEMU
+	if qemu == "" {
+		qemu = DefaultQEMU
+	}
+	args := append(append([]string{}, q.Args...),
+		"-drive", "if=pflash,format=raw,unit=0,file="+strings.Replace(path, ",", ",,", -1),
+		"-display", "none", "-serial", "stdio", "-monitor", "none", "-no-reboot")
+
+	qctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	cmd := exec.CommandContext(qctx, qemu, args...)
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		return true, err
+	}
+	// QEMU errors are logged along with the serial output.
+	cmd.Stderr = cmd.Stdout
+	if err := cmd.Start(); err != nil {
+		return true, err
+	}
+	booted, failed := q.watch(out)
+	timedOut := qctx.Err() == context.DeadlineExceeded
+	cancel()
+	waitErr := cmd.Wait()
+
+	switch {
+	case ctx.Err() != nil:
+		return true, ctx.Err()
+	case booted:
+		return true, nil
+	case failed:
+		return false, fmt.Errorf("serial output matched %q", q.Failure)
+	case timedOut:
+		return false, fmt.Errorf("serial output did not match %q within %v", q.Success, timeout)
+	}
+	return false, fmt.Errorf("QEMU exited before booting: %v", waitErr)
+}
+
+// watch reads the serial output until Success or Failure match, or the end
+// of the output.
+func (q *QEMUTester) watch(r io.Reader) (booted, failed bool) {
+	var window []byte
+	buf := make([]byte, 4096)
+	for {
+		n, err := r.Read(buf)
+		if n > 0 {
+			if q.Log != nil {
+				q.Log.Write(buf[:n])
+			}
+			window = append(window, buf[:n]...)
+			if q.Failure != nil && q.Failure.Match(window) {
+				return false, true
+			}
+			if q.Success.Match(window) {
+				return true, false
+			}
+			if len(window) > qemuMatchWindow {
+				window = append([]byte{}, window[len(window)-qemuMatchWindow:]...)
+			}
+		}
+		if err != nil {
+			return false, false
+		}
+	}
+}
@@ -0,0 +1,165 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// TestQEMUTester replaces QEMU with a shell script. The QEMU arguments follow
+// the script, so $0 is the first one.
+func TestQEMUTester(t *testing.T) {
+	sh, err := exec.LookPath("sh")
+	if err != nil {
+		t.Skip("no shell to stand in for QEMU")
+	}
+	var tests = []struct {
+		name    string
+		script  string
+		booted  bool
+		err     string
+		minTime time.Duration
+	}{
+		{"prompt without newline", `printf 'BdsDxe: loading\nShell> '; exec sleep 10`, true, "", 0},
+		{"pflash argument", `echo "$0 $@"; exec sleep 10`, true, "", 0},
+		{"assertion", `echo 'ASSERT [DxeCore] failed'; exec sleep 10`, false, "matched", 0},
+		{"timeout", `echo 'still booting'; exec sleep 10`, false, "did not match", 200 * time.Millisecond},
+		{"exit", `echo 'triple fault'`, false, "exited", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			log := &bytes.Buffer{}
+			q := &QEMUTester{
+				QEMU:    sh,
+				Args:    []string{"-c", test.script},
+				Success: regexp.MustCompile(`Shell> |file=/tmp/bios,,1\.bin`),
+				Failure: regexp.MustCompile(`ASSERT`),
+				Timeout: 200 * time.Millisecond,
+				Log:     log,
+			}
+			start := time.Now()
+			booted, err := q.Test(context.Background(), "/tmp/bios,1.bin")
+			if booted != test.booted {
+				t.Errorf("booted is %v, want %v (log %q)", booted, test.booted, log.String())
+			}
+			if (err == nil) != (test.err == "") || (err != nil && !strings.Contains(err.Error(), test.err)) {
+				t.Errorf("got error %v, want %q", err, test.err)
+			}
+			if d := time.Since(start); d < test.minTime || d > 5*time.Second {
+				t.Errorf("test took %v", d)
+			}
+		})
+	}
+}
+
+func TestQEMUTesterNoBinary(t *testing.T) {
+	q := &QEMUTester{QEMU: "/nonexistent/qemu", Success: regexp.MustCompile("Shell> ")}
+	if booted, err := q.Test(context.Background(), "bios.bin"); !booted || err == nil {
+		t.Errorf("got (%v, %v), want an error testing the image", booted, err)
+	}
+}
+
+func TestLoadQEMUTester(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var tests = []struct {
+		name   string
+		config string
+		err    bool
+	}{
+		{"valid", `{"Args": ["-machine", "q35"], "Success": "Shell> ", "Failure": "ASSERT", "Timeout": "90s"}`, false},
+		{"no success", `{"Args": ["-machine", "q35"]}`, true},
+		{"bad regexp", `{"Success": "("}`, true},
+		{"bad timeout", `{"Success": "Shell> ", "Timeout": "soon"}`, true},
+		{"bad json", `{`, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(dir, "config.json")
+			if err := ioutil.WriteFile(path, []byte(test.config), 0666); err != nil {
+				t.Fatal(err)
+			}
+			q, err := LoadQEMUTester(path)
+			if (err != nil) != test.err {
+				t.Fatalf("got error %v, expected error: %v", err, test.err)
+			}
+			if err != nil {
+				return
+			}
+			if q.Timeout != 90*time.Second || q.Success.String() != "Shell> " || q.Failure.String() != "ASSERT" ||
+				len(q.Args) != 2 {
+				t.Errorf("unexpected configuration %+v", q)
+			}
+		})
+	}
+}
+
+func TestDXECleanerQEMUCLI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "qemu")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	config := filepath.Join(dir, "config.json")
+	if err := ioutil.WriteFile(config, []byte(`{"Success": "Shell> "}`), 0666); err != nil {
+		t.Fatal(err)
+	}
+	blacklist := filepath.Join(dir, "blacklist")
+	if err := ioutil.WriteFile(blacklist, []byte(patchTestGUID("D2").String()+"\n"), 0666); err != nil {
+		t.Fatal(err)
+	}
+
+	driver := func(name string) *uefi.File {
+		f := &uefi.File{}
+		f.Header.GUID = patchTestGUID(name)
+		f.Header.Type = uefi.FVFileTypeDriver
+		return f
+	}
+	query := "guid==" + patchTestGUID("D2").String()
+	var tests = []struct {
+		args        []string
+		bisect      bool
+		match, skip string
+	}{
+		{[]string{"dxecleaner_qemu", config}, false, "D2", ""},
+		{[]string{"dxecleaner_qemu_blacklist", config, blacklist}, false, "D1", "D2"},
+		{[]string{"dxecleaner_qemu_query", config, query}, false, "D2", "D1"},
+		{[]string{"dxecleaner_qemu_bisect_blacklist", config, blacklist, "-", "2", "checkpoint"}, true, "D1", "D2"},
+		{[]string{"dxecleaner_qemu_bisect_query", config, query, "-", "2", "checkpoint"}, true, "D2", "D1"},
+	}
+	for _, test := range tests {
+		t.Run(test.args[0], func(t *testing.T) {
+			visitors, err := ParseCLI(test.args)
+			if err != nil {
+				t.Fatal(err)
+			}
+			v := visitors[0].(*DXECleaner)
+			if v.Bisect != test.bisect {
+				t.Errorf("got bisect %v, want %v", v.Bisect, test.bisect)
+			}
+			if !v.Predicate(driver(test.match)) {
+				t.Errorf("%s should be removed", test.match)
+			}
+			if test.skip != "" && v.Predicate(driver(test.skip)) {
+				t.Errorf("%s should be kept", test.skip)
+			}
+		})
+	}
+}
@@ -0,0 +1,471 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// queryField returns the values of a field for a file.
+type queryField func(f *uefi.File) []string
+
+var queryFields = map[string]queryField{
+	"guid": func(f *uefi.File) []string {
+		return []string{f.Header.GUID.String()}
+	},
+	"name": func(f *uefi.File) []string {
+		var names []string
+		for _, s := range querySections(f.Sections) {
+			if s.Header.Type == uefi.SectionTypeUserInterface {
+				names = append(names, s.Name)
+			}
+		}
+		return names
+	},
+	"type": func(f *uefi.File) []string {
+		return []string{strings.TrimPrefix(f.Header.Type.String(), "EFI_FV_FILETYPE_")}
+	},
+	"size": func(f *uefi.File) []string {
+		return []string{strconv.FormatUint(f.Header.ExtendedSize, 10)}
+	},
+	"depex": func(f *uefi.File) []string {
+		var depexes []string
+		for _, s := range querySections(f.Sections) {
+			if len(s.DepEx) == 0 {
+				continue
+			}
+			var ops []string
+			for _, op := range s.DepEx {
+				ops = append(ops, string(op.OpCode))
+				if op.GUID != nil {
+					ops = append(ops, op.GUID.String())
+				}
+			}
+			depexes = append(depexes, strings.Join(ops, " "))
+		}
+		return depexes
+	},
+	"compression": func(f *uefi.File) []string {
+		var compressions []string
+		for _, s := range querySections(f.Sections) {
+			if s.TypeSpecific == nil {
+				continue
+			}
+			switch h := s.TypeSpecific.Header.(type) {
+			case *uefi.SectionCompression:
+				compressions = append(compressions, h.Compression)
+			case *uefi.SectionGUIDDefined:
+				if h.Compression != "" {
+					compressions = append(compressions, h.Compression)
+				}
+			}
+		}
+		if len(compressions) == 0 {
+			return []string{"NONE"}
+		}
+		return compressions
+	},
+	"fv": func(f *uefi.File) []string {
+		if fv := f.Volume(); fv != nil {
+			return []string{fv.FVName.String()}
+		}
+		return nil
+	},
+	"machine": func(f *uefi.File) []string {
+		var machines []string
+		for _, s := range querySections(f.Sections) {
+			if s.PE != nil {
+				machines = append(machines, s.PE.Machine.String())
+			}
+		}
+		return machines
+	},
+}
+
+// querySections lists the sections and the sections they encapsulate.
+// Sections of encapsulated firmware volumes belong to other files and are not
+// listed.
+func querySections(sections []*uefi.Section) []*uefi.Section {
+	var all []*uefi.Section
+	for _, s := range sections {
+		all = append(all, s)
+		for _, e := range s.Encapsulated {
+			if es, ok := e.Value.(*uefi.Section); ok {
+				all = append(all, querySections([]*uefi.Section{es})...)
+			}
+		}
+	}
+	return all
+}
+
+// queryNode is a node of a parsed query.
+type queryNode func(f *uefi.File) bool
+
+// ParseQuery parses a query into a predicate matching firmware files. A
+// query is an expression such as:
+//
+//     type==DRIVER && size>64K && has_section(PE32) && !name=~Net
+//
+// Comparisons are written FIELD OP VALUE, where OP is one of ==, !=, =~
+// (regexp match), !~ (regexp mismatch), <, <=, > and >=. They are combined
+// with &&, ||, ! and parentheses. Values containing spaces or operator
+// characters must be quoted with '' or "". String comparisons and regexps
+// are case insensitive and regexps are not anchored.
+//
+// The fields of a file are:
+//
+//     guid:        the GUID of the file
+//     name:        the name in the user interface section
+//     type:        the file type without the EFI_FV_FILETYPE_ prefix
+//     size:        the size of the file, values may use the K, M and G suffixes
+//     depex:       the dependency expression, such as "PUSH <GUID> PUSH <GUID> AND END"
+//     compression: the compression of the encapsulation sections or NONE
+//     fv:          the GUID of the firmware volume holding the file
+//     machine:     the machine of the PE32 and TE images, such as X64
+//
+// A field with several values, such as the machines of a file with several
+// images, matches when any of its values does. The has_section(TYPE)
+// function matches files with a section of TYPE, without the EFI_SECTION_
+// prefix, including sections encapsulated in compressed sections.
+//
+// The fv field is only known for files which were parsed in or visited
+// through their firmware volume, see uefi.File.Volume.
+func ParseQuery(s string) (FindPredicate, error) {
+	tokens, err := lexQuery(s)
+	if err != nil {
+		return nil, fmt.Errorf("query %q: %v", s, err)
+	}
+	p := &queryParser{tokens: tokens}
+	node, err := p.parseOr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos].text)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("query %q: %v", s, err)
+	}
+
+	return func(f uefi.Firmware) bool {
+		if f, ok := f.(*uefi.File); ok {
+			return node(f)
+		}
+		return false
+	}, nil
+}
+
+// queryOperators are the operators which tell a query from a regexp.
+var queryOperators = []string{"==", "!=", "=~", "!~", "<", ">", "&&", "||", "has_section("}
+
+// FindQueryPredicate returns the predicate of a query when s uses one of the
+// query operators and FindFilePredicate(s) otherwise.
+func FindQueryPredicate(s string) (FindPredicate, error) {
+	for _, op := range queryOperators {
+		if strings.Contains(s, op) {
+			return ParseQuery(s)
+		}
+	}
+	return FindFilePredicate(s)
+}
+
+type queryTokenKind int
+
+const (
+	queryWord queryTokenKind = iota
+	queryString
+	queryOperator
+)
+
+type queryToken struct {
+	kind queryTokenKind
+	text string
+}
+
+// queryLexOperators are the operators of a query, longest first.
+var queryLexOperators = []string{"&&", "||", "==", "!=", "=~", "!~", "<=", ">=", "<", ">", "!", "(", ")"}
+
+// lexQuery splits a query into tokens.
+func lexQuery(s string) ([]queryToken, error) {
+	var tokens []queryToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '"' || c == '\'':
+			end := strings.IndexByte(s[i+1:], c)
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated string at offset %d", i)
+			}
+			tokens = append(tokens, queryToken{queryString, s[i+1 : i+1+end]})
+			i += end + 2
+		default:
+			op := ""
+			for _, o := range queryLexOperators {
+				if strings.HasPrefix(s[i:], o) {
+					op = o
+					break
+				}
+			}
+			if op != "" {
+				tokens = append(tokens, queryToken{queryOperator, op})
+				i += len(op)
+				continue
+			}
+			start := i
+			for i < len(s) && !unicode.IsSpace(rune(s[i])) && !strings.ContainsRune("\"'&|=!<>()", rune(s[i])) {
+				i++
+			}
+			if i == start {
+				return nil, fmt.Errorf("unexpected %q at offset %d", s[i], i)
+			}
+			tokens = append(tokens, queryToken{queryWord, s[start:i]})
+		}
+	}
+	return tokens, nil
+}
+
+// queryParser is a recursive descent parser for the grammar:
+//
+//     or         = and { "||" and }
+//     and        = unary { "&&" unary }
+//     unary      = "!" unary | "(" or ")" | function | comparison
+//     function   = WORD "(" value ")"
+//     comparison = WORD OP value
+type queryParser struct {
+	tokens []queryToken
+	pos    int
+}
+
+func (p *queryParser) peek(text string) bool {
+	return p.pos < len(p.tokens) && p.tokens[p.pos].kind == queryOperator && p.tokens[p.pos].text == text
+}
+
+func (p *queryParser) next() (queryToken, error) {
+	if p.pos >= len(p.tokens) {
+		return queryToken{}, fmt.Errorf("unexpected end of query")
+	}
+	p.pos++
+	return p.tokens[p.pos-1], nil
+}
+
+func (p *queryParser) expect(text string) error {
+	if !p.peek(text) {
+		if p.pos >= len(p.tokens) {
+			return fmt.Errorf("expected %q at end of query", text)
+		}
+		return fmt.Errorf("expected %q, got %q", text, p.tokens[p.pos].text)
+	}
+	p.pos++
+	return nil
+}
+
+func (p *queryParser) value() (string, error) {
+	t, err := p.next()
+	if err != nil {
+		return "", err
+	}
+	if t.kind == queryOperator {
+		return "", fmt.Errorf("expected a value, got %q", t.text)
+	}
+	return t.text, nil
+}
+
+func (p *queryParser) parseOr() (queryNode, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("||") {
+		p.pos++
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *uefi.File) bool {
+			return l(f) || right(f)
+		}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseAnd() (queryNode, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek("&&") {
+		p.pos++
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		l := left
+		left = func(f *uefi.File) bool {
+			return l(f) && right(f)
+		}
+	}
+	return left, nil
+}
+
+func (p *queryParser) parseUnary() (queryNode, error) {
+	switch {
+	case p.peek("!"):
+		p.pos++
+		n, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return func(f *uefi.File) bool {
+			return !n(f)
+		}, nil
+	case p.peek("("):
+		p.pos++
+		n, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		return n, p.expect(")")
+	}
+
+	t, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if t.kind != queryWord {
+		return nil, fmt.Errorf("expected a field, got %q", t.text)
+	}
+	if p.peek("(") {
+		return p.parseFunction(t.text)
+	}
+	return p.parseComparison(t.text)
+}
+
+func (p *queryParser) parseFunction(name string) (queryNode, error) {
+	if name != "has_section" {
+		return nil, fmt.Errorf("unknown function %q", name)
+	}
+	p.pos++
+	arg, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	arg = strings.TrimPrefix(strings.ToUpper(arg), "EFI_SECTION_")
+	return func(f *uefi.File) bool {
+		for _, s := range querySections(f.Sections) {
+			if strings.TrimPrefix(s.Header.Type.String(), "EFI_SECTION_") == arg {
+				return true
+			}
+		}
+		return false
+	}, nil
+}
+
+func (p *queryParser) parseComparison(name string) (queryNode, error) {
+	field, ok := queryFields[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown field %q", name)
+	}
+	op, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	if op.kind != queryOperator {
+		return nil, fmt.Errorf("expected an operator after %q, got %q", name, op.text)
+	}
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+
+	var match func(string) bool
+	switch op.text {
+	case "==", "!=":
+		if name == "type" {
+			value = strings.TrimPrefix(strings.ToUpper(value), "EFI_FV_FILETYPE_")
+		}
+		if name == "size" {
+			n, err := parseQuerySize(value)
+			if err != nil {
+				return nil, err
+			}
+			value = strconv.FormatUint(n, 10)
+		}
+		match = func(v string) bool {
+			return strings.EqualFold(v, value)
+		}
+	case "=~", "!~":
+		re, err := regexp.Compile("(?i)" + value)
+		if err != nil {
+			return nil, err
+		}
+		match = re.MatchString
+	case "<", "<=", ">", ">=":
+		if name != "size" {
+			return nil, fmt.Errorf("operator %q only applies to size", op.text)
+		}
+		n, err := parseQuerySize(value)
+		if err != nil {
+			return nil, err
+		}
+		cmp := op.text
+		match = func(v string) bool {
+			size, _ := strconv.ParseUint(v, 10, 64)
+			switch cmp {
+			case "<":
+				return size < n
+			case "<=":
+				return size <= n
+			case ">":
+				return size > n
+			}
+			return size >= n
+		}
+	default:
+		return nil, fmt.Errorf("expected an operator after %q, got %q", name, op.text)
+	}
+
+	negate := op.text == "!=" || op.text == "!~"
+	return func(f *uefi.File) bool {
+		for _, v := range field(f) {
+			if match(v) {
+				return !negate
+			}
+		}
+		return negate
+	}, nil
+}
+
+// parseQuerySize parses a size with an optional K, M or G suffix.
+func parseQuerySize(s string) (uint64, error) {
+	if s == "" {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	shift := uint(0)
+	switch strings.ToUpper(s[len(s)-1:]) {
+	case "K":
+		shift = 10
+	case "M":
+		shift = 20
+	case "G":
+		shift = 30
+	}
+	if shift != 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseUint(s, 0, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n << shift, nil
+}
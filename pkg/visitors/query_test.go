@@ -0,0 +1,248 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+var (
+	queryFV1       = guid.MustParse("11111111-2222-3333-4444-555555555555")
+	queryFV2       = guid.MustParse("66666666-7777-8888-9999-AAAAAAAAAAAA")
+	queryDepexGUID = guid.MustParse("8D59D32B-C655-4AE9-9B15-F25904992A43")
+)
+
+// queryTestFile creates a file with a user interface section and the given
+// sections.
+func queryTestFile(name string, t uefi.FVFileType, size uint64, sections ...*uefi.Section) *uefi.File {
+	f := &uefi.File{}
+	f.Header.GUID = patchTestGUID(name)
+	f.Header.Type = t
+	f.Header.ExtendedSize = size
+	ui := &uefi.Section{Name: name}
+	ui.Header.Type = uefi.SectionTypeUserInterface
+	f.Sections = append(sections, ui)
+	return f
+}
+
+func queryTestPE(machine uefi.PEMachine) *uefi.Section {
+	s := &uefi.Section{PE: &uefi.PEImage{Machine: machine}}
+	s.Header.Type = uefi.SectionTypePE32
+	return s
+}
+
+// queryTestFVs returns two volumes with files of various types.
+func queryTestFVs() []*uefi.FirmwareVolume {
+	depex := &uefi.Section{DepEx: []uefi.DepExOp{
+		{OpCode: "PUSH", GUID: queryDepexGUID},
+		{OpCode: "END"},
+	}}
+	depex.Header.Type = uefi.SectionTypeDXEDepEx
+
+	compressed := &uefi.Section{
+		TypeSpecific: &uefi.TypeSpecificHeader{
+			Type:   uefi.SectionTypeGUIDDefined,
+			Header: &uefi.SectionGUIDDefined{Compression: "LZMA"},
+		},
+		Encapsulated: []*uefi.TypedFirmware{uefi.MakeTyped(queryTestPE(uefi.PEMachineAArch64))},
+	}
+	compressed.Header.Type = uefi.SectionTypeGUIDDefined
+
+	fv1 := &uefi.FirmwareVolume{Files: []*uefi.File{
+		queryTestFile("NetDxe", uefi.FVFileTypeDriver, 0x20000, queryTestPE(uefi.PEMachineX64), depex),
+		queryTestFile("Shell", uefi.FVFileTypeApplication, 0x30000, compressed),
+	}}
+	fv1.FVName = *queryFV1
+	fv2 := &uefi.FirmwareVolume{Files: []*uefi.File{
+		queryTestFile("SmallDxe", uefi.FVFileTypeDriver, 0x800, queryTestPE(uefi.PEMachineX64)),
+		queryTestFile("Logo", uefi.FVFileTypeFreeForm, 0x10000),
+	}}
+	fv2.FVName = *queryFV2
+	return []*uefi.FirmwareVolume{fv1, fv2}
+}
+
+func TestQuery(t *testing.T) {
+	var tests = []struct {
+		query string
+		want  []string
+	}{
+		{"type==DRIVER", []string{"NetDxe", "SmallDxe"}},
+		{"type==EFI_FV_FILETYPE_application", []string{"Shell"}},
+		{"type!=DRIVER", []string{"Shell", "Logo"}},
+		{"size>64K", []string{"NetDxe", "Shell"}},
+		{"size<=0x10000", []string{"SmallDxe", "Logo"}},
+		{"size==2K", []string{"SmallDxe"}},
+		{"type==DRIVER && size>64K && has_section(PE32) && !name=~Net", nil},
+		{"type==DRIVER && size<64K && has_section(PE32) && !name=~Net", []string{"SmallDxe"}},
+		{"has_section(EFI_SECTION_PE32)", []string{"NetDxe", "Shell", "SmallDxe"}},
+		{"has_section(DXE_DEPEX)", []string{"NetDxe"}},
+		{"depex=~8d59d32b", []string{"NetDxe"}},
+		{"depex=~'^PUSH .* END$'", []string{"NetDxe"}},
+		{"compression==LZMA", []string{"Shell"}},
+		{"compression==NONE", []string{"NetDxe", "SmallDxe", "Logo"}},
+		{"machine==AARCH64", []string{"Shell"}},
+		{"machine!=X64", []string{"Shell", "Logo"}},
+		{"fv==" + queryFV2.String(), []string{"SmallDxe", "Logo"}},
+		{"guid==" + patchTestGUID("Logo").String(), []string{"Logo"}},
+		{"name==shell || (name=~dxe && !(size>=0x20000))", []string{"Shell", "SmallDxe"}},
+		{`name=~"^(Net|Logo)"`, []string{"NetDxe", "Logo"}},
+		{"name!~o", []string{"NetDxe", "Shell", "SmallDxe"}},
+	}
+	for _, test := range tests {
+		t.Run(test.query, func(t *testing.T) {
+			pred, err := ParseQuery(test.query)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var names []string
+			for _, fv := range queryTestFVs() {
+				find := &Find{Predicate: pred}
+				if err := find.Run(fv); err != nil {
+					t.Fatal(err)
+				}
+				for _, m := range find.Matches {
+					names = append(names, m.(*uefi.File).Sections[len(m.(*uefi.File).Sections)-1].Name)
+				}
+			}
+			if !reflect.DeepEqual(names, test.want) {
+				t.Errorf("matched %v, want %v", names, test.want)
+			}
+		})
+	}
+}
+
+func TestQueryVolumeReuse(t *testing.T) {
+	pred, err := ParseQuery("fv==" + queryFV2.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	fvs := queryTestFVs()
+	for _, fv := range fvs {
+		if err := (&Find{Predicate: pred}).Run(fv); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Move Shell to the second volume and visit both volumes concurrently.
+	shell := fvs[0].Files[1]
+	fvs[0].Files = fvs[0].Files[:1]
+	fvs[1].Files = append(fvs[1].Files, shell)
+	want := [][]*uefi.File{nil, fvs[1].Files}
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		for j, fv := range fvs {
+			wg.Add(1)
+			go func(fv *uefi.FirmwareVolume, want []*uefi.File) {
+				defer wg.Done()
+				find := &Find{Predicate: pred}
+				if err := find.Run(fv); err != nil {
+					t.Error(err)
+					return
+				}
+				if len(find.Matches) != len(want) {
+					t.Errorf("matched %v, want %v", find.Matches, want)
+					return
+				}
+				for k, m := range find.Matches {
+					if m != want[k] {
+						t.Errorf("matched %v, want %v", find.Matches, want)
+					}
+				}
+			}(fv, want[j])
+		}
+	}
+	wg.Wait()
+
+	// A file no longer in its volume has no volume.
+	fvs[1].Files = fvs[1].Files[:2]
+	if pred(shell) {
+		t.Errorf("removed file matched fv==%v", queryFV2)
+	}
+}
+
+func TestQueryErrors(t *testing.T) {
+	for _, query := range []string{
+		"",
+		"type",
+		"type==",
+		"color==red",
+		"size<big",
+		"name<3",
+		"name=~'('",
+		"has_section(PE32",
+		"has_depex(PE32)",
+		"(type==DRIVER",
+		"type==DRIVER)",
+		"type==DRIVER &&",
+		"name=='Shell",
+		"type==DRIVER type==RAW",
+	} {
+		if _, err := ParseQuery(query); err == nil {
+			t.Errorf("query %q should not parse", query)
+		}
+	}
+}
+
+func TestFindQueryPredicate(t *testing.T) {
+	fv := queryTestFVs()[0]
+	for _, arg := range []string{"Shell", "shell", patchTestGUID("Shell").String(), "name==Shell", "has_section(GUID_DEFINED)"} {
+		pred, err := FindQueryPredicate(arg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f, err := FindExactlyOne(fv, pred)
+		if err != nil {
+			t.Fatalf("%q: %v", arg, err)
+		}
+		if f != fv.Files[1] {
+			t.Errorf("%q matched %v, want the Shell file", arg, f)
+		}
+	}
+}
+
+func TestExtractQuery(t *testing.T) {
+	dir, err := ioutil.TempDir("", "section-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fv := patchTestFV(t, "A", "B", "C")
+	pred, err := ParseQuery("guid==" + patchTestGUID("B").String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index uint64
+	if err := (&Extract{BasePath: dir, DirPath: ".", Index: &index, Predicate: pred}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+
+	var extracted []string
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() {
+			rel, _ := filepath.Rel(dir, path)
+			extracted = append(extracted, rel)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []string{
+		filepath.Join("0x0", patchTestGUID("B").String(), "1", "0", "0.sec"),
+		"summary.json",
+	}
+	if !reflect.DeepEqual(extracted, want) {
+		t.Errorf("extracted %v, want %v", extracted, want)
+	}
+}
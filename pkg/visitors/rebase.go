@@ -0,0 +1,288 @@
+// Copyright 2018 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/linuxboot/fiano/pkg/compression"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// xipFileTypes are the file types whose images execute in place from flash.
+var xipFileTypes = map[uefi.FVFileType]bool{
+	uefi.FVFileTypeSECCore:            true,
+	uefi.FVFileTypePEICore:            true,
+	uefi.FVFileTypePEIM:               true,
+	uefi.FVFileTypeCombinedPEIMDriver: true,
+}
+
+// Rebase applies relocations to the PE32 and TE images of execute in place
+// files (SEC, PEI core and PEIMs) so that their image base matches their
+// address in flash. Images inside compressed or otherwise encoded sections are
+// loaded into memory before they run and are left alone.
+type Rebase struct {
+	// Address at which the end of the firmware is mapped. If 0, the end of the
+	// firmware is mapped at 4GiB like on x86.
+	TopOfFlash uint64
+
+	// Compression configures the compressors used when assembling. If nil,
+	// compression.DefaultConfig() is used.
+	Compression *compression.Config
+
+	// Output
+	Rebased []*uefi.File
+
+	// Address of the start of the buffer of the current node.
+	addr uint64
+}
+
+// SetCompression implements CompressionSetter.
+func (v *Rebase) SetCompression(cfg *compression.Config) {
+	v.Compression = cfg
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *Rebase) Run(f uefi.Firmware) error {
+	// The layout must be final before computing addresses.
+	if err := (&Assemble{Compression: v.Compression}).Run(f); err != nil {
+		return err
+	}
+
+	top := v.TopOfFlash
+	if top == 0 {
+		top = 1 << 32
+	}
+	v.addr = top - uint64(len(f.Buf()))
+	if err := f.Apply(v); err != nil {
+		return err
+	}
+
+	// Propagate the changed images up. The sizes do not change so the
+	// layout stays the same.
+	return (&Assemble{Compression: v.Compression}).Run(f)
+}
+
+// Visit applies the Rebase visitor to any Firmware type.
+func (v *Rebase) Visit(f uefi.Firmware) error {
+	switch f := f.(type) {
+	case *uefi.FlashImage:
+		for _, r := range f.Regions {
+			v2 := *v
+			if fr := r.Value.(uefi.Region).FlashRegion(); fr != nil {
+				v2.addr = v.addr + uint64(fr.BaseOffset())
+			}
+			if err := r.Value.Apply(&v2); err != nil {
+				return err
+			}
+			v.Rebased = v2.Rebased
+		}
+		return nil
+
+	case *uefi.BIOSRegion:
+		// Assemble concatenates the elements.
+		offset := uint64(0)
+		for _, e := range f.Elements {
+			v2 := *v
+			v2.addr = v.addr + offset
+			if err := e.Value.Apply(&v2); err != nil {
+				return err
+			}
+			v.Rebased = v2.Rebased
+			offset += uint64(len(e.Value.Buf()))
+		}
+		return nil
+
+	case *uefi.FirmwareVolume:
+		offsets, err := fileOffsets(f)
+		if err != nil {
+			return err
+		}
+		for i, file := range f.Files {
+			v2 := *v
+			v2.addr = v.addr + offsets[i]
+			if err := file.Apply(&v2); err != nil {
+				return err
+			}
+			v.Rebased = v2.Rebased
+		}
+		return nil
+
+	case *uefi.File:
+		return v.rebaseFile(f)
+
+	default:
+		// Nothing else contains execute in place images.
+		return nil
+	}
+}
+
+// fileOffsets returns the offsets of the files of an assembled volume. Pad
+// files inserted by Assemble are not in the file list and are skipped.
+func fileOffsets(fv *uefi.FirmwareVolume) ([]uint64, error) {
+	buf := fv.Buf()
+	offsets := make([]uint64, len(fv.Files))
+	offset := fv.DataOffset
+	for i, file := range fv.Files {
+		fBuf := file.Buf()
+		for {
+			offset = uefi.Align8(offset)
+			if offset+uefi.FileHeaderMinLength > uint64(len(buf)) {
+				return nil, fmt.Errorf("file %v not found in firmware volume %v", file.Header.GUID, fv.FVName)
+			}
+			if bytes.HasPrefix(buf[offset:], fBuf) {
+				break
+			}
+			// Skip the pad file.
+			var fh uefi.FileHeaderExtended
+			if err := binary.Read(bytes.NewReader(buf[offset:]), binary.LittleEndian, &fh.FileHeader); err != nil {
+				return nil, err
+			}
+			size := uefi.Read3Size(fh.Size)
+			if fh.Attributes.IsLarge() {
+				if err := binary.Read(bytes.NewReader(buf[offset+uefi.FileHeaderMinLength:]), binary.LittleEndian, &fh.ExtendedSize); err != nil {
+					return nil, err
+				}
+				size = fh.ExtendedSize
+			}
+			if size < uefi.FileHeaderMinLength {
+				return nil, fmt.Errorf("file %v not found in firmware volume %v", file.Header.GUID, fv.FVName)
+			}
+			offset += size
+		}
+		offsets[i] = offset
+		offset += uint64(len(fBuf))
+	}
+	return offsets, nil
+}
+
+func (v *Rebase) rebaseFile(f *uefi.File) error {
+	dataAddr := v.addr + f.DataOffset
+	if len(f.Sections) == 0 {
+		if !xipFileTypes[f.Header.Type] || f.NVarStore != nil {
+			return nil
+		}
+		// The sections of some file types are not parsed, rebase the raw
+		// file data instead.
+		data := append([]byte{}, f.Buf()[f.DataOffset:]...)
+		changed := false
+		for offset := uint64(0); offset+uefi.SectionMinLength <= uint64(len(data)); {
+			offset = uefi.Align4(offset)
+			s, err := uefi.NewSection(data[offset:], 0)
+			if err != nil {
+				return fmt.Errorf("file %v: %v", f.Header.GUID, err)
+			}
+			if s.Header.ExtendedSize < uefi.SectionMinLength {
+				return fmt.Errorf("file %v: section at %#x has invalid size %#x", f.Header.GUID, offset, s.Header.ExtendedSize)
+			}
+			sBuf := data[offset : offset+uint64(s.Header.ExtendedSize)]
+			c, err := rebaseSection(s, sBuf, dataAddr+offset)
+			if err != nil {
+				return fmt.Errorf("file %v: %v", f.Header.GUID, err)
+			}
+			changed = changed || c
+			offset += uint64(s.Header.ExtendedSize)
+		}
+		if changed {
+			v.Rebased = append(v.Rebased, f)
+			return f.ChecksumAndAssemble(data)
+		}
+		return nil
+	}
+
+	changed := false
+	offset := uint64(0)
+	for _, s := range f.Sections {
+		offset = uefi.Align4(offset)
+		sAddr := dataAddr + offset
+		offset += uint64(len(s.Buf()))
+
+		switch s.Header.Type {
+		case uefi.SectionTypePE32, uefi.SectionTypeTE:
+			if !xipFileTypes[f.Header.Type] {
+				continue
+			}
+			sBuf := append([]byte{}, s.Buf()...)
+			c, err := rebaseSection(s, sBuf, sAddr)
+			if err != nil {
+				return fmt.Errorf("file %v: %v", f.Header.GUID, err)
+			}
+			if c {
+				s.SetBuf(sBuf)
+				changed = true
+			}
+		case uefi.SectionTypeFirmwareVolumeImage:
+			// Volumes in volume image sections are also mapped in flash.
+			v2 := *v
+			v2.addr = sAddr + sectionHeaderLen(s)
+			for _, e := range s.Encapsulated {
+				if err := e.Value.Apply(&v2); err != nil {
+					return err
+				}
+			}
+			v.Rebased = v2.Rebased
+		}
+	}
+	if changed {
+		v.Rebased = append(v.Rebased, f)
+	}
+	return nil
+}
+
+// sectionHeaderLen returns the length of the common section header.
+func sectionHeaderLen(s *uefi.Section) uint64 {
+	if s.Header.Size == [3]uint8{0xFF, 0xFF, 0xFF} {
+		return uefi.SectionExtMinLength
+	}
+	return uefi.SectionMinLength
+}
+
+// rebaseSection rebases the image of a PE32 or TE section located at addr.
+// sBuf holds the full section and is modified in place. It returns whether the
+// image was changed.
+func rebaseSection(s *uefi.Section, sBuf []byte, addr uint64) (bool, error) {
+	if s.Header.Type != uefi.SectionTypePE32 && s.Header.Type != uefi.SectionTypeTE {
+		return false, nil
+	}
+	hl := sectionHeaderLen(s)
+	image := sBuf[hl:]
+	pe, err := uefi.ParsePEImage(image)
+	if err != nil {
+		return false, err
+	}
+	newBase := addr + hl
+	if pe.Format == uefi.PEFormatTE {
+		// The TE header replaces the stripped PE headers.
+		newBase = newBase + uefi.TEHeaderSize - uint64(pe.StrippedSize)
+	}
+	if pe.ImageBase == newBase {
+		return false, nil
+	}
+	if err := pe.Rebase(image, newBase); err != nil {
+		return false, fmt.Errorf("unable to rebase %v image from %#x to %#x: %v", pe.Format, pe.ImageBase, newBase, err)
+	}
+	s.PE = pe
+	return true, nil
+}
+
+func init() {
+	RegisterCLI("rebase", "rebase execute in place SEC and PEI images to their address in flash", 0, func(args []string) (uefi.Visitor, error) {
+		return &Rebase{}, nil
+	})
+	RegisterCLI("rebase_at", "rebase_at top-of-flash\n rebase like rebase, with the end of the firmware mapped at top-of-flash instead of 4GiB", 1, func(args []string) (uefi.Visitor, error) {
+		top, err := strconv.ParseUint(args[0], 0, 64)
+		if err != nil {
+			return nil, err
+		}
+		if top == 0 {
+			return nil, errors.New("top of flash must not be 0")
+		}
+		return &Rebase{TopOfFlash: top}, nil
+	})
+}
@@ -0,0 +1,145 @@
+// Copyright 2018 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+const (
+	testPEBase    = 0x10000
+	testPEPointer = 0x210 // Offset of an absolute pointer to testPEBase+0x300
+)
+
+// buildRelocatablePE32 builds an IA32 PE32 image with a .text section
+// containing one absolute pointer and a .reloc section fixing it up.
+// Sections are file aligned on their virtual addresses as required for XIP.
+func buildRelocatablePE32() []byte {
+	const (
+		peOffset  = 0x80
+		optOffset = peOffset + 4 + 20
+		secOffset = optOffset + 0xe0
+	)
+	buf := make([]byte, 0x600)
+	copy(buf, "MZ")
+	binary.LittleEndian.PutUint32(buf[0x3c:], peOffset)
+	copy(buf[peOffset:], "PE\x00\x00")
+	binary.LittleEndian.PutUint16(buf[peOffset+4:], uint16(uefi.PEMachineI386))
+	binary.LittleEndian.PutUint16(buf[peOffset+6:], 2)     // NumberOfSections
+	binary.LittleEndian.PutUint16(buf[peOffset+20:], 0xe0) // SizeOfOptionalHeader
+
+	opt := buf[optOffset:]
+	binary.LittleEndian.PutUint16(opt, 0x10b) // PE32
+	binary.LittleEndian.PutUint32(opt[16:], 0x200)
+	binary.LittleEndian.PutUint32(opt[28:], testPEBase)
+	binary.LittleEndian.PutUint32(opt[32:], 0x200) // SectionAlignment
+	binary.LittleEndian.PutUint32(opt[36:], 0x200) // FileAlignment
+	binary.LittleEndian.PutUint32(opt[56:], 0x600) // SizeOfImage
+	binary.LittleEndian.PutUint32(opt[60:], 0x200) // SizeOfHeaders
+	binary.LittleEndian.PutUint16(opt[68:], uint16(uefi.PESubsystemEFIBootServiceDriver))
+	binary.LittleEndian.PutUint32(opt[92:], 16)        // NumberOfRvaAndSizes
+	binary.LittleEndian.PutUint32(opt[96+5*8:], 0x400) // Base relocation directory
+	binary.LittleEndian.PutUint32(opt[96+5*8+4:], 12)
+
+	for i, s := range []struct {
+		name string
+		addr uint32
+	}{{".text", 0x200}, {".reloc", 0x400}} {
+		sec := buf[secOffset+i*40:]
+		copy(sec, s.name)
+		binary.LittleEndian.PutUint32(sec[8:], 0x200)
+		binary.LittleEndian.PutUint32(sec[12:], s.addr)
+		binary.LittleEndian.PutUint32(sec[16:], 0x200)
+		binary.LittleEndian.PutUint32(sec[20:], s.addr)
+	}
+
+	binary.LittleEndian.PutUint32(buf[testPEPointer:], testPEBase+0x300)
+	// One HIGHLOW relocation and one ABSOLUTE padding entry.
+	binary.LittleEndian.PutUint32(buf[0x400:], 0x200)
+	binary.LittleEndian.PutUint32(buf[0x404:], 12)
+	binary.LittleEndian.PutUint16(buf[0x408:], 3<<12|(testPEPointer-0x200))
+	return buf
+}
+
+// rebaseVolume returns a 64KiB volume holding a PEIM with the image of
+// buildRelocatablePE32, and its PE32 section.
+func rebaseVolume(t *testing.T) (*uefi.FirmwareVolume, *uefi.Section) {
+	fv, err := createEmptyFirmwareVolume(0, 0x10000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := uefi.CreateSection(uefi.SectionTypePE32, buildRelocatablePE32(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.GenSecHeader(); err != nil {
+		t.Fatal(err)
+	}
+	file := &uefi.File{Sections: []*uefi.Section{s}}
+	file.Header.GUID = *guid.MustParse("7E577E57-0123-4567-89AB-CDEF00000006")
+	file.Header.Type = uefi.FVFileTypePEIM
+	file.Header.SetState(uefi.FileStateValid)
+	file.DataOffset = uefi.FileHeaderMinLength
+	fv.Files = append(fv.Files, file)
+	return fv, s
+}
+
+func TestRebase(t *testing.T) {
+	fv, s := rebaseVolume(t)
+
+	r := &Rebase{}
+	if err := r.Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Rebased) != 1 {
+		t.Fatalf("expected 1 rebased file, got %d", len(r.Rebased))
+	}
+
+	// The volume is mapped at 4GiB-64KiB and the image follows the volume
+	// header, the file header and the section header.
+	wantBase := uint64(0xFFFF0000 + fv.DataOffset + uefi.FileHeaderMinLength + uefi.SectionMinLength)
+	if s.PE.ImageBase != wantBase {
+		t.Errorf("image base mismatch, expected %#x, got %#x", wantBase, s.PE.ImageBase)
+	}
+	image := s.Buf()[uefi.SectionMinLength:]
+	if ptr := binary.LittleEndian.Uint32(image[testPEPointer:]); uint64(ptr) != wantBase+0x300 {
+		t.Errorf("relocated pointer mismatch, expected %#x, got %#x", wantBase+0x300, ptr)
+	}
+
+	// Rebasing again is a no-op.
+	r = &Rebase{}
+	if err := r.Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if len(r.Rebased) != 0 {
+		t.Errorf("expected no rebased file, got %d", len(r.Rebased))
+	}
+}
+
+func TestRebaseAtCLI(t *testing.T) {
+	v, err := ParseCLI([]string{"rebase_at", "0x1000000"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fv, s := rebaseVolume(t)
+	if err := v[0].Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	// The volume is mapped at 16MiB-64KiB.
+	wantBase := uint64(0xFF0000 + fv.DataOffset + uefi.FileHeaderMinLength + uefi.SectionMinLength)
+	if s.PE.ImageBase != wantBase {
+		t.Errorf("image base mismatch, expected %#x, got %#x", wantBase, s.PE.ImageBase)
+	}
+
+	for _, arg := range []string{"0", "top"} {
+		if _, err := ParseCLI([]string{"rebase_at", arg}); err == nil {
+			t.Errorf("rebase_at %v: expected an error", arg)
+		}
+	}
+}
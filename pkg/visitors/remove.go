@@ -100,12 +100,14 @@ func (v *Remove) Visit(f uefi.Firmware) error {
 					} else {
 						f.Files = append(f.Files[:i], f.Files[i+1:]...)
 					}
+					f.MarkDirty()
 					v.printf("Remove: %d files now\n", len(f.Files))
 
 					// Creates a stack of undoes in case there are multiple FVs.
 					prev := v.Undo
 					v.Undo = func() {
 						f.Files = originalList
+						f.MarkDirty()
 						v.printf("Undo: %d files now\n", len(f.Files))
 						v.Undo = prev
 					}
@@ -119,7 +121,7 @@ func (v *Remove) Visit(f uefi.Firmware) error {
 
 func init() {
 	RegisterCLI("remove", "remove a file from the volume", 1, func(args []string) (uefi.Visitor, error) {
-		pred, err := FindFilePredicate(args[0])
+		pred, err := FindQueryPredicate(args[0])
 		if err != nil {
 			return nil, err
 		}
@@ -130,7 +132,7 @@ func init() {
 		}, nil
 	})
 	RegisterCLI("remove_pad", "remove a file from the volume and replace it with a pad file of the same size", 1, func(args []string) (uefi.Visitor, error) {
-		pred, err := FindFilePredicate(args[0])
+		pred, err := FindQueryPredicate(args[0])
 		if err != nil {
 			return nil, err
 		}
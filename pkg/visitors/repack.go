@@ -21,6 +21,10 @@ type Repack struct {
 	// Input
 	Predicate func(f uefi.Firmware) bool
 
+	// Compression configures the compressors used when assembling. If nil,
+	// compression.DefaultConfig() is used.
+	Compression *compression.Config
+
 	// Matched File
 	FileMatch *uefi.File
 }
@@ -37,7 +41,7 @@ func removeFileCompression(nfv *uefi.FirmwareVolume) error {
 				continue
 			}
 			gdh := s.TypeSpecific.Header.(*uefi.SectionGUIDDefined)
-			if guid := gdh.GUID; guid != compression.LZMAGUID && guid != compression.LZMAX86GUID {
+			if compression.CompressorFromGUID(&gdh.GUID) == nil {
 				// This doesn't have a compressed section
 				newSectionList = append(newSectionList, s)
 				continue
@@ -53,6 +57,7 @@ func removeFileCompression(nfv *uefi.FirmwareVolume) error {
 			}
 		}
 		f.Sections = newSectionList
+		f.MarkDirty()
 	}
 	return nil
 }
@@ -112,7 +117,7 @@ func createFirmwareVolume(pfv *uefi.FirmwareVolume) (*uefi.FirmwareVolume, error
 	return nfv, nil
 }
 
-func createVolumeImageFile(cs *uefi.Section) (*uefi.File, error) {
+func createVolumeImageFile(cs *uefi.Section, cfg *compression.Config) (*uefi.File, error) {
 	f := &uefi.File{}
 
 	f.Header.Type = uefi.FVFileTypeVolumeImage
@@ -121,7 +126,7 @@ func createVolumeImageFile(cs *uefi.Section) (*uefi.File, error) {
 	f.Sections = []*uefi.Section{cs}
 
 	// Call assemble to populate cs's buffer. then sha1 it for the guid.
-	a := &Assemble{}
+	a := &Assemble{Compression: cfg}
 	if err := a.Run(cs); err != nil {
 		return nil, err
 	}
@@ -131,7 +136,7 @@ func createVolumeImageFile(cs *uefi.Section) (*uefi.File, error) {
 	return f, nil
 }
 
-func repackFV(fv *uefi.FirmwareVolume) error {
+func repackFV(fv *uefi.FirmwareVolume, cfg *compression.Config) error {
 	// fv should be the pointer to the enclosing firmware volume that needs to be repacked.
 
 	// Create new Firmware Volume.
@@ -159,16 +164,22 @@ func repackFV(fv *uefi.FirmwareVolume) error {
 	}
 
 	// Create new FV image file
-	file, err := createVolumeImageFile(cs)
+	file, err := createVolumeImageFile(cs, cfg)
 	if err != nil {
 		return err
 	}
 
 	// Set new file as the only firmware file in the original fv.
 	fv.Files = append([]*uefi.File{}, file)
+	fv.MarkDirty()
 	return nil
 }
 
+// SetCompression implements CompressionSetter.
+func (v *Repack) SetCompression(cfg *compression.Config) {
+	v.Compression = cfg
+}
+
 // Run wraps Visit and performs some setup and teardown tasks.
 func (v *Repack) Run(f uefi.Firmware) error {
 	// Check that fv being repacked isn't already nested.
@@ -190,7 +201,7 @@ func (v *Repack) Run(f uefi.Firmware) error {
 	// edit the FV directly.
 	if fvMatch, ok := find.Matches[0].(*uefi.FirmwareVolume); ok {
 		// Call repack function.
-		return repackFV(fvMatch)
+		return repackFV(fvMatch, v.Compression)
 	}
 	var ok bool
 	if v.FileMatch, ok = find.Matches[0].(*uefi.File); !ok {
@@ -202,7 +213,7 @@ func (v *Repack) Run(f uefi.Firmware) error {
 	}
 
 	// Assemble the tree just to make sure things are right.
-	a := &Assemble{}
+	a := &Assemble{Compression: v.Compression}
 	return a.Run(f)
 }
 
@@ -213,7 +224,7 @@ func (v *Repack) Visit(f uefi.Firmware) error {
 		for i := 0; i < len(f.Files); i++ {
 			if f.Files[i] == v.FileMatch {
 				// call repack function.
-				return repackFV(f)
+				return repackFV(f, v.Compression)
 			}
 		}
 	}
@@ -79,7 +79,7 @@ func init() {
 }
 
 func TestRepack(t *testing.T) {
-	if err := repackFV(pfv); err != nil {
+	if err := repackFV(pfv, nil); err != nil {
 		t.Fatalf("Failed to repack firmware volume, got %v", err)
 	}
 
@@ -7,6 +7,7 @@ package visitors
 import (
 	"bytes"
 	"errors"
+	"fmt"
 	"io/ioutil"
 
 	"github.com/linuxboot/fiano/pkg/uefi"
@@ -17,9 +18,14 @@ type ReplacePE32 struct {
 	// Input
 	Predicate func(f uefi.Firmware) bool
 	NewPE32   []byte
+	// AnyMachine allows replacing an image with one built for another
+	// machine, which would not run.
+	AnyMachine bool
 
 	// Output
 	Matches []uefi.Firmware
+
+	pe *uefi.PEImage
 }
 
 // Run wraps Visit and performs some setup and teardown tasks.
@@ -28,6 +34,11 @@ func (v *ReplacePE32) Run(f uefi.Firmware) error {
 	if !bytes.HasPrefix(v.NewPE32, []byte("MZ")) {
 		return errors.New("supplied binary is not a valid pe32 image")
 	}
+	pe, err := uefi.ParsePEImage(v.NewPE32)
+	if err != nil {
+		return fmt.Errorf("supplied binary is not a valid pe32 image: %v", err)
+	}
+	v.pe = pe
 
 	// Run "find" to generate a list of matches to replace.
 	find := Find{
@@ -63,11 +74,16 @@ func (v *ReplacePE32) Visit(f uefi.Firmware) error {
 
 	case *uefi.Section:
 		if f.Header.Type == uefi.SectionTypePE32 {
+			// Images which can not be parsed have no machine to check.
+			if old := f.PE; old != nil && old.Machine != v.pe.Machine && !v.AnyMachine {
+				return fmt.Errorf("supplied binary is a %v image, the one it replaces is %v", v.pe.Machine, old.Machine)
+			}
 			f.SetBuf(v.NewPE32)
 			f.Encapsulated = nil // Should already be empty
 			if err := f.GenSecHeader(); err != nil {
 				return err
 			}
+			f.PE = v.pe
 		}
 		return f.ApplyChildren(v)
 
@@ -77,23 +93,31 @@ func (v *ReplacePE32) Visit(f uefi.Firmware) error {
 	}
 }
 
-func init() {
-	RegisterCLI("replace_pe32", "replace a pe32 given a GUID and new file", 2, func(args []string) (uefi.Visitor, error) {
-		pred, err := FindFilePredicate(args[0])
-		if err != nil {
-			return nil, err
-		}
+func newCLIReplacePE32(args []string, anyMachine bool) (uefi.Visitor, error) {
+	pred, err := FindFilePredicate(args[0])
+	if err != nil {
+		return nil, err
+	}
 
-		filename := args[1]
-		newPE32, err := ioutil.ReadFile(filename)
-		if err != nil {
-			return nil, err
-		}
+	filename := args[1]
+	newPE32, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find all the matching files and replace their inner PE32s.
+	return &ReplacePE32{
+		Predicate:  pred,
+		NewPE32:    newPE32,
+		AnyMachine: anyMachine,
+	}, nil
+}
 
-		// Find all the matching files and replace their inner PE32s.
-		return &ReplacePE32{
-			Predicate: pred,
-			NewPE32:   newPE32,
-		}, nil
+func init() {
+	RegisterCLI("replace_pe32", "replace a pe32 given a GUID and new file", 2, func(args []string) (uefi.Visitor, error) {
+		return newCLIReplacePE32(args, false)
+	})
+	RegisterCLI("replace_pe32_any_machine", "replace_pe32_any_machine GUID file\n replace a pe32 like replace_pe32, even with one built for another machine", 2, func(args []string) (uefi.Visitor, error) {
+		return newCLIReplacePE32(args, true)
 	})
 }
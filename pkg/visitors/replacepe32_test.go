@@ -5,19 +5,24 @@
 package visitors
 
 import (
+	"bytes"
+	"encoding/binary"
 	"reflect"
 	"testing"
 
+	"github.com/linuxboot/fiano/pkg/guid"
 	"github.com/linuxboot/fiano/pkg/uefi"
 )
 
 func TestReplacePE32(t *testing.T) {
 	f := parseImage(t)
 
-	// Apply the visitor.
+	// Apply the visitor. The IA32 test image replaces an X64 one.
+	pe := buildRelocatablePE32()
 	replace := &ReplacePE32{
-		Predicate: FindFileGUIDPredicate(*testGUID),
-		NewPE32:   []byte("MZbanana"),
+		Predicate:  FindFileGUIDPredicate(*testGUID),
+		NewPE32:    pe,
+		AnyMachine: true,
 	}
 	if err := replace.Run(f); err != nil {
 		t.Fatal(err)
@@ -33,7 +38,7 @@ func TestReplacePE32(t *testing.T) {
 	if len(results) != 1 {
 		t.Fatalf("got %d matches; expected 1", len(results))
 	}
-	want := []byte{0x0c, 0x00, 0x00, byte(uefi.SectionTypePE32), 'M', 'Z', 'b', 'a', 'n', 'a', 'n', 'a'}
+	want := append([]byte{0x04, 0x06, 0x00, byte(uefi.SectionTypePE32)}, pe...)
 	file, ok := results[0].(*uefi.File)
 	if !ok {
 		t.Fatalf("did not match a file, got type :%T", file)
@@ -53,12 +58,14 @@ func TestErrors(t *testing.T) {
 		match   string
 		err     string
 	}{
-		{"No Matches", []byte("MZbanana"), "no-match-string",
+		{"No Matches", buildRelocatablePE32(), "no-match-string",
 			"no matches found for replacement"},
-		{"Multiple Matches", []byte("MZbanana"), ".*",
+		{"Multiple Matches", buildRelocatablePE32(), ".*",
 			"multiple matches found! There can be only one. Use find to list all matches"},
 		{"Not PE32", []byte("banana"), ".*",
 			"supplied binary is not a valid pe32 image"},
+		{"Bad PE32", []byte("MZbanana"), ".*",
+			"supplied binary is not a valid pe32 image: pe image too small for DOS header, got 0x8 bytes"},
 	}
 	for _, test := range tests {
 		t.Run(test.name, func(t *testing.T) {
@@ -80,3 +87,42 @@ func TestErrors(t *testing.T) {
 		})
 	}
 }
+
+func TestReplacePE32Machine(t *testing.T) {
+	fv, err := createEmptyFirmwareVolume(0, 0x10000, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := uefi.CreateSection(uefi.SectionTypePE32, buildRelocatablePE32(), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &uefi.File{Sections: []*uefi.Section{s}}
+	file.Header.GUID = *guid.MustParse("7E577E57-0123-4567-89AB-CDEF00000005")
+	file.Header.Type = uefi.FVFileTypeDriver
+	fv.Files = append(fv.Files, file)
+
+	x64 := buildRelocatablePE32()
+	binary.LittleEndian.PutUint16(x64[0x84:], uint16(uefi.PEMachineX64))
+	replace := &ReplacePE32{Predicate: FindFileGUIDPredicate(file.Header.GUID), NewPE32: x64}
+	want := "supplied binary is a X64 image, the one it replaces is IA32"
+	if err := replace.Run(fv); err == nil || err.Error() != want {
+		t.Errorf("replacing an IA32 image with a X64 one: got %v, want %v", err, want)
+	}
+	if s.PE.Machine != uefi.PEMachineI386 {
+		t.Errorf("the IA32 image was replaced")
+	}
+
+	// The same machine, or an explicit override, is accepted.
+	replace = &ReplacePE32{Predicate: FindFileGUIDPredicate(file.Header.GUID), NewPE32: buildRelocatablePE32()}
+	if err := replace.Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	replace = &ReplacePE32{Predicate: FindFileGUIDPredicate(file.Header.GUID), NewPE32: x64, AnyMachine: true}
+	if err := replace.Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if s.PE.Machine != uefi.PEMachineX64 || !bytes.Equal(s.Buf()[uefi.SectionMinLength:], x64) {
+		t.Errorf("the image was not replaced with the X64 one, got a %v image", s.PE.Machine)
+	}
+}
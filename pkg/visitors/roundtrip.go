@@ -0,0 +1,217 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/linuxboot/fiano/pkg/compression"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// RoundTrip checks that the firmware is reassembled to the bytes it was parsed
+// from. Assemble and Save keep the parsed bytes of the nodes which were not
+// edited, so RoundTrip first marks every node dirty: the whole tree is then
+// rebuilt from its fields, which tests the parser and Assemble together. The
+// tree is left rebuilt.
+type RoundTrip struct {
+	// Input
+	// Compression configures the compressors used when assembling. If nil,
+	// compression.DefaultConfig() is used.
+	Compression *compression.Config
+	// The result is written to this writer.
+	W io.Writer
+
+	// Output
+	// Offset is the offset of the first differing byte, or -1 if the
+	// reassembled image is identical.
+	Offset int64
+	// Owner is the path of the innermost node containing Offset in the
+	// original image.
+	Owner string
+}
+
+// SetCompression implements CompressionSetter.
+func (v *RoundTrip) SetCompression(cfg *compression.Config) {
+	v.Compression = cfg
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *RoundTrip) Run(f uefi.Firmware) error {
+	return f.Apply(v)
+}
+
+// Visit applies the RoundTrip visitor to any Firmware type.
+func (v *RoundTrip) Visit(f uefi.Firmware) error {
+	orig := append([]byte{}, f.Buf()...)
+	var nodes []roundTripNode
+	if err := (&roundTripLayout{nodes: &nodes, align: 1}).Run(f); err != nil {
+		return err
+	}
+	if err := (&Assemble{Compression: v.Compression}).Run(f); err != nil {
+		return err
+	}
+	buf := f.Buf()
+
+	v.Offset, v.Owner = -1, ""
+	for i := 0; i < len(orig) || i < len(buf); i++ {
+		if i >= len(orig) || i >= len(buf) || orig[i] != buf[i] {
+			v.Offset = int64(i)
+			break
+		}
+	}
+	if v.Offset < 0 {
+		if v.W != nil {
+			fmt.Fprintf(v.W, "round trip OK, %d bytes\n", len(buf))
+		}
+		return nil
+	}
+	// The nodes are listed parents first, so the last one containing the
+	// offset is the innermost.
+	for _, n := range nodes {
+		if uint64(v.Offset) >= n.offset && uint64(v.Offset) < n.offset+n.size {
+			v.Owner = n.path
+		}
+	}
+	return fmt.Errorf("round trip differs at offset %#x in %s: %#x bytes reassembled from %#x",
+		v.Offset, v.Owner, len(buf), len(orig))
+}
+
+// roundTripNode is the location of a node in the original image.
+type roundTripNode struct {
+	path   string
+	offset uint64
+	size   uint64
+}
+
+// roundTripLayout marks the nodes of a tree dirty and records their location
+// in the image. The children of encoded sections have no location in the
+// image, they are only marked dirty.
+type roundTripLayout struct {
+	nodes *[]roundTripNode
+	path  string
+	// Offsets are absolute. The next node starts at offset, aligned to align
+	// bytes from base.
+	base   uint64
+	offset uint64
+	align  uint64
+	// Set inside encoded sections.
+	hidden bool
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *roundTripLayout) Run(f uefi.Firmware) error {
+	return f.Apply(v)
+}
+
+// Visit applies the roundTripLayout visitor to any Firmware type.
+func (v *roundTripLayout) Visit(f uefi.Firmware) error {
+	uefi.MarkDirty(f)
+	start := v.base + uefi.Align(v.offset-v.base, v.align)
+	if r, ok := f.(uefi.Region); ok && r.FlashRegion() != nil {
+		start = uint64(r.FlashRegion().BaseOffset())
+	}
+	size := uint64(len(f.Buf()))
+	v.offset = start + size
+
+	path := roundTripName(f)
+	if v.path != "" {
+		path = v.path + " / " + path
+	}
+	if !v.hidden {
+		*v.nodes = append(*v.nodes, roundTripNode{path: path, offset: start, size: size})
+	}
+	// child returns a visitor for the children at offset.
+	child := func(offset, align uint64) *roundTripLayout {
+		return &roundTripLayout{nodes: v.nodes, path: path, base: offset, offset: offset, align: align, hidden: v.hidden}
+	}
+
+	switch f := f.(type) {
+	case *uefi.FirmwareVolume:
+		files := child(start+f.DataOffset, 8)
+		for _, file := range f.Files {
+			if err := file.Apply(files); err != nil {
+				return err
+			}
+		}
+		if f.VarStore != nil {
+			if err := f.VarStore.Apply(child(start+f.DataOffset, 1)); err != nil {
+				return err
+			}
+		}
+		if f.FTW != nil {
+			return f.FTW.Apply(child(start+f.FTW.Offset, 1))
+		}
+		return nil
+	case *uefi.File:
+		return f.ApplyChildren(child(start+f.DataOffset, 4))
+	case *uefi.Section:
+		offset, verbatim := roundTripSectionData(f)
+		c := child(start+offset, 4)
+		c.hidden = c.hidden || !verbatim
+		return f.ApplyChildren(c)
+	case *uefi.NVar:
+		return f.ApplyChildren(child(start+uint64(f.DataOffset), 1))
+	case *uefi.VariableStore:
+		for _, variable := range f.Variables {
+			if err := variable.Apply(child(start+variable.Offset, 1)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return f.ApplyChildren(child(start, 1))
+}
+
+// roundTripSectionData returns the offset of the data of an encapsulation
+// section and whether it holds its children as they are, not encoded.
+func roundTripSectionData(s *uefi.Section) (uint64, bool) {
+	offset := uint64(uefi.SectionMinLength)
+	if s.Header.Size == [3]uint8{0xFF, 0xFF, 0xFF} {
+		offset = uefi.SectionExtMinLength
+	}
+	if s.TypeSpecific == nil {
+		return offset, s.Header.Type == uefi.SectionTypeFirmwareVolumeImage
+	}
+	switch ts := s.TypeSpecific.Header.(type) {
+	case *uefi.SectionGUIDDefined:
+		return uint64(ts.DataOffset), ts.GUID == *uefi.CRC32GUID ||
+			ts.Attributes&uint16(uefi.GUIDEDSectionProcessingRequired) == 0
+	case *uefi.SectionCompression:
+		return offset + uint64(ts.GetBinHeaderLen()), ts.CompressionType == uefi.CompressionTypeNone
+	}
+	return offset, false
+}
+
+// roundTripName describes a node in the path of the owner of a difference.
+func roundTripName(f uefi.Firmware) string {
+	switch f := f.(type) {
+	case uefi.Region:
+		return f.Type().String() + " region"
+	case *uefi.FirmwareVolume:
+		return "FV " + f.String()
+	case *uefi.File:
+		if name := fileName(f); name != "" {
+			return fmt.Sprintf("File %v (%v)", f.Header.GUID, name)
+		}
+		return fmt.Sprintf("File %v", f.Header.GUID)
+	case *uefi.Section:
+		return "Section " + f.Type
+	case *uefi.NVar:
+		return fmt.Sprintf("NVAR %v:%v", f.GUID, f.Name)
+	case *uefi.Variable:
+		return fmt.Sprintf("VSS variable %v:%v", f.GUID, f.Name)
+	}
+	return strings.TrimPrefix(fmt.Sprintf("%T", f), "*uefi.")
+}
+
+func init() {
+	RegisterCLI("roundtrip-check", "roundtrip-check\n rebuild the whole firmware and report the first byte differing from the original", 0, func(args []string) (uefi.Visitor, error) {
+		return &RoundTrip{W: os.Stdout}, nil
+	})
+}
@@ -0,0 +1,109 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/compression"
+	"github.com/linuxboot/fiano/pkg/uefi"
+	"github.com/ulikunitz/xz/lzma"
+)
+
+// roundTripTestFV builds a volume with a file compressed by another LZMA
+// encoder, which the LZMA compressor does not reproduce.
+func roundTripTestFV(t *testing.T) (*uefi.FirmwareVolume, []byte) {
+	raw, err := uefi.CreateSection(uefi.SectionTypeRaw, []byte("compressed payload"), nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = raw.GenSecHeader(); err != nil {
+		t.Fatal(err)
+	}
+	stream := &bytes.Buffer{}
+	w, err := lzma.WriterConfig{EOSMarker: true, DictCap: 1 << 16}.NewWriter(stream)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(raw.Buf()); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if reencoded, err := (&compression.LZMA{}).Encode(raw.Buf()); err != nil || bytes.Equal(reencoded, stream.Bytes()) {
+		t.Fatalf("the LZMA compressor should encode the payload differently, got error %v", err)
+	}
+	s, err := uefi.CreateSection(uefi.SectionTypeGUIDDefined, stream.Bytes(), nil, &compression.LZMAGUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = s.GenSecHeader(); err != nil {
+		t.Fatal(err)
+	}
+
+	fv := patchTestFV(t, "A", "B")
+	f := &uefi.File{}
+	f.Header.GUID = patchTestGUID("LZMA")
+	f.Header.Type = uefi.FVFileTypeFreeForm
+	f.Header.State = 0xF8
+	f.Sections = []*uefi.Section{s}
+	fv.Files = append(fv.Files, f)
+	if err = (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	fv, err = uefi.NewFirmwareVolume(fv.Buf(), 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fv, stream.Bytes()
+}
+
+func TestRoundTrip(t *testing.T) {
+	fv, stream := roundTripTestFV(t)
+	orig := append([]byte{}, fv.Buf()...)
+	w := &bytes.Buffer{}
+	v := &RoundTrip{W: w}
+	if err := v.Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if v.Offset != -1 || !strings.Contains(w.String(), "round trip OK") {
+		t.Errorf("got offset %#x and output %q, want no difference", v.Offset, w.String())
+	}
+	if !bytes.Equal(fv.Buf(), orig) || !bytes.Contains(fv.Buf(), stream) {
+		t.Error("the original compressed data was not kept")
+	}
+
+	// Editing the payload recompresses it.
+	g := patchTestGUID("LZMA")
+	lzmaFile := find(t, fv, &g)[0].(*uefi.File)
+	lzmaFile.Sections[0].Encapsulated[0].Value.(*uefi.Section).SetBuf([]byte("edited"))
+	if err := (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(fv.Buf(), stream) {
+		t.Error("the edited payload was not recompressed")
+	}
+}
+
+func TestRoundTripDifference(t *testing.T) {
+	fv, _ := roundTripTestFV(t)
+	// The assembler erases the free space of the volume.
+	buf := fv.Buf()
+	buf[len(buf)-0x10] = 0x42
+	fv, err := uefi.NewFirmwareVolume(buf, 0, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &RoundTrip{}
+	if err = v.Run(fv); err == nil {
+		t.Fatal("expected a difference")
+	}
+	if v.Offset != int64(len(buf)-0x10) || v.Owner != "FV "+patchFVName.String() {
+		t.Errorf("got difference at %#x in %q", v.Offset, v.Owner)
+	}
+}
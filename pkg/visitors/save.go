@@ -7,12 +7,22 @@ package visitors
 import (
 	"io/ioutil"
 
+	"github.com/linuxboot/fiano/pkg/compression"
 	"github.com/linuxboot/fiano/pkg/uefi"
 )
 
 // Save calls Assemble, then outputs the top image to a file.
 type Save struct {
 	DirPath string
+
+	// Compression configures the compressors used when assembling. If nil,
+	// compression.DefaultConfig() is used.
+	Compression *compression.Config
+}
+
+// SetCompression implements CompressionSetter.
+func (v *Save) SetCompression(cfg *compression.Config) {
+	v.Compression = cfg
 }
 
 // Run just applies the visitor.
@@ -23,7 +33,7 @@ func (v *Save) Run(f uefi.Firmware) error {
 // Visit calls the assemble visitor to make sure everything is reconstructed.
 // It then outputs the top level buffer to a file.
 func (v *Save) Visit(f uefi.Firmware) error {
-	a := &Assemble{}
+	a := &Assemble{Compression: v.Compression}
 	// Assemble the binary to make sure the top level buffer is correct
 	if err := f.Apply(a); err != nil {
 		return err
@@ -0,0 +1,375 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+// secureBootVariables are the vendor GUIDs of the Secure Boot signature
+// databases.
+var secureBootVariables = map[string]*guid.GUID{
+	"PK":  uefi.EFIGlobalVariableGUID,
+	"KEK": uefi.EFIGlobalVariableGUID,
+	"db":  uefi.ImageSecurityDatabaseGUID,
+	"dbx": uefi.ImageSecurityDatabaseGUID,
+}
+
+// Attributes of Secure Boot variables created in stores which do not hold
+// them yet.
+const (
+	secureBootNVarAttributes = uefi.NVarEntryRuntime
+	secureBootVSSAttributes  = uefi.VariableNonVolatile | uefi.VariableBootServiceAccess |
+		uefi.VariableRuntimeAccess
+)
+
+// vssAuthAttributes are the attributes of VSS variables which need the
+// authentication header of authenticated stores.
+const vssAuthAttributes = uefi.VariableAuthenticatedWriteAccess | uefi.VariableTimeBasedAuthenticatedWriteAccess
+
+// secureBootAttributes returns the attributes of a Secure Boot variable
+// created in s. Only authenticated stores have room for the timestamp of time
+// based authenticated variables.
+func secureBootAttributes(s *uefi.VariableStore) uefi.VariableAttributes {
+	if s.IsAuthenticated() {
+		return secureBootVSSAttributes | uefi.VariableTimeBasedAuthenticatedWriteAccess
+	}
+	return secureBootVSSAttributes
+}
+
+// SecureBootKeys lists and edits the signature database of a Secure Boot
+// variable (PK, KEK, db or dbx) in the NVAR and VSS stores.
+type SecureBootKeys struct {
+	// Input
+	Variable string
+	// Edit returns the new signature lists of the variable. If nil, the
+	// signatures are only listed.
+	Edit func(lists []*uefi.SignatureList) ([]*uefi.SignatureList, error)
+
+	// Output
+	Stores  int
+	Changed int
+	// Signatures are listed to this writer.
+	W io.Writer
+}
+
+func (v *SecureBootKeys) printf(format string, a ...interface{}) {
+	if v.W != nil {
+		fmt.Fprintf(v.W, format, a...)
+	}
+}
+
+// Run wraps Visit and performs some setup and teardown tasks.
+func (v *SecureBootKeys) Run(f uefi.Firmware) error {
+	if _, ok := secureBootVariables[v.Variable]; !ok {
+		return fmt.Errorf("%q is not a Secure Boot variable, expected PK, KEK, db or dbx", v.Variable)
+	}
+	v.Stores, v.Changed = 0, 0
+	if err := f.Apply(v); err != nil {
+		return err
+	}
+	if v.Stores == 0 {
+		return errors.New("no NVAR or VSS store found")
+	}
+	if v.Edit != nil && v.Changed == 0 {
+		return fmt.Errorf("%v not modified", v.Variable)
+	}
+	return nil
+}
+
+// Visit applies the SecureBootKeys visitor to any Firmware type.
+func (v *SecureBootKeys) Visit(f uefi.Firmware) error {
+	g := *secureBootVariables[v.Variable]
+	switch f := f.(type) {
+	case *uefi.File:
+		// Only update top level stores, not the ones nested in variables.
+		if f.NVarStore == nil {
+			break
+		}
+		v.Stores++
+		var data []byte
+		if chains := nvarChains(f.NVarStore, v.Variable, g); len(chains) > 0 {
+			chain := chains[len(chains)-1]
+			data = chain[len(chain)-1].Data()
+		}
+		newData, changed, err := v.edit("NVAR", data)
+		if err != nil || !changed {
+			return err
+		}
+		if len(newData) == 0 {
+			// The firmware deletes a variable set to an empty value.
+			return (&NVarDelete{Name: v.Variable, GUID: g}).delete(f.NVarStore)
+		}
+		set := &NVarSet{Name: v.Variable, GUID: g, Content: newData, Attributes: secureBootNVarAttributes}
+		return set.set(f.NVarStore)
+
+	case *uefi.VariableStore:
+		v.Stores++
+		var data []byte
+		if vr := currentVariable(f, v.Variable, g); vr != nil {
+			data = vr.Buf()[vr.DataOffset:]
+		}
+		newData, changed, err := v.edit(f.Type(), data)
+		if err != nil || !changed {
+			return err
+		}
+		if len(newData) == 0 {
+			return deleteVariable(f, v.Variable, g)
+		}
+		return setVariable(f, v.Variable, g, secureBootAttributes(f), newData)
+	}
+	return f.ApplyChildren(v)
+}
+
+// edit lists and edits the signature lists in data. It returns the new data
+// and whether it changed. The new data is empty when the last signature was
+// removed.
+func (v *SecureBootKeys) edit(store string, data []byte) ([]byte, bool, error) {
+	lists, err := uefi.ParseSignatureLists(data)
+	if err != nil {
+		return nil, false, fmt.Errorf("unable to parse %v in %v store: %v", v.Variable, store, err)
+	}
+	if v.Edit == nil {
+		for _, l := range lists {
+			for _, s := range l.Signatures {
+				v.printf("%v\t%v\t%v\t%v\t%v\n", store, v.Variable, l.TypeName, signatureID(s), s.Subject)
+			}
+		}
+		return nil, false, nil
+	}
+	newLists, err := v.Edit(lists)
+	if err != nil {
+		return nil, false, err
+	}
+	newData, err := uefi.AssembleSignatureLists(newLists)
+	if err != nil {
+		return nil, false, err
+	}
+	if bytes.Equal(newData, data) {
+		return nil, false, nil
+	}
+	v.Changed++
+	return newData, true, nil
+}
+
+// signatureID identifies a signature: the hash itself for hash signatures and
+// the SHA256 of the data for the others, like a certificate fingerprint.
+func signatureID(s *uefi.Signature) string {
+	if s.Hash != "" {
+		return s.Hash
+	}
+	sum := sha256.Sum256(s.Bytes())
+	return hex.EncodeToString(sum[:])
+}
+
+// addSignature returns an Edit function adding a signature of the given type
+// to the database. Hashes are added to an existing list of the same type,
+// other signatures get their own list.
+func addSignature(sigType *guid.GUID, s *uefi.Signature) func([]*uefi.SignatureList) ([]*uefi.SignatureList, error) {
+	return func(lists []*uefi.SignatureList) ([]*uefi.SignatureList, error) {
+		id := signatureID(s)
+		for _, l := range lists {
+			for _, ls := range l.Signatures {
+				if l.Type == *sigType && signatureID(ls) == id {
+					// Already present
+					return lists, nil
+				}
+			}
+		}
+		if s.Hash != "" {
+			for _, l := range lists {
+				if l.Type == *sigType && len(l.Header) == 0 {
+					l.Signatures = append(l.Signatures, s)
+					return lists, nil
+				}
+			}
+		}
+		return append(lists, &uefi.SignatureList{Type: *sigType, Signatures: []*uefi.Signature{s}}), nil
+	}
+}
+
+// removeSignature returns an Edit function removing the signatures with the
+// given ID from the database.
+func removeSignature(id string) func([]*uefi.SignatureList) ([]*uefi.SignatureList, error) {
+	return func(lists []*uefi.SignatureList) ([]*uefi.SignatureList, error) {
+		var newLists []*uefi.SignatureList
+		for _, l := range lists {
+			var sigs []*uefi.Signature
+			for _, s := range l.Signatures {
+				if signatureID(s) != id {
+					sigs = append(sigs, s)
+				}
+			}
+			if len(sigs) > 0 {
+				l.Signatures = sigs
+				newLists = append(newLists, l)
+			}
+		}
+		return newLists, nil
+	}
+}
+
+// currentVariable returns the variable of a VSS store holding the current
+// value, nil if there is none.
+func currentVariable(s *uefi.VariableStore, name string, g guid.GUID) *uefi.Variable {
+	var current *uefi.Variable
+	for _, vr := range s.Variables {
+		if vr.IsValid() && vr.Name == name && vr.GUID == g {
+			current = vr
+		}
+	}
+	return current
+}
+
+// setVariable sets the value of a variable in a VSS store. Like the firmware
+// does, the new value is appended and the previous one is marked deleted.
+func setVariable(s *uefi.VariableStore, name string, g guid.GUID, attributes uefi.VariableAttributes, data []byte) error {
+	n := &uefi.Variable{GUID: g, Name: name}
+	n.Header.State = uefi.VariableAdded
+	n.Header.Attributes = attributes
+	if s.IsAuthenticated() {
+		n.AuthHeader = &uefi.AuthVariableHeader{}
+	}
+	current := currentVariable(s, name, g)
+	if current != nil {
+		n.Header.Attributes = current.Header.Attributes
+		if current.AuthHeader != nil && n.AuthHeader != nil {
+			*n.AuthHeader = *current.AuthHeader
+		}
+	}
+	if n.AuthHeader == nil {
+		// There is no authentication header behind these attributes.
+		n.Header.Attributes &^= vssAuthAttributes
+	}
+	if err := n.Assemble(data); err != nil {
+		return err
+	}
+	variables := s.Variables
+	if !variableFits(s, variables, n) {
+		// Reclaim the space of deleted variables, like the firmware does
+		// when the store is full.
+		variables = nil
+		for _, vr := range s.Variables {
+			if vr.IsValid() && vr != current {
+				variables = append(variables, vr)
+			}
+		}
+		if !variableFits(s, variables, n) {
+			return fmt.Errorf("out of space in variable store %v, new variable size: %v", s.Type(), len(n.Buf()))
+		}
+	} else if current != nil {
+		current.Header.State &= uefi.VariableDeleted
+		if err := current.Assemble(current.Buf()[current.DataOffset:]); err != nil {
+			return err
+		}
+	}
+	s.Variables = append(variables[:len(variables):len(variables)], n)
+	s.MarkDirty()
+
+	// Assemble the store to update its buffer
+	a := &Assemble{}
+	return a.Run(s)
+}
+
+// deleteVariable marks the current value of a variable in a VSS store
+// deleted.
+func deleteVariable(s *uefi.VariableStore, name string, g guid.GUID) error {
+	current := currentVariable(s, name, g)
+	if current == nil {
+		return nil
+	}
+	current.Header.State &= uefi.VariableDeleted
+	if err := current.Assemble(current.Buf()[current.DataOffset:]); err != nil {
+		return err
+	}
+	s.MarkDirty()
+
+	// Assemble the store to update its buffer
+	a := &Assemble{}
+	return a.Run(s)
+}
+
+// variableFits tells whether n fits in the store after variables.
+func variableFits(s *uefi.VariableStore, variables []*uefi.Variable, n *uefi.Variable) bool {
+	end, err := s.HeaderBuf()
+	if err != nil {
+		return false
+	}
+	size := uint64(len(end))
+	for _, vr := range append(variables[:len(variables):len(variables)], n) {
+		size = uefi.Align4(size) + uint64(len(vr.Buf()))
+	}
+	return size <= uint64(s.Header.Size)
+}
+
+// readCertificate reads a DER or PEM encoded X.509 certificate.
+func readCertificate(fileName string) ([]byte, error) {
+	buf, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	if b, _ := pem.Decode(buf); b != nil {
+		buf = b.Bytes
+	}
+	if _, err := x509.ParseCertificate(buf); err != nil {
+		return nil, fmt.Errorf("unable to parse certificate %q: %v", fileName, err)
+	}
+	return buf, nil
+}
+
+func init() {
+	RegisterCLI("list_sb_keys", "list the certificates and hashes of Secure Boot variable PK, KEK, db or dbx", 1, func(args []string) (uefi.Visitor, error) {
+		return &SecureBootKeys{
+			Variable: args[0],
+			W:        os.Stdout,
+		}, nil
+	})
+	RegisterCLI("add_sb_cert", "add the X.509 certificate in FILE owned by GUID to Secure Boot variable VAR: VAR GUID FILE", 3, func(args []string) (uefi.Visitor, error) {
+		owner, err := guid.Parse(args[1])
+		if err != nil {
+			return nil, err
+		}
+		cert, err := readCertificate(args[2])
+		if err != nil {
+			return nil, err
+		}
+		return &SecureBootKeys{
+			Variable: args[0],
+			Edit:     addSignature(uefi.CertX509GUID, &uefi.Signature{Owner: *owner, Certificate: cert}),
+		}, nil
+	})
+	RegisterCLI("add_sb_hash", "add the hex encoded SHA256 HASH owned by GUID to Secure Boot variable VAR: VAR GUID HASH", 3, func(args []string) (uefi.Visitor, error) {
+		owner, err := guid.Parse(args[1])
+		if err != nil {
+			return nil, err
+		}
+		hash, err := hex.DecodeString(args[2])
+		if err != nil || len(hash) != sha256.Size {
+			return nil, fmt.Errorf("%q is not a hex encoded SHA256 hash", args[2])
+		}
+		return &SecureBootKeys{
+			Variable: args[0],
+			Edit:     addSignature(uefi.CertSHA256GUID, &uefi.Signature{Owner: *owner, Hash: hex.EncodeToString(hash)}),
+		}, nil
+	})
+	RegisterCLI("remove_sb_key", "remove the hash or certificate with the ID listed by list_sb_keys from Secure Boot variable VAR: VAR ID", 2, func(args []string) (uefi.Visitor, error) {
+		return &SecureBootKeys{
+			Variable: args[0],
+			Edit:     removeSignature(args[1]),
+		}, nil
+	})
+}
@@ -0,0 +1,188 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/binary"
+	"encoding/hex"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/linuxboot/fiano/pkg/uefi"
+)
+
+func testSBCertificate(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "Test PK"},
+		NotBefore:    time.Unix(0, 0),
+		NotAfter:     time.Unix(0, 0).AddDate(100, 0, 0),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert
+}
+
+// listSBKeys returns the listing of a Secure Boot variable.
+func listSBKeys(t *testing.T, f uefi.Firmware, variable string) string {
+	b := &strings.Builder{}
+	if err := (&SecureBootKeys{Variable: variable, W: b}).Run(f); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestSecureBootKeysVSS(t *testing.T) {
+	uefi.Attributes.ErasePolarity = 0xFF
+	fv := parseNVRAMFV(t, buildNVRAMFV(
+		buildVSSVariable(uefi.VariableAdded, "Timeout", []byte{5, 0}),
+	))
+	cert := testSBCertificate(t)
+	certSum := sha256.Sum256(cert)
+	certID := hex.EncodeToString(certSum[:])
+	hash := hex.EncodeToString(bytes.Repeat([]byte{0xAB}, 32))
+
+	edits := []func([]*uefi.SignatureList) ([]*uefi.SignatureList, error){
+		addSignature(uefi.CertX509GUID, &uefi.Signature{Owner: *efiGlobalVariable, Certificate: cert}),
+		addSignature(uefi.CertSHA256GUID, &uefi.Signature{Owner: *efiGlobalVariable, Hash: hash}),
+	}
+	for _, edit := range edits {
+		if err := (&SecureBootKeys{Variable: "PK", Edit: edit}).Run(fv); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Adding the same certificate again does not change the variable.
+	if err := (&SecureBootKeys{Variable: "PK", Edit: edits[0]}).Run(fv); err == nil {
+		t.Errorf("adding a duplicate certificate should fail")
+	}
+	if err := (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	fv = parseNVRAMFV(t, fv.Buf())
+	want := "VSS2\tPK\tX509\t" + certID + "\tCN=Test PK\n" +
+		"VSS2\tPK\tSHA256\t" + hash + "\t\n"
+	if got := listSBKeys(t, fv, "PK"); got != want {
+		t.Errorf("wrong PK listing, expected \n%v\n got \n%v", want, got)
+	}
+	var valid int
+	for _, v := range fv.VarStore.Variables {
+		if v.Name == "PK" && v.IsValid() {
+			valid++
+		}
+	}
+	if valid != 1 {
+		t.Errorf("found %d valid PK variables, want 1", valid)
+	}
+
+	if err := (&SecureBootKeys{Variable: "PK", Edit: removeSignature(certID)}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	want = "VSS2\tPK\tSHA256\t" + hash + "\t\n"
+	if got := listSBKeys(t, fv, "PK"); got != want {
+		t.Errorf("wrong PK listing, expected \n%v\n got \n%v", want, got)
+	}
+
+	// Removing the only entry deletes the variable.
+	if err := (&SecureBootKeys{Variable: "PK", Edit: removeSignature(hash)}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	fv = parseNVRAMFV(t, fv.Buf())
+	if got := listSBKeys(t, fv, "PK"); got != "" {
+		t.Errorf("wrong PK listing, expected nothing, got \n%v", got)
+	}
+	if currentVariable(fv.VarStore, "PK", *efiGlobalVariable) != nil {
+		t.Errorf("PK was not deleted")
+	}
+	if err := (&SecureBootKeys{Variable: "Setup"}).Run(fv); err == nil {
+		t.Errorf("Setup should not be accepted as a Secure Boot variable")
+	}
+}
+
+func TestSecureBootKeysNVar(t *testing.T) {
+	pd := ParseDir{BasePath: "../../integration/roms/nvartest/"}
+	parsedRoot, err := pd.Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Assemble{}).Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	hash := hex.EncodeToString(bytes.Repeat([]byte{0xCD}, 32))
+	add := &SecureBootKeys{
+		Variable: "dbx",
+		Edit:     addSignature(uefi.CertSHA256GUID, &uefi.Signature{Owner: *efiGlobalVariable, Hash: hash}),
+	}
+	if err = add.Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	s := reparseNVarTest(t, parsedRoot)
+	lists, err := uefi.ParseSignatureLists(nvarValue(t, s, "dbx", uefi.ImageSecurityDatabaseGUID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(lists) != 1 || len(lists[0].Signatures) != 1 || lists[0].Signatures[0].Hash != hash {
+		t.Errorf("dbx does not hold the added hash")
+	}
+
+	// Removing the only entry deletes the variable.
+	remove := &SecureBootKeys{Variable: "dbx", Edit: removeSignature(hash)}
+	if err = remove.Run(parsedRoot); err != nil {
+		t.Fatal(err)
+	}
+	s = reparseNVarTest(t, parsedRoot)
+	if chains := nvarChains(s, "dbx", *uefi.ImageSecurityDatabaseGUID); len(chains) != 0 {
+		t.Errorf("found %d chains for dbx, want 0", len(chains))
+	}
+}
+
+func TestSecureBootKeysVSSNotAuthenticated(t *testing.T) {
+	uefi.Attributes.ErasePolarity = 0xFF
+	buf := bytes.Repeat([]byte{0xFF}, 0x400)
+	h := new(bytes.Buffer)
+	h.Write(uefi.VariableStoreGUID[:])
+	binary.Write(h, binary.LittleEndian, uefi.VariableStoreHeader{
+		Size:   0x400,
+		Format: uefi.VariableStoreFormatted,
+		State:  uefi.VariableStoreHealthy,
+	})
+	copy(buf, h.Bytes())
+	s, err := uefi.NewVariableStore(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edit := addSignature(uefi.CertX509GUID, &uefi.Signature{Owner: *efiGlobalVariable, Certificate: testSBCertificate(t)})
+	if err := (&SecureBootKeys{Variable: "db", Edit: edit}).Run(s); err != nil {
+		t.Fatal(err)
+	}
+	if s, err = uefi.NewVariableStore(s.Buf()); err != nil {
+		t.Fatal(err)
+	}
+	v := currentVariable(s, "db", *uefi.ImageSecurityDatabaseGUID)
+	if v == nil {
+		t.Fatal("db was not added")
+	}
+	if v.AuthHeader != nil || v.Header.Attributes != secureBootVSSAttributes {
+		t.Errorf("db in a non-authenticated store: got attributes %v, want %v without an authentication header",
+			v.Header.Attributes, uefi.VariableAttributes(secureBootVSSAttributes))
+	}
+}
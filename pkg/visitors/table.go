@@ -62,6 +62,14 @@ func (v *Table) Visit(f uefi.Firmware) error {
 		return v.printFirmware(f, "NVAR Store", "", "", v.curOffset, v.curOffset)
 	case *uefi.NVar:
 		return v.printFirmware(f, "NVAR", f.GUID.String(), f, v.curOffset, v.curOffset+uint64(f.DataOffset))
+	case *uefi.VariableStore:
+		return v.printFirmware(f, "VSS Store", "", f.Type(), v.curOffset, v.curOffset)
+	case *uefi.Variable:
+		return v.printFirmware(f, "VSS", f.GUID.String(), f, v.offset+f.Offset, v.offset+f.Offset+uint64(f.DataOffset))
+	case *uefi.FTWWorkingBlock:
+		// The working block follows the variable store, aligned to 8 bytes.
+		v.curOffset = uefi.Align8(v.curOffset)
+		return v.printFirmware(f, "FTW", f.Header.Signature.String(), "", v.curOffset, 0)
 	case *uefi.MERegion:
 		if f.FRegion != nil {
 			offset = uint64(f.FRegion.BaseOffset())
@@ -153,6 +161,8 @@ func (v *Table) printFirmware(f uefi.Firmware, node, name, typez interface{}, of
 	case *uefi.FirmwareVolume:
 		// Print free space at the end of the volume
 		v2.printRow(&v2, "Free", "", "", offset+length-f.FreeSpace, f.FreeSpace)
+	case *uefi.VariableStore:
+		v2.printRow(&v2, "Free", "", "", offset+f.FreeSpaceOffset, length-f.FreeSpaceOffset)
 	case *uefi.NVarStore:
 		// Print free space and GUID store
 		v2.printRow(&v2, "Free", "", "", offset+f.FreeSpaceOffset, f.GUIDStoreOffset-f.FreeSpaceOffset)
@@ -8,6 +8,7 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 
@@ -205,6 +206,23 @@ func (v *Validate) Visit(f uefi.Firmware) error {
 			break
 		}
 
+		// CRC32 Check
+		if f.Header.Type == uefi.SectionTypeGUIDDefined {
+			gd := f.TypeSpecific.Header.(*uefi.SectionGUIDDefined)
+			if gd.GUID != *uefi.CRC32GUID {
+				break
+			}
+			if uint32(gd.DataOffset) > buflen {
+				v.Errors = append(v.Errors, fmt.Errorf("section data offset %#x is beyond section size %#x",
+					gd.DataOffset, buflen))
+				break
+			}
+			if sum := crc32.ChecksumIEEE(f.Buf()[gd.DataOffset:]); sum != gd.CRC32 {
+				v.Errors = append(v.Errors, fmt.Errorf("section CRC32 mismatch! Header has %#08x, data has %#08x",
+					gd.CRC32, sum))
+			}
+		}
+
 	case *uefi.BIOSRegion:
 		if f.FlashRegion() != nil && !f.FlashRegion().Valid() {
 			v.Errors = append(v.Errors, fmt.Errorf("BIOSRegion is not valid, region was %v", *f.FlashRegion()))
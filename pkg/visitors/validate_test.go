@@ -73,3 +73,37 @@ func TestValidateFile(t *testing.T) {
 		})
 	}
 }
+
+func TestValidateCRC32Section(t *testing.T) {
+	ui, err := uefi.CreateSection(uefi.SectionTypeUserInterface, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ui.Name = "Linux"
+	s, err := uefi.CreateSection(uefi.SectionTypeGUIDDefined, nil, []uefi.Firmware{ui}, uefi.CRC32GUID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Assemble{}).Run(s); err != nil {
+		t.Fatal(err)
+	}
+
+	v := &Validate{}
+	if err := v.Run(s); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Errors) != 0 {
+		t.Errorf("expected no errors, got %v", v.Errors)
+	}
+
+	// Corrupt the payload.
+	buf := s.Buf()
+	buf[len(buf)-1] ^= 0xFF
+	v = &Validate{}
+	if err := v.Run(s); err != nil {
+		t.Fatal(err)
+	}
+	if len(v.Errors) != 1 {
+		t.Errorf("expected 1 CRC32 error, got %v", v.Errors)
+	}
+}
@@ -0,0 +1,225 @@
+// Copyright 2019 the LinuxBoot Authors. All rights reserved
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package visitors
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/linuxboot/fiano/pkg/guid"
+	"github.com/linuxboot/fiano/pkg/uefi"
+	"github.com/linuxboot/fiano/pkg/unicode"
+)
+
+const (
+	testNVRAMSize     = 0x1000
+	testNVRAMDataOff  = 0x48
+	testVarStoreSize  = 0x400
+	testFTWQueueSize  = 0x100
+	testFTWOffset     = testNVRAMDataOff + testVarStoreSize
+	testFVBEraseValue = 0x800 // EFI_FVB2_ERASE_POLARITY
+)
+
+var efiGlobalVariable = guid.MustParse("8BE4DF61-93CA-11D2-AA0D-00E098032B8C")
+
+// buildVSSVariable builds an authenticated variable.
+func buildVSSVariable(state uefi.VariableState, name string, data []byte) []byte {
+	b := new(bytes.Buffer)
+	binary.Write(b, binary.LittleEndian, uefi.VariableHeader{
+		StartID:    uefi.VariableStartID,
+		State:      state,
+		Attributes: uefi.VariableNonVolatile | uefi.VariableBootServiceAccess,
+	})
+	binary.Write(b, binary.LittleEndian, uefi.AuthVariableHeader{})
+	n := unicode.UTF8ToUCS2(name)
+	binary.Write(b, binary.LittleEndian, []uint32{uint32(len(n)), uint32(len(data))})
+	b.Write(efiGlobalVariable[:])
+	b.Write(n)
+	b.Write(data)
+	return b.Bytes()
+}
+
+// buildNVRAMFV builds an NVRAM volume with an authenticated variable store
+// holding vars followed by an FTW working block.
+func buildNVRAMFV(vars ...[]byte) []byte {
+	buf := bytes.Repeat([]byte{0xFF}, testNVRAMSize)
+
+	h := new(bytes.Buffer)
+	h.Write(make([]byte, 16))
+	h.Write(uefi.EVSA[:])
+	binary.Write(h, binary.LittleEndian, uint64(testNVRAMSize))
+	h.WriteString("_FVH")
+	binary.Write(h, binary.LittleEndian, uint32(testFVBEraseValue))
+	binary.Write(h, binary.LittleEndian, uint16(testNVRAMDataOff))
+	binary.Write(h, binary.LittleEndian, uint16(0)) // Checksum
+	binary.Write(h, binary.LittleEndian, uint16(0)) // ExtHeaderOffset
+	h.Write([]byte{0, 2})
+	binary.Write(h, binary.LittleEndian, []uint32{testNVRAMSize / 0x1000, 0x1000, 0, 0})
+	copy(buf, h.Bytes())
+	sum, _ := uefi.Checksum16(buf[:testNVRAMDataOff])
+	binary.LittleEndian.PutUint16(buf[50:], 0-sum)
+
+	vs := new(bytes.Buffer)
+	vs.Write(uefi.AuthVariableStoreGUID[:])
+	binary.Write(vs, binary.LittleEndian, uefi.VariableStoreHeader{
+		Size:   testVarStoreSize,
+		Format: uefi.VariableStoreFormatted,
+		State:  uefi.VariableStoreHealthy,
+	})
+	for _, v := range vars {
+		for vs.Len()%4 != 0 {
+			vs.WriteByte(0xFF)
+		}
+		vs.Write(v)
+	}
+	copy(buf[testNVRAMDataOff:], vs.Bytes())
+
+	ftw := uefi.FTWWorkingBlock{Header: uefi.FTWWorkingBlockHeader{
+		Signature:      *uefi.FTWWorkingBlockGUID,
+		State:          0xFE,
+		Reserved:       [3]uint8{0xFF, 0xFF, 0xFF},
+		WriteQueueSize: testFTWQueueSize,
+	}}
+	ftw.Header.CRC = ftw.CalculateCRC()
+	fh := new(bytes.Buffer)
+	binary.Write(fh, binary.LittleEndian, ftw.Header)
+	copy(buf[testFTWOffset:], fh.Bytes())
+	return buf
+}
+
+func parseNVRAMFV(t *testing.T, buf []byte) *uefi.FirmwareVolume {
+	fv, err := uefi.NewFirmwareVolume(buf, 0, false)
+	if err != nil {
+		t.Fatalf("Unable to parse NVRAM volume: %v", err)
+	}
+	if fv.VarStore == nil {
+		t.Fatalf("Variable store not found")
+	}
+	if fv.FTW == nil {
+		t.Fatalf("FTW working block not found")
+	}
+	return fv
+}
+
+func TestNVRAMVolume(t *testing.T) {
+	buf := buildNVRAMFV(
+		buildVSSVariable(uefi.VariableAdded&uefi.VariableDeleted, "Timeout", []byte{3, 0}),
+		buildVSSVariable(uefi.VariableAdded, "Timeout", []byte{5, 0}),
+		buildVSSVariable(uefi.VariableAdded, "Lang", []byte("eng")),
+	)
+	fv := parseNVRAMFV(t, buf)
+	if !fv.VarStore.IsAuthenticated() {
+		t.Errorf("Variable store should be authenticated")
+	}
+	if len(fv.VarStore.Variables) != 3 {
+		t.Fatalf("Wrong number of variables, expected 3 got %d", len(fv.VarStore.Variables))
+	}
+	if fv.FTW.Offset != testFTWOffset || fv.FTW.ExpectedCRC != nil {
+		t.Errorf("Bad FTW working block at %#x, ExpectedCRC %v", fv.FTW.Offset, fv.FTW.ExpectedCRC)
+	}
+	count := &Count{}
+	if err := count.Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if got := count.FirmwareTypeCount["Variable"]; got != 3 {
+		t.Errorf("Counted %d Variable, want 3", got)
+	}
+
+	// Assembling without changes keeps the volume identical.
+	if err := (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fv.Buf(), buf) {
+		t.Errorf("Assembled volume differs from the original")
+	}
+
+	// Change the value of a variable.
+	v := fv.VarStore.Variables[1]
+	if err := v.Assemble([]byte{10, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err := (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	fv = parseNVRAMFV(t, fv.Buf())
+	v = fv.VarStore.Variables[1]
+	if v.Name != "Timeout" || !bytes.Equal(v.Buf()[v.DataOffset:], []byte{10, 0, 0, 0}) {
+		t.Errorf("Variable not updated, got %v = %v", v.Name, v.Buf()[v.DataOffset:])
+	}
+	if l := fv.VarStore.Variables[2]; l.Name != "Lang" {
+		t.Errorf("Variable following the updated one was lost, got %v", l.Name)
+	}
+}
+
+func TestFTWWorkingBlockCRC(t *testing.T) {
+	fv := parseNVRAMFV(t, buildNVRAMFV())
+	// Edit the header as a JSON round trip would.
+	fv.FTW.Header.WriteQueueSize = testFTWQueueSize / 2
+	uefi.MarkDirty(fv.FTW)
+	if err := (&Assemble{}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	fv = parseNVRAMFV(t, fv.Buf())
+	if fv.FTW.Header.WriteQueueSize != testFTWQueueSize/2 || fv.FTW.ExpectedCRC != nil {
+		t.Errorf("Edited FTW working block: got queue size %#x and expected CRC %v, want %#x and a valid CRC",
+			fv.FTW.Header.WriteQueueSize, fv.FTW.ExpectedCRC, testFTWQueueSize/2)
+	}
+}
+
+func TestNVRAMVolumeExtract(t *testing.T) {
+	buf := buildNVRAMFV(
+		buildVSSVariable(uefi.VariableAdded&uefi.VariableDeleted, "Timeout", []byte{3, 0}),
+		buildVSSVariable(uefi.VariableAdded, "Timeout", []byte{5, 0}),
+	)
+	fv := parseNVRAMFV(t, buf)
+
+	tmpDir, err := ioutil.TempDir("", "vss-test")
+	if err != nil {
+		t.Fatalf("could not create temp dir: %v", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var fIndex uint64
+	if err = (&Extract{BasePath: tmpDir, DirPath: ".", Index: &fIndex}).Run(fv); err != nil {
+		t.Fatal(err)
+	}
+	vDir := filepath.Join(tmpDir, "0x0", "vss", efiGlobalVariable.String())
+	for _, name := range []string{"Timeout.bin", "Timeout-0x1c.bin"} {
+		if _, err := os.Stat(filepath.Join(vDir, name)); err != nil {
+			t.Errorf("Variable not extracted: %v", err)
+		}
+	}
+	if err = ioutil.WriteFile(filepath.Join(vDir, "Timeout.bin"), []byte{7, 0}, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := (&ParseDir{BasePath: tmpDir}).Parse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = (&Assemble{}).Run(f); err != nil {
+		t.Fatal(err)
+	}
+	want := buildNVRAMFV(
+		buildVSSVariable(uefi.VariableAdded&uefi.VariableDeleted, "Timeout", []byte{3, 0}),
+		buildVSSVariable(uefi.VariableAdded, "Timeout", []byte{7, 0}),
+	)
+	if !bytes.Equal(f.Buf(), want) {
+		t.Errorf("Round tripped volume differs from the expected one")
+	}
+
+	// The decoded value follows the new data.
+	out := &bytes.Buffer{}
+	if err = f.Apply(&JSON{W: out}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(out.Bytes(), []byte(`"Timeout": 7`)) {
+		t.Errorf("Decoded Timeout not found in JSON output:\n%s", out)
+	}
+}